@@ -0,0 +1,63 @@
+package memberlist
+
+import "time"
+
+// Clock is the source of time used by the protocol's timers: the probe,
+// gossip and push/pull schedules, probe and ack timeouts, and the suspicion
+// timers. The default is the wall clock; a simulation can provide a virtual
+// clock so that thousands of nodes can be driven from a single process
+// without waiting out real protocol intervals.
+//
+// Clock 抽象了协议使用的所有定时器，便于在单进程内用虚拟时钟进行大规模仿真。
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current
+	// time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+
+	// AfterFunc waits for the duration to elapse and then calls f in its
+	// own goroutine.
+	AfterFunc(d time.Duration, f func()) Timer
+
+	// NewTicker returns a ticker that delivers the current time on its
+	// channel once per period.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a single event returned by Clock.AfterFunc. It has the same
+// semantics as *time.Timer, which satisfies it.
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a periodic event returned by Clock.NewTicker.
+type Ticker interface {
+	// C returns the channel on which ticks are delivered.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker. It does not close the channel.
+	Stop()
+}
+
+// realClock implements Clock using the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+// realTicker adapts *time.Ticker to the Ticker interface.
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time { return r.t.C }
+
+func (r realTicker) Stop() { r.t.Stop() }
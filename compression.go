@@ -0,0 +1,382 @@
+package memberlist
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/lzw"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressor implements a single compression algorithm. Implementations
+// must be safe for concurrent use. Decompress fails rather than produce more
+// than limit bytes, so a small message can't expand into a huge one.
+type compressor interface {
+	Compress(in []byte) ([]byte, error)
+	Decompress(in []byte, limit int) ([]byte, error)
+}
+
+// compressors is the registry of every algorithm we can decode. The names
+// are what users put in Config.CompressionAlgorithms.
+var compressors = map[compressionType]compressor{
+	lzwAlgo:     lzwCompressor{},
+	snappyAlgo:  snappyCompressor{},
+	zstdAlgo:    newZstdCompressor(),
+	deflateAlgo: deflateCompressor{},
+}
+
+var compressionNames = map[string]compressionType{
+	"lzw":     lzwAlgo,
+	"snappy":  snappyAlgo,
+	"zstd":    zstdAlgo,
+	"deflate": deflateAlgo,
+}
+
+func (t compressionType) String() string {
+	for name, algo := range compressionNames {
+		if algo == t {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// parseCompressionAlgorithms turns the configured algorithm names into the
+// list we advertise, in order of preference. LZW is always appended if it
+// is missing since every version of memberlist understands it.
+func parseCompressionAlgorithms(names []string) ([]compressionType, error) {
+	var algos []compressionType
+	seen := make(map[compressionType]bool)
+	for _, name := range names {
+		algo, ok := compressionNames[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown compression algorithm %q", name)
+		}
+		if !seen[algo] {
+			seen[algo] = true
+			algos = append(algos, algo)
+		}
+	}
+	if !seen[lzwAlgo] {
+		algos = append(algos, lzwAlgo)
+	}
+	return algos, nil
+}
+
+// pickCompression returns our most preferred algorithm that the remote side
+// also supports. Peers that haven't advertised anything get LZW.
+func (m *Memberlist) pickCompression(remote []compressionType) compressionType {
+	for _, local := range m.compression {
+		for _, r := range remote {
+			if local == r {
+				return local
+			}
+		}
+	}
+	return lzwAlgo
+}
+
+// compressionForAddr picks an algorithm for a node we only know by its
+// address, such as the target of a push/pull.
+func (m *Memberlist) compressionForAddr(addr string) compressionType {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	for _, n := range m.nodes {
+		if n.Address() == addr {
+			return m.pickCompression(n.compression)
+		}
+	}
+	return lzwAlgo
+}
+
+type lzwCompressor struct{}
+
+func (lzwCompressor) Compress(in []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := lzw.NewWriter(&buf, lzw.LSB, lzwLitWidth)
+	if _, err := w.Write(in); err != nil {
+		return nil, err
+	}
+
+	// Ensure we flush everything out
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (lzwCompressor) Decompress(in []byte, limit int) ([]byte, error) {
+	r := lzw.NewReader(bytes.NewReader(in), lzw.LSB, lzwLitWidth)
+	defer r.Close()
+	return readLimited(r, limit)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(in []byte) ([]byte, error) {
+	return snappy.Encode(nil, in), nil
+}
+
+func (snappyCompressor) Decompress(in []byte, limit int) ([]byte, error) {
+	// The decoded length is up front, so check it before allocating.
+	n, err := snappy.DecodedLen(in)
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, errDecompressedTooLarge(limit)
+	}
+	return snappy.Decode(nil, in)
+}
+
+type deflateCompressor struct{}
+
+func (deflateCompressor) Compress(in []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(in); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCompressor) Decompress(in []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(in))
+	defer r.Close()
+	return readLimited(r, limit)
+}
+
+// zstdIdleDecoders is how many idle decoders zstdCompressor keeps for each
+// limit. Each one has a goroutine of its own, so the rest are closed.
+const zstdIdleDecoders = 4
+
+// zstdCompressor shares one encoder; EncodeAll is safe to call
+// concurrently. A decoder only streams one input at a time, so idle ones
+// are kept per limit and reused.
+type zstdCompressor struct {
+	enc *zstd.Encoder
+	err error
+
+	l        sync.Mutex
+	decoders map[int]chan *zstd.Decoder
+}
+
+func newZstdCompressor() *zstdCompressor {
+	// This only fails on bad options, but if it does zstd just stops working
+	// rather than taking the process down with it.
+	enc, err := zstd.NewWriter(nil)
+	return &zstdCompressor{enc: enc, err: err}
+}
+
+func (z *zstdCompressor) Compress(in []byte) ([]byte, error) {
+	if z.err != nil {
+		return nil, z.err
+	}
+	return z.enc.EncodeAll(in, nil), nil
+}
+
+// Decompress streams through a decoder so that it can stop at limit. The
+// decoder is also built with limit as its most memory, so a frame can't ask
+// for a window bigger than that.
+func (z *zstdCompressor) Decompress(in []byte, limit int) ([]byte, error) {
+	z.l.Lock()
+	if z.decoders == nil {
+		z.decoders = make(map[int]chan *zstd.Decoder)
+	}
+	idle, ok := z.decoders[limit]
+	if !ok {
+		idle = make(chan *zstd.Decoder, zstdIdleDecoders)
+		z.decoders[limit] = idle
+	}
+	z.l.Unlock()
+
+	var dec *zstd.Decoder
+	select {
+	case dec = <-idle:
+	default:
+		maxMemory := uint64(limit)
+		if maxMemory < zstd.MinWindowSize {
+			maxMemory = zstd.MinWindowSize
+		}
+		var err error
+		dec, err = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxMemory(maxMemory))
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		select {
+		case idle <- dec:
+		default:
+			dec.Close()
+		}
+	}()
+
+	if err := dec.Reset(bytes.NewReader(in)); err != nil {
+		return nil, err
+	}
+	return readLimited(dec, limit)
+}
+
+// readLimited reads the rest of r, failing if there's more than limit bytes.
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, errDecompressedTooLarge(limit)
+	}
+	return out, nil
+}
+
+func errDecompressedTooLarge(limit int) error {
+	return fmt.Errorf("Decompressed payload is larger than %d bytes", limit)
+}
+
+const (
+	// compressChunkSize is how much of a stream goes into each chunk of a
+	// compressChunksMsg before it's compressed.
+	compressChunkSize = 64 * 1024
+
+	// maxCompressedChunk is the largest compressed chunk we accept. None of
+	// the algorithms grow a chunk by anywhere near this much.
+	maxCompressedChunk = 4 * compressChunkSize
+)
+
+// chunkWriter compresses a stream a chunk at a time, so that neither side
+// needs the whole stream in memory. Each chunk is written with its length
+// in front, and Close marks the end with a zero length.
+type chunkWriter struct {
+	w    io.Writer
+	comp compressor
+	buf  []byte
+}
+
+func newChunkWriter(w io.Writer, algo compressionType) (*chunkWriter, error) {
+	comp, ok := compressors[algo]
+	if !ok {
+		return nil, fmt.Errorf("Cannot compress with unknown algorithm %d", algo)
+	}
+	return &chunkWriter{
+		w:    w,
+		comp: comp,
+		buf:  make([]byte, 0, compressChunkSize),
+	}, nil
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(c.buf[len(c.buf):cap(c.buf)], p)
+		c.buf = c.buf[:len(c.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(c.buf) == cap(c.buf) {
+			if err := c.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush compresses and writes out whatever is buffered.
+func (c *chunkWriter) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	out, err := c.comp.Compress(c.buf)
+	if err != nil {
+		return err
+	}
+	c.buf = c.buf[:0]
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(out)))
+	if _, err := c.w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err = c.w.Write(out)
+	return err
+}
+
+// Close writes out the last chunk and the end marker. It doesn't close the
+// underlying writer.
+func (c *chunkWriter) Close() error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	var end [4]byte
+	_, err := c.w.Write(end[:])
+	return err
+}
+
+// chunkReader reads a stream written by a chunkWriter, decompressing one
+// chunk at a time. It never reads past the end marker.
+type chunkReader struct {
+	r    io.Reader
+	comp compressor
+	buf  []byte
+	done bool
+}
+
+func newChunkReader(r io.Reader, algo compressionType) (*chunkReader, error) {
+	comp, ok := compressors[algo]
+	if !ok {
+		return nil, fmt.Errorf("Cannot decompress unknown algorithm %d", algo)
+	}
+	return &chunkReader{r: r, comp: comp}, nil
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+
+		var size [4]byte
+		if _, err := io.ReadFull(c.r, size[:]); err != nil {
+			return 0, err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			c.done = true
+			continue
+		}
+		if n > maxCompressedChunk {
+			return 0, fmt.Errorf("Compressed chunk of %d bytes is too large", n)
+		}
+
+		in := make([]byte, n)
+		if _, err := io.ReadFull(c.r, in); err != nil {
+			return 0, err
+		}
+		out, err := c.comp.Decompress(in, compressChunkSize)
+		if err != nil {
+			return 0, err
+		}
+		c.buf = out
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
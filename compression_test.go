@@ -0,0 +1,174 @@
+package memberlist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressors_RoundTrip(t *testing.T) {
+	// Something msgpack-ish with plenty of repetition.
+	var in bytes.Buffer
+	for i := 0; i < 200; i++ {
+		in.WriteString("node-name\x00127.0.0.1\x00alive\x00")
+	}
+
+	for algo := range compressors {
+		buf, err := compressPayload(algo, in.Bytes())
+		require.NoError(t, err, algo.String())
+		require.True(t, buf.Len() < in.Len(), "%s didn't compress", algo)
+
+		out, err := decompressPayload(buf.Bytes()[1:], maxPacketBytes)
+		require.NoError(t, err, algo.String())
+		require.Equal(t, in.Bytes(), out, algo.String())
+	}
+
+	_, err := compressPayload(compressionType(200), in.Bytes())
+	require.Error(t, err)
+	_, err = decompressBuffer(&compress{Algo: compressionType(200)}, maxPacketBytes)
+	require.Error(t, err)
+}
+
+func TestCompressors_DecompressLimit(t *testing.T) {
+	// Zeros compress down to almost nothing, like a decompression bomb.
+	in := make([]byte, 4096)
+	for algo, comp := range compressors {
+		buf, err := comp.Compress(in)
+		require.NoError(t, err, algo.String())
+
+		out, err := comp.Decompress(buf, len(in))
+		require.NoError(t, err, algo.String())
+		require.Equal(t, in, out, algo.String())
+
+		_, err = comp.Decompress(buf, len(in)-1)
+		require.Error(t, err, algo.String())
+	}
+
+	// A packet can't expand past what fits in one.
+	for algo := range compressors {
+		buf, err := compressPayload(algo, make([]byte, maxPacketBytes+1))
+		require.NoError(t, err, algo.String())
+		_, err = decompressPayload(buf.Bytes()[1:], maxPacketBytes)
+		require.Error(t, err, algo.String())
+	}
+
+	// The chunk reader holds each chunk to the chunk size.
+	var buf bytes.Buffer
+	out, err := compressors[deflateAlgo].Compress(make([]byte, compressChunkSize+1))
+	require.NoError(t, err)
+	buf.Write([]byte{0, 0, byte(len(out) >> 8), byte(len(out))})
+	buf.Write(out)
+	r, err := newChunkReader(&buf, deflateAlgo)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	require.Error(t, err)
+}
+
+func TestChunkWriter_RoundTrip(t *testing.T) {
+	// Enough for a few chunks, with a short one at the end.
+	var in bytes.Buffer
+	for in.Len() < 3*compressChunkSize+100 {
+		in.WriteString("node-name\x00127.0.0.1\x00alive\x00")
+	}
+
+	for algo := range compressors {
+		var buf bytes.Buffer
+		w, err := newChunkWriter(&buf, algo)
+		require.NoError(t, err, algo.String())
+		for p := in.Bytes(); len(p) > 0; p = p[1000:] {
+			if len(p) < 1000 {
+				_, err = w.Write(p)
+				require.NoError(t, err, algo.String())
+				break
+			}
+			_, err = w.Write(p[:1000])
+			require.NoError(t, err, algo.String())
+		}
+		require.NoError(t, w.Close(), algo.String())
+		require.True(t, buf.Len() < in.Len(), "%s didn't compress", algo)
+
+		// The reader stops at the end marker, leaving what follows.
+		buf.WriteString("next")
+		r, err := newChunkReader(&buf, algo)
+		require.NoError(t, err, algo.String())
+		out, err := ioutil.ReadAll(r)
+		require.NoError(t, err, algo.String())
+		require.Equal(t, in.Bytes(), out, algo.String())
+		require.Equal(t, "next", buf.String())
+	}
+
+	_, err := newChunkWriter(nil, compressionType(200))
+	require.Error(t, err)
+	_, err = newChunkReader(bytes.NewReader([]byte{0, 0, 0, 1}), compressionType(200))
+	require.Error(t, err)
+
+	// Oversized chunks are refused before they're read.
+	r, err := newChunkReader(bytes.NewReader([]byte{0xff, 0, 0, 0}), lzwAlgo)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	require.Error(t, err)
+}
+
+func TestParseCompressionAlgorithms(t *testing.T) {
+	algos, err := parseCompressionAlgorithms([]string{"snappy", "zstd", "snappy"})
+	require.NoError(t, err)
+	require.Equal(t, []compressionType{snappyAlgo, zstdAlgo, lzwAlgo}, algos)
+
+	algos, err = parseCompressionAlgorithms(nil)
+	require.NoError(t, err)
+	require.Equal(t, []compressionType{lzwAlgo}, algos)
+
+	_, err = parseCompressionAlgorithms([]string{"gzip"})
+	require.Error(t, err)
+}
+
+func TestMemberlist_PickCompression(t *testing.T) {
+	m := &Memberlist{compression: []compressionType{zstdAlgo, snappyAlgo, lzwAlgo}}
+
+	require.Equal(t, zstdAlgo, m.pickCompression([]compressionType{lzwAlgo, snappyAlgo, zstdAlgo}))
+	require.Equal(t, snappyAlgo, m.pickCompression([]compressionType{deflateAlgo, snappyAlgo, lzwAlgo}))
+	require.Equal(t, lzwAlgo, m.pickCompression([]compressionType{deflateAlgo, lzwAlgo}))
+
+	// Old nodes don't advertise anything.
+	require.Equal(t, lzwAlgo, m.pickCompression(nil))
+}
+
+func TestMemberlist_NegotiateCompression(t *testing.T) {
+	d := &MockDelegate{}
+	c1 := testConfig(t)
+	c1.CompressionAlgorithms = []string{"zstd", "deflate"}
+	c1.Delegate = d
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.CompressionAlgorithms = []string{"snappy", "deflate"}
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m2.Join([]string{m1.config.BindAddr})
+	require.NoError(t, err)
+	waitUntilSize(t, m1, 2)
+	waitUntilSize(t, m2, 2)
+
+	// The push/pull told each side what the other supports.
+	require.Equal(t, deflateAlgo, m2.compressionForAddr(m1.LocalNode().Address()))
+	require.Equal(t, deflateAlgo, m1.compressionForAddr(m2.LocalNode().Address()))
+
+	// Another full push/pull with the negotiated algorithm.
+	require.NoError(t, m1.pushPullNode(m2.LocalNode().Address(), false))
+
+	// And user messages over packets.
+	require.NoError(t, m2.SendBestEffort(m1.LocalNode(), bytes.Repeat([]byte("x"), 200)))
+	retry(t, 20, 50*time.Millisecond, func(failf func(string, ...interface{})) {
+		if len(d.getMessages()) != 1 {
+			failf("expected a message, got %d", len(d.getMessages()))
+		}
+	})
+}
@@ -1,10 +1,15 @@
 package memberlist
 
 import (
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"time"
+
+	"github.com/hashicorp/memberlist/coordinate"
+	"golang.org/x/crypto/ed25519"
 )
 
 type Config struct {
@@ -197,6 +202,19 @@ type Config struct {
 	ProbeInterval time.Duration
 	ProbeTimeout  time.Duration
 
+	// DynamicProbeTimeout enables per-node probe timeouts derived from the
+	// round trip times measured by earlier probes of the same node. Once
+	// enough samples have been collected, the timeout for a node is twice
+	// the ProbeTimeoutPercentile of its recent round trip times, clamped to
+	// the range [ProbeTimeoutMin, ProbeTimeoutMax]. Until then, and for
+	// all nodes when this is disabled, ProbeTimeout is used.
+	//
+	// 开启后，根据历史 ping/ack 的 RTT 为每个节点动态计算探测超时时间。
+	DynamicProbeTimeout    bool
+	ProbeTimeoutPercentile float64
+	ProbeTimeoutMin        time.Duration
+	ProbeTimeoutMax        time.Duration
+
 	// DisableTcpPings will turn off the fallback TCP pings that are attempted
 	// if the direct UDP ping fails. These get pipelined along with the
 	// indirect UDP pings.
@@ -211,6 +229,17 @@ type Config struct {
 	// 在节点认为自己不能可靠的探测其他节点时，会根据这个参数增加探测间隔。一般使用默认配置即可。
 	AwarenessMaxMultiplier int
 
+	// FailureDetector decides whether a node that failed a probe should be
+	// suspected, from the outcomes of our earlier probes of it, and gives
+	// the continuous suspicion level reported by SuspicionLevel. Suspects
+	// we hear about from other nodes are handled the same way regardless.
+	// nil uses the SWIM behavior of suspecting a node after any failed
+	// probe; NewPhiAccrualDetector suspects it once the time since its last
+	// ack is unlikely given the earlier intervals between acks.
+	//
+	// 故障检测器，决定探测失败的节点是否标记为 suspect ，为空时使用 SWIM 默认行为，可选 phi-accrual 。
+	FailureDetector FailureDetector
+
 	// GossipInterval and GossipNodes are used to configure the gossip
 	// behavior of memberlist.
 	//
@@ -233,6 +262,28 @@ type Config struct {
 	GossipNodes         int				// 每次给几个节点扩散数据
 	GossipToTheDeadTime time.Duration	// 在这个时间内仍然会尝试给 Dead 状态的节点发送数据，使用默认配置即可
 
+	// Zone is the rack or availability zone this node runs in, which is
+	// advertised to the other nodes along with our address. When it's set,
+	// GossipCrossZoneNodes of the GossipNodes picked each round are from
+	// other zones and the rest from ours, which keeps most gossip within
+	// the zone while updates still spread everywhere. Indirect probes
+	// prefer helpers outside our zone, so that a network failure within
+	// the zone doesn't stop them from reaching the target. Nodes that don't
+	// advertise a zone count as being in another zone. An empty zone picks
+	// gossip targets and helpers uniformly at random.
+	//
+	// 节点所在的可用区，设置后 gossip 主要发给同一可用区的节点，间接探测优先选择其他可用区的节点。
+	Zone string
+
+	// GossipCrossZoneNodes is how many of the GossipNodes picked each round
+	// are from other zones, the rest being from ours. It only applies when
+	// Zone is set; without a zone every target is picked at random. If
+	// fewer nodes are known in either group, the rest are picked from the
+	// other.
+	//
+	// 每轮 gossip 中发给其他可用区节点的数量，仅在设置 Zone 时生效。
+	GossipCrossZoneNodes int
+
 
 
 
@@ -261,6 +312,16 @@ type Config struct {
 	// 是否数据压缩，默认是 true ，可以减少带宽。根据需要来配置。
 	EnableCompression bool
 
+	// CompressionAlgorithms lists the compression algorithms this node
+	// advertises, in order of preference. Supported names are "zstd",
+	// "snappy", "deflate" and "lzw". Messages to a node use the first of
+	// these that the node also advertises. LZW is always supported, and is
+	// used for nodes that haven't advertised anything, such as nodes
+	// running older versions or nodes we haven't heard from yet.
+	//
+	// 支持的压缩算法，按优先级排列。发送时选择双方都支持的第一个算法，默认 LZW 。
+	CompressionAlgorithms []string
+
 
 
 	// SecretKey is used to initialize the primary encryption key in a keyring.
@@ -276,6 +337,17 @@ type Config struct {
 	// automatically initialized using the SecretKey and SecretKeys values.
 	Keyring *Keyring
 
+	// MinCipherSuite is the weakest cipher suite we accept. Encrypted
+	// messages using an older suite are dropped, or treated as plaintext
+	// if GossipVerifyIncoming is off. The primary key must be tagged with
+	// at least this suite, and the keyring refuses changes that would
+	// make it weaker. Zero accepts every suite. Raise it only after every
+	// node's primary key uses a suite at least this strong, see
+	// Keyring.AddKeyWithSuite.
+	//
+	// 允许的最低加密套件，低于该套件的加密消息会被丢弃，0 表示不限制。
+	MinCipherSuite CipherSuite
+
 
 
 
@@ -348,6 +420,131 @@ type Config struct {
 	// called PacketBufferSize now that we have generalized the transport.
 	UDPBufferSize int
 
+	// MTUDiscoveryInterval is the interval between path MTU discovery
+	// probes. Each probe sends a ping padded to a candidate size to a
+	// random node, and a binary search between MTUDiscoveryMin and
+	// MTUDiscoveryMax finds the largest packet that gets acknowledged.
+	// Gossip to a node then uses its discovered size instead of
+	// UDPBufferSize. Setting this to zero disables discovery.
+	//
+	// Probes are sent with the "don't fragment" bit set, which needs a
+	// transport that implements DontFragmentTransport. The NetTransport
+	// does on Linux. With any other transport discovery doesn't run and
+	// every node gets UDPBufferSize.
+	//
+	// 路径 MTU 探测的时间间隔，为 0 时关闭探测，所有节点都使用 UDPBufferSize 。探测报文需设置不分片标志，Transport 不支持时不进行探测。
+	MTUDiscoveryInterval time.Duration
+	MTUDiscoveryMin      int
+	MTUDiscoveryMax      int
+
+	// EnableCoordinates turns on the Vivaldi network coordinate subsystem.
+	// Each node's coordinate is piggybacked on the acks it sends, and every
+	// completed probe updates the local coordinate, so that the RTT between
+	// any two members can be estimated without measuring it directly. The
+	// user's Ping delegate keeps working and sees only its own payload.
+	// All nodes in the cluster should agree on this setting, otherwise the
+	// Ping delegates on nodes without it will see the wrapped ack payload.
+	//
+	// CoordinateConfig tunes the Vivaldi algorithm; nil uses
+	// coordinate.DefaultConfig().
+	//
+	// 开启 Vivaldi 网络坐标，坐标附带在 ack 消息中，用于估算任意两个节点间的 RTT 。
+	EnableCoordinates bool
+	CoordinateConfig  *coordinate.Config
+
+	// SnapshotPath is a file where membership changes and our incarnation
+	// number are recorded. On Create the incarnation is restored, so our
+	// first alive messages aren't ignored as stale, and the members that
+	// were alive when we stopped are rejoined in the background. Nothing
+	// is rejoined after a graceful Leave. An empty path disables this.
+	//
+	// 快照文件路径，重启时恢复 incarnation 并自动重新加入之前已知的节点，为空时关闭。
+	SnapshotPath string
+
+	// Clock is the time source for the probe, gossip and push/pull
+	// schedules, probe timeouts and suspicion timers. It is meant for
+	// simulations that drive many nodes from a virtual clock; nil uses
+	// the wall clock.
+	//
+	// 协议定时器使用的时钟，仿真时可替换为虚拟时钟，为空时使用系统时钟。
+	Clock Clock
+
+	// Label is prepended to every packet and stream we send, and incoming
+	// traffic whose label doesn't match is dropped and counted in the
+	// memberlist.label.dropped metric. This keeps clusters that share a
+	// port range or seed list from merging by accident; it is not a
+	// security feature, use encryption for that. It must be at most 255
+	// bytes, and an empty label sends no header at all.
+	//
+	// SkipInboundLabelCheck accepts traffic regardless of its label, which
+	// allows a label to be rolled out to, or changed on, a running cluster
+	// one node at a time.
+	//
+	// 集群标签，附加在所有报文和流连接上，标签不一致的流量会被丢弃；迁移期间可跳过检查。
+	Label                 string
+	SkipInboundLabelCheck bool
+
+	// CIDRsAllowed restricts which source networks we accept packets and
+	// streams from, checked before anything is decoded. Alive messages
+	// that advertise an address outside these networks are ignored as
+	// well. This is defense in depth for hosts where encryption is off;
+	// nil allows every address. ParseCIDRs builds this from strings.
+	//
+	// Traffic is checked against the "ip:port" address the transport says
+	// it came from, which for InmemTransport and for packets between
+	// UnixTransports is the sender's. Streams accepted by a UnixTransport
+	// come from a socket with no IP, so they aren't filtered; access to the
+	// socket directory controls those instead.
+	//
+	// 允许通信的来源网段白名单，为空时不做限制；没有 IP 的 Unix 套接字连接不做过滤。
+	CIDRsAllowed []net.IPNet
+
+	// IdentityKey is this node's ed25519 private key. When set, our alive
+	// messages, refutations and graceful leaves are signed with it.
+	//
+	// Identity decides which key may speak for each node name. When set,
+	// alive messages about other nodes must be signed by an accepted key,
+	// which keeps a member that holds the shared gossip key from
+	// impersonating others or making them leave. Every node in the cluster
+	// must have an IdentityKey before this is turned on.
+	//
+	// 节点的 ed25519 身份私钥和身份校验委托，开启后 alive/leave 消息必须带有可信签名。
+	IdentityKey ed25519.PrivateKey
+	Identity    IdentityDelegate
+
+	// ReplayWindow turns on replay protection for encrypted packets. Each
+	// packet carries its send time and a random nonce inside the
+	// encryption, and packets older than the window or already seen
+	// within it are dropped and counted in the memberlist.replay metrics.
+	// Only so many nonces are remembered, so if a node receives more than
+	// about 256k packets within a window the rest are dropped as well.
+	// The window must be larger than the clock skew between nodes plus
+	// the network delay. Every node must support this before it is
+	// turned on with GossipVerifyIncoming, which is when packets without
+	// the guard are rejected. Zero disables it.
+	//
+	// 加密报文的防重放窗口，超出窗口或重复的报文会被丢弃，为 0 时关闭。
+	ReplayWindow time.Duration
+
+	// Queries answers queries sent with Memberlist.Query. Nodes without one
+	// still pass queries on and ack them if asked to. Acks and responses
+	// only go to an origin that's already a member, at its own address.
+	//
+	// QueryTimeoutMult scales the default query timeout, which is
+	// QueryTimeoutMult * GossipInterval * ceil(log10(N+1)), so that it grows
+	// with the time the query needs to reach every node. The same value caps
+	// the timeout of queries we receive, which is set by their origin.
+	//
+	// QuerySizeLimit caps the encoded size of a query, which has to fit in
+	// a gossip packet. QueryResponseSizeLimit caps the payload of a single
+	// response; responses too big for a packet are sent over a stream.
+	//
+	// 集群查询的响应委托、默认超时倍数（同时限制收到的查询的超时），以及查询和单个响应的大小上限。
+	Queries                QueryDelegate
+	QueryTimeoutMult       int
+	QuerySizeLimit         int
+	QueryResponseSizeLimit int
+
 
 	// DeadNodeReclaimTime controls the time before a dead node's name can be
 	// reclaimed by one with a different address or port. By default, this is 0,
@@ -387,13 +584,20 @@ func DefaultLANConfig() *Config {
 		DisableTcpPings:         false,                  // TCP pings are safe, even with mixed versions
 		AwarenessMaxMultiplier:  8,                      // Probe interval backs off to 8 seconds
 
+		DynamicProbeTimeout:    false,                  // Use the fixed ProbeTimeout
+		ProbeTimeoutPercentile: 0.99,                   // Wait for the 99th percentile RTT
+		ProbeTimeoutMin:        100 * time.Millisecond, // Never wait less than this
+		ProbeTimeoutMax:        3 * time.Second,        // Never wait more than this
+
 		GossipNodes:          3,                      // Gossip to 3 nodes
 		GossipInterval:       200 * time.Millisecond, // Gossip more rapidly
 		GossipToTheDeadTime:  30 * time.Second,       // Same as push/pull
+		GossipCrossZoneNodes: 1,                      // Gossip to 1 node outside our zone
 		GossipVerifyIncoming: true,
 		GossipVerifyOutgoing: true,
 
-		EnableCompression: true, // Enable compression by default
+		EnableCompression:     true, // Enable compression by default
+		CompressionAlgorithms: []string{"zstd", "snappy", "deflate", "lzw"},
 
 		SecretKey: nil,
 		Keyring:   nil,
@@ -402,6 +606,17 @@ func DefaultLANConfig() *Config {
 
 		HandoffQueueDepth: 1024,
 		UDPBufferSize:     1400,
+
+		MTUDiscoveryInterval: 0,    // Use UDPBufferSize for every node
+		MTUDiscoveryMin:      512,  // Small enough for any sane path
+		MTUDiscoveryMax:      8972, // Jumbo frames less IP and UDP headers
+
+		EnableCoordinates: false,
+		CoordinateConfig:  coordinate.DefaultConfig(),
+
+		QueryTimeoutMult:       16,
+		QuerySizeLimit:         1024,
+		QueryResponseSizeLimit: 64 * 1024,
 	}
 }
 
@@ -447,3 +662,39 @@ func DefaultLocalConfig() *Config {
 func (c *Config) EncryptionEnabled() bool {
 	return c.Keyring != nil && len(c.Keyring.GetKeys()) > 0
 }
+
+// ParseCIDRs parses a list of CIDR strings, such as "10.0.0.0/8", for use
+// as Config.CIDRsAllowed. It returns nil for an empty list, which allows
+// every address.
+func ParseCIDRs(v []string) ([]net.IPNet, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	nets := make([]net.IPNet, 0, len(v))
+	for _, p := range v {
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR %q: %v", p, err)
+		}
+		nets = append(nets, *network)
+	}
+	return nets, nil
+}
+
+// IPMustBeChecked returns true if CIDRsAllowed restricts addresses.
+func (c *Config) IPMustBeChecked() bool {
+	return len(c.CIDRsAllowed) > 0
+}
+
+// IPAllowed returns an error if the address is outside CIDRsAllowed.
+func (c *Config) IPAllowed(ip net.IP) error {
+	if !c.IPMustBeChecked() {
+		return nil
+	}
+	for _, n := range c.CIDRsAllowed {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in the allowed CIDRs", ip)
+}
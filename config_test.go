@@ -0,0 +1,36 @@
+package memberlist
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_ParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs(nil)
+	require.NoError(t, err)
+	require.Nil(t, nets)
+
+	nets, err = ParseCIDRs([]string{"10.0.0.0/8", "fd00::/8"})
+	require.NoError(t, err)
+	require.Len(t, nets, 2)
+
+	_, err = ParseCIDRs([]string{"10.0.0.0/8", "10.0.0.1"})
+	require.Error(t, err)
+}
+
+func TestConfig_IPAllowed(t *testing.T) {
+	c := DefaultLANConfig()
+	require.False(t, c.IPMustBeChecked())
+	require.NoError(t, c.IPAllowed(net.ParseIP("192.168.1.1")))
+
+	nets, err := ParseCIDRs([]string{"10.0.0.0/8", "fd00::/8"})
+	require.NoError(t, err)
+	c.CIDRsAllowed = nets
+	require.True(t, c.IPMustBeChecked())
+	require.NoError(t, c.IPAllowed(net.ParseIP("10.1.2.3")))
+	require.NoError(t, c.IPAllowed(net.ParseIP("fd00::1")))
+	require.Error(t, c.IPAllowed(net.ParseIP("192.168.1.1")))
+	require.Error(t, c.IPAllowed(net.ParseIP("fe80::1")))
+}
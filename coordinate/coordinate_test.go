@@ -0,0 +1,160 @@
+package coordinate
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// verifyEqualFloats will compare f1 and f2 and fail if they are not
+// "equal" within a threshold.
+func verifyEqualFloats(t *testing.T, f1 float64, f2 float64) {
+	const zeroThreshold = 1.0e-6
+	if math.Abs(f1-f2) > zeroThreshold {
+		t.Fatalf("equal assertion fail, %9.6f != %9.6f", f1, f2)
+	}
+}
+
+// verifyEqualVectors will compare vec1 and vec2 and fail if they are not
+// "equal" within a threshold.
+func verifyEqualVectors(t *testing.T, vec1 []float64, vec2 []float64) {
+	if len(vec1) != len(vec2) {
+		t.Fatalf("vector length mismatch, %d != %d", len(vec1), len(vec2))
+	}
+
+	for i := range vec1 {
+		verifyEqualFloats(t, vec1[i], vec2[i])
+	}
+}
+
+func TestCoordinate_NewCoordinate(t *testing.T) {
+	config := DefaultConfig()
+	c := NewCoordinate(config)
+	if uint(len(c.Vec)) != config.Dimensionality {
+		t.Fatalf("dimensionality not set correctly %d != %d",
+			len(c.Vec), config.Dimensionality)
+	}
+}
+
+func TestCoordinate_Clone(t *testing.T) {
+	c := NewCoordinate(DefaultConfig())
+	c.Vec[0], c.Vec[1], c.Vec[2] = 1.0, 2.0, 3.0
+	c.Error = 5.0
+	c.Adjustment = 10.0
+	c.Height = 4.2
+
+	other := c.Clone()
+	if c.Error != other.Error || c.Adjustment != other.Adjustment || c.Height != other.Height {
+		t.Fatalf("clone mismatch: %#v != %#v", other, c)
+	}
+	verifyEqualVectors(t, c.Vec, other.Vec)
+
+	// Make sure it's a deep copy.
+	other.Vec[0] = c.Vec[0] + 0.5
+	if c.Vec[0] == other.Vec[0] {
+		t.Fatalf("vector was not deep copied")
+	}
+}
+
+func TestCoordinate_IsValid(t *testing.T) {
+	c := NewCoordinate(DefaultConfig())
+	if !c.IsValid() {
+		t.Fatalf("new coordinate should be valid")
+	}
+
+	for _, bad := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		c := NewCoordinate(DefaultConfig())
+		c.Vec[3] = bad
+		if c.IsValid() {
+			t.Fatalf("coordinate with %v should not be valid", bad)
+		}
+
+		c = NewCoordinate(DefaultConfig())
+		c.Height = bad
+		if c.IsValid() {
+			t.Fatalf("coordinate with height %v should not be valid", bad)
+		}
+	}
+}
+
+func TestCoordinate_ApplyForce(t *testing.T) {
+	config := DefaultConfig()
+	config.Dimensionality = 3
+	config.HeightMin = 0
+
+	origin := NewCoordinate(config)
+
+	// This proves that we normalize, get the direction right, and apply the
+	// force multiplier correctly.
+	above := NewCoordinate(config)
+	above.Vec = []float64{0.0, 0.0, 2.9}
+	c := origin.ApplyForce(config, 5.3, above)
+	verifyEqualVectors(t, c.Vec, []float64{0.0, 0.0, -5.3})
+
+	// Scoot a point not starting at the origin to make sure there's nothing
+	// special there.
+	right := NewCoordinate(config)
+	right.Vec = []float64{3.4, 0.0, -5.3}
+	c = c.ApplyForce(config, 2.0, right)
+	verifyEqualVectors(t, c.Vec, []float64{-2.0, 0.0, -5.3})
+
+	// If the points are right on top of each other, then we should end up
+	// in a random direction, one unit away. This makes sure the unit vector
+	// build up doesn't divide by zero.
+	c = origin.ApplyForce(config, 1.0, origin)
+	verifyEqualFloats(t, origin.DistanceTo(c).Seconds(), 1.0)
+
+	// Enable a minimum height and make sure that gets factored in properly.
+	config.HeightMin = 10.0e-6
+	origin = NewCoordinate(config)
+	c = origin.ApplyForce(config, 5.3, above)
+	verifyEqualVectors(t, c.Vec, []float64{0.0, 0.0, -5.3})
+	verifyEqualFloats(t, c.Height, config.HeightMin+5.3*config.HeightMin/2.9)
+
+	// Make sure the height minimum is enforced.
+	c = origin.ApplyForce(config, -5.3, above)
+	verifyEqualVectors(t, c.Vec, []float64{0.0, 0.0, 5.3})
+	verifyEqualFloats(t, c.Height, config.HeightMin)
+
+	// Shenanigans should get called if the dimensions don't match.
+	defer func() {
+		if r := recover(); r != ErrDimensionalityConflict {
+			t.Fatalf("bad: %v", r)
+		}
+	}()
+	bad := c.Clone()
+	bad.Vec = make([]float64, len(bad.Vec)+1)
+	c.ApplyForce(config, 1.0, bad)
+}
+
+func TestCoordinate_DistanceTo(t *testing.T) {
+	config := DefaultConfig()
+	config.Dimensionality = 3
+	config.HeightMin = 0
+
+	c1, c2 := NewCoordinate(config), NewCoordinate(config)
+	c1.Vec = []float64{-0.5, 1.3, 2.4}
+	c2.Vec = []float64{1.2, -2.3, 3.4}
+
+	verifyEqualFloats(t, c1.DistanceTo(c1).Seconds(), 0.0)
+	verifyEqualFloats(t, c1.DistanceTo(c2).Seconds(), c2.DistanceTo(c1).Seconds())
+	verifyEqualFloats(t, c1.DistanceTo(c2).Seconds(), 4.104875150354758)
+
+	// Make sure negative adjustment factors are ignored.
+	c1.Adjustment = -1.0e6
+	verifyEqualFloats(t, c1.DistanceTo(c2).Seconds(), 4.104875150354758)
+
+	// Make sure positive adjustment factors affect the distance.
+	c1.Adjustment = 0.1
+	c2.Adjustment = 0.2
+	verifyEqualFloats(t, c1.DistanceTo(c2).Seconds(), 4.104875150354758+0.3)
+
+	// Make sure the heights affect the distance.
+	c1.Height = 0.7
+	c2.Height = 0.1
+	verifyEqualFloats(t, c1.DistanceTo(c2).Seconds(), 4.104875150354758+0.3+0.8)
+
+	if d := c1.DistanceTo(c2); d < 5*time.Second {
+		t.Fatalf("bad: %v", d)
+	}
+}
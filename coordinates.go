@@ -0,0 +1,143 @@
+package memberlist
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/memberlist/coordinate"
+)
+
+// coordinateAckVersion is the first byte of an ack payload that carries a
+// coordinate. Payloads that don't start with it, or don't decode, are passed
+// to the user's PingDelegate untouched.
+const coordinateAckVersion uint8 = 1
+
+// coordinateAck is the ack payload sent when coordinates are enabled. It
+// wraps whatever the user's PingDelegate wants to send.
+type coordinateAck struct {
+	Coord   *coordinate.Coordinate
+	Payload []byte `codec:",omitempty"`
+}
+
+// coordinatePingDelegate sits between memberlist and the user's PingDelegate,
+// adding our coordinate to outgoing acks and feeding the coordinates in
+// incoming acks to the Vivaldi client.
+type coordinatePingDelegate struct {
+	m    *Memberlist
+	user PingDelegate
+}
+
+func (p *coordinatePingDelegate) AckPayload() []byte {
+	ack := coordinateAck{Coord: p.m.coordClient.GetCoordinate()}
+	if p.user != nil {
+		ack.Payload = p.user.AckPayload()
+	}
+
+	buf := bytes.NewBuffer([]byte{coordinateAckVersion})
+	enc := codec.NewEncoder(buf, &codec.MsgpackHandle{})
+	if err := enc.Encode(&ack); err != nil {
+		p.m.logger.Printf("[ERR] memberlist: Failed to encode coordinate: %v", err)
+		return ack.Payload
+	}
+	return buf.Bytes()
+}
+
+func (p *coordinatePingDelegate) NotifyPingComplete(other *Node, rtt time.Duration, payload []byte) {
+	ack, ok := decodeCoordinateAck(payload)
+	if !ok {
+		if p.user != nil {
+			p.user.NotifyPingComplete(other, rtt, payload)
+		}
+		return
+	}
+
+	if _, err := p.m.coordClient.Update(other.Name, ack.Coord, rtt); err != nil {
+		p.m.logger.Printf("[DEBUG] memberlist: Rejected coordinate from %s: %v", other.Name, err)
+	} else {
+		p.m.coordLock.Lock()
+		p.m.coordCache[other.Name] = ack.Coord
+		p.m.coordLock.Unlock()
+	}
+
+	if p.user != nil {
+		p.user.NotifyPingComplete(other, rtt, ack.Payload)
+	}
+}
+
+// decodeCoordinateAck unwraps an ack payload built by AckPayload.
+func decodeCoordinateAck(payload []byte) (*coordinateAck, bool) {
+	if len(payload) == 0 || payload[0] != coordinateAckVersion {
+		return nil, false
+	}
+
+	var ack coordinateAck
+	if err := decode(payload[1:], &ack); err != nil || ack.Coord == nil {
+		return nil, false
+	}
+	return &ack, true
+}
+
+// forgetCoordinate drops the cached coordinate and latency samples for a node
+// that has been reaped.
+func (m *Memberlist) forgetCoordinate(name string) {
+	if m.coordClient == nil {
+		return
+	}
+
+	m.coordClient.ForgetNode(name)
+	m.coordLock.Lock()
+	delete(m.coordCache, name)
+	m.coordLock.Unlock()
+}
+
+// GetCoordinate returns the current network coordinate of the local node.
+// It returns an error if coordinates are not enabled.
+func (m *Memberlist) GetCoordinate() (*coordinate.Coordinate, error) {
+	if m.coordClient == nil {
+		return nil, fmt.Errorf("Coordinates are disabled")
+	}
+	return m.coordClient.GetCoordinate(), nil
+}
+
+// GetCachedCoordinate returns the last coordinate received from the given
+// node, and whether one is known. The local node's own coordinate is
+// returned for our own name.
+func (m *Memberlist) GetCachedCoordinate(name string) (*coordinate.Coordinate, bool) {
+	if m.coordClient == nil {
+		return nil, false
+	}
+	if name == m.config.Name {
+		return m.coordClient.GetCoordinate(), true
+	}
+
+	m.coordLock.RLock()
+	defer m.coordLock.RUnlock()
+	coord, ok := m.coordCache[name]
+	if !ok {
+		return nil, false
+	}
+	return coord.Clone(), true
+}
+
+// EstimateRTT returns the estimated round trip time between two members,
+// either of which may be the local node, based on their coordinates.
+func (m *Memberlist) EstimateRTT(a, b string) (time.Duration, error) {
+	if m.coordClient == nil {
+		return 0, fmt.Errorf("Coordinates are disabled")
+	}
+
+	coordA, ok := m.GetCachedCoordinate(a)
+	if !ok {
+		return 0, fmt.Errorf("No coordinate for node %q", a)
+	}
+	coordB, ok := m.GetCachedCoordinate(b)
+	if !ok {
+		return 0, fmt.Errorf("No coordinate for node %q", b)
+	}
+	if !coordA.IsCompatibleWith(coordB) {
+		return 0, fmt.Errorf("Coordinates for %q and %q have different dimensions", a, b)
+	}
+	return coordA.DistanceTo(coordB), nil
+}
@@ -0,0 +1,85 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemberlist_Coordinates(t *testing.T) {
+	newConfig := func() *Config {
+		c := testConfig(t)
+		c.ProbeInterval = 100 * time.Millisecond
+		c.EnableCoordinates = true
+		c.Ping = &MockPing{}
+		return c
+	}
+
+	c1 := newConfig()
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := newConfig()
+	c2.BindPort = m1.config.BindPort
+	mock := c2.Ping.(*MockPing)
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m2.Join([]string{m1.config.BindAddr})
+	require.NoError(t, err)
+	waitUntilSize(t, m1, 2)
+	waitUntilSize(t, m2, 2)
+
+	retry(t, 20, 100*time.Millisecond, func(failf func(string, ...interface{})) {
+		if _, ok := m2.GetCachedCoordinate(c1.Name); !ok {
+			failf("no coordinate for %s", c1.Name)
+		}
+		if _, ok := m1.GetCachedCoordinate(c2.Name); !ok {
+			failf("no coordinate for %s", c2.Name)
+		}
+	})
+
+	// The user's delegate still sees its own payload.
+	_, rtt, payload := mock.getContents()
+	require.True(t, rtt > 0)
+	require.Equal(t, DEFAULT_PAYLOAD, string(payload))
+
+	local, err := m2.GetCoordinate()
+	require.NoError(t, err)
+	self, ok := m2.GetCachedCoordinate(c2.Name)
+	require.True(t, ok)
+	require.Equal(t, local, self)
+
+	_, err = m2.EstimateRTT(c1.Name, c2.Name)
+	require.NoError(t, err)
+	_, err = m2.EstimateRTT(c1.Name, "nope")
+	require.Error(t, err)
+
+	// Reaped nodes are forgotten.
+	m2.forgetCoordinate(c1.Name)
+	_, ok = m2.GetCachedCoordinate(c1.Name)
+	require.False(t, ok)
+}
+
+func TestMemberlist_CoordinatesDisabled(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	_, err := m.GetCoordinate()
+	require.Error(t, err)
+	_, ok := m.GetCachedCoordinate(m.config.Name)
+	require.False(t, ok)
+	_, err = m.EstimateRTT(m.config.Name, m.config.Name)
+	require.Error(t, err)
+}
+
+func TestDecodeCoordinateAck_Raw(t *testing.T) {
+	for _, payload := range [][]byte{nil, []byte("whatever"), {coordinateAckVersion, 0xff}} {
+		if _, ok := decodeCoordinateAck(payload); ok {
+			t.Fatalf("should not decode %v", payload)
+		}
+	}
+}
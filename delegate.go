@@ -1,5 +1,7 @@
 package memberlist
 
+import "io"
+
 
 
 
@@ -56,3 +58,31 @@ type Delegate interface {
 	// boolean indicates this is for a join instead of a push/pull.
 	MergeRemoteState(buf []byte, join bool)
 }
+
+// StreamingDelegate is an optional extension of Delegate for applications
+// whose push/pull state is too large to hold in memory in one piece. If the
+// Delegate implements it, these methods are used instead of LocalState and
+// MergeRemoteState.
+//
+// The remote state is handed to MergeRemoteStateReader as it's read from
+// the connection. For joins the node states are read in full first, so the
+// join can be verified and offered to the MergeDelegate as a whole, but the
+// user state still isn't buffered. The local state may be read while the
+// remote state is being merged, as the reply to a push/pull is sent while
+// the initiator's state is read.
+//
+// 可选接口：以 io.Reader 的形式收发 push/pull 的用户状态，避免整块缓存。
+type StreamingDelegate interface {
+	Delegate
+
+	// LocalStateReader is used for a TCP Push/Pull instead of LocalState.
+	// It returns the state to send and its length, which has to be known
+	// up front; the reader must yield exactly that many bytes.
+	LocalStateReader(join bool) (r io.Reader, size int)
+
+	// MergeRemoteStateReader is invoked instead of MergeRemoteState with
+	// the remote side's state, which is size bytes long. The reader is
+	// only valid until the method returns, and whatever isn't read from
+	// it is discarded.
+	MergeRemoteStateReader(r io.Reader, size int, join bool)
+}
@@ -19,6 +19,24 @@ type EventDelegate interface {
 	NotifyUpdate(*Node)
 }
 
+// SuspectEventDelegate is an optional extension of EventDelegate for
+// applications that want to know when nodes are suspected of having failed,
+// before they are declared dead. It's used if Config.Events implements it,
+// and its methods are called under the same rules as the others.
+type SuspectEventDelegate interface {
+	EventDelegate
+
+	// NotifySuspect is invoked when a node becomes suspect, either because
+	// we failed to probe it or because another node told us so. If it
+	// isn't refuted in time, NotifyLeave follows. The Node argument must
+	// not be modified.
+	NotifySuspect(*Node)
+
+	// NotifyRefute is invoked when a suspect node proves it's alive. The
+	// Node argument must not be modified.
+	NotifyRefute(*Node)
+}
+
 // ChannelEventDelegate is used to enable an application to receive
 // events about joins and leaves over a channel instead of a direct
 // function call.
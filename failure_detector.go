@@ -0,0 +1,295 @@
+package memberlist
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ProbeResult is the outcome of one round of probing a node, as seen by a
+// FailureDetector.
+type ProbeResult struct {
+	// Node is the name of the node that was probed.
+	Node string
+
+	// Time is when the ack arrived, or when we gave up waiting for one.
+	Time time.Time
+
+	// Acked is set if the node answered, directly, through one of the
+	// indirect probes or over the TCP fallback.
+	Acked bool
+
+	// RTT is the round trip time of a direct ack, and zero otherwise.
+	RTT time.Duration
+
+	// Nacks is the number of peers that told us they couldn't reach the
+	// node either, out of the ExpectedNacks peers able to send them.
+	Nacks         int
+	ExpectedNacks int
+}
+
+// FailureDetector decides when a node we probe should be suspected. It is
+// told the outcome of every probe, and asked whether to suspect a node
+// after one fails. Once a node is suspected the usual suspicion timer and
+// refutation apply, so a detector only changes when we start suspecting
+// nodes, not how the cluster agrees that they have failed.
+//
+// Implementations must be safe for concurrent use, since Suspicion may be
+// called by the application while probes are running.
+//
+// 故障检测器接口：根据探测结果决定何时怀疑一个节点，并给出连续的怀疑程度。
+type FailureDetector interface {
+	// Observe records the outcome of a probe.
+	Observe(r ProbeResult)
+
+	// Suspect is called after a failed probe, and returns true if the node
+	// should be marked as suspect now.
+	Suspect(node string, now time.Time) bool
+
+	// Suspicion returns how suspicious the node looks at the given time.
+	// Zero means healthy, and larger values mean more suspicious. The
+	// scale is up to the detector.
+	Suspicion(node string, now time.Time) float64
+
+	// Remove forgets everything about the node.
+	Remove(node string)
+}
+
+// swimDetector is the default FailureDetector, which suspects a node as soon
+// as a probe of it fails. Its suspicion level is 1 if the last probe failed
+// and 0 otherwise.
+type swimDetector struct {
+	sync.Mutex
+	failed map[string]bool
+}
+
+func newSWIMDetector() *swimDetector {
+	return &swimDetector{
+		failed: make(map[string]bool),
+	}
+}
+
+// See FailureDetector.
+func (d *swimDetector) Observe(r ProbeResult) {
+	d.Lock()
+	defer d.Unlock()
+
+	if r.Acked {
+		delete(d.failed, r.Node)
+	} else {
+		d.failed[r.Node] = true
+	}
+}
+
+// See FailureDetector.
+func (d *swimDetector) Suspect(node string, now time.Time) bool {
+	return true
+}
+
+// See FailureDetector.
+func (d *swimDetector) Suspicion(node string, now time.Time) float64 {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.failed[node] {
+		return 1
+	}
+	return 0
+}
+
+// See FailureDetector.
+func (d *swimDetector) Remove(node string) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.failed, node)
+}
+
+const (
+	// phiMinSamples is the number of intervals between acks we need for a
+	// node before we trust its distribution. Until then a failed probe is
+	// suspected straight away, as SWIM does.
+	phiMinSamples = 3
+)
+
+// PhiAccrualConfig tunes a PhiAccrualDetector.
+type PhiAccrualConfig struct {
+	// Threshold is the phi at which a node that failed a probe is
+	// suspected. A phi of 1 means about a 10% chance that suspecting the
+	// node now is a mistake, 2 about 1%, 3 about 0.1% and so on.
+	Threshold float64
+
+	// WindowSize is the number of most recent intervals between acks kept
+	// for each node.
+	WindowSize int
+
+	// MinStdDev is the smallest standard deviation assumed for the
+	// intervals, so that very regular acks don't make a node suspect the
+	// moment one is late.
+	MinStdDev time.Duration
+
+	// AcceptablePause is added to the mean interval, giving nodes this
+	// much extra time before their phi starts to climb.
+	AcceptablePause time.Duration
+}
+
+// DefaultPhiAccrualConfig returns a configuration that suits the default
+// probe interval.
+func DefaultPhiAccrualConfig() *PhiAccrualConfig {
+	return &PhiAccrualConfig{
+		Threshold:       8,
+		WindowSize:      100,
+		MinStdDev:       500 * time.Millisecond,
+		AcceptablePause: 0,
+	}
+}
+
+// PhiAccrualDetector is a FailureDetector that gives each node a continuous
+// suspicion level, phi, rather than a verdict after each probe. It treats
+// acks as heartbeats and keeps a window of the intervals between them, and
+// phi is -log10 of the probability that an ack would be at least as late
+// as the next one is now, assuming the intervals are normally distributed.
+// A node that fails a probe is only suspected once its phi reaches the
+// threshold, so a single lost probe of a node that normally answers is
+// tolerated.
+//
+// Since every node is probed once per round, the intervals it sees grow
+// with the size of the cluster; the detector adapts to that by itself.
+//
+// phi-accrual 故障检测器：根据 ack 到达间隔的分布计算连续的怀疑程度 phi 。
+type PhiAccrualDetector struct {
+	config *PhiAccrualConfig
+
+	lock  sync.Mutex
+	nodes map[string]*phiHistory
+}
+
+// phiHistory holds the ack history of a single node.
+type phiHistory struct {
+	last      time.Time       // Time of the last ack
+	failed    bool            // Whether the last probe failed
+	intervals []time.Duration // Most recent intervals between acks
+	next      int             // Where the next interval goes once full
+}
+
+// add records a new interval, evicting the oldest one once the window is
+// full.
+func (h *phiHistory) add(interval time.Duration, size int) {
+	if len(h.intervals) < size {
+		h.intervals = append(h.intervals, interval)
+		return
+	}
+	h.intervals[h.next] = interval
+	h.next = (h.next + 1) % size
+}
+
+// stats returns the mean and standard deviation of the intervals, in
+// seconds.
+func (h *phiHistory) stats() (mean, stdDev float64) {
+	for _, i := range h.intervals {
+		mean += i.Seconds()
+	}
+	mean /= float64(len(h.intervals))
+	for _, i := range h.intervals {
+		d := i.Seconds() - mean
+		stdDev += d * d
+	}
+	stdDev = math.Sqrt(stdDev / float64(len(h.intervals)))
+	return mean, stdDev
+}
+
+// NewPhiAccrualDetector returns a detector using the given configuration,
+// or DefaultPhiAccrualConfig if it's nil.
+func NewPhiAccrualDetector(config *PhiAccrualConfig) *PhiAccrualDetector {
+	if config == nil {
+		config = DefaultPhiAccrualConfig()
+	}
+	return &PhiAccrualDetector{
+		config: config,
+		nodes:  make(map[string]*phiHistory),
+	}
+}
+
+// See FailureDetector.
+func (d *PhiAccrualDetector) Observe(r ProbeResult) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	h, ok := d.nodes[r.Node]
+	if !ok {
+		h = &phiHistory{}
+		d.nodes[r.Node] = h
+	}
+	h.failed = !r.Acked
+	if !r.Acked {
+		return
+	}
+
+	if !h.last.IsZero() {
+		if !r.Time.After(h.last) {
+			return
+		}
+		h.add(r.Time.Sub(h.last), d.config.WindowSize)
+	}
+	h.last = r.Time
+}
+
+// See FailureDetector.
+func (d *PhiAccrualDetector) Suspect(node string, now time.Time) bool {
+	return d.Suspicion(node, now) >= d.config.Threshold
+}
+
+// Suspicion returns the node's phi. Until we've seen enough acks from it
+// this is the threshold if the last probe failed, and zero otherwise.
+func (d *PhiAccrualDetector) Suspicion(node string, now time.Time) float64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	h, ok := d.nodes[node]
+	if !ok {
+		return 0
+	}
+	if len(h.intervals) < phiMinSamples {
+		if h.failed {
+			return d.config.Threshold
+		}
+		return 0
+	}
+
+	mean, stdDev := h.stats()
+	mean += d.config.AcceptablePause.Seconds()
+	if min := d.config.MinStdDev.Seconds(); stdDev < min {
+		stdDev = min
+	}
+	return phi(now.Sub(h.last).Seconds(), mean, stdDev)
+}
+
+// See FailureDetector.
+func (d *PhiAccrualDetector) Remove(node string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.nodes, node)
+}
+
+// phi returns -log10 of the probability that a normally distributed interval
+// with the given mean and standard deviation is longer than elapsed. This
+// uses a logistic approximation of the normal CDF, which avoids precision
+// problems in the tail.
+func phi(elapsed, mean, stdDev float64) float64 {
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1.0 + e))
+	}
+	return -math.Log10(1.0 - 1.0/(1.0+e))
+}
+
+// SuspicionLevel returns how suspicious the given node looks to our failure
+// detector right now. Zero means healthy; see Config.FailureDetector for
+// the scale. Nodes we don't probe, including ourselves, are at zero.
+//
+// 返回故障检测器对该节点当前的怀疑程度，0 表示健康。
+func (m *Memberlist) SuspicionLevel(node string) float64 {
+	return m.detector.Suspicion(node, m.clock.Now())
+}
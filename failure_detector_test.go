@@ -0,0 +1,105 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSWIMDetector(t *testing.T) {
+	d := newSWIMDetector()
+	now := time.Now()
+	require.Equal(t, 0.0, d.Suspicion("a", now))
+	require.True(t, d.Suspect("a", now))
+
+	d.Observe(ProbeResult{Node: "a", Time: now})
+	require.Equal(t, 1.0, d.Suspicion("a", now))
+
+	d.Observe(ProbeResult{Node: "a", Time: now, Acked: true})
+	require.Equal(t, 0.0, d.Suspicion("a", now))
+
+	d.Observe(ProbeResult{Node: "a", Time: now})
+	d.Remove("a")
+	require.Equal(t, 0.0, d.Suspicion("a", now))
+}
+
+func TestPhiAccrualDetector(t *testing.T) {
+	d := NewPhiAccrualDetector(nil)
+	start := time.Now()
+
+	// Without enough history a failed probe is suspected, as with SWIM.
+	d.Observe(ProbeResult{Node: "a", Time: start, Acked: true})
+	d.Observe(ProbeResult{Node: "a", Time: start.Add(time.Second)})
+	require.True(t, d.Suspect("a", start.Add(time.Second)))
+
+	// Acks every few seconds, with a little jitter.
+	last := start
+	for i := 1; i <= 20; i++ {
+		last = start.Add(time.Duration(i)*3*time.Second + time.Duration(i%3)*100*time.Millisecond)
+		d.Observe(ProbeResult{Node: "a", Time: last, Acked: true})
+	}
+
+	// A single missed ack isn't enough, and the level climbs with time.
+	d.Observe(ProbeResult{Node: "a", Time: last.Add(3 * time.Second)})
+	require.False(t, d.Suspect("a", last.Add(3*time.Second)))
+	early := d.Suspicion("a", last.Add(time.Second))
+	late := d.Suspicion("a", last.Add(4*time.Second))
+	require.True(t, early < late, "phi should grow, got %v then %v", early, late)
+	require.True(t, early < 1, "phi %v too high right after an ack", early)
+
+	// Much later than any interval we've seen is suspect.
+	require.True(t, d.Suspect("a", last.Add(10*time.Second)))
+
+	d.Remove("a")
+	require.Equal(t, 0.0, d.Suspicion("a", last.Add(time.Hour)))
+}
+
+func TestPhi(t *testing.T) {
+	require.InDelta(t, 0.3, phi(1, 1, 0.1), 0.01)
+	prev := 0.0
+	for elapsed := 0.5; elapsed < 3; elapsed += 0.1 {
+		p := phi(elapsed, 1, 0.2)
+		require.True(t, p >= prev, "phi isn't increasing at %v", elapsed)
+		prev = p
+	}
+}
+
+func TestMemberList_ProbeNode_PhiAccrual(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	detector := NewPhiAccrualDetector(nil)
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+		c.FailureDetector = detector
+	})
+	defer m1.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: uint16(m1.config.BindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: uint16(m1.config.BindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a2, nil, false)
+
+	// Nobody answers for the second node, but it has been acking
+	// regularly up until now.
+	now := time.Now()
+	for i := 10; i >= 0; i-- {
+		detector.Observe(ProbeResult{Node: addr2.String(), Time: now.Add(-time.Duration(i) * time.Second), Acked: true})
+	}
+
+	n := m1.nodeMap[addr2.String()]
+	m1.probeNode(n)
+	require.Equal(t, StateAlive, n.State, "a single failed probe shouldn't be suspected")
+	require.True(t, m1.SuspicionLevel(addr2.String()) > 0)
+
+	// Once its phi is past the threshold the next failure is suspected.
+	detector.lock.Lock()
+	detector.nodes[addr2.String()].last = now.Add(-time.Minute)
+	detector.lock.Unlock()
+	m1.probeNode(n)
+	require.Equal(t, StateSuspect, n.State)
+}
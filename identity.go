@@ -0,0 +1,147 @@
+package memberlist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	metrics "github.com/armon/go-metrics"
+	"golang.org/x/crypto/ed25519"
+)
+
+// IdentityDelegate decides which public key may speak for a node name. When
+// Config.Identity is set, every alive message about another node must carry
+// a valid ed25519 signature, and the key that made it must be accepted here.
+// Graceful leaves must be signed by the same key. This stops a member that
+// holds the shared gossip key from impersonating other members, or from
+// making them leave, by name.
+//
+// Dead and suspect messages from other members can't be signed by the
+// subject, since they're how failures are reported. With identities
+// enforced they are only accepted for incarnations the subject has itself
+// signed, so a false accusation can always be refuted.
+type IdentityDelegate interface {
+	// VerifyIdentity is invoked with a node whose alive message was
+	// signed by key. Returning an error rejects the message.
+	VerifyIdentity(node *Node, key ed25519.PublicKey) error
+}
+
+// StaticIdentities is an IdentityDelegate that pins each node name to a
+// single public key. Nodes that aren't listed are rejected.
+type StaticIdentities map[string]ed25519.PublicKey
+
+// VerifyIdentity implements IdentityDelegate.
+func (s StaticIdentities) VerifyIdentity(node *Node, key ed25519.PublicKey) error {
+	pinned, ok := s[node.Name]
+	if !ok {
+		return fmt.Errorf("No identity is known for node %q", node.Name)
+	}
+	if !bytes.Equal(pinned, key) {
+		return fmt.Errorf("Node %q is not using its known identity", node.Name)
+	}
+	return nil
+}
+
+// Domain separators so an alive signature can't be replayed as a leave.
+const (
+	aliveSigContext = "memberlist-alive-v1"
+	leaveSigContext = "memberlist-leave-v1"
+)
+
+// aliveSigningBytes is the canonical encoding of an alive message that its
+// signature covers.
+func aliveSigningBytes(a *alive) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(aliveSigContext)
+	binary.Write(&buf, binary.BigEndian, a.Incarnation)
+	writeSigField(&buf, []byte(a.Node))
+	writeSigField(&buf, a.Addr)
+	binary.Write(&buf, binary.BigEndian, a.Port)
+	writeSigField(&buf, a.Meta)
+	writeSigField(&buf, a.Vsn)
+	algos := make([]byte, len(a.Compression))
+	for i, c := range a.Compression {
+		algos[i] = byte(c)
+	}
+	writeSigField(&buf, algos)
+
+	// The zone was added later, so leave it out when there isn't one to
+	// keep signatures from older versions valid.
+	if a.Zone != "" {
+		writeSigField(&buf, []byte(a.Zone))
+	}
+	return buf.Bytes()
+}
+
+// leaveSigningBytes is the canonical encoding of a graceful leave that its
+// signature covers.
+func leaveSigningBytes(d *dead) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(leaveSigContext)
+	binary.Write(&buf, binary.BigEndian, d.Incarnation)
+	writeSigField(&buf, []byte(d.Node))
+	return buf.Bytes()
+}
+
+// writeSigField writes a length prefixed field.
+func writeSigField(buf *bytes.Buffer, b []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(b)))
+	buf.Write(b)
+}
+
+// signAlive signs an alive message about ourselves, if we have a key.
+func (m *Memberlist) signAlive(a *alive) {
+	key := m.config.IdentityKey
+	if key == nil {
+		return
+	}
+	a.PubKey = key.Public().(ed25519.PublicKey)
+	a.Sig = ed25519.Sign(key, aliveSigningBytes(a))
+}
+
+// signLeave signs our own leave message, if we have a key.
+func (m *Memberlist) signLeave(d *dead) {
+	if key := m.config.IdentityKey; key != nil {
+		d.Sig = ed25519.Sign(key, leaveSigningBytes(d))
+	}
+}
+
+// verifyAlive checks an alive message's signature and asks the identity
+// delegate whether the signing key may speak for the node.
+func (m *Memberlist) verifyAlive(a *alive) error {
+	if len(a.PubKey) != ed25519.PublicKeySize || len(a.Sig) != ed25519.SignatureSize {
+		return fmt.Errorf("missing or malformed signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(a.PubKey), aliveSigningBytes(a), a.Sig) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	node := &Node{
+		Name: a.Node,
+		Addr: a.Addr,
+		Port: a.Port,
+		Meta: a.Meta,
+	}
+	if len(a.Vsn) > 5 {
+		node.PMin, node.PMax, node.PCur = a.Vsn[0], a.Vsn[1], a.Vsn[2]
+		node.DMin, node.DMax, node.DCur = a.Vsn[3], a.Vsn[4], a.Vsn[5]
+	}
+	return m.config.Identity.VerifyIdentity(node, ed25519.PublicKey(a.PubKey))
+}
+
+// verifyLeave checks that a graceful leave was signed with the key we last
+// verified for the node. The node lock must be held.
+func (m *Memberlist) verifyLeave(state *nodeState, d *dead) error {
+	if state.pubKey == nil {
+		return fmt.Errorf("no verified identity")
+	}
+	if len(d.Sig) != ed25519.SignatureSize || !ed25519.Verify(state.pubKey, leaveSigningBytes(d), d.Sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// identityRejected counts a message dropped by identity checks.
+func identityRejected(kind string) {
+	metrics.IncrCounter([]string{"memberlist", "identity", "rejected", kind}, 1)
+}
@@ -0,0 +1,187 @@
+package memberlist
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func testIdentityKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return pub, priv
+}
+
+func TestStaticIdentities(t *testing.T) {
+	pub, _ := testIdentityKey(t)
+	other, _ := testIdentityKey(t)
+	ids := StaticIdentities{"a": pub}
+
+	require.NoError(t, ids.VerifyIdentity(&Node{Name: "a"}, pub))
+	require.Error(t, ids.VerifyIdentity(&Node{Name: "a"}, other))
+	require.Error(t, ids.VerifyIdentity(&Node{Name: "b"}, pub))
+}
+
+func TestIdentity_SignVerify(t *testing.T) {
+	pub, priv := testIdentityKey(t)
+	m := &Memberlist{config: &Config{
+		IdentityKey: priv,
+		Identity:    StaticIdentities{"a": pub},
+	}}
+
+	a := alive{
+		Incarnation: 3,
+		Node:        "a",
+		Addr:        []byte{127, 0, 0, 1},
+		Port:        7946,
+		Meta:        []byte("meta"),
+		Vsn:         []uint8{1, 2, 3, 4, 5, 6},
+		Compression: []compressionType{zstdAlgo, lzwAlgo},
+	}
+	m.signAlive(&a)
+	require.Equal(t, []byte(pub), a.PubKey)
+	require.NoError(t, m.verifyAlive(&a))
+
+	// Any change to a signed field breaks the signature.
+	tampered := a
+	tampered.Meta = []byte("evil")
+	require.Error(t, m.verifyAlive(&tampered))
+	tampered = a
+	tampered.Incarnation++
+	require.Error(t, m.verifyAlive(&tampered))
+
+	// Unsigned messages are rejected outright.
+	unsigned := a
+	unsigned.PubKey, unsigned.Sig = nil, nil
+	require.Error(t, m.verifyAlive(&unsigned))
+
+	// A valid signature from a key that isn't trusted for the name.
+	_, rogue := testIdentityKey(t)
+	m.config.IdentityKey = rogue
+	forged := a
+	m.signAlive(&forged)
+	require.Error(t, m.verifyAlive(&forged))
+
+	// Leaves are checked against the key we last verified.
+	m.config.IdentityKey = priv
+	state := &nodeState{pubKey: pub}
+	d := dead{Incarnation: 3, Node: "a", From: "a"}
+	require.Error(t, m.verifyLeave(state, &d))
+	m.signLeave(&d)
+	require.NoError(t, m.verifyLeave(state, &d))
+	require.Error(t, m.verifyLeave(&nodeState{}, &d))
+
+	// An alive signature can't be passed off as a leave.
+	d.Sig = a.Sig
+	require.Error(t, m.verifyLeave(state, &d))
+}
+
+func TestMemberlist_Identity(t *testing.T) {
+	network := &MockNetwork{}
+	ids := StaticIdentities{}
+	keys := map[string]ed25519.PrivateKey{}
+	for _, name := range []string{"node0", "node1", "node2"} {
+		pub, priv := testIdentityKey(t)
+		ids[name] = pub
+		keys[name] = priv
+	}
+
+	var ms []*Memberlist
+	for _, name := range []string{"node0", "node1", "node2"} {
+		c := testConfig(t)
+		c.Name = name
+		c.Transport = network.NewTransport()
+		c.IdentityKey = keys[name]
+		c.Identity = ids
+		m, err := Create(c)
+		require.NoError(t, err)
+		defer m.Shutdown()
+		if len(ms) > 0 {
+			_, err = m.Join([]string{ms[0].LocalNode().Address()})
+			require.NoError(t, err)
+		}
+		ms = append(ms, m)
+	}
+	m0 := ms[0]
+
+	// node2 only learns about node1 through node0 relaying its signed
+	// state.
+	for _, m := range ms {
+		waitUntilSize(t, m, 3)
+	}
+
+	stateOf := func(name string) *nodeState {
+		m0.nodeLock.RLock()
+		defer m0.nodeLock.RUnlock()
+		s := *m0.nodeMap[name]
+		return &s
+	}
+	before := stateOf("node1")
+
+	// node2 tries to move node1 to its own address, unsigned and then
+	// signed with its own key.
+	a := alive{
+		Incarnation: before.Incarnation + 1,
+		Node:        "node1",
+		Addr:        net.ParseIP("10.0.0.1").To4(),
+		Port:        1234,
+		Vsn:         m0.config.BuildVsnArray(),
+	}
+	m0.aliveNode(&a, nil, false)
+	ms[2].signAlive(&a)
+	m0.aliveNode(&a, nil, false)
+	require.Equal(t, before.Address(), stateOf("node1").Address())
+	require.Equal(t, before.Incarnation, stateOf("node1").Incarnation)
+
+	// It can't make node1 leave, or accuse it at an incarnation node1
+	// never signed.
+	d := dead{Incarnation: before.Incarnation, Node: "node1", From: "node1"}
+	ms[2].signLeave(&d)
+	m0.deadNode(&d)
+	m0.suspectNode(&suspect{Incarnation: before.Incarnation + 10, Node: "node1", From: "node2"})
+	m0.deadNode(&dead{Incarnation: before.Incarnation + 10, Node: "node1", From: "node2"})
+	require.Equal(t, StateAlive, stateOf("node1").State)
+
+	// A genuine leave goes through.
+	require.NoError(t, ms[1].Leave(time.Second))
+	retry(t, 20, 50*time.Millisecond, func(failf func(string, ...interface{})) {
+		if s := stateOf("node1").State; s != StateLeft {
+			failf("node1 is %v", s)
+		}
+	})
+}
+
+func TestMemberlist_Identity_RejectsUnknown(t *testing.T) {
+	network := &MockNetwork{}
+	pub, priv := testIdentityKey(t)
+
+	c1 := testConfig(t)
+	c1.Name = "trusted"
+	c1.Transport = network.NewTransport()
+	c1.IdentityKey = priv
+	c1.Identity = StaticIdentities{"trusted": pub}
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	// A node without a pinned key can talk to us but never becomes a
+	// member.
+	_, other := testIdentityKey(t)
+	c2 := testConfig(t)
+	c2.Name = "stranger"
+	c2.Transport = network.NewTransport()
+	c2.IdentityKey = other
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m2.Join([]string{m1.LocalNode().Address()})
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1, m1.NumMembers())
+	require.Equal(t, 2, m2.NumMembers())
+}
@@ -0,0 +1,313 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// inmemPacketBuffer is how many packets an InmemTransport queues
+	// before it starts dropping them, like a socket receive buffer.
+	inmemPacketBuffer = 1024
+
+	// inmemStreamBacklog is how many dialed streams an InmemTransport
+	// queues before dials have to wait, like a listen backlog.
+	inmemStreamBacklog = 64
+)
+
+// InmemNetwork connects InmemTransports within a single process, so that
+// several memberlists can take part in a cluster without any network I/O.
+// Unlike MockNetwork it doesn't inject faults, and the transports it makes
+// implement the whole Transport contract, including shutdown and advertised
+// addresses. The zero value is ready to use.
+//
+// 进程内的网络：同一进程中的多个 memberlist 不经过网络即可组成集群。
+type InmemNetwork struct {
+	// Clock, if set, timestamps packets and times dial timeouts. It should
+	// be the same clock the memberlists on this network are configured
+	// with; nil uses the wall clock.
+	Clock Clock
+
+	l          sync.RWMutex
+	transports map[string]*InmemTransport // Address, including advertised ones -> transport
+	port       int
+}
+
+// NewTransport returns a transport reachable at addr, which must be in the
+// form "ip:port". If addr is empty a unique loopback address is picked.
+func (n *InmemNetwork) NewTransport(addr string) (*InmemTransport, error) {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	if n.transports == nil {
+		n.transports = make(map[string]*InmemTransport)
+	}
+	if addr == "" {
+		for {
+			n.port++
+			addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(n.port))
+			if _, ok := n.transports[addr]; !ok {
+				break
+			}
+		}
+	}
+
+	ip, port, err := parseInmemAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	addr = joinHostPort(ip.String(), uint16(port))
+	if _, ok := n.transports[addr]; ok {
+		return nil, fmt.Errorf("Address %q is already in use", addr)
+	}
+
+	t := &InmemTransport{
+		net:        n,
+		addr:       &inmemAddr{addr},
+		ip:         ip,
+		port:       port,
+		packetCh:   make(chan *Packet, inmemPacketBuffer),
+		streamCh:   make(chan net.Conn, inmemStreamBacklog),
+		shutdownCh: make(chan struct{}),
+		aliases:    []string{addr},
+	}
+	n.transports[addr] = t
+	return t, nil
+}
+
+// clock returns the network's clock, defaulting to the wall clock.
+func (n *InmemNetwork) clock() Clock {
+	if n.Clock != nil {
+		return n.Clock
+	}
+	return realClock{}
+}
+
+// transport looks up a running transport by address.
+func (n *InmemNetwork) transport(addr string) (*InmemTransport, bool) {
+	n.l.RLock()
+	defer n.l.RUnlock()
+	t, ok := n.transports[addr]
+	return t, ok
+}
+
+// parseInmemAddr splits an "ip:port" address.
+func parseInmemAddr(addr string) (net.IP, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("Failed to parse IP %q", host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to parse port %q: %v", portStr, err)
+	}
+	return ip, int(port), nil
+}
+
+// inmemAddr is the address of an InmemTransport.
+type inmemAddr struct {
+	addr string
+}
+
+// See net.Addr.
+func (a *inmemAddr) Network() string {
+	return "inmem"
+}
+
+// See net.Addr.
+func (a *inmemAddr) String() string {
+	return a.addr
+}
+
+// InmemTransport is a Transport that passes packets and streams to other
+// transports on the same InmemNetwork. Packets are queued on the receiving
+// side and dropped if its queue is full, and streams are in-memory pipes.
+type InmemTransport struct {
+	net      *InmemNetwork
+	addr     *inmemAddr
+	ip       net.IP
+	port     int
+	packetCh chan *Packet
+	streamCh chan net.Conn
+
+	shutdownLock sync.Mutex // Guards shutdown and aliases
+	shutdown     bool
+	shutdownCh   chan struct{}
+	aliases      []string // Addresses registered on the network
+}
+
+// Addr returns the address the transport was created with.
+func (t *InmemTransport) Addr() net.Addr {
+	return t.addr
+}
+
+// See Transport. If an address is given, the transport is made reachable
+// at it as well, so it can't be one another transport is using.
+func (t *InmemTransport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	if ip == "" {
+		return t.ip, t.port, nil
+	}
+
+	advertiseAddr := net.ParseIP(ip)
+	if advertiseAddr == nil {
+		return nil, 0, fmt.Errorf("Failed to parse advertise address %q", ip)
+	}
+	if ip4 := advertiseAddr.To4(); ip4 != nil {
+		advertiseAddr = ip4
+	}
+	if port == 0 {
+		port = t.port
+	}
+	addr := joinHostPort(advertiseAddr.String(), uint16(port))
+
+	t.shutdownLock.Lock()
+	defer t.shutdownLock.Unlock()
+	if t.shutdown {
+		return nil, 0, fmt.Errorf("Transport is shut down")
+	}
+
+	t.net.l.Lock()
+	defer t.net.l.Unlock()
+	if other, ok := t.net.transports[addr]; ok && other != t {
+		return nil, 0, fmt.Errorf("Advertise address %q is already in use", addr)
+	} else if !ok {
+		t.net.transports[addr] = t
+		t.aliases = append(t.aliases, addr)
+	}
+	return advertiseAddr, port, nil
+}
+
+// See Transport.
+func (t *InmemTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	dest, ok := t.net.transport(addr)
+	if !ok {
+		return time.Time{}, fmt.Errorf("No route to %q", addr)
+	}
+
+	// The caller is free to reuse b once we return.
+	buf := make([]byte, len(b))
+	copy(buf, b)
+
+	now := t.net.clock().Now()
+	select {
+	case dest.packetCh <- &Packet{
+		Buf:       buf,
+		From:      t.addr,
+		Timestamp: now,
+	}:
+	default:
+		// The receiver's queue is full, drop it like UDP would.
+	}
+	return now, nil
+}
+
+// See Transport.
+func (t *InmemTransport) PacketCh() <-chan *Packet {
+	return t.packetCh
+}
+
+// See Transport.
+func (t *InmemTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	dest, ok := t.net.transport(addr)
+	if !ok {
+		return nil, fmt.Errorf("No route to %q", addr)
+	}
+
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timeoutCh = t.net.clock().After(timeout)
+	}
+
+	// Hold the receiver's lock so that a stream isn't queued after it has
+	// shut down and closed what's left in its backlog.
+	p1, p2 := net.Pipe()
+	dest.shutdownLock.Lock()
+	if dest.shutdown {
+		dest.shutdownLock.Unlock()
+		return nil, fmt.Errorf("No route to %q", addr)
+	}
+	select {
+	case dest.streamCh <- &inmemConn{p1, dest.addr, t.addr}:
+		dest.shutdownLock.Unlock()
+		return &inmemConn{p2, t.addr, dest.addr}, nil
+	default:
+	}
+	dest.shutdownLock.Unlock()
+
+	// The backlog is full, so wait for the receiver to catch up.
+	select {
+	case dest.streamCh <- &inmemConn{p1, dest.addr, t.addr}:
+		dest.shutdownLock.Lock()
+		if dest.shutdown {
+			dest.closeBacklog()
+		}
+		dest.shutdownLock.Unlock()
+		return &inmemConn{p2, t.addr, dest.addr}, nil
+	case <-dest.shutdownCh:
+		return nil, fmt.Errorf("No route to %q", addr)
+	case <-t.shutdownCh:
+		return nil, fmt.Errorf("Transport is shut down")
+	case <-timeoutCh:
+		return nil, fmt.Errorf("Dial to %q timed out", addr)
+	}
+}
+
+// inmemConn is one end of an in-memory stream, reporting the addresses of
+// both transports instead of the pipe's.
+type inmemConn struct {
+	net.Conn
+	local, remote *inmemAddr
+}
+
+func (c *inmemConn) LocalAddr() net.Addr { return c.local }
+
+func (c *inmemConn) RemoteAddr() net.Addr { return c.remote }
+
+// See Transport.
+func (t *InmemTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// See Transport. Once shut down the transport can't be reached, and its
+// addresses can be used by new transports.
+func (t *InmemTransport) Shutdown() error {
+	t.shutdownLock.Lock()
+	defer t.shutdownLock.Unlock()
+	if t.shutdown {
+		return nil
+	}
+	t.shutdown = true
+	close(t.shutdownCh)
+
+	t.net.l.Lock()
+	for _, addr := range t.aliases {
+		delete(t.net.transports, addr)
+	}
+	t.net.l.Unlock()
+
+	t.closeBacklog()
+	return nil
+}
+
+// closeBacklog closes any streams that were dialed but never taken from the
+// stream channel. The lock must be held.
+func (t *InmemTransport) closeBacklog() {
+	for {
+		select {
+		case conn := <-t.streamCh:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package memberlist
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// keyringFanout limits how many nodes a KeyManager talks to at once.
+const keyringFanout = 16
+
+// keyringOp is the change a keyring request asks for.
+type keyringOp uint8
+
+const (
+	installKeyOp keyringOp = iota
+	useKeyOp
+	removeKeyOp
+	listKeysOp
+)
+
+func (op keyringOp) String() string {
+	switch op {
+	case installKeyOp:
+		return "install"
+	case useKeyOp:
+		return "use"
+	case removeKeyOp:
+		return "remove"
+	case listKeysOp:
+		return "list"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(op))
+	}
+}
+
+// keyringReq is sent over an encrypted stream to change a node's keyring.
+type keyringReq struct {
+	Op    keyringOp
+	Key   []byte
+	Suite CipherSuite `codec:",omitempty"` // Zero keeps an installed key's suite
+}
+
+// keyringResp is the reply to a keyringReq.
+type keyringResp struct {
+	Error      string   `codec:",omitempty"`
+	Keys       [][]byte `codec:",omitempty"`
+	PrimaryKey []byte   `codec:",omitempty"`
+}
+
+// KeyManager changes the keyrings of every member of the cluster at once.
+// Requests travel over streams encrypted with the current primary key, so
+// only a member that already holds a key can make changes, and encryption
+// must be enabled. Obtain one with Memberlist.KeyManager.
+//
+// A typical rotation is InstallKey, UseKey, then RemoveKey of the old key,
+// checking the response of each step before moving on.
+type KeyManager struct {
+	m *Memberlist
+
+	// l serializes operations so that their effects arrive in order.
+	l sync.Mutex
+}
+
+// KeyResponse reports the outcome of a KeyManager operation.
+type KeyResponse struct {
+	// Messages maps the names of nodes that failed to the reason.
+	Messages map[string]string
+
+	// NumNodes is the number of nodes asked, including this one. NumResp
+	// counts those that answered and NumErr those that failed.
+	NumNodes int
+	NumResp  int
+	NumErr   int
+
+	// Keys counts how many nodes hold each key, and PrimaryKeys how many use
+	// it as their primary key. Keys are base64 encoded. These are only
+	// filled in by ListKeys.
+	Keys        map[string]int
+	PrimaryKeys map[string]int
+}
+
+// KeyManager returns the key manager for the cluster.
+func (m *Memberlist) KeyManager() *KeyManager {
+	return &KeyManager{m: m}
+}
+
+// InstallKey adds a key to the keyring of every member, tagged with
+// CipherSuiteAESGCM unless it is already installed. The key can decrypt
+// messages once installed but isn't used to send until UseKey.
+func (k *KeyManager) InstallKey(key []byte) (*KeyResponse, error) {
+	return k.run(&keyringReq{Op: installKeyOp, Key: key})
+}
+
+// InstallKeyWithSuite works like InstallKey, but tags the key with the given
+// cipher suite on every member. See Keyring.AddKeyWithSuite.
+func (k *KeyManager) InstallKeyWithSuite(key []byte, suite CipherSuite) (*KeyResponse, error) {
+	return k.run(&keyringReq{Op: installKeyOp, Key: key, Suite: suite})
+}
+
+// UseKey makes an installed key the primary key on every member.
+func (k *KeyManager) UseKey(key []byte) (*KeyResponse, error) {
+	return k.run(&keyringReq{Op: useKeyOp, Key: key})
+}
+
+// RemoveKey removes a key from every member. Members using it as their
+// primary key refuse.
+func (k *KeyManager) RemoveKey(key []byte) (*KeyResponse, error) {
+	return k.run(&keyringReq{Op: removeKeyOp, Key: key})
+}
+
+// ListKeys collects the keys installed on every member.
+func (k *KeyManager) ListKeys() (*KeyResponse, error) {
+	return k.run(&keyringReq{Op: listKeysOp})
+}
+
+// run sends the request to every live member, applies it locally and
+// gathers the results. The error is non-nil if any node failed.
+func (k *KeyManager) run(req *keyringReq) (*KeyResponse, error) {
+	k.l.Lock()
+	defer k.l.Unlock()
+
+	m := k.m
+	if !m.config.EncryptionEnabled() {
+		return nil, fmt.Errorf("Keyring changes require encryption to be enabled")
+	}
+	defer metrics.MeasureSince([]string{"memberlist", "keyring", req.Op.String()}, time.Now())
+
+	m.nodeLock.RLock()
+	var targets []string
+	for _, n := range m.nodes {
+		if n.Name != m.config.Name && !n.DeadOrLeft() {
+			targets = append(targets, n.Name)
+		}
+	}
+	addrs := make(map[string]string, len(targets))
+	for _, name := range targets {
+		addrs[name] = m.nodeMap[name].Address()
+	}
+	m.nodeLock.RUnlock()
+
+	resp := &KeyResponse{
+		Messages:    make(map[string]string),
+		NumNodes:    len(targets) + 1,
+		Keys:        make(map[string]int),
+		PrimaryKeys: make(map[string]int),
+	}
+	var l sync.Mutex
+	record := func(name string, r *keyringResp, err error) {
+		l.Lock()
+		defer l.Unlock()
+
+		if err == nil && r.Error != "" {
+			err = fmt.Errorf("%s", r.Error)
+		}
+		if err != nil {
+			resp.NumErr++
+			resp.Messages[name] = err.Error()
+			return
+		}
+		resp.NumResp++
+		if req.Op == listKeysOp {
+			for _, key := range r.Keys {
+				resp.Keys[base64.StdEncoding.EncodeToString(key)]++
+			}
+			resp.PrimaryKeys[base64.StdEncoding.EncodeToString(r.PrimaryKey)]++
+		}
+	}
+
+	// Apply it locally last, so a UseKey doesn't change the key our own
+	// requests are encrypted with while they are still going out.
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, keyringFanout)
+	for _, name := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name, addr string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			r, err := m.sendKeyringReq(addr, req)
+			record(name, r, err)
+		}(name, addrs[name])
+	}
+	wg.Wait()
+	record(m.config.Name, m.applyKeyringReq(req), nil)
+
+	if resp.NumErr > 0 {
+		return resp, fmt.Errorf("%d/%d nodes reported failure", resp.NumErr, resp.NumNodes)
+	}
+	return resp, nil
+}
+
+// sendKeyringReq sends a keyring request to a single node and waits for the
+// reply.
+func (m *Memberlist) sendKeyringReq(addr string, req *keyringReq) (*keyringResp, error) {
+	conn, err := m.dialStream(addr, m.config.TCPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
+
+	out, err := encode(keyringMsg, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.rawSendMsgStream(conn, out.Bytes(), m.compressionForAddr(addr)); err != nil {
+		return nil, err
+	}
+
+	msgType, _, dec, err := m.readStream(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch msgType {
+	case keyringRespMsg:
+		var resp keyringResp
+		if err := dec.Decode(&resp); err != nil {
+			return nil, err
+		}
+		return &resp, nil
+	case errMsg:
+		var resp errResp
+		if err := dec.Decode(&resp); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("remote error: %v", resp.Error)
+	default:
+		return nil, fmt.Errorf("received invalid msgType (%d), expected keyringRespMsg (%d) %s", msgType, keyringRespMsg, LogConn(conn))
+	}
+}
+
+// handleKeyringReq applies a keyring request received over a stream and
+// sends back the result.
+func (m *Memberlist) handleKeyringReq(conn net.Conn, dec *codec.Decoder) error {
+	var req keyringReq
+	if err := dec.Decode(&req); err != nil {
+		return err
+	}
+
+	// readStream only guarantees the stream was encrypted when we verify
+	// incoming messages, and nobody without a key may touch the keyring.
+	var resp *keyringResp
+	if !m.config.EncryptionEnabled() || !m.config.GossipVerifyIncoming {
+		resp = &keyringResp{Error: "Keyring changes require encryption with GossipVerifyIncoming"}
+	} else {
+		resp = m.applyKeyringReq(&req)
+	}
+
+	out, err := encode(keyringRespMsg, resp)
+	if err != nil {
+		return err
+	}
+	return m.rawSendMsgStream(conn, out.Bytes(), lzwAlgo)
+}
+
+// applyKeyringReq performs a keyring request on the local keyring.
+func (m *Memberlist) applyKeyringReq(req *keyringReq) *keyringResp {
+	keyring := m.config.Keyring
+	if keyring == nil {
+		return &keyringResp{Error: "Encryption is not enabled"}
+	}
+
+	var err error
+	switch req.Op {
+	case installKeyOp:
+		if req.Suite != 0 {
+			err = keyring.AddKeyWithSuite(req.Key, req.Suite)
+		} else {
+			err = keyring.AddKey(req.Key)
+		}
+	case useKeyOp:
+		err = keyring.UseKey(req.Key)
+	case removeKeyOp:
+		err = keyring.RemoveKey(req.Key)
+	case listKeysOp:
+		return &keyringResp{
+			Keys:       keyring.GetKeys(),
+			PrimaryKey: keyring.GetPrimaryKey(),
+		}
+	default:
+		err = fmt.Errorf("Unknown keyring operation %d", req.Op)
+	}
+
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to %s key: %v", req.Op, err)
+		return &keyringResp{Error: err.Error()}
+	}
+	m.logger.Printf("[INFO] memberlist: Applied keyring %s request", req.Op)
+	return &keyringResp{}
+}
@@ -0,0 +1,110 @@
+package memberlist
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newKeyManagerCluster(t *testing.T, n int, key []byte) []*Memberlist {
+	var members []*Memberlist
+	for i := 0; i < n; i++ {
+		keyring, err := NewKeyring(nil, key)
+		require.NoError(t, err)
+
+		c := testConfig(t)
+		c.Keyring = keyring
+		if i > 0 {
+			c.BindPort = members[0].config.BindPort
+		}
+		m, err := Create(c)
+		require.NoError(t, err)
+		members = append(members, m)
+
+		if i > 0 {
+			_, err = m.Join([]string{members[0].config.BindAddr})
+			require.NoError(t, err)
+		}
+	}
+	for _, m := range members {
+		waitUntilSize(t, m, n)
+	}
+	return members
+}
+
+func TestKeyManager_Rotate(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 16)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	members := newKeyManagerCluster(t, 3, oldKey)
+	for _, m := range members {
+		defer m.Shutdown()
+	}
+	km := members[0].KeyManager()
+
+	resp, err := km.InstallKeyWithSuite(newKey, CipherSuiteXChaCha20Poly1305)
+	require.NoError(t, err)
+	require.Equal(t, 3, resp.NumNodes)
+	require.Equal(t, 3, resp.NumResp)
+
+	resp, err = km.UseKey(newKey)
+	require.NoError(t, err)
+	require.Equal(t, 3, resp.NumResp)
+
+	resp, err = km.RemoveKey(oldKey)
+	require.NoError(t, err)
+	require.Equal(t, 3, resp.NumResp)
+
+	for _, m := range members {
+		key, suite := m.config.Keyring.getPrimaryKeySuite()
+		require.Equal(t, newKey, key)
+		require.Equal(t, CipherSuiteXChaCha20Poly1305, suite)
+		require.Len(t, m.config.Keyring.GetKeys(), 1)
+	}
+
+	// The cluster still talks after the rotation, from another member.
+	resp, err = members[2].KeyManager().ListKeys()
+	require.NoError(t, err)
+	encoded := base64.StdEncoding.EncodeToString(newKey)
+	require.Equal(t, map[string]int{encoded: 3}, resp.Keys)
+	require.Equal(t, map[string]int{encoded: 3}, resp.PrimaryKeys)
+}
+
+func TestKeyManager_Failures(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 16)
+	members := newKeyManagerCluster(t, 2, key)
+	for _, m := range members {
+		defer m.Shutdown()
+	}
+	km := members[1].KeyManager()
+
+	// Nobody has this key, so every node refuses.
+	resp, err := km.UseKey(bytes.Repeat([]byte{3}, 16))
+	require.Error(t, err)
+	require.Equal(t, 2, resp.NumErr)
+	require.Contains(t, resp.Messages, members[0].config.Name)
+	require.Contains(t, resp.Messages, members[1].config.Name)
+
+	// Removing the primary key is refused too.
+	resp, err = km.RemoveKey(key)
+	require.Error(t, err)
+	require.Equal(t, 2, resp.NumErr)
+
+	// A node that would accept plaintext streams doesn't allow changes.
+	members[0].config.GossipVerifyIncoming = false
+	resp, err = km.InstallKey(bytes.Repeat([]byte{4}, 16))
+	require.Error(t, err)
+	require.Equal(t, 1, resp.NumErr)
+	require.Contains(t, resp.Messages, members[0].config.Name)
+	require.Len(t, members[0].config.Keyring.GetKeys(), 1)
+}
+
+func TestKeyManager_RequiresEncryption(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	_, err := m.KeyManager().ListKeys()
+	require.Error(t, err)
+}
@@ -13,6 +13,14 @@ type Keyring struct {
 	// message decryption.
 	keys [][]byte
 
+	// suites maps each key to the cipher suite it is used with. Keys added
+	// without a suite use CipherSuiteAESGCM.
+	suites map[string]CipherSuite
+
+	// minSuite is the weakest suite the primary key may use, taken from
+	// Config.MinCipherSuite.
+	minSuite CipherSuite
+
 	// The keyring lock is used while performing IO operations on the keyring.
 	l sync.Mutex
 }
@@ -20,6 +28,7 @@ type Keyring struct {
 // Init allocates substructures
 func (k *Keyring) init() {
 	k.keys = make([][]byte, 0)
+	k.suites = make(map[string]CipherSuite)
 }
 
 // NewKeyring constructs a new container for a set of encryption keys. The
@@ -87,6 +96,54 @@ func (k *Keyring) AddKey(key []byte) error {
 		}
 	}
 
+	return k.addKey(key, CipherSuiteAESGCM)
+}
+
+// AddKeyWithSuite works like AddKey, but tags the key with the cipher suite
+// to use when it is the primary key. Adding a key that is already installed
+// changes its suite, so a cluster can move to a new suite without downtime:
+// add the key with the new suite on every node, then UseKey it. The same
+// key bytes can't be used with two suites at once.
+//
+// CipherSuiteAES256GCM and CipherSuiteXChaCha20Poly1305 need a 32 byte key.
+func (k *Keyring) AddKeyWithSuite(key []byte, suite CipherSuite) error {
+	if err := validateSuiteKey(suite, key); err != nil {
+		return err
+	}
+
+	for i, installedKey := range k.keys {
+		if bytes.Equal(installedKey, key) {
+			k.l.Lock()
+			defer k.l.Unlock()
+			if i == 0 {
+				if err := k.checkMinSuite(suite); err != nil {
+					return err
+				}
+			}
+			k.suites[string(key)] = suite
+			return nil
+		}
+	}
+
+	return k.addKey(key, suite)
+}
+
+// addKey installs a key that isn't on the ring yet.
+func (k *Keyring) addKey(key []byte, suite CipherSuite) error {
+	k.l.Lock()
+	if len(k.keys) == 0 {
+		// It's about to become the primary key
+		if err := k.checkMinSuite(suite); err != nil {
+			k.l.Unlock()
+			return err
+		}
+	}
+	if k.suites == nil {
+		k.suites = make(map[string]CipherSuite)
+	}
+	k.suites[string(key)] = suite
+	k.l.Unlock()
+
 	keys := append(k.keys, key)
 	primaryKey := k.GetPrimaryKey()
 	if primaryKey == nil {
@@ -98,9 +155,16 @@ func (k *Keyring) AddKey(key []byte) error {
 
 // UseKey changes the key used to encrypt messages. This is the only key used to
 // encrypt messages, so peers should know this key before this method is called.
+// A key whose suite is below Config.MinCipherSuite can't be used.
 func (k *Keyring) UseKey(key []byte) error {
 	for _, installedKey := range k.keys {
 		if bytes.Equal(key, installedKey) {
+			k.l.Lock()
+			err := k.checkMinSuite(k.suites[string(key)])
+			k.l.Unlock()
+			if err != nil {
+				return err
+			}
 			k.installKeys(k.keys, key)
 			return nil
 		}
@@ -118,6 +182,10 @@ func (k *Keyring) RemoveKey(key []byte) error {
 		if bytes.Equal(key, installedKey) {
 			keys := append(k.keys[:i], k.keys[i+1:]...)
 			k.installKeys(keys, k.keys[0])
+
+			k.l.Lock()
+			delete(k.suites, string(key))
+			k.l.Unlock()
 		}
 	}
 	return nil
@@ -158,3 +226,43 @@ func (k *Keyring) GetPrimaryKey() (key []byte) {
 	}
 	return
 }
+
+// GetKeySuite returns the cipher suite a key on the ring is tagged with.
+func (k *Keyring) GetKeySuite(key []byte) (CipherSuite, error) {
+	k.l.Lock()
+	defer k.l.Unlock()
+
+	suite, ok := k.suites[string(key)]
+	if !ok {
+		return 0, fmt.Errorf("Requested key is not in the keyring")
+	}
+	return suite, nil
+}
+
+// setMinSuite sets the weakest suite the primary key may use from now on.
+func (k *Keyring) setMinSuite(suite CipherSuite) {
+	k.l.Lock()
+	defer k.l.Unlock()
+	k.minSuite = suite
+}
+
+// checkMinSuite returns an error if suite is too weak for the primary key.
+// The lock must be held.
+func (k *Keyring) checkMinSuite(suite CipherSuite) error {
+	if suite < k.minSuite {
+		return fmt.Errorf("Key uses cipher suite %s, below the minimum %s", suite, k.minSuite)
+	}
+	return nil
+}
+
+// getPrimaryKeySuite returns the primary key and its suite together, so a
+// concurrent UseKey can't pair a key with the wrong suite.
+func (k *Keyring) getPrimaryKeySuite() ([]byte, CipherSuite) {
+	k.l.Lock()
+	defer k.l.Unlock()
+
+	if len(k.keys) == 0 {
+		return nil, 0
+	}
+	return k.keys[0], k.suites[string(k.keys[0])]
+}
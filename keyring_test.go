@@ -152,3 +152,53 @@ func TestKeyRing_MultiKeyEncryptDecrypt(t *testing.T) {
 		t.Fatalf("Expected no keys to decrypt message")
 	}
 }
+
+func TestKeyring_Suites(t *testing.T) {
+	keyring, err := NewKeyring(nil, TestKeys[0])
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	suite, err := keyring.GetKeySuite(TestKeys[0])
+	if err != nil || suite != CipherSuiteAESGCM {
+		t.Fatalf("bad: %v %v", suite, err)
+	}
+
+	// The newer suites need 32 byte keys.
+	if err := keyring.AddKeyWithSuite(TestKeys[1], CipherSuiteXChaCha20Poly1305); err == nil {
+		t.Fatalf("expected a key size error")
+	}
+
+	key := append(append([]byte{}, TestKeys[1]...), TestKeys[2]...)
+	if err := keyring.AddKeyWithSuite(key, CipherSuiteAES256GCM); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if suite, _ := keyring.GetKeySuite(key); suite != CipherSuiteAES256GCM {
+		t.Fatalf("bad: %v", suite)
+	}
+
+	// Adding it again retags it, and AddKey leaves the tag alone.
+	if err := keyring.AddKeyWithSuite(key, CipherSuiteXChaCha20Poly1305); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := keyring.AddKey(key); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(keyring.GetKeys()) != 2 {
+		t.Fatalf("expected 2 keys, have %d", len(keyring.GetKeys()))
+	}
+	if err := keyring.UseKey(key); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	primary, suite := keyring.getPrimaryKeySuite()
+	if !bytes.Equal(primary, key) || suite != CipherSuiteXChaCha20Poly1305 {
+		t.Fatalf("bad: %v %v", primary, suite)
+	}
+
+	if err := keyring.RemoveKey(TestKeys[0]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := keyring.GetKeySuite(TestKeys[0]); err == nil {
+		t.Fatalf("removed key should have no suite")
+	}
+}
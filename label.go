@@ -0,0 +1,150 @@
+package memberlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// hasLabelMsg is the message type of the label header that is prepended to
+// every packet and stream when Config.Label is set. It sits far above the
+// regular message types so that it can never collide with them.
+//
+// The header is: [hasLabelMsg][label length][label bytes]
+const hasLabelMsg messageType = 244
+
+// labelMaxSize is the longest label that fits in the one byte length.
+const labelMaxSize = 255
+
+// validateLabel checks that a label can be encoded in the header.
+func validateLabel(label string) error {
+	if len(label) > labelMaxSize {
+		return fmt.Errorf("Label is %d bytes, longer than the maximum of %d", len(label), labelMaxSize)
+	}
+	return nil
+}
+
+// labelOverhead returns the number of bytes the label header adds to a
+// packet.
+func labelOverhead(label string) int {
+	if label == "" {
+		return 0
+	}
+	return 2 + len(label)
+}
+
+// addLabelHeaderToPacket prefixes a packet with the label header. An empty
+// label leaves the packet untouched so unlabelled clusters stay compatible.
+func addLabelHeaderToPacket(buf []byte, label string) []byte {
+	if label == "" {
+		return buf
+	}
+	out := make([]byte, 2+len(label)+len(buf))
+	out[0] = byte(hasLabelMsg)
+	out[1] = byte(len(label))
+	copy(out[2:], label)
+	copy(out[2+len(label):], buf)
+	return out
+}
+
+// removeLabelHeaderFromPacket strips the label header from a packet, if it
+// has one, and returns the rest of the packet along with the label.
+func removeLabelHeaderFromPacket(buf []byte) ([]byte, string, error) {
+	if len(buf) == 0 || messageType(buf[0]) != hasLabelMsg {
+		return buf, "", nil
+	}
+	if len(buf) < 2 {
+		return nil, "", fmt.Errorf("Truncated label header")
+	}
+	size := int(buf[1])
+	if size == 0 {
+		return nil, "", fmt.Errorf("Empty label header")
+	}
+	if len(buf) < 2+size {
+		return nil, "", fmt.Errorf("Truncated label header")
+	}
+	return buf[2+size:], string(buf[2 : 2+size]), nil
+}
+
+// addLabelHeaderToStream writes the label header to a new stream. An empty
+// label writes nothing.
+func addLabelHeaderToStream(conn net.Conn, label string) error {
+	if label == "" {
+		return nil
+	}
+	_, err := conn.Write(addLabelHeaderToPacket(nil, label))
+	return err
+}
+
+// removeLabelHeaderFromStream reads the label header from the start of a
+// stream, if it has one. The returned conn must be used in place of the
+// original since bytes may have been buffered from it.
+func removeLabelHeaderFromStream(conn net.Conn) (net.Conn, string, error) {
+	br := bufio.NewReader(conn)
+	wrapped := &bufferedConn{Conn: conn, r: br}
+
+	peek, err := br.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return wrapped, "", nil
+		}
+		return nil, "", err
+	}
+	if messageType(peek[0]) != hasLabelMsg {
+		return wrapped, "", nil
+	}
+
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, "", err
+	}
+	size := int(hdr[1])
+	if size == 0 {
+		return nil, "", fmt.Errorf("Empty label header")
+	}
+	label := make([]byte, size)
+	if _, err := io.ReadFull(br, label); err != nil {
+		return nil, "", err
+	}
+	return wrapped, string(label), nil
+}
+
+// bufferedConn is a net.Conn whose reads go through a buffer that may
+// already hold data peeked from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// checkLabel decides whether traffic carrying the given label may be
+// processed. Mismatches are counted and rejected unless the inbound check is
+// disabled.
+func (m *Memberlist) checkLabel(label string) error {
+	if m.config.SkipInboundLabelCheck || label == m.config.Label {
+		return nil
+	}
+	metrics.IncrCounter([]string{"memberlist", "label", "dropped"}, 1)
+	return fmt.Errorf("Label %q does not match ours %q", label, m.config.Label)
+}
+
+// dialStream opens a stream to the given address and writes our label
+// header, if any.
+func (m *Memberlist) dialStream(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := m.transport.DialTimeout(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := addLabelHeaderToStream(conn, m.config.Label); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,173 @@
+package memberlist
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabel_PacketHeader(t *testing.T) {
+	msg := []byte{byte(pingMsg), 1, 2, 3}
+
+	// No label means no header.
+	require.Equal(t, msg, addLabelHeaderToPacket(msg, ""))
+	buf, label, err := removeLabelHeaderFromPacket(msg)
+	require.NoError(t, err)
+	require.Equal(t, msg, buf)
+	require.Equal(t, "", label)
+
+	buf, label, err = removeLabelHeaderFromPacket(addLabelHeaderToPacket(msg, "blue"))
+	require.NoError(t, err)
+	require.Equal(t, msg, buf)
+	require.Equal(t, "blue", label)
+
+	// Malformed headers are rejected.
+	for _, bad := range [][]byte{
+		{byte(hasLabelMsg)},
+		{byte(hasLabelMsg), 0, byte(pingMsg)},
+		{byte(hasLabelMsg), 5, 'b', 'l'},
+	} {
+		_, _, err := removeLabelHeaderFromPacket(bad)
+		require.Error(t, err, "%v", bad)
+	}
+
+	require.NoError(t, validateLabel(strings.Repeat("x", labelMaxSize)))
+	require.Error(t, validateLabel(strings.Repeat("x", labelMaxSize+1)))
+}
+
+func TestLabel_StreamHeader(t *testing.T) {
+	for _, label := range []string{"", "blue"} {
+		client, server := net.Pipe()
+		go func() {
+			defer client.Close()
+			require.NoError(t, addLabelHeaderToStream(client, label))
+			client.Write([]byte("payload"))
+		}()
+
+		conn, got, err := removeLabelHeaderFromStream(server)
+		require.NoError(t, err)
+		require.Equal(t, label, got)
+
+		// Whatever was buffered while peeking must still be readable.
+		rest, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "payload", string(rest))
+	}
+}
+
+func TestMemberlist_Label(t *testing.T) {
+	network := &MockNetwork{}
+	create := func(name, label string, skip bool) *Memberlist {
+		c := testConfig(t)
+		c.Name = name
+		c.Transport = network.NewTransport()
+		c.Label = label
+		c.SkipInboundLabelCheck = skip
+		m, err := Create(c)
+		require.NoError(t, err)
+		return m
+	}
+
+	blue1 := create("blue1", "blue", false)
+	defer blue1.Shutdown()
+	blue2 := create("blue2", "blue", false)
+	defer blue2.Shutdown()
+	red := create("red", "red", false)
+	defer red.Shutdown()
+	plain := create("plain", "", false)
+	defer plain.Shutdown()
+
+	_, err := blue2.Join([]string{blue1.LocalNode().Address()})
+	require.NoError(t, err)
+	waitUntilSize(t, blue1, 2)
+
+	// A different label, or none at all, is turned away.
+	_, err = red.Join([]string{blue1.LocalNode().Address()})
+	require.Error(t, err)
+	_, err = plain.Join([]string{blue1.LocalNode().Address()})
+	require.Error(t, err)
+	require.Equal(t, 2, blue1.NumMembers())
+
+	// Packets are dropped too.
+	_, err = red.Ping("blue1", &MockAddress{blue1.LocalNode().Address()})
+	require.Error(t, err)
+	_, err = blue2.Ping("blue1", &MockAddress{blue1.LocalNode().Address()})
+	require.NoError(t, err)
+
+	// With the check skipped, an unlabelled node can join a labelled one
+	// during a migration.
+	migrating := create("migrating", "", true)
+	defer migrating.Shutdown()
+	_, err = plain.Join([]string{migrating.LocalNode().Address()})
+	require.NoError(t, err)
+	_, err = blue1.Join([]string{migrating.LocalNode().Address()})
+	require.NoError(t, err)
+}
+
+func TestMemberlist_LabelTooLong(t *testing.T) {
+	c := testConfig(t)
+	c.Label = strings.Repeat("x", labelMaxSize+1)
+	_, err := Create(c)
+	require.Error(t, err)
+}
+
+// maxPacketTransport records the largest packet written through it.
+type maxPacketTransport struct {
+	*MockTransport
+
+	l   sync.Mutex
+	max int
+}
+
+func (t *maxPacketTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	t.l.Lock()
+	if len(b) > t.max {
+		t.max = len(b)
+	}
+	t.l.Unlock()
+	return t.MockTransport.WriteTo(b, addr)
+}
+
+func TestMemberlist_LabelGossipFits(t *testing.T) {
+	network := &MockNetwork{}
+	label := strings.Repeat("x", labelMaxSize)
+
+	tr := &maxPacketTransport{MockTransport: network.NewTransport()}
+	c1 := testConfig(t)
+	c1.Transport = tr
+	c1.Label = label
+	c1.GossipInterval = time.Hour // driven by hand below
+	c1.EnableCompression = false  // so the packets are as big as they get
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.Transport = network.NewTransport()
+	c2.Label = label
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m1.Join([]string{m2.LocalNode().Address()})
+	require.NoError(t, err)
+
+	// Queue up more broadcasts than fit in a packet, then make sure the
+	// label header didn't push the gossip past the buffer size.
+	for i := 0; i < 100; i++ {
+		a := alive{Node: fmt.Sprintf("node%d", i), Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+		m1.aliveNode(&a, nil, false)
+	}
+	m1.gossip()
+
+	tr.l.Lock()
+	defer tr.l.Unlock()
+	require.True(t, tr.max > c1.UDPBufferSize/2, "expected a full packet, largest was %d", tr.max)
+	require.True(t, tr.max <= c1.UDPBufferSize, "packet of %d bytes is over %d", tr.max, c1.UDPBufferSize)
+}
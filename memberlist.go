@@ -28,6 +28,7 @@ import (
 
 	multierror "github.com/hashicorp/go-multierror"
 	sockaddr "github.com/hashicorp/go-sockaddr"
+	"github.com/hashicorp/memberlist/coordinate"
 	"github.com/miekg/dns"
 )
 
@@ -87,12 +88,25 @@ type Memberlist struct {
 
 
 	awareness  *awareness
+	clock      Clock
+	detector   FailureDetector
+	rtts       *rttTracker
+	mtus       *mtuTracker
+
+	compression []compressionType // Algorithms we advertise, most preferred first
+	snap        *snapshotter      // nil unless Config.SnapshotPath is set
+	replay      *replayFilter     // nil unless Config.ReplayWindow is set
+
+	ping        PingDelegate       // Config.Ping, wrapped when coordinates are enabled
+	coordClient *coordinate.Client // nil unless Config.EnableCoordinates
+	coordCache  map[string]*coordinate.Coordinate
+	coordLock   sync.RWMutex
 
 
 	tickerLock sync.Mutex
 
 
-	tickers    []*time.Ticker
+	tickers    []Ticker
 	stopTick   chan struct{}
 
 
@@ -104,6 +118,15 @@ type Memberlist struct {
 
 	broadcasts *TransmitLimitedQueue
 
+	queryLock      sync.Mutex
+	queries        map[uint32]*QueryResponse // Our pending queries by ID
+	querySeen      map[queryKey]time.Time    // Queries already handled -> when to forget them
+	queryLastPrune time.Time
+
+	streamLock      sync.Mutex
+	streamListeners map[string]*streamListener // Protocol ID -> listener
+	streamSessions  map[string]*streamMux      // Address -> session we dialed
+
 	logger *log.Logger
 }
 
@@ -127,6 +150,11 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 		return nil, fmt.Errorf("Protocol version '%d' too high. Must be in range: [%d, %d]", conf.ProtocolVersion, ProtocolVersionMin, ProtocolVersionMax)
 	}
 
+	// 检查集群标签
+	if err := validateLabel(conf.Label); err != nil {
+		return nil, err
+	}
+
 	// 如果指定了密钥
 	if len(conf.SecretKey) > 0 {
 
@@ -154,6 +182,35 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 		}
 	}
 
+	// 创建 Vivaldi 坐标客户端
+	var coordClient *coordinate.Client
+	if conf.EnableCoordinates {
+		coordConf := conf.CoordinateConfig
+		if coordConf == nil {
+			coordConf = coordinate.DefaultConfig()
+		}
+		var err error
+		if coordClient, err = coordinate.NewClient(coordConf); err != nil {
+			return nil, fmt.Errorf("Failed to create coordinate client: %v", err)
+		}
+	}
+
+	// 检查主密钥的加密套件
+	if conf.EncryptionEnabled() && conf.MinCipherSuite > 0 {
+		if _, suite := conf.Keyring.getPrimaryKeySuite(); suite < conf.MinCipherSuite {
+			return nil, fmt.Errorf("Primary key uses cipher suite %s, below the minimum %s", suite, conf.MinCipherSuite)
+		}
+	}
+	if conf.Keyring != nil {
+		// Keep later key changes from dropping below it
+		conf.Keyring.setMinSuite(conf.MinCipherSuite)
+	}
+
+	compression, err := parseCompressionAlgorithms(conf.CompressionAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+
 	// 检查 logger 配置
 	if conf.LogOutput != nil && conf.Logger != nil {
 		return nil, fmt.Errorf("Cannot specify both LogOutput and Logger. Please choose a single log configuration setting.")
@@ -180,8 +237,9 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 		//
 		nc := &NetTransportConfig{
 			BindAddrs: []string{conf.BindAddr},
-			BindPort:  conf.BindPort,
-			Logger:    logger,
+			BindPort:   conf.BindPort,
+			Logger:     logger,
+			TCPTimeout: conf.TCPTimeout,
 		}
 
 		// See comment below for details about the retry in here.
@@ -226,6 +284,14 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 	}
 
 
+	clock := conf.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	detector := conf.FailureDetector
+	if detector == nil {
+		detector = newSWIMDetector()
+	}
 
 	m := &Memberlist{
 		config:               conf,
@@ -238,16 +304,47 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 		nodeMap:              make(map[string]*nodeState),
 		nodeTimers:           make(map[string]*suspicion),
 		awareness:            newAwareness(conf.AwarenessMaxMultiplier),
+		clock:                clock,
+		detector:             detector,
+		rtts:                 newRTTTracker(),
+		mtus:                 newMTUTracker(clock, conf.MTUDiscoveryMin, conf.MTUDiscoveryMax),
+		compression:          compression,
 		ackHandlers:          make(map[uint32]*ackHandler),
 		broadcasts:           &TransmitLimitedQueue{RetransmitMult: conf.RetransmitMult},
+		queries:              make(map[uint32]*QueryResponse),
+		querySeen:            make(map[queryKey]time.Time),
+		streamListeners:      make(map[string]*streamListener),
+		streamSessions:       make(map[string]*streamMux),
 		logger:               logger,
 	}
 
 
+	if conf.ReplayWindow > 0 {
+		m.replay = newReplayFilter(conf.ReplayWindow)
+	}
+
 	m.broadcasts.NumNodes = func() int {
 		return m.estNumNodes()
 	}
 
+	// 从快照中恢复 incarnation
+	if conf.SnapshotPath != "" {
+		snap, err := newSnapshotter(conf.SnapshotPath, m.snapshotState, clock, logger, m.shutdownCh)
+		if err != nil {
+			transport.Shutdown()
+			return nil, err
+		}
+		m.snap = snap
+		m.incarnation = snap.prevIncarnation
+	}
+
+	m.ping = conf.Ping
+	if coordClient != nil {
+		m.coordClient = coordClient
+		m.coordCache = make(map[string]*coordinate.Coordinate)
+		m.ping = &coordinatePingDelegate{m: m, user: conf.Ping}
+	}
+
 
 	go m.streamListen() 	// 开启 tcp 服务
 	go m.packetListen()		// 开启 udp 服务
@@ -272,9 +369,43 @@ func Create(conf *Config) (*Memberlist, error) {
 		return nil, err
 	}
 	m.schedule()
+
+	// Find our way back to the members we knew before a restart
+	if m.snap != nil {
+		var prev []string
+		for name, addr := range m.snap.prevNodes {
+			if name != m.config.Name {
+				prev = append(prev, addr)
+			}
+		}
+		if len(prev) > 0 {
+			go m.rejoin(prev)
+		}
+	}
 	return m, nil
 }
 
+// rejoin tries the members recorded in the snapshot one at a time, in
+// random order, until one of them lets us back in.
+func (m *Memberlist) rejoin(addrs []string) {
+	m.logger.Printf("[INFO] memberlist: Attempting rejoin of %d previously known nodes", len(addrs))
+	for i := range addrs {
+		j := randomOffset(i + 1)
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	}
+
+	for _, addr := range addrs {
+		if m.hasShutdown() || m.hasLeft() {
+			return
+		}
+		if _, err := m.Join([]string{addr}); err == nil {
+			m.logger.Printf("[INFO] memberlist: Rejoined the cluster via %s", addr)
+			return
+		}
+	}
+	m.logger.Printf("[WARN] memberlist: Failed to rejoin any previously known node")
+}
+
 // Join is used to take an existing Memberlist and attempt to join a cluster
 // by contacting all the given hosts and performing a state sync. Initially,
 // the Memberlist only contains our own state, so doing this will cause
@@ -481,7 +612,10 @@ func (m *Memberlist) setAlive() error {
 		Port:        uint16(port),
 		Meta:        meta,
 		Vsn:         m.config.BuildVsnArray(),
+		Compression: m.compression,
+		Zone:        m.config.Zone,
 	}
+	m.signAlive(&a)
 	m.aliveNode(&a, nil, true)
 	return nil
 }
@@ -522,7 +656,10 @@ func (m *Memberlist) UpdateNode(timeout time.Duration) error {
 		Port:        state.Port,
 		Meta:        meta,
 		Vsn:         m.config.BuildVsnArray(),
+		Compression: m.compression,
+		Zone:        m.config.Zone,
 	}
+	m.signAlive(&a)
 	notifyCh := make(chan struct{})
 	m.aliveNode(&a, notifyCh, true)
 
@@ -530,7 +667,7 @@ func (m *Memberlist) UpdateNode(timeout time.Duration) error {
 	if m.anyAlive() {
 		var timeoutCh <-chan time.Time
 		if timeout > 0 {
-			timeoutCh = time.After(timeout)
+			timeoutCh = m.clock.After(timeout)
 		}
 		select {
 		case <-notifyCh:
@@ -602,6 +739,41 @@ func (m *Memberlist) Members() []*Node {
 	return nodes
 }
 
+// NodeStates returns a snapshot of every node we know about, including
+// ourselves and nodes that are suspect, dead or have left but haven't been
+// reaped yet. Unlike Members, the entries are copies, so they may be kept
+// and modified freely.
+//
+// 返回所有已知节点状态的快照，包括 suspect 节点的确认数和剩余超时时间。
+func (m *Memberlist) NodeStates() []NodeStatus {
+	now := m.clock.Now()
+
+	m.nodeLock.RLock()
+	states := make([]NodeStatus, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		status := NodeStatus{
+			Node:        n.Node,
+			State:       n.State,
+			Incarnation: n.Incarnation,
+			StateChange: n.StateChange,
+		}
+		status.Addr = append(net.IP(nil), n.Addr...)
+		status.Meta = append([]byte(nil), n.Meta...)
+		if timer, ok := m.nodeTimers[n.Name]; ok && n.State == StateSuspect {
+			status.Confirmations = timer.Confirmations()
+			status.SuspicionTimeout = timer.Remaining()
+		}
+		states = append(states, status)
+	}
+	m.nodeLock.RUnlock()
+
+	// The detector is user code, so it's asked without holding the lock.
+	for i := range states {
+		states[i].Suspicion = m.detector.Suspicion(states[i].Name, now)
+	}
+	return states
+}
+
 // NumMembers returns the number of alive nodes currently known. Between
 // the time of calling this and calling Members, the number of alive nodes
 // may have changed, so this shouldn't be used to determine how many
@@ -657,13 +829,14 @@ func (m *Memberlist) Leave(timeout time.Duration) error {
 			Node:        state.Name,
 			From:        state.Name,
 		}
+		m.signLeave(&d)
 		m.deadNode(&d)
 
 		// Block until the broadcast goes out
 		if m.anyAlive() {
 			var timeoutCh <-chan time.Time
 			if timeout > 0 {
-				timeoutCh = time.After(timeout)
+				timeoutCh = m.clock.After(timeout)
 			}
 			select {
 			case <-m.leaveBroadcast:
@@ -732,6 +905,11 @@ func (m *Memberlist) Shutdown() error {
 	atomic.StoreInt32(&m.shutdown, 1)
 	close(m.shutdownCh)
 	m.deschedule()
+
+	// Make sure the snapshot is on disk before we return
+	if m.snap != nil {
+		m.snap.wait()
+	}
 	return nil
 }
 
@@ -743,7 +921,7 @@ func (m *Memberlist) hasLeft() bool {
 	return atomic.LoadInt32(&m.leave) == 1
 }
 
-func (m *Memberlist) getNodeState(addr string) nodeStateType {
+func (m *Memberlist) getNodeState(addr string) NodeStateType {
 	m.nodeLock.RLock()
 	defer m.nodeLock.RUnlock()
 
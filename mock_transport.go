@@ -2,28 +2,277 @@ package memberlist
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
 // MockNetwork is used as a factory that produces MockTransport instances which
 // are uniquely addressed and wired up to talk to each other.
+//
+// By default every packet and stream is delivered instantly. Faults such as
+// loss, latency and partitions can be injected per link with SetLinkFaults,
+// Partition and friends, and changed at any time while nodes are running.
 type MockNetwork struct {
+	// Clock, if set, timestamps packets and times injected latency. It
+	// should be the same clock the memberlists on this network are
+	// configured with so that RTTs are measured in one timebase. With a
+	// clock, packets are queued up to mockPacketBuffer and dropped beyond
+	// that; without one, WriteTo waits for the receiver to take them.
+	Clock Clock
+
+	l          sync.RWMutex
 	transports map[string]*MockTransport
 	port       int
+
+	faults       map[mockLink]*LinkFaults
+	defaultFault *LinkFaults
+	rng          *rand.Rand
+}
+
+// LinkFaults describes how traffic on a one-way link between two mock
+// transports is disturbed. Probabilities are in [0, 1].
+//
+// 单向链路上注入的故障：丢包、重复、乱序、延迟以及 UDP/TCP 阻断。
+type LinkFaults struct {
+	// Loss is the probability that a packet is dropped.
+	Loss float64
+
+	// Duplicate is the probability that a packet is delivered twice.
+	Duplicate float64
+
+	// Reorder is the probability that a packet is held back by
+	// ReorderDelay, letting packets sent after it arrive first.
+	Reorder      float64
+	ReorderDelay time.Duration
+
+	// Latency is added to every packet and stream dial, plus a uniformly
+	// random amount up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// BlockPackets drops every packet, like a firewall that blocks UDP.
+	BlockPackets bool
+
+	// BlockStreams makes stream dials hang until their timeout. Since a
+	// stream needs both directions, blocking either direction of a link
+	// blocks dials both ways. Streams that are already open are left
+	// alone.
+	BlockStreams bool
+}
+
+// mockLink is a one-way link between two mock transports, by address.
+type mockLink struct {
+	from, to string
+}
+
+// mockReorderDelay is used when LinkFaults.Reorder is set without a delay.
+const mockReorderDelay = 10 * time.Millisecond
+
+// Seed resets the random source used to inject faults, so that runs are
+// repeatable. The default seed is 1.
+func (n *MockNetwork) Seed(seed int64) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	n.rng = rand.New(rand.NewSource(seed))
+}
+
+// SetLinkFaults sets the faults for traffic sent from one address to
+// another, replacing any that were set before. A nil f restores a clean
+// link.
+func (n *MockNetwork) SetLinkFaults(from, to string, f *LinkFaults) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	n.setLinkFaults(mockLink{from, to}, f)
+}
+
+// SetDefaultFaults sets the faults for every link that doesn't have its own.
+// A nil f restores clean links.
+func (n *MockNetwork) SetDefaultFaults(f *LinkFaults) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	if f != nil {
+		c := *f
+		f = &c
+	}
+	n.defaultFault = f
+}
+
+// Partition stops all traffic sent from the from addresses to the to
+// addresses. The reverse direction is untouched for packets, which makes it
+// possible to build asymmetric partitions; streams are blocked both ways.
+// Other faults already set on these links are kept.
+func (n *MockNetwork) Partition(from, to []string) {
+	n.block(from, to, true, true)
+}
+
+// BlockPackets drops packets sent from the from addresses to the to
+// addresses while leaving streams open, like a firewall that only blocks
+// UDP.
+func (n *MockNetwork) BlockPackets(from, to []string) {
+	n.block(from, to, true, false)
+}
+
+// Heal removes all injected faults, including the defaults.
+func (n *MockNetwork) Heal() {
+	n.l.Lock()
+	defer n.l.Unlock()
+	n.faults = nil
+	n.defaultFault = nil
+}
+
+// block sets the blocking flags on every link from -> to.
+func (n *MockNetwork) block(from, to []string, packets, streams bool) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	for _, a := range from {
+		for _, b := range to {
+			link := mockLink{a, b}
+			f := LinkFaults{}
+			if cur := n.linkFaults(link); cur != nil {
+				f = *cur
+			}
+			f.BlockPackets = f.BlockPackets || packets
+			f.BlockStreams = f.BlockStreams || streams
+			n.setLinkFaults(link, &f)
+		}
+	}
+}
+
+// setLinkFaults stores a copy of f for the link. The lock must be held.
+func (n *MockNetwork) setLinkFaults(link mockLink, f *LinkFaults) {
+	if f == nil {
+		delete(n.faults, link)
+		return
+	}
+	if n.faults == nil {
+		n.faults = make(map[mockLink]*LinkFaults)
+	}
+	c := *f
+	n.faults[link] = &c
+}
+
+// linkFaults returns the faults for a link, or nil if it is clean. The lock
+// must be held.
+func (n *MockNetwork) linkFaults(link mockLink) *LinkFaults {
+	if f, ok := n.faults[link]; ok {
+		return f
+	}
+	return n.defaultFault
+}
+
+// clock returns the network's clock, defaulting to the wall clock.
+func (n *MockNetwork) clock() Clock {
+	if n.Clock != nil {
+		return n.Clock
+	}
+	return realClock{}
+}
+
+// packetPlan decides the fate of one packet on a link: how many copies to
+// deliver and how long to hold each one back.
+func (n *MockNetwork) packetPlan(from, to string) []time.Duration {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	f := n.linkFaults(mockLink{from, to})
+	if f == nil {
+		return []time.Duration{0}
+	}
+	if f.BlockPackets || n.chance(f.Loss) {
+		return nil
+	}
+
+	copies := 1
+	if n.chance(f.Duplicate) {
+		copies++
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = n.latency(f)
+		if n.chance(f.Reorder) {
+			if f.ReorderDelay > 0 {
+				delays[i] += f.ReorderDelay
+			} else {
+				delays[i] += mockReorderDelay
+			}
+		}
+	}
+	return delays
 }
 
+// dialPlan returns the latency for a stream dial, and whether it's blocked.
+func (n *MockNetwork) dialPlan(from, to string) (time.Duration, bool) {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	there, back := n.linkFaults(mockLink{from, to}), n.linkFaults(mockLink{to, from})
+	if (there != nil && there.BlockStreams) || (back != nil && back.BlockStreams) {
+		return 0, true
+	}
+	if there == nil {
+		return 0, false
+	}
+	return n.latency(there), false
+}
+
+// latency returns the delay for one delivery on a link. The lock must be
+// held.
+func (n *MockNetwork) latency(f *LinkFaults) time.Duration {
+	d := f.Latency
+	if f.Jitter > 0 {
+		d += time.Duration(n.random().Int63n(int64(f.Jitter)))
+	}
+	return d
+}
+
+// chance returns true with probability p. The lock must be held.
+func (n *MockNetwork) chance(p float64) bool {
+	return p > 0 && n.random().Float64() < p
+}
+
+// random returns the fault source, seeding it on first use. The lock must be
+// held.
+func (n *MockNetwork) random() *rand.Rand {
+	if n.rng == nil {
+		n.rng = rand.New(rand.NewSource(1))
+	}
+	return n.rng
+}
+
+// transport looks up a transport by address.
+func (n *MockNetwork) transport(addr string) (*MockTransport, bool) {
+	n.l.RLock()
+	defer n.l.RUnlock()
+	t, ok := n.transports[addr]
+	return t, ok
+}
+
+// mockPacketBuffer is how many packets a MockTransport on a network with a
+// Clock queues before it starts dropping them, like a socket receive buffer.
+// Without it, two nodes driven by the same virtual clock whose packet
+// listeners answer each other at the same moment would block forever.
+const mockPacketBuffer = 1024
+
 // NewTransport returns a new MockTransport with a unique address, wired up to
 // talk to the other transports in the MockNetwork.
 func (n *MockNetwork) NewTransport() *MockTransport {
+	n.l.Lock()
+	defer n.l.Unlock()
+
 	n.port += 1
 	addr := fmt.Sprintf("127.0.0.1:%d", n.port)
 	transport := &MockTransport{
-		net:      n,
-		addr:     &MockAddress{addr},
-		packetCh: make(chan *Packet),
-		streamCh: make(chan net.Conn),
+		net:        n,
+		addr:       &MockAddress{addr},
+		packetCh:   make(chan *Packet),
+		streamCh:   make(chan net.Conn),
+		shutdownCh: make(chan struct{}),
+	}
+	if n.Clock != nil {
+		transport.packetCh = make(chan *Packet, mockPacketBuffer)
 	}
 
 	if n.transports == nil {
@@ -55,6 +304,10 @@ type MockTransport struct {
 	addr     *MockAddress
 	packetCh chan *Packet
 	streamCh chan net.Conn
+
+	shutdownLock sync.Mutex
+	shutdown     bool
+	shutdownCh   chan struct{}
 }
 
 // See Transport.
@@ -79,18 +332,48 @@ func (t *MockTransport) FinalAdvertiseAddr(string, int) (net.IP, int, error) {
 
 // See Transport.
 func (t *MockTransport) WriteTo(b []byte, addr string) (time.Time, error) {
-	dest, ok := t.net.transports[addr]
+	dest, ok := t.net.transport(addr)
 	if !ok {
 		return time.Time{}, fmt.Errorf("No route to %q", addr)
 	}
 
-	now := time.Now()
-	dest.packetCh <- &Packet{
+	clock := t.net.clock()
+	for _, delay := range t.net.packetPlan(t.addr.String(), addr) {
+		if delay > 0 {
+			clock.AfterFunc(delay, func() { dest.deliver(b, t.addr, clock.Now()) })
+		} else {
+			dest.deliver(b, t.addr, clock.Now())
+		}
+	}
+	return clock.Now(), nil
+}
+
+// deliver hands a packet to the transport's listener. Without a clock it
+// waits for the listener to take it. Packets for a transport that has shut
+// down are dropped, since nothing will take them.
+func (t *MockTransport) deliver(b []byte, from *MockAddress, now time.Time) {
+	p := &Packet{
 		Buf:       b,
-		From:      t.addr,
+		From:      from,
 		Timestamp: now,
 	}
-	return now, nil
+	if t.net.Clock == nil {
+		select {
+		case t.packetCh <- p:
+		case <-t.shutdownCh:
+		}
+		return
+	}
+	select {
+	case <-t.shutdownCh:
+		return
+	default:
+	}
+	select {
+	case t.packetCh <- p:
+	default:
+		// The receiver's buffer is full, drop it like UDP would.
+	}
 }
 
 // See Transport.
@@ -100,22 +383,54 @@ func (t *MockTransport) PacketCh() <-chan *Packet {
 
 // See Transport.
 func (t *MockTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
-	dest, ok := t.net.transports[addr]
+	dest, ok := t.net.transport(addr)
 	if !ok {
 		return nil, fmt.Errorf("No route to %q", addr)
 	}
 
+	clock := t.net.clock()
+	latency, blocked := t.net.dialPlan(t.addr.String(), addr)
+	if blocked {
+		<-clock.After(timeout)
+		return nil, fmt.Errorf("Dial to %q timed out", addr)
+	}
+	if latency > 0 {
+		<-clock.After(latency)
+	}
+
 	p1, p2 := net.Pipe()
-	dest.streamCh <- p1
-	return p2, nil
+	select {
+	case dest.streamCh <- &mockConn{p1, dest.addr, t.addr}:
+		return &mockConn{p2, t.addr, dest.addr}, nil
+	case <-dest.shutdownCh:
+		return nil, fmt.Errorf("No route to %q", addr)
+	}
+}
+
+// mockConn is one end of a mock stream, reporting the mock addresses of
+// both transports instead of the pipe's.
+type mockConn struct {
+	net.Conn
+	local, remote *MockAddress
 }
 
+func (c *mockConn) LocalAddr() net.Addr { return c.local }
+
+func (c *mockConn) RemoteAddr() net.Addr { return c.remote }
+
 // See Transport.
 func (t *MockTransport) StreamCh() <-chan net.Conn {
 	return t.streamCh
 }
 
-// See Transport.
+// See Transport. Once shut down the transport drops packets sent to it and
+// refuses streams.
 func (t *MockTransport) Shutdown() error {
+	t.shutdownLock.Lock()
+	defer t.shutdownLock.Unlock()
+	if !t.shutdown {
+		t.shutdown = true
+		close(t.shutdownCh)
+	}
 	return nil
 }
@@ -0,0 +1,258 @@
+package memberlist
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// mtuGranularity is how close the bounds of the path MTU search need to
+	// get before we consider the search done.
+	mtuGranularity = 32
+
+	// mtuProbeAttempts is the number of times a candidate size must go
+	// unacknowledged before we decide it's too big. This keeps ordinary
+	// packet loss from driving the estimate down.
+	mtuProbeAttempts = 2
+
+	// mtuRefreshInterval is how long a discovered path MTU is trusted
+	// before the search is run again, in case the path has changed.
+	mtuRefreshInterval = 10 * time.Minute
+)
+
+// pathMTU tracks the binary search for the largest packet that makes it to a
+// single peer.
+type pathMTU struct {
+	// lo is the largest size we believe gets through, and hi is the
+	// largest size that might still get through.
+	lo, hi int
+
+	// failures is the number of unacknowledged probes at the current
+	// candidate size.
+	failures int
+
+	// size is the result of the last completed search, or zero if no
+	// search has completed yet.
+	size int
+
+	// discovered is when size was last set.
+	discovered time.Time
+}
+
+// candidate returns the next size to probe.
+func (p *pathMTU) candidate() int {
+	return (p.lo + p.hi + 1) / 2
+}
+
+// done returns true if there's no search in progress.
+func (p *pathMTU) done() bool {
+	return p.hi-p.lo <= mtuGranularity
+}
+
+// record updates the search with the outcome of probing the given size at
+// now, and returns true if the search finished as a result.
+func (p *pathMTU) record(size int, acked bool, now time.Time) bool {
+	if p.done() || size != p.candidate() {
+		return false
+	}
+
+	if acked {
+		p.lo = size
+		p.failures = 0
+	} else if p.failures++; p.failures >= mtuProbeAttempts {
+		p.hi = size - 1
+		p.failures = 0
+	}
+
+	if p.done() {
+		p.size = p.lo
+		p.discovered = now
+		return true
+	}
+	return false
+}
+
+// mtuTracker holds the path MTU state for all the peers we gossip with.
+type mtuTracker struct {
+	sync.Mutex
+	clock    Clock
+	min, max int
+	peers    map[string]*pathMTU
+}
+
+func newMTUTracker(clock Clock, min, max int) *mtuTracker {
+	return &mtuTracker{
+		clock: clock,
+		min:   min,
+		max:   max,
+		peers: make(map[string]*pathMTU),
+	}
+}
+
+// NextProbe returns the size that should be probed next for the given node,
+// and false if no probe is needed right now.
+func (t *mtuTracker) NextProbe(node string) (int, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	p, ok := t.peers[node]
+	if !ok {
+		p = &pathMTU{lo: t.min, hi: t.max}
+		t.peers[node] = p
+	}
+
+	if p.done() {
+		if t.clock.Now().Sub(p.discovered) < mtuRefreshInterval {
+			return 0, false
+		}
+
+		// Restart the search, but keep using the old result until the
+		// new one is complete.
+		p.lo, p.hi = t.min, t.max
+	}
+	return p.candidate(), true
+}
+
+// Record feeds the outcome of a probe into the search for the given node, and
+// returns the discovered size if that probe finished the search.
+func (t *mtuTracker) Record(node string, size int, acked bool) (int, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	p, ok := t.peers[node]
+	if !ok {
+		return 0, false
+	}
+	if p.record(size, acked, t.clock.Now()) {
+		return p.size, true
+	}
+	return 0, false
+}
+
+// Size returns the discovered path MTU for the given node, or false if it
+// hasn't been discovered yet.
+func (t *mtuTracker) Size(node string) (int, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	p, ok := t.peers[node]
+	if !ok || p.size == 0 {
+		return 0, false
+	}
+	return p.size, true
+}
+
+// Remove forgets everything about the given node.
+func (t *mtuTracker) Remove(node string) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.peers, node)
+}
+
+// packetBudget returns the maximum number of bytes we should put in a packet
+// bound for the given node. This is the discovered path MTU for the node if we
+// have one, otherwise the configured UDPBufferSize.
+func (m *Memberlist) packetBudget(node string) int {
+	if m.config.MTUDiscoveryInterval > 0 {
+		if size, ok := m.mtus.Size(node); ok {
+			return size
+		}
+	}
+	return m.config.UDPBufferSize
+}
+
+// packetOverhead returns the number of bytes that will be added to a packet
+// bound for the given node after it's handed to rawSendMsgPacket. A nil node
+// is one we don't know, which is assumed to get everything.
+func (m *Memberlist) packetOverhead(node *Node) int {
+	overhead := labelOverhead(m.config.Label)
+	if node == nil || node.PMax >= 5 {
+		overhead += 5 // CRC header
+	}
+	if m.config.EncryptionEnabled() && m.config.GossipVerifyOutgoing {
+		overhead += m.encryptedOverhead()
+	}
+	return overhead
+}
+
+// discoverMTU is invoked every MTUDiscoveryInterval to advance the path MTU
+// search for a random node that needs it.
+func (m *Memberlist) discoverMTU() {
+	if _, ok := m.transport.(DontFragmentTransport); !ok {
+		return
+	}
+
+	m.nodeLock.RLock()
+	nodes := kRandomNodes(1, m.nodes, func(n *nodeState) bool {
+		return n.Name == m.config.Name ||
+			n.State != StateAlive
+	})
+	m.nodeLock.RUnlock()
+
+	if len(nodes) == 0 {
+		return
+	}
+	node := nodes[0]
+
+	size, ok := m.mtus.NextProbe(node.Name)
+	if !ok {
+		return
+	}
+
+	acked, err := m.probeMTU(node, size)
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to send MTU probe to %s: %v", node.Name, err)
+		return
+	}
+	if mtu, ok := m.mtus.Record(node.Name, size, acked); ok {
+		m.logger.Printf("[DEBUG] memberlist: Discovered path MTU of %d bytes for %s", mtu, node.Name)
+	}
+}
+
+// probeMTU sends a ping to the given node that has been padded so it takes up
+// exactly size bytes on the wire, and waits to see if it gets acknowledged.
+// The padding is random so compression can't shrink the packet, and the
+// don't fragment bit is set so it can't be split up on the way.
+func (m *Memberlist) probeMTU(node *nodeState, size int) (bool, error) {
+	df, ok := m.transport.(DontFragmentTransport)
+	if !ok {
+		return false, fmt.Errorf("Transport can't send packets without fragmenting them")
+	}
+
+	p := ping{SeqNo: m.nextSeqNo(), Node: node.Name}
+	target := size - m.packetOverhead(&node.Node)
+
+	// Encode once without padding to find the base size, then again once
+	// we know how much padding is needed. The length prefix for the padding
+	// can grow by a few bytes, so correct for that with a final pass.
+	buf, err := encode(pingMsg, &p)
+	if err != nil {
+		return false, err
+	}
+	for pass := 0; pass < 2 && buf.Len() != target; pass++ {
+		padLen := len(p.Pad) + target - buf.Len()
+		if padLen < 0 {
+			return false, fmt.Errorf("MTU probe size %d is too small", size)
+		}
+		p.Pad = make([]byte, padLen)
+		if _, err := rand.Read(p.Pad); err != nil {
+			return false, err
+		}
+		if buf, err = encode(pingMsg, &p); err != nil {
+			return false, err
+		}
+	}
+
+	timeout := m.probeTimeout(node.Name)
+	ackCh := make(chan ackMessage, 1)
+	m.setProbeChannels(p.SeqNo, ackCh, nil, timeout)
+	if err := m.writeMsgPacket(node.Address(), &node.Node, buf.Bytes(), df.WriteToDontFragment); err != nil {
+		return false, err
+	}
+
+	v := <-ackCh
+	return v.Complete, nil
+}
@@ -0,0 +1,117 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathMTU_Search(t *testing.T) {
+	limit := 1234
+	p := &pathMTU{lo: 512, hi: 8972}
+	for i := 0; !p.done(); i++ {
+		if i > 100 {
+			t.Fatalf("search didn't converge")
+		}
+		size := p.candidate()
+		p.record(size, size <= limit, time.Now())
+	}
+	require.True(t, p.size <= limit)
+	require.True(t, p.size > limit-mtuGranularity)
+	require.False(t, p.discovered.IsZero())
+}
+
+func TestPathMTU_SingleLossIgnored(t *testing.T) {
+	p := &pathMTU{lo: 512, hi: 8972}
+	size := p.candidate()
+	p.record(size, false, time.Now())
+	require.Equal(t, size, p.candidate(), "one lost probe shouldn't move the search")
+	p.record(size, false, time.Now())
+	require.Equal(t, size-1, p.hi)
+
+	// Stale results for a size we're no longer probing are ignored.
+	p.record(size, true, time.Now())
+	require.Equal(t, 512, p.lo)
+}
+
+// mtuLimitTransport is like a path with a small MTU. Packets sent with the
+// don't fragment bit set are dropped if they're bigger than the limit, any
+// others get through.
+type mtuLimitTransport struct {
+	*MockTransport
+	limit int
+}
+
+func (t *mtuLimitTransport) WriteToDontFragment(b []byte, addr string) (time.Time, error) {
+	if len(b) > t.limit {
+		return time.Now(), nil
+	}
+	return t.MockTransport.WriteTo(b, addr)
+}
+
+func TestMemberlist_DiscoverMTU(t *testing.T) {
+	network := &MockNetwork{}
+	limit := 1000
+
+	c1 := testConfig(t)
+	c1.Transport = &mtuLimitTransport{network.NewTransport(), limit}
+	c1.MTUDiscoveryInterval = time.Hour // driven by hand below
+	c1.ProbeTimeout = 20 * time.Millisecond
+	c1.SecretKey = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.Transport = network.NewTransport()
+	c2.SecretKey = c1.SecretKey
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m1.Join([]string{m2.LocalNode().Address()})
+	require.NoError(t, err)
+	require.Equal(t, c1.UDPBufferSize, m1.packetBudget(c2.Name))
+
+	for i := 0; i < 100; i++ {
+		if _, ok := m1.mtus.Size(c2.Name); ok {
+			break
+		}
+		m1.discoverMTU()
+	}
+
+	size := m1.packetBudget(c2.Name)
+	require.True(t, size <= limit, "size %d", size)
+	require.True(t, size > limit-mtuGranularity, "size %d", size)
+}
+
+func TestMemberlist_DiscoverMTU_NoDontFragment(t *testing.T) {
+	network := &MockNetwork{}
+
+	c1 := testConfig(t)
+	c1.Transport = network.NewTransport()
+	c1.MTUDiscoveryInterval = time.Hour // driven by hand below
+	c1.ProbeTimeout = 20 * time.Millisecond
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.Transport = network.NewTransport()
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	_, err = m1.Join([]string{m2.LocalNode().Address()})
+	require.NoError(t, err)
+
+	// Every probe would get through, but none should be sent since they
+	// could be fragmented.
+	for i := 0; i < 20; i++ {
+		m1.discoverMTU()
+	}
+	_, ok := m1.mtus.Size(c2.Name)
+	require.False(t, ok)
+	require.Equal(t, c1.UDPBufferSize, m1.packetBudget(c2.Name))
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync/atomic"
 	"time"
@@ -35,8 +36,16 @@ const (
 	// understand version 4 or greater.
 	ProtocolVersion2Compatible = 2
 
-
-	ProtocolVersionMax = 5
+	// Version 5 added CRCs to packets.
+	//
+	// Version 6 added digest based push/pull, which is used with
+	// memberlists who understand version 6 or greater, except for joins.
+	//
+	// Version 7 added chunked compression and encryption of stream
+	// messages, so push/pull state can be compressed and encrypted as it's
+	// written rather than all at once. It's sent to memberlists who
+	// understand version 7 or greater, or who say they can read it.
+	ProtocolVersionMax = 7
 )
 
 // messageType is an integer ID of a type of message that can be received
@@ -60,6 +69,17 @@ const (
 	nackRespMsg
 	hasCrcMsg
 	errMsg
+	keyringMsg
+	keyringRespMsg
+	replayGuardMsg
+	queryMsg
+	queryRespMsg
+	streamOpenMsg
+	streamDataMsg
+	pushPullDigestMsg
+	pushPullDiffMsg
+	compressChunksMsg
+	encryptChunksMsg
 )
 
 // compressionType is used to specify the compression algorithm
@@ -67,6 +87,9 @@ type compressionType uint8
 
 const (
 	lzwAlgo compressionType = iota
+	snappyAlgo
+	zstdAlgo
+	deflateAlgo
 )
 
 const (
@@ -76,7 +99,9 @@ const (
 	userMsgOverhead        = 1
 	blockingWarning        = 10 * time.Millisecond // Warn if a UDP packet takes this long to process
 	maxPushStateBytes      = 20 * 1024 * 1024	// 20MB
+	maxPacketBytes         = udpPacketBufSize // Most a compressed packet may expand to
 	maxPushPullRequests    = 128 // Maximum number of concurrent push/pull requests
+	maxEncryptedChunk      = compressChunkSize + 64 // Room for any cipher suite's overhead
 )
 
 // ping request sent directly to node
@@ -89,6 +114,9 @@ type ping struct {
 	// restart with a new name.
 	Node string
 
+	// Pad is filled with random bytes to bring the ping up to a given
+	// size during path MTU discovery. It is ignored by the receiver.
+	Pad []byte `codec:",omitempty"`
 }
 
 // indirect ping sent to an indirect ndoe
@@ -137,6 +165,19 @@ type alive struct {
 	// The versions of the protocol/delegate that are being spoken, order:
 	// pmin, pmax, pcur, dmin, dmax, dcur
 	Vsn []uint8
+
+	// Compression algorithms the node can decode, in order of preference.
+	// Older versions don't send this and only understand LZW.
+	Compression []compressionType `codec:",omitempty"`
+
+	// The zone the node runs in, if it has one. Older versions don't send
+	// this.
+	Zone string `codec:",omitempty"`
+
+	// The node's ed25519 public key and its signature over the fields
+	// above, when it has an identity key.
+	PubKey []byte `codec:",omitempty"`
+	Sig    []byte `codec:",omitempty"`
 }
 
 // dead is broadcast when we confirm a node is dead
@@ -145,6 +186,9 @@ type dead struct {
 	Incarnation uint32
 	Node        string
 	From        string // Include who is suspecting
+
+	// Sig is the node's signature when it is leaving (Node == From).
+	Sig []byte `codec:",omitempty"`
 }
 
 
@@ -154,6 +198,18 @@ type pushPullHeader struct {
 	Nodes        int
 	UserStateLen int  // Encodes the byte lengh of user state
 	Join         bool // Is this a join request or a anti-entropy run
+
+	// Compression algorithms the sender can decode, so that the reply can
+	// use something better than LZW.
+	Compression []compressionType `codec:",omitempty"`
+
+	// Buckets lists the digest buckets whose nodes are being sent, when
+	// this answers a pushPullDigest.
+	Buckets []int `codec:",omitempty"`
+
+	// Stream is set if the sender can read a reply that uses chunked
+	// compression and encryption.
+	Stream bool `codec:",omitempty"`
 }
 
 // userMsgHeader is used to encapsulate a userMsg
@@ -168,8 +224,13 @@ type pushNodeState struct {
 	Port        uint16
 	Meta        []byte
 	Incarnation uint32
-	State       nodeStateType
+	State       NodeStateType
 	Vsn         []uint8 // Protocol versions
+	Compression []compressionType `codec:",omitempty"`
+	Zone        string            `codec:",omitempty"`
+	PubKey      []byte            `codec:",omitempty"` // Signer of the alive message for Incarnation
+	Sig         []byte            `codec:",omitempty"`
+	LeaveSig    []byte            `codec:",omitempty"` // Signature of the leave, if State is left
 }
 
 // compress is used to wrap an underlying payload
@@ -188,14 +249,72 @@ type msgHandoff struct {
 
 // encryptionVersion returns the encryption version to use
 func (m *Memberlist) encryptionVersion() encryptionVersion {
+	_, vsn := m.primaryKey()
+	return vsn
+}
+
+// encryptedOverhead returns how much encryption, including the replay guard
+// inside it, adds to a packet.
+func (m *Memberlist) encryptedOverhead() int {
+	overhead := encryptOverhead(m.encryptionVersion())
+	if m.replay != nil {
+		overhead += replayHeaderSize
+	}
+	return overhead
+}
+
+// primaryKey returns the key to encrypt with, and the encryption version
+// for the cipher suite it is tagged with.
+func (m *Memberlist) primaryKey() ([]byte, encryptionVersion) {
+	var key []byte
+	suite := CipherSuiteAESGCM
+	if m.config.Keyring != nil {
+		key, suite = m.config.Keyring.getPrimaryKeySuite()
+	}
+
+	if suite > CipherSuiteAESGCM {
+		return key, encryptionVersion(suite)
+	}
 	switch m.ProtocolVersion() {
 	case 1:
-		return 0
+		return key, 0
 	default:
-		return 1
+		return key, 1
 	}
 }
 
+// checkCipherSuite rejects encrypted messages that use a weaker cipher suite
+// than Config.MinCipherSuite allows.
+func (m *Memberlist) checkCipherSuite(msg []byte) error {
+	if len(msg) == 0 || m.config.MinCipherSuite == 0 {
+		return nil
+	}
+
+	if suite := encryptionVersion(msg[0]).suite(); suite < m.config.MinCipherSuite {
+		metrics.IncrCounter([]string{"memberlist", "cipher", "rejected"}, 1)
+		return fmt.Errorf("Cipher suite %s is below the minimum %s", suite, m.config.MinCipherSuite)
+	}
+	return nil
+}
+
+// sourceAllowed checks a remote address against Config.CIDRsAllowed.
+func (m *Memberlist) sourceAllowed(addr net.Addr) error {
+	if addr == nil {
+		return fmt.Errorf("Unknown source address")
+	}
+
+	// Unix sockets have no IP to check. The peer is on this host, and the
+	// socket directory's permissions decide who that can be.
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return nil
+	}
+	ip, err := addrIP(addr)
+	if err != nil {
+		return err
+	}
+	return m.config.IPAllowed(ip)
+}
+
 // streamListen is a long running goroutine that pulls incoming streams from the
 // transport and hands them off for processing.
 func (m *Memberlist) streamListen() {
@@ -214,7 +333,20 @@ func (m *Memberlist) streamListen() {
 func (m *Memberlist) handleConn(conn net.Conn) {
 	m.logger.Printf("[DEBUG] memberlist: Stream connection %s", LogConn(conn))
 
-	defer conn.Close()
+	// Application streams outlive this handler.
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			conn.Close()
+		}
+	}()
+
+	if m.config.IPMustBeChecked() {
+		if err := m.sourceAllowed(conn.RemoteAddr()); err != nil {
+			m.logger.Printf("[WARN] memberlist: Dropping stream: %v %s", err, LogConn(conn))
+			return
+		}
+	}
 
 
 	// 增加计数 `memberlist.tcp.accept`
@@ -223,6 +355,17 @@ func (m *Memberlist) handleConn(conn net.Conn) {
 	// 设置读写超时
 	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
 
+	// 检查集群标签
+	conn, label, err := removeLabelHeaderFromStream(conn)
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to read label header: %s", err)
+		return
+	}
+	if err := m.checkLabel(label); err != nil {
+		m.logger.Printf("[WARN] memberlist: Dropping stream: %s %s", err, LogConn(conn))
+		return
+	}
+
 	// 读取
 	msgType, bufConn, dec, err := m.readStream(conn)
 
@@ -244,7 +387,7 @@ func (m *Memberlist) handleConn(conn net.Conn) {
 			}
 
 			// 发送错误消息给 conn
-			err = m.rawSendMsgStream(conn, out.Bytes())
+			err = m.rawSendMsgStream(conn, out.Bytes(), lzwAlgo)
 			if err != nil {
 				m.logger.Printf("[ERR] memberlist: Failed to send error: %s %s", err, LogConn(conn))
 				return
@@ -270,21 +413,70 @@ func (m *Memberlist) handleConn(conn net.Conn) {
 			return
 		}
 
-		join, remoteNodes, userState, err := m.readRemoteState(bufConn, dec)
+		header, err := m.readRemoteHeader(dec)
 		if err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to read remote state: %s %s", err, LogConn(conn))
 			return
 		}
+		join := header.Join
+
+		// We reply with our state as it was before theirs is merged. The
+		// initiator sends all of its state before reading ours, so ours is
+		// written while theirs is read and merged, or with enough state on
+		// both sides each would wait for the other to read.
+		reply := pushPullHeader{
+			Join:        join,
+			Compression: m.compression,
+			Stream:      true,
+		}
+		nodes, userState := m.copyLocalState(&reply, nil)
+
+		// Reply with an algorithm the initiator told us it can decode
+		algo := m.pickCompression(header.Compression)
+		sendCh := make(chan error, 1)
+		go func() {
+			sendCh <- m.writeState(conn, pushPullMsg, &reply, nodes, userState, algo, header.Stream)
+		}()
 
-		if err := m.sendLocalState(conn, join); err != nil {
+		// The initiator gets our whole reply even if merging fails, so it
+		// can decide about the merge for itself
+		mergeErr := m.mergeRemoteBody(join, header, bufConn, dec)
+		if err := <-sendCh; err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to push local state: %s %s", err, LogConn(conn))
+		}
+		if mergeErr != nil {
+			m.logger.Printf("[ERR] memberlist: Failed push/pull merge: %s %s", mergeErr, LogConn(conn))
+		}
+	case pushPullDigestMsg:
+		// Digest push/pulls count against the same limit
+		numConcurrent := atomic.AddUint32(&m.pushPullReq, 1)
+		defer atomic.AddUint32(&m.pushPullReq, ^uint32(0))
+
+		if numConcurrent >= maxPushPullRequests {
+			m.logger.Printf("[ERR] memberlist: Too many pending push/pull requests")
 			return
 		}
 
-		if err := m.mergeRemoteState(join, remoteNodes, userState); err != nil {
-			m.logger.Printf("[ERR] memberlist: Failed push/pull merge: %s %s", err, LogConn(conn))
+		if err := m.handlePushPullDigest(conn, dec); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed digest push/pull: %s %s", err, LogConn(conn))
 			return
 		}
+	case queryRespMsg:
+		var resp queryResp
+		if err := dec.Decode(&resp); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to decode query response: %s %s", err, LogConn(conn))
+			return
+		}
+		m.deliverQueryResponse(&resp)
+	case streamOpenMsg:
+		var err error
+		if handedOff, err = m.handleStreamOpen(conn, dec); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to start stream session: %s %s", err, LogConn(conn))
+		}
+	case keyringMsg:
+		if err := m.handleKeyringReq(conn, dec); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to handle keyring request: %s %s", err, LogConn(conn))
+		}
 	case pingMsg:
 		var p ping
 		if err := dec.Decode(&p); err != nil {
@@ -304,7 +496,7 @@ func (m *Memberlist) handleConn(conn net.Conn) {
 			return
 		}
 
-		err = m.rawSendMsgStream(conn, out.Bytes())
+		err = m.rawSendMsgStream(conn, out.Bytes(), lzwAlgo)
 		if err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to send ack: %s %s", err, LogConn(conn))
 			return
@@ -330,11 +522,38 @@ func (m *Memberlist) packetListen() {
 }
 
 func (m *Memberlist) ingestPacket(buf []byte, from net.Addr, timestamp time.Time) {
+	if m.config.IPMustBeChecked() {
+		if err := m.sourceAllowed(from); err != nil {
+			m.logger.Printf("[WARN] memberlist: Dropping packet: %v %s", err, LogAddress(from))
+			return
+		}
+	}
+
+	// Strip and check the label before anything else
+	buf, label, err := removeLabelHeaderFromPacket(buf)
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to read label header: %v %s", err, LogAddress(from))
+		return
+	}
+	if err := m.checkLabel(label); err != nil {
+		m.logger.Printf("[WARN] memberlist: Dropping packet: %v %s", err, LogAddress(from))
+		return
+	}
+
 	// Check if encryption is enabled
 	if m.config.EncryptionEnabled() {
-		// Decrypt the payload
-		plain, err := decryptPayload(m.config.Keyring.GetKeys(), buf, nil)
+		// A plaintext packet can look like one with a weak suite, so that
+		// only drops it when we verify. Either way it isn't decrypted.
+		var plain []byte
+		err := m.checkCipherSuite(buf)
 		if err != nil {
+			if m.config.GossipVerifyIncoming {
+				m.logger.Printf("[ERR] memberlist: Dropping packet: %v %s", err, LogAddress(from))
+				return
+			}
+			m.logger.Printf("[WARN] memberlist: Treating packet as plaintext: %v %s", err, LogAddress(from))
+			plain = buf
+		} else if plain, err = decryptPayload(m.config.Keyring.GetKeys(), buf, nil); err != nil {
 			if !m.config.GossipVerifyIncoming {
 				// Treat the message as plaintext
 				plain = buf
@@ -346,6 +565,16 @@ func (m *Memberlist) ingestPacket(buf []byte, from net.Addr, timestamp time.Time
 
 		// Continue processing the plaintext buffer
 		buf = plain
+
+		// Reject stale and duplicate packets
+		if m.replay != nil {
+			guarded, err := m.replay.check(buf, m.clock.Now(), m.config.GossipVerifyIncoming)
+			if err != nil {
+				m.logger.Printf("[WARN] memberlist: Dropping packet: %v %s", err, LogAddress(from))
+				return
+			}
+			buf = guarded
+		}
 	}
 
 	// See if there's a checksum included to verify the contents of the message
@@ -382,6 +611,8 @@ func (m *Memberlist) handleCommand(buf []byte, from net.Addr, timestamp time.Tim
 		m.handleAck(buf, from, timestamp)
 	case nackRespMsg:
 		m.handleNack(buf, from)
+	case queryRespMsg:
+		m.handleQueryResponse(buf, from)
 
 	case suspectMsg:
 		fallthrough
@@ -390,6 +621,8 @@ func (m *Memberlist) handleCommand(buf []byte, from net.Addr, timestamp time.Tim
 	case deadMsg:
 		fallthrough
 	case userMsg:
+		fallthrough
+	case queryMsg:
 		// Determine the message queue, prioritize alive
 		queue := m.lowPriorityMsgQueue
 		if msgType == aliveMsg {
@@ -458,6 +691,8 @@ func (m *Memberlist) packetHandler() {
 					m.handleDead(buf, from)
 				case userMsg:
 					m.handleUser(buf, from)
+				case queryMsg:
+					m.handleQuery(buf, from)
 				default:
 					m.logger.Printf("[ERR] memberlist: Message type (%d) not supported %s (packet handler)", msgType, LogAddress(from))
 				}
@@ -501,8 +736,8 @@ func (m *Memberlist) handlePing(buf []byte, from net.Addr) {
 	}
 	var ack ackResp
 	ack.SeqNo = p.SeqNo
-	if m.config.Ping != nil {
-		ack.Payload = m.config.Ping.AckPayload()
+	if m.ping != nil {
+		ack.Payload = m.ping.AckPayload()
 	}
 	if err := m.encodeAndSendMsg(from.String(), ackRespMsg, &ack); err != nil {
 		m.logger.Printf("[ERR] memberlist: Failed to send ack: %s %s", err, LogAddress(from))
@@ -538,7 +773,8 @@ func (m *Memberlist) handleIndirectPing(buf []byte, from net.Addr) {
 			m.logger.Printf("[ERR] memberlist: Failed to forward ack: %s %s", err, LogAddress(from))
 		}
 	}
-	m.setAckHandler(localSeqNo, respHandler, m.config.ProbeTimeout)
+	probeTimeout := m.probeTimeout(ind.Node)
+	m.setAckHandler(localSeqNo, respHandler, probeTimeout)
 
 	// Send the ping.
 	addr := joinHostPort(net.IP(ind.Target).String(), ind.Port)
@@ -552,7 +788,7 @@ func (m *Memberlist) handleIndirectPing(buf []byte, from net.Addr) {
 			select {
 			case <-cancelCh:
 				return
-			case <-time.After(m.config.ProbeTimeout):
+			case <-m.clock.After(probeTimeout):
 				nack := nackResp{ind.SeqNo}
 				if err := m.encodeAndSendMsg(from.String(), nackRespMsg, &nack); err != nil {
 					m.logger.Printf("[ERR] memberlist: Failed to send nack: %s %s", err, LogAddress(from))
@@ -625,7 +861,7 @@ func (m *Memberlist) handleUser(buf []byte, from net.Addr) {
 // handleCompressed is used to unpack a compressed message
 func (m *Memberlist) handleCompressed(buf []byte, from net.Addr, timestamp time.Time) {
 	// Try to decode the payload
-	payload, err := decompressPayload(buf)
+	payload, err := decompressPayload(buf, maxPacketBytes)
 	if err != nil {
 		m.logger.Printf("[ERR] memberlist: Failed to decompress payload: %v %s", err, LogAddress(from))
 		return
@@ -651,10 +887,7 @@ func (m *Memberlist) encodeAndSendMsg(addr string, msgType messageType, msg inte
 // opportunistically create a compoundMsg and piggy back other broadcasts.
 func (m *Memberlist) sendMsg(addr string, msg []byte) error {
 	// Check if we can piggy back any messages
-	bytesAvail := m.config.UDPBufferSize - len(msg) - compoundHeaderOverhead
-	if m.config.EncryptionEnabled() && m.config.GossipVerifyOutgoing {
-		bytesAvail -= encryptOverhead(m.encryptionVersion())
-	}
+	bytesAvail := m.config.UDPBufferSize - len(msg) - compoundHeaderOverhead - m.packetOverhead(nil)
 	extra := m.getBroadcasts(compoundOverhead, bytesAvail)
 
 	// Fast path if nothing to piggypack
@@ -677,19 +910,12 @@ func (m *Memberlist) sendMsg(addr string, msg []byte) error {
 // rawSendMsgPacket is used to send message via packet to another host without
 // modification, other than compression or encryption if enabled.
 func (m *Memberlist) rawSendMsgPacket(addr string, node *Node, msg []byte) error {
-	// Check if we have compression enabled
-	if m.config.EnableCompression {
-		buf, err := compressPayload(msg)
-		if err != nil {
-			m.logger.Printf("[WARN] memberlist: Failed to compress payload: %v", err)
-		} else {
-			// Only use compression if it reduced the size
-			if buf.Len() < len(msg) {
-				msg = buf.Bytes()
-			}
-		}
-	}
+	return m.writeMsgPacket(addr, node, msg, m.transport.WriteTo)
+}
 
+// writeMsgPacket does the work for rawSendMsgPacket, handing the finished
+// packet to the given write function.
+func (m *Memberlist) writeMsgPacket(addr string, node *Node, msg []byte, write func([]byte, string) (time.Time, error)) error {
 	// Try to look up the destination node. Note this will only work if the
 	// bare ip address is used as the node name, which is not guaranteed.
 	if node == nil {
@@ -706,6 +932,23 @@ func (m *Memberlist) rawSendMsgPacket(addr string, node *Node, msg []byte) error
 		}
 	}
 
+	// Check if we have compression enabled
+	if m.config.EnableCompression {
+		algo := lzwAlgo
+		if node != nil {
+			algo = m.pickCompression(node.compression)
+		}
+		buf, err := compressPayload(algo, msg)
+		if err != nil {
+			m.logger.Printf("[WARN] memberlist: Failed to compress payload: %v", err)
+		} else {
+			// Only use compression if it reduced the size
+			if buf.Len() < len(msg) {
+				msg = buf.Bytes()
+			}
+		}
+	}
+
 	// Add a CRC to the end of the payload if the recipient understands
 	// ProtocolVersion >= 5
 	if node != nil && node.PMax >= 5 {
@@ -718,10 +961,19 @@ func (m *Memberlist) rawSendMsgPacket(addr string, node *Node, msg []byte) error
 
 	// Check if we have encryption enabled
 	if m.config.EncryptionEnabled() && m.config.GossipVerifyOutgoing {
+		// Guard against the packet being captured and replayed
+		if m.replay != nil {
+			guarded, err := m.replay.wrap(msg, m.clock.Now())
+			if err != nil {
+				return err
+			}
+			msg = guarded
+		}
+
 		// Encrypt the payload
 		var buf bytes.Buffer
-		primaryKey := m.config.Keyring.GetPrimaryKey()
-		err := encryptPayload(m.encryptionVersion(), primaryKey, msg, nil, &buf)
+		primaryKey, encVsn := m.primaryKey()
+		err := encryptPayload(encVsn, primaryKey, msg, nil, &buf)
 		if err != nil {
 			m.logger.Printf("[ERR] memberlist: Encryption of message failed: %v", err)
 			return err
@@ -729,17 +981,20 @@ func (m *Memberlist) rawSendMsgPacket(addr string, node *Node, msg []byte) error
 		msg = buf.Bytes()
 	}
 
+	msg = addLabelHeaderToPacket(msg, m.config.Label)
+
 	metrics.IncrCounter([]string{"memberlist", "udp", "sent"}, float32(len(msg)))
-	_, err := m.transport.WriteTo(msg, addr)
+	_, err := write(msg, addr)
 	return err
 }
 
 // rawSendMsgStream is used to stream a message to another host without
 // modification, other than applying compression and encryption if enabled.
-func (m *Memberlist) rawSendMsgStream(conn net.Conn, sendBuf []byte) error {
+// The algorithm must be one the remote side can decode.
+func (m *Memberlist) rawSendMsgStream(conn net.Conn, sendBuf []byte, algo compressionType) error {
 	// Check if compresion is enabled
 	if m.config.EnableCompression {
-		compBuf, err := compressPayload(sendBuf)
+		compBuf, err := compressPayload(algo, sendBuf)
 		if err != nil {
 			m.logger.Printf("[ERROR] memberlist: Failed to compress payload: %v", err)
 		} else {
@@ -771,7 +1026,7 @@ func (m *Memberlist) rawSendMsgStream(conn net.Conn, sendBuf []byte) error {
 
 // sendUserMsg is used to stream a user message to another host.
 func (m *Memberlist) sendUserMsg(addr string, sendBuf []byte) error {
-	conn, err := m.transport.DialTimeout(addr, m.config.TCPTimeout)
+	conn, err := m.dialStream(addr, m.config.TCPTimeout)
 	if err != nil {
 		return err
 	}
@@ -791,116 +1046,342 @@ func (m *Memberlist) sendUserMsg(addr string, sendBuf []byte) error {
 	if _, err := bufConn.Write(sendBuf); err != nil {
 		return err
 	}
-	return m.rawSendMsgStream(conn, bufConn.Bytes())
+	return m.rawSendMsgStream(conn, bufConn.Bytes(), m.compressionForAddr(addr))
 }
 
 // sendAndReceiveState is used to initiate a push/pull over a stream with a
-// remote host.
-func (m *Memberlist) sendAndReceiveState(addr string, join bool) ([]pushNodeState, []byte, error) {
+// remote host, and merges the state it sends back.
+func (m *Memberlist) sendAndReceiveState(addr string, join bool) error {
 	// Attempt to connect
-	conn, err := m.transport.DialTimeout(addr, m.config.TCPTimeout)
+	conn, err := m.dialStream(addr, m.config.TCPTimeout)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 	defer conn.Close()
 	m.logger.Printf("[DEBUG] memberlist: Initiating push/pull sync with: %s", conn.RemoteAddr())
 	metrics.IncrCounter([]string{"memberlist", "tcp", "connect"}, 1)
 
 	// Send our state
-	if err := m.sendLocalState(conn, join); err != nil {
-		return nil, nil, err
+	stream := m.protocolMaxForAddr(addr) >= 7
+	if err := m.sendLocalState(conn, join, m.compressionForAddr(addr), stream); err != nil {
+		return err
 	}
 
 	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
 	msgType, bufConn, dec, err := m.readStream(conn)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
 	if msgType == errMsg {
 		var resp errResp
 		if err := dec.Decode(&resp); err != nil {
-			return nil, nil, err
+			return err
 		}
-		return nil, nil, fmt.Errorf("remote error: %v", resp.Error)
+		return fmt.Errorf("remote error: %v", resp.Error)
 	}
 
 	// Quit if not push/pull
 	if msgType != pushPullMsg {
 		err := fmt.Errorf("received invalid msgType (%d), expected pushPullMsg (%d) %s", msgType, pushPullMsg, LogConn(conn))
-		return nil, nil, err
+		return err
 	}
 
-	// Read remote state
-	_, remoteNodes, userState, err := m.readRemoteState(bufConn, dec)
-	return remoteNodes, userState, err
+	header, err := m.readRemoteHeader(dec)
+	if err != nil {
+		return err
+	}
+	return m.mergeRemoteBody(join, header, bufConn, dec)
 }
 
 // sendLocalState is invoked to send our local state over a stream connection.
-func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
-
+// If stream is set the other side can read chunked compression.
+func (m *Memberlist) sendLocalState(conn net.Conn, join bool, algo compressionType, stream bool) error {
+	header := pushPullHeader{
+		Join:        join,
+		Compression: m.compression,
+		Stream:      true,
+	}
+	return m.sendState(conn, pushPullMsg, &header, nil, algo, stream)
+}
 
-	// Setup a deadline
-	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
+// sendState sends a push/pull message of the given type over a stream
+// connection, with the state of the nodes the filter function accepts, or
+// of every node if it's nil, followed by the delegate's state. The header's
+// node count and user state length are filled in.
+func (m *Memberlist) sendState(conn net.Conn, msgType messageType, header *pushPullHeader, filterFn func(*nodeState) bool, algo compressionType, stream bool) error {
+	nodes, userState := m.copyLocalState(header, filterFn)
+	return m.writeState(conn, msgType, header, nodes, userState, algo, stream)
+}
 
-	// Prepare the local node state
+// copyLocalState copies the state of the nodes the filter function accepts,
+// or of every node if it's nil, and gets the delegate's state to go with
+// it, filling in the header's node count and user state length.
+func (m *Memberlist) copyLocalState(header *pushPullHeader, filterFn func(*nodeState) bool) ([]pushNodeState, io.Reader) {
 	m.nodeLock.RLock()
-	localNodes := make([]pushNodeState, len(m.nodes))
-	for idx, n := range m.nodes {
-		localNodes[idx].Name = n.Name
-		localNodes[idx].Addr = n.Addr
-		localNodes[idx].Port = n.Port
-		localNodes[idx].Incarnation = n.Incarnation
-		localNodes[idx].State = n.State
-		localNodes[idx].Meta = n.Meta
-		localNodes[idx].Vsn = []uint8{ n.PMin, n.PMax, n.PCur, n.DMin, n.DMax, n.DCur}
+	nodes := make([]pushNodeState, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		if filterFn != nil && !filterFn(n) {
+			continue
+		}
+		nodes = append(nodes, pushNodeState{
+			Name:        n.Name,
+			Addr:        n.Addr,
+			Port:        n.Port,
+			Incarnation: n.Incarnation,
+			State:       n.State,
+			Meta:        n.Meta,
+			Vsn:         []uint8{n.PMin, n.PMax, n.PCur, n.DMin, n.DMax, n.DCur},
+			Compression: n.compression,
+			Zone:        n.Zone,
+			PubKey:      n.pubKey,
+			Sig:         n.sig,
+			LeaveSig:    n.leaveSig,
+		})
 	}
 	m.nodeLock.RUnlock()
+	header.Nodes = len(nodes)
 
 	// Get the delegate state
-	var userData []byte
-	if m.config.Delegate != nil {
-		userData = m.config.Delegate.LocalState(join)
-	}
+	var userState io.Reader
+	if sd, ok := m.config.Delegate.(StreamingDelegate); ok {
+		userState, header.UserStateLen = sd.LocalStateReader(header.Join)
+	} else if m.config.Delegate != nil {
+		userData := m.config.Delegate.LocalState(header.Join)
+		userState, header.UserStateLen = bytes.NewReader(userData), len(userData)
+	}
+	return nodes, userState
+}
 
-	// Create a bytes buffer writer
-	bufConn := bytes.NewBuffer(nil)
+// writeState writes a push/pull message made by copyLocalState. The node
+// lock isn't held while writing to the network, and the message is only put
+// together in memory if it has to be encrypted or compressed in one piece.
+func (m *Memberlist) writeState(conn net.Conn, msgType messageType, header *pushPullHeader, nodes []pushNodeState, userState io.Reader, algo compressionType, stream bool) error {
+	// Setup a deadline
+	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
 
-	// Send our node state
-	header := pushPullHeader{
-		Nodes: len(localNodes),			//
-		UserStateLen: len(userData),	//
-		Join: join,						//
+	w, finish, err := m.newStateWriter(conn, algo, stream)
+	if err != nil {
+		return err
 	}
 
-	//
 	hd := codec.MsgpackHandle{}
-	enc := codec.NewEncoder(bufConn, &hd)
+	enc := codec.NewEncoder(w, &hd)
 
 	// Begin state push
-	if _, err := bufConn.Write([]byte{byte(pushPullMsg)}); err != nil {
+	if _, err := w.Write([]byte{byte(msgType)}); err != nil {
 		return err
 	}
 
-	if err := enc.Encode(&header); err != nil {
+	if err := enc.Encode(header); err != nil {
 		return err
 	}
 
-	for i := 0; i < header.Nodes; i++ {
-		if err := enc.Encode(&localNodes[i]); err != nil {
+	for i := range nodes {
+		if err := enc.Encode(&nodes[i]); err != nil {
 			return err
 		}
 	}
 
 	// Write the user state as well
-	if userData != nil {
-		if _, err := bufConn.Write(userData); err != nil {
+	if header.UserStateLen > 0 {
+		if _, err := io.CopyN(w, userState, int64(header.UserStateLen)); err != nil {
+			return fmt.Errorf("Failed to write user state: %v", err)
+		}
+	}
+
+	return finish()
+}
+
+// newStateWriter returns where to write a push/pull message for the given
+// connection, and a function that sends whatever is left once it's all been
+// written. If stream says the other side can read chunked compression and
+// encryption the message goes out a chunk at a time as it's written,
+// otherwise it has to be compressed and encrypted in one piece.
+func (m *Memberlist) newStateWriter(conn net.Conn, algo compressionType, stream bool) (io.Writer, func() error, error) {
+	encrypt := m.config.EncryptionEnabled() && m.config.GossipVerifyOutgoing
+	if !stream && (encrypt || m.config.EnableCompression) {
+		buf := bytes.NewBuffer(nil)
+		return buf, func() error {
+			return m.rawSendMsgStream(conn, buf.Bytes(), algo)
+		}, nil
+	}
+
+	cw := &countWriter{w: conn}
+	bw := bufio.NewWriter(cw)
+	var w io.Writer = bw
+	var closers []io.Closer
+
+	// Encryption wraps compression, as it does for whole messages
+	if encrypt {
+		if _, err := w.Write([]byte{byte(encryptChunksMsg)}); err != nil {
+			return nil, nil, err
+		}
+		ew := m.newEncryptChunkWriter(w)
+		w = ew
+		closers = append(closers, ew)
+	}
+	if m.config.EnableCompression {
+		if _, err := w.Write([]byte{byte(compressChunksMsg), byte(algo)}); err != nil {
+			return nil, nil, err
+		}
+		zw, err := newChunkWriter(w, algo)
+		if err != nil {
+			return nil, nil, err
+		}
+		w = zw
+		closers = append(closers, zw)
+	}
+
+	return w, func() error {
+		for i := len(closers) - 1; i >= 0; i-- {
+			if err := closers[i].Close(); err != nil {
+				return err
+			}
+		}
+		if err := bw.Flush(); err != nil {
 			return err
 		}
+		metrics.IncrCounter([]string{"memberlist", "tcp", "sent"}, float32(cw.n))
+		return nil
+	}, nil
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+// encryptChunkWriter encrypts a stream a chunk at a time with our primary
+// key, so that neither side needs the whole stream in memory. Each chunk is
+// written as a flag byte, which is set on the last one, its length and the
+// sealed chunk. The flag, length and position of the chunk are authenticated
+// along with it, so chunks can't be reordered, dropped or cut short without
+// the reader noticing.
+type encryptChunkWriter struct {
+	w   io.Writer
+	key []byte
+	vsn encryptionVersion
+	seq uint32
+	buf []byte
+	out bytes.Buffer
+}
+
+func (m *Memberlist) newEncryptChunkWriter(w io.Writer) *encryptChunkWriter {
+	key, vsn := m.primaryKey()
+	return &encryptChunkWriter{
+		w:   w,
+		key: key,
+		vsn: vsn,
+		buf: make([]byte, 0, compressChunkSize),
 	}
+}
 
-	// Get the send buffer
-	return m.rawSendMsgStream(conn, bufConn.Bytes())
+func (e *encryptChunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(e.buf) == cap(e.buf) {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush encrypts and writes out whatever is buffered.
+func (e *encryptChunkWriter) flush(last bool) error {
+	var hdr [5]byte
+	if last {
+		hdr[0] = 1
+	}
+	binary.BigEndian.PutUint32(hdr[1:], uint32(encryptedLength(e.vsn, len(e.buf))))
+
+	e.out.Reset()
+	if err := encryptPayload(e.vsn, e.key, e.buf, chunkData(hdr, e.seq), &e.out); err != nil {
+		return err
+	}
+	e.buf = e.buf[:0]
+	e.seq++
+
+	if _, err := e.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(e.out.Bytes())
+	return err
+}
+
+// Close writes out the last chunk, which may be empty. It doesn't close the
+// underlying writer.
+func (e *encryptChunkWriter) Close() error {
+	return e.flush(true)
+}
+
+// chunkData returns the additional data authenticated with an encrypted
+// chunk.
+func chunkData(hdr [5]byte, seq uint32) []byte {
+	data := make([]byte, 0, 10)
+	data = append(data, byte(encryptChunksMsg))
+	data = append(data, hdr[:]...)
+	return append(data, byte(seq>>24), byte(seq>>16), byte(seq>>8), byte(seq))
+}
+
+// decryptChunkReader reads a stream written by an encryptChunkWriter,
+// decrypting one chunk at a time. It never reads past the last chunk.
+type decryptChunkReader struct {
+	m    *Memberlist
+	r    io.Reader
+	seq  uint32
+	buf  []byte
+	done bool
+}
+
+func (d *decryptChunkReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		var hdr [5]byte
+		if _, err := io.ReadFull(d.r, hdr[:]); err != nil {
+			return 0, err
+		}
+		n := binary.BigEndian.Uint32(hdr[1:])
+		if n > maxEncryptedChunk {
+			return 0, fmt.Errorf("Encrypted chunk of %d bytes is too large", n)
+		}
+
+		in := make([]byte, n)
+		if _, err := io.ReadFull(d.r, in); err != nil {
+			return 0, err
+		}
+		if err := d.m.checkCipherSuite(in); err != nil {
+			return 0, err
+		}
+		out, err := decryptPayload(d.m.config.Keyring.GetKeys(), in, chunkData(hdr, d.seq))
+		if err != nil {
+			return 0, err
+		}
+		d.seq++
+		d.buf = out
+		d.done = hdr[0] == 1
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
 }
 
 // encryptLocalState is used to help encrypt local state before sending
@@ -912,13 +1393,12 @@ func (m *Memberlist) encryptLocalState(sendBuf []byte) ([]byte, error) {
 
 	// Write the size of the message
 	sizeBuf := make([]byte, 4)
-	encVsn := m.encryptionVersion()
+	key, encVsn := m.primaryKey()
 	encLen := encryptedLength(encVsn, len(sendBuf))
 	binary.BigEndian.PutUint32(sizeBuf, uint32(encLen))
 	buf.Write(sizeBuf)
 
 	// Write the encrypted cipher text to the buffer
-	key := m.config.Keyring.GetPrimaryKey()
 	err := encryptPayload(encVsn, key, sendBuf, buf.Bytes()[:5], &buf)
 	if err != nil {
 		return nil, err
@@ -986,6 +1466,11 @@ func (m *Memberlist) decryptRemoteState(bufConn io.Reader) ([]byte, error) {
 	// 获取解密 key
 	keys := m.config.Keyring.GetKeys()
 
+	// 检查加密套件
+	if err := m.checkCipherSuite(cipherBytes); err != nil {
+		return nil, err
+	}
+
 	// 解密
 	return decryptPayload(keys, cipherBytes, dataBytes)
 }
@@ -1011,22 +1496,31 @@ func (m *Memberlist) readStream(conn net.Conn) (messageType, io.Reader, *codec.D
 
 
 	// 检查消息是否被加密
-	if msgType == encryptMsg {
+	if msgType == encryptMsg || msgType == encryptChunksMsg {
 
 		// 如果消息加密，但是 conf 未开启加密，则报错
 		if !m.config.EncryptionEnabled() {
 			return 0, nil, nil, fmt.Errorf("Remote state is encrypted and encryption is not configured")
 		}
 
-		// 解密
-		plain, err := m.decryptRemoteState(bufConn)
-		if err != nil {
-			return 0, nil, nil, err
-		}
+		if msgType == encryptMsg {
+			// 解密
+			plain, err := m.decryptRemoteState(bufConn)
+			if err != nil {
+				return 0, nil, nil, err
+			}
 
-		// Reset message type and bufConn
-		msgType = messageType(plain[0])
-		bufConn = bytes.NewReader(plain[1:])
+			// Reset message type and bufConn
+			msgType = messageType(plain[0])
+			bufConn = bytes.NewReader(plain[1:])
+		} else {
+			// Chunked encryption is decrypted as it's read
+			bufConn = bufio.NewReader(&decryptChunkReader{m: m, r: bufConn})
+			if _, err := io.ReadFull(bufConn, buf[:]); err != nil {
+				return 0, nil, nil, err
+			}
+			msgType = messageType(buf[0])
+		}
 
 	} else {
 		// 如果消息未加密，但是 conf 开启了加密，则报错
@@ -1036,6 +1530,23 @@ func (m *Memberlist) readStream(conn net.Conn) (messageType, io.Reader, *codec.D
 	}
 
 
+	// Chunked compression is decompressed as it's read
+	if msgType == compressChunksMsg {
+		if _, err := io.ReadFull(bufConn, buf[:]); err != nil {
+			return 0, nil, nil, err
+		}
+		cr, err := newChunkReader(bufConn, compressionType(buf[0]))
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		bufConn = bufio.NewReader(cr)
+
+		if _, err := io.ReadFull(bufConn, buf[:]); err != nil {
+			return 0, nil, nil, err
+		}
+		msgType = messageType(buf[0])
+	}
+
 	// Get the msgPack decoders
 	//
 	hd := codec.MsgpackHandle{}
@@ -1052,7 +1563,7 @@ func (m *Memberlist) readStream(conn net.Conn) (messageType, io.Reader, *codec.D
 		}
 
 
-		decomp, err := decompressBuffer(&c)
+		decomp, err := decompressBuffer(&c, maxPushStateBytes)
 		if err != nil {
 			return 0, nil, nil, err
 		}
@@ -1074,56 +1585,71 @@ func (m *Memberlist) readStream(conn net.Conn) (messageType, io.Reader, *codec.D
 
 
 
-// readRemoteState is used to read the remote state from a connection
-//
-// readRemoteState 用于从连接中读取远程状态。
-func (m *Memberlist) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (bool, []pushNodeState, []byte, error) {
-
+// readRemoteNodes reads the node states that follow a push/pull header
+// into memory, leaving the user state to be read. The count in the header
+// comes from the remote side, so it's not trusted for allocations.
+func (m *Memberlist) readRemoteNodes(header *pushPullHeader, dec *codec.Decoder) ([]pushNodeState, error) {
+	var remoteNodes []pushNodeState
+	for i := 0; i < header.Nodes; i++ {
+		var n pushNodeState
+		if err := m.readRemoteNode(dec, &n); err != nil {
+			return nil, err
+		}
+		remoteNodes = append(remoteNodes, n)
+	}
+	return remoteNodes, nil
+}
 
-	// Read the push/pull header
+// readRemoteHeader reads the header of a push/pull message.
+func (m *Memberlist) readRemoteHeader(dec *codec.Decoder) (*pushPullHeader, error) {
 	var header pushPullHeader
 	if err := dec.Decode(&header); err != nil {
-		return false, nil, nil, err
+		return nil, err
 	}
-
-	// Allocate space for the transfer
-	remoteNodes := make([]pushNodeState, header.Nodes)
-
-	// Try to decode all the states
-	for i := 0; i < header.Nodes; i++ {
-		if err := dec.Decode(&remoteNodes[i]); err != nil {
-			return false, nil, nil, err
-		}
+	if header.Nodes < 0 || header.UserStateLen < 0 {
+		return nil, fmt.Errorf("Invalid push/pull header with %d nodes and %d bytes of user state",
+			header.Nodes, header.UserStateLen)
 	}
+	return &header, nil
+}
 
-	// Read the remote user state into a buffer
-	var userBuf []byte
-	if header.UserStateLen > 0 {
-		userBuf = make([]byte, header.UserStateLen)
-		bytes, err := io.ReadAtLeast(bufConn, userBuf, header.UserStateLen)
-		if err == nil && bytes != header.UserStateLen {
-			err = fmt.Errorf(
-				"Failed to read full user state (%d / %d)",
-				bytes, header.UserStateLen)
-		}
-		if err != nil {
-			return false, nil, nil, err
-		}
+// readRemoteNode reads the next node state of a push/pull message.
+func (m *Memberlist) readRemoteNode(dec *codec.Decoder, n *pushNodeState) error {
+	if err := dec.Decode(n); err != nil {
+		return err
 	}
 
 	// For proto versions < 2, there is no port provided.
 	// Mask old behavior by using the configured port.
-	for idx := range remoteNodes {
-		if m.ProtocolVersion() < 2 || remoteNodes[idx].Port == 0 {
-			remoteNodes[idx].Port = uint16(m.config.BindPort)
-		}
+	if m.ProtocolVersion() < 2 || n.Port == 0 {
+		n.Port = uint16(m.config.BindPort)
 	}
+	return nil
+}
 
-	return header.Join, remoteNodes, userBuf, nil
+// mergeRemoteBody reads and merges the node states and user state that
+// follow a push/pull header. A join has to be verified, and offered to the
+// merge delegate, as a whole before any of it is merged, so its nodes are
+// read in full first; everything else is merged as it's read. The user
+// state goes straight to the delegate either way.
+func (m *Memberlist) mergeRemoteBody(join bool, header *pushPullHeader, bufConn io.Reader, dec *codec.Decoder) error {
+	if !join {
+		return m.streamRemoteState(header, bufConn, dec, nil)
+	}
+
+	remoteNodes, err := m.readRemoteNodes(header, dec)
+	if err != nil {
+		return err
+	}
+	if err := m.mergeRemoteState(join, remoteNodes); err != nil {
+		return err
+	}
+	return m.mergeUserState(bufConn, header.UserStateLen, join)
 }
 
-// mergeRemoteState is used to merge the remote state with our local state
-func (m *Memberlist) mergeRemoteState(join bool, remoteNodes []pushNodeState, userBuf []byte) error {
+// mergeRemoteState is used to merge the remote node states with our local
+// state
+func (m *Memberlist) mergeRemoteState(join bool, remoteNodes []pushNodeState) error {
 	if err := m.verifyProtocol(remoteNodes); err != nil {
 		return err
 	}
@@ -1152,11 +1678,78 @@ func (m *Memberlist) mergeRemoteState(join bool, remoteNodes []pushNodeState, us
 
 	// Merge the membership state
 	m.mergeState(remoteNodes)
+	return nil
+}
+
+// streamRemoteState reads the node states and user state of a push/pull
+// message, after its header, and merges each one as it's read rather than
+// holding on to all of them. If checkFn is given it's called on each node
+// first.
+//
+// Each node's versions are verified against ours and those of the nodes
+// before it, as verifyProtocol does for a whole state. If one doesn't fit
+// we stop there, and the nodes already merged stay, just as if they had
+// been gossiped to us. Joins shouldn't take that chance, so mergeRemoteBody
+// reads their nodes in full instead.
+func (m *Memberlist) streamRemoteState(header *pushPullHeader, bufConn io.Reader, dec *codec.Decoder, checkFn func(*pushNodeState) error) error {
+	v := newVersionCheck()
+	m.nodeLock.RLock()
+	for _, n := range m.nodes {
+		v.addLocal(n)
+	}
+	m.nodeLock.RUnlock()
+
+	for i := 0; i < header.Nodes; i++ {
+		var n pushNodeState
+		if err := m.readRemoteNode(dec, &n); err != nil {
+			return err
+		}
+		if checkFn != nil {
+			if err := checkFn(&n); err != nil {
+				return err
+			}
+		}
+
+		v.addRemote(&n)
+		if err := v.verify(); err != nil {
+			return err
+		}
+		m.mergeNode(&n)
+	}
 
-	// Invoke the delegate for user state
-	if userBuf != nil && m.config.Delegate != nil {
+	return m.mergeUserState(bufConn, header.UserStateLen, header.Join)
+}
+
+// mergeUserState hands the remote user state to the delegate. It is read
+// from r, which must hold at least size bytes of it.
+func (m *Memberlist) mergeUserState(r io.Reader, size int, join bool) error {
+	if size <= 0 {
+		return nil
+	}
+
+	lr := &io.LimitedReader{R: r, N: int64(size)}
+	if sd, ok := m.config.Delegate.(StreamingDelegate); ok {
+		sd.MergeRemoteStateReader(lr, size, join)
+	} else if m.config.Delegate != nil {
+		// The size comes from the remote side, so don't let it make us
+		// allocate any more than a whole push/pull could hold
+		if size > maxPushStateBytes {
+			return fmt.Errorf("Remote user state is larger than limit (%d)", size)
+		}
+		userBuf := make([]byte, size)
+		if _, err := io.ReadFull(lr, userBuf); err != nil {
+			return fmt.Errorf("Failed to read full user state (%d / %d)", size-int(lr.N), size)
+		}
 		m.config.Delegate.MergeRemoteState(userBuf, join)
 	}
+
+	// Skip whatever the delegate didn't read, making sure it was all there
+	if _, err := io.Copy(ioutil.Discard, lr); err != nil {
+		return err
+	}
+	if lr.N != 0 {
+		return fmt.Errorf("Failed to read full user state (%d / %d)", size-int(lr.N), size)
+	}
 	return nil
 }
 
@@ -1196,7 +1789,10 @@ func (m *Memberlist) readUserMsg(bufConn io.Reader, dec *codec.Decoder) error {
 // operations, given the deadline. The bool return parameter is true if we
 // we able to round trip a ping to the other node.
 func (m *Memberlist) sendPingAndWaitForAck(addr string, ping ping, deadline time.Time) (bool, error) {
-	conn, err := m.transport.DialTimeout(addr, deadline.Sub(time.Now()))
+	// The deadline comes from the protocol clock, but sockets need a wall
+	// clock deadline.
+	timeout := deadline.Sub(m.clock.Now())
+	conn, err := m.dialStream(addr, timeout)
 	if err != nil {
 		// If the node is actually dead we expect this to fail, so we
 		// shouldn't spam the logs with it. After this point, errors
@@ -1205,14 +1801,14 @@ func (m *Memberlist) sendPingAndWaitForAck(addr string, ping ping, deadline time
 		return false, nil
 	}
 	defer conn.Close()
-	conn.SetDeadline(deadline)
+	conn.SetDeadline(time.Now().Add(timeout))
 
 	out, err := encode(pingMsg, &ping)
 	if err != nil {
 		return false, err
 	}
 
-	if err = m.rawSendMsgStream(conn, out.Bytes()); err != nil {
+	if err = m.rawSendMsgStream(conn, out.Bytes(), m.compressionForAddr(addr)); err != nil {
 		return false, err
 	}
 
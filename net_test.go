@@ -5,10 +5,13 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -285,7 +288,7 @@ func TestTCPPing(t *testing.T) {
 			t.Fatalf("failed to encode ack: %s", err)
 		}
 
-		err = m.rawSendMsgStream(conn, out.Bytes())
+		err = m.rawSendMsgStream(conn, out.Bytes(), lzwAlgo)
 		if err != nil {
 			t.Fatalf("failed to send ack: %s", err)
 		}
@@ -324,7 +327,7 @@ func TestTCPPing(t *testing.T) {
 			t.Fatalf("failed to encode ack: %s", err)
 		}
 
-		err = m.rawSendMsgStream(conn, out.Bytes())
+		err = m.rawSendMsgStream(conn, out.Bytes(), lzwAlgo)
 		if err != nil {
 			t.Fatalf("failed to send ack: %s", err)
 		}
@@ -358,7 +361,7 @@ func TestTCPPing(t *testing.T) {
 			t.Fatalf("failed to encode bogus msg: %s", err)
 		}
 
-		err = m.rawSendMsgStream(conn, out.Bytes())
+		err = m.rawSendMsgStream(conn, out.Bytes(), lzwAlgo)
 		if err != nil {
 			t.Fatalf("failed to send bogus msg: %s", err)
 		}
@@ -401,7 +404,7 @@ func TestTCPPushPull(t *testing.T) {
 			Port: uint16(m.config.BindPort),
 		},
 		Incarnation: 0,
-		State:       stateSuspect,
+		State:       StateSuspect,
 		StateChange: time.Now().Add(-1 * time.Second),
 	})
 
@@ -417,17 +420,17 @@ func TestTCPPushPull(t *testing.T) {
 	localNodes[0].Addr = net.ParseIP(m.config.BindAddr)
 	localNodes[0].Port = uint16(m.config.BindPort)
 	localNodes[0].Incarnation = 1
-	localNodes[0].State = stateAlive
+	localNodes[0].State = StateAlive
 	localNodes[1].Name = "Test 1"
 	localNodes[1].Addr = net.ParseIP(m.config.BindAddr)
 	localNodes[1].Port = uint16(m.config.BindPort)
 	localNodes[1].Incarnation = 1
-	localNodes[1].State = stateAlive
+	localNodes[1].State = StateAlive
 	localNodes[2].Name = "Test 2"
 	localNodes[2].Addr = net.ParseIP(m.config.BindAddr)
 	localNodes[2].Port = uint16(m.config.BindPort)
 	localNodes[2].Incarnation = 1
-	localNodes[2].State = stateAlive
+	localNodes[2].State = StateAlive
 
 	// Send our node state
 	header := pushPullHeader{Nodes: 3}
@@ -462,7 +465,7 @@ func TestTCPPushPull(t *testing.T) {
 		if err := dec.Decode(&c); err != nil {
 			t.Fatalf("unexpected err %s", err)
 		}
-		decomp, err := decompressBuffer(&c)
+		decomp, err := decompressBuffer(&c, maxPushStateBytes)
 		if err != nil {
 			t.Fatalf("unexpected err %s", err)
 		}
@@ -510,11 +513,324 @@ func TestTCPPushPull(t *testing.T) {
 	if n.Incarnation != 0 {
 		t.Fatal("bad incarnation")
 	}
-	if n.State != stateSuspect {
+	if n.State != StateSuspect {
 		t.Fatal("bad state")
 	}
 }
 
+func TestSendState_Chunked(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	for i := 0; i < 50; i++ {
+		a := alive{Node: fmt.Sprintf("node%d", i), Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+
+	// send writes our state and returns the raw bytes that went out.
+	send := func(stream bool) []byte {
+		client, server := net.Pipe()
+		defer server.Close()
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- m.sendLocalState(client, false, lzwAlgo, stream)
+			client.Close()
+		}()
+		raw, err := ioutil.ReadAll(server)
+		require.NoError(t, err)
+		require.NoError(t, <-errCh)
+		return raw
+	}
+
+	// receive reads back state sent as raw bytes.
+	receive := func(raw []byte) []pushNodeState {
+		client, server := net.Pipe()
+		defer server.Close()
+
+		go func() {
+			client.Write(raw)
+			client.Close()
+		}()
+		msgType, _, dec, err := m.readStream(server)
+		require.NoError(t, err)
+		require.Equal(t, pushPullMsg, msgType)
+		header, err := m.readRemoteHeader(dec)
+		require.NoError(t, err)
+		require.True(t, header.Stream)
+		nodes, err := m.readRemoteNodes(header, dec)
+		require.NoError(t, err)
+		return nodes
+	}
+
+	raw := send(true)
+	require.Equal(t, byte(compressChunksMsg), raw[0])
+	require.Len(t, receive(raw), 50)
+
+	// Without chunked compression the whole message is compressed.
+	raw = send(false)
+	require.Equal(t, byte(compressMsg), raw[0])
+	require.Len(t, receive(raw), 50)
+
+	// And without compression it's written as is.
+	m.config.EnableCompression = false
+	raw = send(true)
+	require.Equal(t, byte(pushPullMsg), raw[0])
+	require.Len(t, receive(raw), 50)
+}
+
+func TestSendState_ChunkedEncrypted(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.SecretKey = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	})
+	defer m.Shutdown()
+
+	// Enough meta data that the state spans a few chunks.
+	meta := bytes.Repeat([]byte{'m'}, 400)
+	for i := 0; i < 500; i++ {
+		a := alive{Node: fmt.Sprintf("node%d", i), Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Meta: meta, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+
+	send := func() []byte {
+		client, server := net.Pipe()
+		go func() {
+			m.sendLocalState(client, false, lzwAlgo, true)
+			client.Close()
+		}()
+		raw, err := ioutil.ReadAll(server)
+		require.NoError(t, err)
+		require.Equal(t, byte(encryptChunksMsg), raw[0])
+		return raw
+	}
+
+	receive := func(raw []byte) ([]pushNodeState, error) {
+		client, server := net.Pipe()
+		defer server.Close()
+
+		go func() {
+			client.Write(raw)
+			client.Close()
+		}()
+		msgType, _, dec, err := m.readStream(server)
+		if err != nil {
+			return nil, err
+		}
+		require.Equal(t, pushPullMsg, msgType)
+		header, err := m.readRemoteHeader(dec)
+		if err != nil {
+			return nil, err
+		}
+		return m.readRemoteNodes(header, dec)
+	}
+
+	// Compression goes inside the encryption.
+	nodes, err := receive(send())
+	require.NoError(t, err)
+	require.Len(t, nodes, 500)
+
+	// Without it the state doesn't fit in one chunk.
+	m.config.EnableCompression = false
+	raw := send()
+	nodes, err = receive(raw)
+	require.NoError(t, err)
+	require.Len(t, nodes, 500)
+
+	// Any change to the ciphertext is caught.
+	tampered := append([]byte(nil), raw...)
+	tampered[len(tampered)/2] ^= 1
+	_, err = receive(tampered)
+	require.Error(t, err)
+
+	// So is a stream cut off at a chunk boundary, before the last chunk.
+	first := 1 + 5 + int(binary.BigEndian.Uint32(raw[2:6]))
+	require.True(t, first < len(raw))
+	_, err = receive(raw[:first])
+	require.Error(t, err)
+}
+
+func TestMemberlist_streamRemoteState_Incompatible(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, true)
+
+	vsn := m.config.BuildVsnArray()
+	tooNew := []uint8{vsn[2] + 1, vsn[1], vsn[2] + 1, vsn[3], vsn[4], vsn[5]}
+	remote := []pushNodeState{
+		{Name: "first", Addr: []byte{127, 0, 0, 2}, Port: 7946, Incarnation: 1, State: StateAlive, Vsn: vsn},
+		{Name: "too-new", Addr: []byte{127, 0, 0, 3}, Port: 7946, Incarnation: 1, State: StateAlive, Vsn: tooNew},
+		{Name: "last", Addr: []byte{127, 0, 0, 4}, Port: 7946, Incarnation: 1, State: StateAlive, Vsn: vsn},
+	}
+
+	var buf bytes.Buffer
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(&buf, &hd)
+	for i := range remote {
+		require.NoError(t, enc.Encode(&remote[i]))
+	}
+
+	// Nodes are merged until one doesn't fit with the rest.
+	header := &pushPullHeader{Nodes: len(remote)}
+	err := m.streamRemoteState(header, &buf, codec.NewDecoder(&buf, &hd), nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "incompatible")
+
+	require.NotNil(t, m.nodeMap["first"])
+	require.Nil(t, m.nodeMap["too-new"])
+	require.Nil(t, m.nodeMap["last"])
+}
+
+// streamingDelegate is a MockDelegate that exchanges its state through
+// readers.
+type streamingDelegate struct {
+	MockDelegate
+	local []byte
+
+	lock   sync.Mutex
+	remote [][]byte
+}
+
+func (d *streamingDelegate) LocalStateReader(join bool) (io.Reader, int) {
+	return bytes.NewReader(d.local), len(d.local)
+}
+
+func (d *streamingDelegate) MergeRemoteStateReader(r io.Reader, size int, join bool) {
+	buf, _ := ioutil.ReadAll(r)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.remote = append(d.remote, buf)
+}
+
+func (d *streamingDelegate) getRemote() [][]byte {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.remote
+}
+
+func TestMemberlist_PushPull_StreamingDelegate(t *testing.T) {
+	// More than a single compressed chunk each.
+	d1 := &streamingDelegate{local: bytes.Repeat([]byte("one"), compressChunkSize)}
+	d2 := &streamingDelegate{local: bytes.Repeat([]byte("two"), compressChunkSize)}
+
+	c1 := testConfig(t)
+	c1.Delegate = d1
+	c1.PushPullInterval = 0
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.Delegate = d2
+	c2.PushPullInterval = 0
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	// The join exchanges state both ways.
+	_, err = m2.Join([]string{m1.config.BindAddr})
+	require.NoError(t, err)
+	waitUntilSize(t, m1, 2)
+	waitUntilSize(t, m2, 2)
+	require.Len(t, d1.getRemote(), 1)
+	require.Len(t, d2.getRemote(), 1)
+
+	// So does a push/pull, which uses a digest and chunked compression.
+	addr := m2.LocalNode().Address()
+	require.True(t, m1.protocolMaxForAddr(addr) >= 7)
+	require.NoError(t, m1.pushPullNode(addr, false))
+	retry(t, 10, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		if len(d1.getRemote()) != 2 || len(d2.getRemote()) != 2 {
+			failf("expected a second exchange of state")
+		}
+	})
+
+	for _, got := range d1.getRemote() {
+		require.Equal(t, d2.local, got)
+	}
+	for _, got := range d2.getRemote() {
+		require.Equal(t, d1.local, got)
+	}
+
+	// The byte slice methods weren't used.
+	require.Empty(t, d1.getRemoteState())
+	require.Empty(t, d2.getRemoteState())
+}
+
+func TestMemberlist_mergeUserState_Limit(t *testing.T) {
+	d := &MockDelegate{}
+	m := GetMemberlist(t, func(c *Config) {
+		c.Delegate = d
+	})
+	defer m.Shutdown()
+
+	// A remote side claiming a huge user state doesn't get us to
+	// allocate it.
+	err := m.mergeUserState(bytes.NewReader(nil), maxPushStateBytes+1, false)
+	require.Error(t, err)
+	require.Empty(t, d.getRemoteState())
+
+	// Joins read their nodes in full, but not the user state.
+	header := &pushPullHeader{Join: true, UserStateLen: maxPushStateBytes + 1}
+	err = m.mergeRemoteBody(true, header, bytes.NewReader(nil), nil)
+	require.Error(t, err)
+	require.Empty(t, d.getRemoteState())
+}
+
+func TestMemberlist_PushPull_ReplyWhileReading(t *testing.T) {
+	d := &streamingDelegate{local: []byte("local")}
+	m := GetMemberlist(t, func(c *Config) {
+		c.Delegate = d
+		c.EnableCompression = false
+	})
+	defer m.Shutdown()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go m.handleConn(server)
+
+	// Send the header and only half of the user state. The pipe doesn't
+	// buffer anything, so the rest can't be written until it's read.
+	remote := bytes.Repeat([]byte("r"), 1024*1024)
+	var buf bytes.Buffer
+	buf.WriteByte(byte(pushPullMsg))
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(&buf, &hd)
+	require.NoError(t, enc.Encode(&pushPullHeader{UserStateLen: len(remote)}))
+	buf.Write(remote[:len(remote)/2])
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.Write(buf.Bytes())
+		errCh <- err
+	}()
+
+	// The reply comes back before the rest has been sent.
+	msgType, bufConn, dec, err := m.readStream(client)
+	require.NoError(t, err)
+	require.Equal(t, pushPullMsg, msgType)
+	header, err := m.readRemoteHeader(dec)
+	require.NoError(t, err)
+	_, err = m.readRemoteNodes(header, dec)
+	require.NoError(t, err)
+	got := make([]byte, header.UserStateLen)
+	_, err = io.ReadFull(bufConn, got)
+	require.NoError(t, err)
+	require.Equal(t, "local", string(got))
+
+	require.NoError(t, <-errCh)
+	_, err = client.Write(remote[len(remote)/2:])
+	require.NoError(t, err)
+	retry(t, 10, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		if len(d.getRemote()) != 1 {
+			failf("expected the remote state to be merged")
+		}
+	})
+	require.True(t, bytes.Equal(remote, d.getRemote()[0]))
+}
+
 func TestSendMsg_Piggyback(t *testing.T) {
 	m := GetMemberlist(t, nil)
 	defer m.Shutdown()
@@ -768,3 +1084,104 @@ func listenUDP(t *testing.T) *net.UDPConn {
 	}
 	return udp
 }
+
+func TestMemberlist_CIDRsAllowed_Source(t *testing.T) {
+	c1 := testConfig(t)
+	var err error
+	c1.CIDRsAllowed, err = ParseCIDRs([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	m2, err := Create(testConfig(t))
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	// Streams and packets from outside the allowed ranges are dropped.
+	_, err = m2.Join([]string{m1.LocalNode().Address()})
+	require.Error(t, err)
+	addr, err := net.ResolveUDPAddr("udp", m1.LocalNode().Address())
+	require.NoError(t, err)
+	_, err = m2.Ping(c1.Name, addr)
+	require.Error(t, err)
+}
+
+func TestMemberlist_CIDRsAllowed_LocalTransports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	network := &InmemNetwork{}
+
+	transports := map[string]func() Transport{
+		"unix": func() Transport {
+			tr, err := NewUnixTransport(&UnixTransportConfig{Dir: dir, Logger: testLogger(t)})
+			require.NoError(t, err)
+			return tr
+		},
+		"inmem": func() Transport {
+			tr, err := network.NewTransport("")
+			require.NoError(t, err)
+			return tr
+		},
+	}
+	for name, newTransport := range transports {
+		t.Run(name, func(t *testing.T) {
+			var ms []*Memberlist
+			for i := 0; i < 2; i++ {
+				c := testConfig(t)
+				c.Name = fmt.Sprintf("%s%d", name, i)
+				c.Transport = newTransport()
+				c.CIDRsAllowed, err = ParseCIDRs([]string{"127.0.0.0/8"})
+				require.NoError(t, err)
+				m, err := Create(c)
+				require.NoError(t, err)
+				defer m.Shutdown()
+				ms = append(ms, m)
+			}
+
+			// Both packets and streams get through.
+			_, err := ms[1].Join([]string{ms[0].LocalNode().Address()})
+			require.NoError(t, err)
+			waitUntilSize(t, ms[0], 2)
+			waitUntilSize(t, ms[1], 2)
+			addr, err := net.ResolveUDPAddr("udp", ms[0].LocalNode().Address())
+			require.NoError(t, err)
+			_, err = ms[1].Ping(ms[0].config.Name, addr)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestMemberlist_CIDRsAllowed_Alive(t *testing.T) {
+	c2 := testConfig(t)
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	m3, err := Create(testConfig(t))
+	require.NoError(t, err)
+	defer m3.Shutdown()
+
+	// m1 accepts traffic from m2, and from 127.0.0.1 where outbound
+	// streams originate, but not m3's advertised address.
+	c1 := testConfig(t)
+	c1.CIDRsAllowed, err = ParseCIDRs([]string{c2.BindAddr + "/32", "127.0.0.1/32"})
+	require.NoError(t, err)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	_, err = m3.Join([]string{m2.LocalNode().Address()})
+	require.NoError(t, err)
+	_, err = m1.Join([]string{m2.LocalNode().Address()})
+	require.NoError(t, err)
+
+	// m1 hears about m3 from an allowed peer, but ignores it.
+	require.Equal(t, 3, m2.NumMembers())
+	require.Equal(t, 2, m1.NumMembers())
+	m1.nodeLock.RLock()
+	_, ok := m1.nodeMap[m3.config.Name]
+	m1.nodeLock.RUnlock()
+	require.False(t, ok)
+}
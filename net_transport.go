@@ -1,7 +1,10 @@
 package memberlist
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"sync"
@@ -20,6 +23,10 @@ const (
 	// udpRecvBufSize is a large buffer size that we attempt to set UDP
 	// sockets to in order to handle a large volume of messages.
 	udpRecvBufSize = 2 * 1024 * 1024
+
+	// defaultTLSHandshakeTimeout is used when a TLSTransportConfig doesn't
+	// specify a handshake timeout.
+	defaultTLSHandshakeTimeout = 10 * time.Second
 )
 
 // NetTransportConfig is used to configure a net transport.
@@ -33,6 +40,41 @@ type NetTransportConfig struct {
 
 	// Logger is a logger for operator messages.
 	Logger *log.Logger
+
+	// StreamPoolSize, if positive, keeps up to this many idle stream
+	// connections per peer so that push/pulls, fallback pings and reliable
+	// messages don't each dial a new TCP connection. Pooled connections
+	// carry a framing that older versions don't understand, so only turn
+	// this on once every node has been upgraded. A transport only looks for
+	// pooled connections from peers while this is set, so set it on every
+	// node.
+	StreamPoolSize int
+
+	// StreamIdleTimeout is how long a pooled connection may sit idle
+	// before it's closed. If this is zero, a default of 30 seconds is used.
+	// Connections that peers pool with us are kept for twice this long, so
+	// it should be about the same on every node.
+	StreamIdleTimeout time.Duration
+
+	// TCPTimeout bounds how long a connection accepted while pooling is
+	// enabled may take to send its first byte, which says whether it's
+	// pooled. Memberlist sets this to Config.TCPTimeout for the transport it
+	// creates. If this is zero, a default of 10 seconds is used.
+	TCPTimeout time.Duration
+
+	// UDPReaders is the number of UDP sockets bound to each address, each
+	// with its own reader goroutine. More than one is only supported on
+	// Linux, where the sockets share the port using SO_REUSEPORT and the
+	// kernel spreads incoming packets across them by source address. Note
+	// that other processes run by the same user may then bind the port too.
+	// Elsewhere, and if this is zero, a single socket is used.
+	UDPReaders int
+
+	// UDPBatchSize is the most packets that are read or written with one
+	// system call. On Linux, recvmmsg and sendmmsg are used; elsewhere
+	// packets are always handled one at a time. If this is zero, a default
+	// of 16 is used. Setting it to 1 turns batching off.
+	UDPBatchSize int
 }
 
 // NetTransport is a Transport implementation that uses connectionless UDP for
@@ -45,7 +87,18 @@ type NetTransport struct {
 	wg           sync.WaitGroup
 	tcpListeners []*net.TCPListener
 	udpListeners []*net.UDPConn
+	udpWriter    *udpBatchWriter // nil unless batching is enabled
 	shutdown     int32
+	shutdownCh   chan struct{}
+
+	pool       *streamPool   // nil unless StreamPoolSize is set
+	handshakes chan struct{} // Accepted connections not yet known to be pooled
+
+	sessionLock sync.Mutex
+	sessions    map[*streamSession]struct{} // Sessions peers have opened with us
+
+	dfLock sync.Mutex
+	dfConn *net.UDPConn // Don't fragment socket, opened by the first MTU probe
 }
 
 // NewNetTransport returns a net transport with the given configuration. On
@@ -60,10 +113,12 @@ func NewNetTransport(config *NetTransportConfig) (*NetTransport, error) {
 	// Build out the new transport.
 	var ok bool
 	t := NetTransport{
-		config:   config,
-		packetCh: make(chan *Packet),
-		streamCh: make(chan net.Conn),
-		logger:   config.Logger,
+		config:     config,
+		packetCh:   make(chan *Packet),
+		streamCh:   make(chan net.Conn),
+		logger:     config.Logger,
+		shutdownCh: make(chan struct{}),
+		sessions:   make(map[*streamSession]struct{}),
 	}
 
 	// Clean up listeners if there's an error.
@@ -92,22 +147,52 @@ func NewNetTransport(config *NetTransportConfig) (*NetTransport, error) {
 			port = tcpLn.Addr().(*net.TCPAddr).Port
 		}
 
+		// When there are several UDP sockets per address they all share
+		// the port, so the first one for each address is the one that
+		// comes first in the list.
 		udpAddr := &net.UDPAddr{IP: ip, Port: port}
-		udpLn, err := net.ListenUDP("udp", udpAddr)
+		readers := t.udpReaders()
+		for i := 0; i < readers; i++ {
+			udpLn, err := listenUDPSocket(udpAddr, readers > 1)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to start UDP listener on %q port %d: %v", addr, port, err)
+			}
+			t.udpListeners = append(t.udpListeners, udpLn)
+			if err := setUDPRecvBuf(udpLn); err != nil {
+				return nil, fmt.Errorf("Failed to resize UDP buffer: %v", err)
+			}
+		}
+	}
+
+	if udpBatching && t.udpBatchSize() > 1 {
+		w, err := newUDPBatchWriter(t.udpListeners[0], t.udpBatchSize())
 		if err != nil {
-			return nil, fmt.Errorf("Failed to start UDP listener on %q port %d: %v", addr, port, err)
+			return nil, fmt.Errorf("Failed to start UDP writer: %v", err)
 		}
-		if err := setUDPRecvBuf(udpLn); err != nil {
-			return nil, fmt.Errorf("Failed to resize UDP buffer: %v", err)
+		t.udpWriter = w
+	}
+
+	// The pool has to be in place before the listeners start, since they
+	// check it for every connection they accept.
+	if config.StreamPoolSize > 0 {
+		idleTimeout := config.StreamIdleTimeout
+		if idleTimeout <= 0 {
+			idleTimeout = defaultStreamIdleTimeout
 		}
-		t.udpListeners = append(t.udpListeners, udpLn)
+		t.pool = newStreamPool(config.StreamPoolSize, idleTimeout)
+		t.handshakes = make(chan struct{}, maxStreamHandshakes)
+		t.wg.Add(1)
+		go t.reapPool()
 	}
 
 	// Fire them up now that we've been able to create them all.
-	for i := 0; i < len(config.BindAddrs); i++ {
-		t.wg.Add(2)
-		go t.tcpListen(t.tcpListeners[i])
-		go t.udpListen(t.udpListeners[i])
+	for _, tcpLn := range t.tcpListeners {
+		t.wg.Add(1)
+		go t.tcpListen(tcpLn)
+	}
+	for _, udpLn := range t.udpListeners {
+		t.wg.Add(1)
+		go t.udpListen(udpLn)
 	}
 
 	ok = true
@@ -179,7 +264,11 @@ func (t *NetTransport) WriteTo(b []byte, addr string) (time.Time, error) {
 	// packet sending interface on the first one. Take the time after the
 	// write call comes back, which will underestimate the time a little,
 	// but help account for any delays before the write occurs.
-	_, err = t.udpListeners[0].WriteTo(b, udpAddr)
+	if t.udpWriter != nil {
+		err = t.udpWriter.writeTo(b, udpAddr)
+	} else {
+		_, err = t.udpListeners[0].WriteTo(b, udpAddr)
+	}
 	return time.Now(), err
 }
 
@@ -190,6 +279,9 @@ func (t *NetTransport) PacketCh() <-chan *Packet {
 
 // See Transport.
 func (t *NetTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	if t.pool != nil {
+		return t.dialPooled(addr, timeout)
+	}
 	dialer := net.Dialer{Timeout: timeout}
 	return dialer.Dial("tcp", addr)
 }
@@ -202,7 +294,10 @@ func (t *NetTransport) StreamCh() <-chan net.Conn {
 // See Transport.
 func (t *NetTransport) Shutdown() error {
 	// This will avoid log spam about errors when we shut down.
-	atomic.StoreInt32(&t.shutdown, 1)
+	if !atomic.CompareAndSwapInt32(&t.shutdown, 0, 1) {
+		return nil
+	}
+	close(t.shutdownCh)
 
 	// Rip through all the connections and shut them down.
 	for _, conn := range t.tcpListeners {
@@ -211,6 +306,16 @@ func (t *NetTransport) Shutdown() error {
 	for _, conn := range t.udpListeners {
 		conn.Close()
 	}
+	t.sessionLock.Lock()
+	for s := range t.sessions {
+		s.conn.Close()
+	}
+	t.sessionLock.Unlock()
+	t.dfLock.Lock()
+	if t.dfConn != nil {
+		t.dfConn.Close()
+	}
+	t.dfLock.Unlock()
 
 	// Block until all the listener threads have died.
 	t.wg.Wait()
@@ -255,43 +360,18 @@ func (t *NetTransport) tcpListen(tcpLn *net.TCPListener) {
 		// No error, reset loop delay
 		loopDelay = 0
 
-		t.streamCh <- conn
-	}
-}
-
-// udpListen is a long running goroutine that accepts incoming UDP packets and
-// hands them off to the packet channel.
-func (t *NetTransport) udpListen(udpLn *net.UDPConn) {
-	defer t.wg.Done()
-	for {
-		// Do a blocking read into a fresh buffer. Grab a time stamp as
-		// close as possible to the I/O.
-		buf := make([]byte, udpPacketBufSize)
-		n, addr, err := udpLn.ReadFrom(buf)
-		ts := time.Now()
-		if err != nil {
-			if s := atomic.LoadInt32(&t.shutdown); s == 1 {
-				break
-			}
-
-			t.logger.Printf("[ERR] memberlist: Error reading UDP packet: %v", err)
+		if t.pool == nil {
+			t.handOff(conn)
 			continue
 		}
 
-		// Check the length - it needs to have at least one byte to be a
-		// proper message.
-		if n < 1 {
-			t.logger.Printf("[ERR] memberlist: UDP packet too short (%d bytes) %s",
-				len(buf), LogAddress(addr))
-			continue
-		}
-
-		// Ingest the packet.
-		metrics.IncrCounter([]string{"memberlist", "udp", "received"}, float32(n))
-		t.packetCh <- &Packet{
-			Buf:       buf[:n],
-			From:      addr,
-			Timestamp: ts,
+		// Stop accepting while too many connections are yet to say
+		// whether they're pooled, rather than piling up goroutines.
+		select {
+		case t.handshakes <- struct{}{}:
+			go t.acceptStream(conn)
+		case <-t.shutdownCh:
+			conn.Close()
 		}
 	}
 }
@@ -310,3 +390,259 @@ func setUDPRecvBuf(c *net.UDPConn) error {
 	}
 	return err
 }
+
+// TLSTransportConfig is used to configure a TLS transport.
+type TLSTransportConfig struct {
+	// NetTransportConfig configures the underlying UDP and TCP listeners.
+	NetTransportConfig
+
+	// CertFile and KeyFile are the PEM encoded certificate and private key
+	// that this node presents to its peers. The same certificate is used
+	// when accepting and when dialing stream connections, so it must be
+	// usable for both client and server authentication. Both files are
+	// read again by ReloadCertificates.
+	CertFile string
+	KeyFile  string
+
+	// CAFile is a PEM encoded bundle of certificate authorities used to
+	// verify peer certificates. It is read again by ReloadCertificates. If
+	// CAFile is empty then CAPool is used instead.
+	CAFile string
+	CAPool *x509.CertPool
+
+	// ServerName, if set, is a name that every peer certificate must be
+	// valid for. Memberlist dials peers by IP address, so this is checked
+	// in place of the usual host name verification, in both directions.
+	ServerName string
+
+	// HandshakeTimeout bounds the TLS handshake for incoming stream
+	// connections. If this is zero, a default of 10 seconds is used.
+	HandshakeTimeout time.Duration
+}
+
+// TLSTransport is a Transport implementation that wraps a NetTransport and
+// uses mutually authenticated TLS for all stream operations. Packets are
+// still sent over plain UDP, so they should be protected using the keyring
+// as usual.
+type TLSTransport struct {
+	*NetTransport
+
+	config     *TLSTransportConfig
+	streamCh   chan net.Conn
+	shutdownCh chan struct{}
+	wg         sync.WaitGroup
+
+	certLock sync.RWMutex
+	cert     *tls.Certificate
+	caPool   *x509.CertPool
+}
+
+// NewTLSTransport returns a TLS transport with the given configuration. On
+// success all the network listeners will be created and listening.
+func NewTLSTransport(config *TLSTransportConfig) (*TLSTransport, error) {
+	t := TLSTransport{
+		config:     config,
+		streamCh:   make(chan net.Conn),
+		shutdownCh: make(chan struct{}),
+	}
+	if err := t.ReloadCertificates(); err != nil {
+		return nil, err
+	}
+
+	nt, err := NewNetTransport(&config.NetTransportConfig)
+	if err != nil {
+		return nil, err
+	}
+	t.NetTransport = nt
+
+	t.wg.Add(1)
+	go t.handshakeListen()
+	return &t, nil
+}
+
+// ReloadCertificates reads the certificate, key and CA files again and starts
+// using them for new stream connections. Connections that are already
+// established are not affected. If any of the files can't be loaded then the
+// previous certificates remain in use and an error is returned.
+func (t *TLSTransport) ReloadCertificates() error {
+	if t.config.CertFile == "" || t.config.KeyFile == "" {
+		return fmt.Errorf("A certificate and key file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(t.config.CertFile, t.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load certificate: %v", err)
+	}
+
+	pool := t.config.CAPool
+	if t.config.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read CA file: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("Failed to parse any certificates from CA file %q", t.config.CAFile)
+		}
+	}
+	if pool == nil {
+		return fmt.Errorf("A CA file or pool is required to verify peers")
+	}
+
+	t.certLock.Lock()
+	t.cert = &cert
+	t.caPool = pool
+	t.certLock.Unlock()
+	return nil
+}
+
+// getCertificate returns the certificate currently presented to peers.
+func (t *TLSTransport) getCertificate() (*tls.Certificate, error) {
+	t.certLock.RLock()
+	defer t.certLock.RUnlock()
+	return t.cert, nil
+}
+
+// verifyPeer checks the certificate chain presented by a peer against the
+// current CA pool, and against the configured server name if there is one.
+// The standard library's verification can't be used directly since it would
+// check the certificate against the IP address we dialed.
+func (t *TLSTransport) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("Peer did not present a certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("Failed to parse peer certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+
+	t.certLock.RLock()
+	pool := t.caPool
+	t.certLock.RUnlock()
+
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return err
+	}
+
+	if t.config.ServerName != "" {
+		if err := certs[0].VerifyHostname(t.config.ServerName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serverConfig returns the TLS configuration for accepted connections.
+func (t *TLSTransport) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return t.getCertificate()
+		},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: t.verifyPeer,
+		MinVersion:            tls.VersionTLS12,
+	}
+}
+
+// clientConfig returns the TLS configuration for dialed connections. Chain
+// verification is done by verifyPeer, so the built-in check is skipped.
+func (t *TLSTransport) clientConfig() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return t.getCertificate()
+		},
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: t.verifyPeer,
+		MinVersion:            tls.VersionTLS12,
+	}
+}
+
+// See Transport.
+func (t *TLSTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, t.clientConfig())
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// See Transport.
+func (t *TLSTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// See Transport.
+func (t *TLSTransport) Shutdown() error {
+	// Tear down the listeners first so no new connections show up, then
+	// stop the handshake goroutines.
+	err := t.NetTransport.Shutdown()
+	close(t.shutdownCh)
+	t.wg.Wait()
+	return err
+}
+
+// handshakeListen is a long running goroutine that takes the raw connections
+// accepted by the underlying NetTransport and performs server handshakes on
+// them.
+func (t *TLSTransport) handshakeListen() {
+	defer t.wg.Done()
+	for {
+		select {
+		case conn := <-t.NetTransport.streamCh:
+			t.wg.Add(1)
+			go t.handshake(conn)
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+// handshake performs the server side of the TLS handshake and hands the
+// connection off to the stream channel if it succeeds.
+func (t *TLSTransport) handshake(conn net.Conn) {
+	defer t.wg.Done()
+
+	timeout := t.config.HandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultTLSHandshakeTimeout
+	}
+
+	tlsConn := tls.Server(conn, t.serverConfig())
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		metrics.IncrCounter([]string{"memberlist", "tls", "handshake_failed"}, 1)
+		t.logger.Printf("[ERR] memberlist: TLS handshake failed: %v %s", err, LogConn(conn))
+		conn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	select {
+	case t.streamCh <- tlsConn:
+	case <-t.shutdownCh:
+		tlsConn.Close()
+	}
+}
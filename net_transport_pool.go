@@ -0,0 +1,385 @@
+package memberlist
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// streamSessionMsg is the first byte of a pooled stream connection. It sits
+// next to hasLabelMsg, far above the regular message types, so a session can
+// be told apart from a plain connection on accept.
+//
+// A session carries a series of exchanges. Each exchange looks to memberlist
+// like a connection of its own: its data is sent in chunks of
+// [4 byte length][bytes], and each side ends its half of the exchange with a
+// zero length chunk. The connection is reused once both halves have ended.
+const streamSessionMsg messageType = 245
+
+const (
+	// defaultStreamIdleTimeout is used when StreamIdleTimeout isn't set.
+	defaultStreamIdleTimeout = 30 * time.Second
+
+	// streamSessionFinishTimeout bounds how long ending an exchange may
+	// take before the connection is given up on.
+	streamSessionFinishTimeout = 10 * time.Second
+
+	// defaultStreamHandshakeTimeout is used when TCPTimeout isn't set.
+	defaultStreamHandshakeTimeout = 10 * time.Second
+
+	// maxStreamHandshakes is how many accepted connections may be waiting
+	// to say whether they're pooled before the listener stops accepting.
+	maxStreamHandshakes = 64
+)
+
+// streamSession is a TCP connection that carries a series of exchanges.
+type streamSession struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	lastUsed time.Time
+}
+
+// exchange returns a connection for the next exchange on the session. done
+// is called once the exchange has ended, with ok set if the session can
+// carry another one.
+func (s *streamSession) exchange(done func(ok bool)) *pooledConn {
+	return &pooledConn{Conn: s.conn, s: s, done: done}
+}
+
+// pooledConn is one exchange on a streamSession. Closing it ends our half,
+// waits for the peer to end theirs and then releases the session, all in
+// the background.
+type pooledConn struct {
+	net.Conn
+	s    *streamSession
+	done func(ok bool)
+
+	rl        sync.Mutex
+	remaining uint32 // Unread bytes in the current chunk
+	eof       bool   // The peer has ended its half
+
+	wl     sync.Mutex
+	closed bool
+}
+
+// Read reads from the peer's half of the exchange, returning io.EOF once
+// the peer has ended it.
+func (c *pooledConn) Read(b []byte) (int, error) {
+	c.rl.Lock()
+	defer c.rl.Unlock()
+
+	for c.remaining == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.s.r, hdr[:]); err != nil {
+			return 0, err
+		}
+		c.remaining = binary.BigEndian.Uint32(hdr[:])
+		if c.remaining == 0 {
+			c.eof = true
+		}
+	}
+
+	if uint32(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.s.r.Read(b)
+	c.remaining -= uint32(n)
+	return n, err
+}
+
+// Write sends b as a single chunk.
+func (c *pooledConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.wl.Lock()
+	defer c.wl.Unlock()
+	if c.closed {
+		return 0, fmt.Errorf("Write on closed stream")
+	}
+
+	chunk := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(chunk, uint32(len(b)))
+	copy(chunk[4:], b)
+	if _, err := c.Conn.Write(chunk); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ends the exchange. It's safe to call more than once.
+func (c *pooledConn) Close() error {
+	c.wl.Lock()
+	defer c.wl.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	go c.finish()
+	return nil
+}
+
+// finish ends our half of the exchange, skips whatever is left of the
+// peer's half and hands the session back. Both sides may be finishing at
+// once, so the end marker is written while draining.
+func (c *pooledConn) finish() {
+	c.Conn.SetDeadline(time.Now().Add(streamSessionFinishTimeout))
+	errCh := make(chan error, 1)
+	go func() {
+		var end [4]byte
+		_, err := c.Conn.Write(end[:])
+		errCh <- err
+	}()
+	_, readErr := io.Copy(ioutil.Discard, c)
+	if writeErr := <-errCh; readErr != nil || writeErr != nil {
+		c.done(false)
+		return
+	}
+	c.Conn.SetDeadline(time.Time{})
+	c.done(true)
+}
+
+// streamPool keeps idle sessions to each peer for reuse.
+type streamPool struct {
+	size        int
+	idleTimeout time.Duration
+
+	l        sync.Mutex
+	idle     map[string][]*streamSession // Address -> idle sessions, newest last
+	shutdown bool
+}
+
+// newStreamPool returns a pool that keeps up to size idle sessions per peer.
+func newStreamPool(size int, idleTimeout time.Duration) *streamPool {
+	return &streamPool{
+		size:        size,
+		idleTimeout: idleTimeout,
+		idle:        make(map[string][]*streamSession),
+	}
+}
+
+// get returns the most recently used idle session to addr, if there is
+// one that hasn't expired.
+func (p *streamPool) get(addr string) *streamSession {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	sessions := p.idle[addr]
+	for len(sessions) > 0 {
+		s := sessions[len(sessions)-1]
+		sessions = sessions[:len(sessions)-1]
+		if time.Since(s.lastUsed) < p.idleTimeout {
+			p.setIdle(addr, sessions)
+			return s
+		}
+		s.conn.Close()
+	}
+	p.setIdle(addr, sessions)
+	return nil
+}
+
+// put returns a session to the pool, closing it if the peer already has as
+// many idle sessions as allowed.
+func (p *streamPool) put(addr string, s *streamSession) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if p.shutdown || len(p.idle[addr]) >= p.size {
+		s.conn.Close()
+		return
+	}
+	s.lastUsed = time.Now()
+	p.idle[addr] = append(p.idle[addr], s)
+	metrics.IncrCounter([]string{"memberlist", "tcp", "pooled"}, 1)
+}
+
+// setIdle replaces the idle sessions for addr. The lock must be held.
+func (p *streamPool) setIdle(addr string, sessions []*streamSession) {
+	if len(sessions) == 0 {
+		delete(p.idle, addr)
+	} else {
+		p.idle[addr] = sessions
+	}
+}
+
+// reap closes sessions that have been idle too long. Sessions are kept in
+// the order they were returned, so the oldest come first.
+func (p *streamPool) reap() {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	for addr, sessions := range p.idle {
+		i := 0
+		for ; i < len(sessions) && time.Since(sessions[i].lastUsed) >= p.idleTimeout; i++ {
+			sessions[i].conn.Close()
+		}
+		p.setIdle(addr, sessions[i:])
+	}
+}
+
+// close closes every idle session and stops accepting new ones.
+func (p *streamPool) close() {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	p.shutdown = true
+	for addr, sessions := range p.idle {
+		for _, s := range sessions {
+			s.conn.Close()
+		}
+		delete(p.idle, addr)
+	}
+}
+
+// dialPooled returns an exchange on an idle session to addr, or on a new
+// session if there isn't one.
+func (t *NetTransport) dialPooled(addr string, timeout time.Duration) (net.Conn, error) {
+	s := t.pool.get(addr)
+	if s == nil {
+		dialer := net.Dialer{Timeout: timeout}
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if timeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		if _, err := conn.Write([]byte{byte(streamSessionMsg)}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetWriteDeadline(time.Time{})
+		s = &streamSession{conn: conn, r: bufio.NewReader(conn)}
+	}
+
+	return s.exchange(func(ok bool) {
+		if ok {
+			t.pool.put(addr, s)
+		} else {
+			s.conn.Close()
+		}
+	}), nil
+}
+
+// reapPool is a long running goroutine that closes expired idle sessions.
+func (t *NetTransport) reapPool() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.pool.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.pool.reap()
+		case <-t.shutdownCh:
+			t.pool.close()
+			return
+		}
+	}
+}
+
+// acceptStream works out whether an accepted connection is a session and
+// hands it off accordingly. It's only used while pooling is enabled, and
+// frees the connection's handshake slot once its first byte is in.
+func (t *NetTransport) acceptStream(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(t.handshakeTimeout()))
+	peek, err := r.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	<-t.handshakes
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if messageType(peek[0]) != streamSessionMsg {
+		t.handOff(&bufferedConn{Conn: conn, r: r})
+		return
+	}
+	r.Discard(1)
+	t.serveSession(&streamSession{conn: conn, r: r})
+}
+
+// serveSession hands each exchange on a session to the stream channel in
+// turn, until the dialer closes it or leaves it idle for too long.
+func (t *NetTransport) serveSession(s *streamSession) {
+	t.sessionLock.Lock()
+	if atomic.LoadInt32(&t.shutdown) == 1 {
+		t.sessionLock.Unlock()
+		s.conn.Close()
+		return
+	}
+	t.sessions[s] = struct{}{}
+	t.sessionLock.Unlock()
+
+	defer func() {
+		t.sessionLock.Lock()
+		delete(t.sessions, s)
+		t.sessionLock.Unlock()
+		s.conn.Close()
+	}()
+
+	done := make(chan bool, 1)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(t.sessionIdleTimeout()))
+		if _, err := s.r.Peek(1); err != nil {
+			return
+		}
+		s.conn.SetReadDeadline(time.Time{})
+
+		if !t.handOff(s.exchange(func(ok bool) { done <- ok })) {
+			return
+		}
+		select {
+		case ok := <-done:
+			if !ok {
+				return
+			}
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
+
+// handOff passes a connection to the stream channel, returning false if
+// the transport shut down first.
+func (t *NetTransport) handOff(conn net.Conn) bool {
+	select {
+	case t.streamCh <- conn:
+		return true
+	case <-t.shutdownCh:
+		conn.Close()
+		return false
+	}
+}
+
+// sessionIdleTimeout is how long an accepted session may sit idle. It's
+// longer than the dialer's idle timeout, so that the dialer is the one to
+// close it and never picks a session we've given up on.
+func (t *NetTransport) sessionIdleTimeout() time.Duration {
+	timeout := t.config.StreamIdleTimeout
+	if timeout <= 0 {
+		timeout = defaultStreamIdleTimeout
+	}
+	return 2 * timeout
+}
+
+// handshakeTimeout is how long an accepted connection may take to say
+// whether it's pooled.
+func (t *NetTransport) handshakeTimeout() time.Duration {
+	if t.config.TCPTimeout > 0 {
+		return t.config.TCPTimeout
+	}
+	return defaultStreamHandshakeTimeout
+}
@@ -0,0 +1,187 @@
+package memberlist
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// defaultUDPBatchSize is used when UDPBatchSize isn't set.
+const defaultUDPBatchSize = 16
+
+// udpMsg is one packet in a batch that's read or written with a single
+// system call.
+type udpMsg struct {
+	buf  []byte       // Buffer to read into, or the packet to write
+	n    int          // Number of bytes read
+	addr *net.UDPAddr // Source or destination address
+}
+
+// udpBatchSize returns the configured batch size, with the default applied.
+func (t *NetTransport) udpBatchSize() int {
+	if t.config.UDPBatchSize <= 0 {
+		return defaultUDPBatchSize
+	}
+	return t.config.UDPBatchSize
+}
+
+// udpReaders returns how many UDP sockets to bind to each address.
+func (t *NetTransport) udpReaders() int {
+	if t.config.UDPReaders <= 1 || !udpReusePort {
+		return 1
+	}
+	return t.config.UDPReaders
+}
+
+// udpListen is a long running goroutine that accepts incoming UDP packets and
+// hands them off to the packet channel. Packets are read in batches where the
+// platform supports it, into buffers that are reused for every read, and
+// only the bytes of each packet are copied out.
+func (t *NetTransport) udpListen(udpLn *net.UDPConn) {
+	defer t.wg.Done()
+
+	msgs := make([]udpMsg, t.udpBatchSize())
+	for i := range msgs {
+		msgs[i].buf = make([]byte, udpPacketBufSize)
+	}
+	bc, err := newUDPBatchConn(udpLn, len(msgs))
+	if err != nil {
+		// The socket is closed if we were shut down before we started.
+		if s := atomic.LoadInt32(&t.shutdown); s == 0 {
+			t.logger.Printf("[ERR] memberlist: Failed to start UDP listener: %v", err)
+		}
+		return
+	}
+
+	for {
+		// Do a blocking read into the batch. Grab a time stamp as close
+		// as possible to the I/O.
+		n, err := bc.readBatch(msgs)
+		ts := time.Now()
+		if err != nil {
+			if s := atomic.LoadInt32(&t.shutdown); s == 1 {
+				break
+			}
+
+			t.logger.Printf("[ERR] memberlist: Error reading UDP packet: %v", err)
+			continue
+		}
+
+		for _, msg := range msgs[:n] {
+			// Check the length - it needs to have at least one byte
+			// to be a proper message.
+			if msg.n < 1 {
+				t.logger.Printf("[ERR] memberlist: UDP packet too short (%d bytes) %s",
+					msg.n, LogAddress(msg.addr))
+				continue
+			}
+
+			// Ingest the packet.
+			buf := make([]byte, msg.n)
+			copy(buf, msg.buf)
+			metrics.IncrCounter([]string{"memberlist", "udp", "received"}, float32(msg.n))
+			select {
+			case t.packetCh <- &Packet{
+				Buf:       buf,
+				From:      msg.addr,
+				Timestamp: ts,
+			}:
+			case <-t.shutdownCh:
+				return
+			}
+		}
+	}
+}
+
+// udpWrite is a packet waiting to be sent by a udpBatchWriter.
+type udpWrite struct {
+	msg  udpMsg
+	done chan error
+}
+
+// udpBatchWriter combines packets written at the same time from different
+// goroutines into batches. There's no goroutine of its own: whoever writes
+// when nothing is being sent sends its packet with a plain write, then sends
+// whatever queued up behind it in batches. A lone writer pays no more than
+// it would without batching.
+type udpBatchWriter struct {
+	conn *net.UDPConn
+	bc   *udpBatchConn
+	msgs []udpMsg
+
+	l        sync.Mutex
+	pending  []*udpWrite
+	flushing bool
+}
+
+// newUDPBatchWriter returns a writer that sends up to size packets at a time
+// on conn.
+func newUDPBatchWriter(conn *net.UDPConn, size int) (*udpBatchWriter, error) {
+	bc, err := newUDPBatchConn(conn, size)
+	if err != nil {
+		return nil, err
+	}
+	return &udpBatchWriter{conn: conn, bc: bc, msgs: make([]udpMsg, size)}, nil
+}
+
+// writeTo sends b to addr, returning once it's been handed to the kernel.
+func (w *udpBatchWriter) writeTo(b []byte, addr *net.UDPAddr) error {
+	w.l.Lock()
+	if w.flushing {
+		req := &udpWrite{msg: udpMsg{buf: b, addr: addr}, done: make(chan error, 1)}
+		w.pending = append(w.pending, req)
+		w.l.Unlock()
+		return <-req.done
+	}
+	w.flushing = true
+	w.l.Unlock()
+
+	// Nobody else is writing, so send ours straight away and then take
+	// care of anything that queued up behind it.
+	_, err := w.conn.WriteToUDP(b, addr)
+
+	w.l.Lock()
+	for len(w.pending) > 0 {
+		batch := w.pending
+		if len(batch) > len(w.msgs) {
+			batch = batch[:len(w.msgs)]
+		}
+		w.pending = w.pending[len(batch):]
+		w.l.Unlock()
+		w.send(batch)
+		w.l.Lock()
+	}
+	w.pending = nil
+	w.flushing = false
+	w.l.Unlock()
+	return err
+}
+
+// send writes a batch, retrying after any packet that fails so that one bad
+// destination doesn't hold up the rest.
+func (w *udpBatchWriter) send(batch []*udpWrite) {
+	for len(batch) > 0 {
+		msgs := w.msgs[:len(batch)]
+		for i, req := range batch {
+			msgs[i] = req.msg
+		}
+
+		n, err := w.bc.writeBatch(msgs)
+		for _, req := range batch[:n] {
+			req.done <- nil
+		}
+		batch = batch[n:]
+		if err != nil && len(batch) > 0 {
+			batch[0].done <- err
+			batch = batch[1:]
+		}
+	}
+
+	// Don't hold on to the packets until the next batch.
+	for i := range w.msgs {
+		w.msgs[i] = udpMsg{}
+	}
+}
@@ -0,0 +1,359 @@
+//go:build linux
+// +build linux
+
+package memberlist
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// udpBatching is set where a batch of packets is read or written with one
+// system call, using recvmmsg and sendmmsg.
+const udpBatching = true
+
+// udpReusePort is set where several sockets can share a UDP port, with the
+// kernel spreading incoming packets across them.
+const udpReusePort = true
+
+// listenUDPSocket binds a UDP socket to addr, allowing other sockets to bind
+// the same port if reusePort is set.
+func listenUDPSocket(addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	if !reusePort {
+		return net.ListenUDP("udp", addr)
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// WriteToDontFragment sends a packet with the don't fragment bit set. See
+// DontFragmentTransport.
+//
+// The packet goes out of a separate socket, so the setting doesn't change
+// how we send anything else. Replies to it are read like any other packet.
+func (t *NetTransport) WriteToDontFragment(b []byte, addr string) (time.Time, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	conn, err := t.dontFragmentConn()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// The kernel refuses packets bigger than the path MTU it knows about,
+	// which is the same as the packet getting dropped along the way.
+	_, err = conn.WriteTo(b, udpAddr)
+	if isMsgSize(err) {
+		err = nil
+	}
+	return time.Now(), err
+}
+
+// dontFragmentConn returns the socket for WriteToDontFragment, opening it and
+// starting a listener for it the first time through.
+func (t *NetTransport) dontFragmentConn() (*net.UDPConn, error) {
+	t.dfLock.Lock()
+	defer t.dfLock.Unlock()
+
+	if t.dfConn != nil {
+		return t.dfConn, nil
+	}
+	if s := atomic.LoadInt32(&t.shutdown); s == 1 {
+		return nil, fmt.Errorf("Transport is shut down")
+	}
+
+	// Bind to the same IP as our main listener so packets take the same
+	// path, but let the kernel pick the port.
+	ip := t.udpListeners[0].LocalAddr().(*net.UDPAddr).IP
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return nil, err
+	}
+	if err := setDontFragment(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to set don't fragment: %v", err)
+	}
+
+	t.dfConn = conn
+	t.wg.Add(1)
+	go t.udpListen(conn)
+	return conn, nil
+}
+
+// setDontFragment turns on path MTU discovery for a UDP socket, which sets
+// the don't fragment bit on everything it sends.
+func setDontFragment(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var operr error
+	if cerr := rc.Control(func(fd uintptr) {
+		var family int
+		family, operr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if operr != nil {
+			return
+		}
+
+		// A dual stack socket needs both, the IPv4 one covers packets
+		// to mapped IPv4 addresses.
+		operr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+		if operr == nil && family == unix.AF_INET6 {
+			operr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return operr
+}
+
+// isMsgSize returns true if err is from a packet that's too big to send
+// without fragmenting it.
+func isMsgSize(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == unix.EMSGSIZE
+}
+
+// mmsghdr matches struct mmsghdr from <sys/socket.h>.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// udpBatchConn reads or writes batches of packets on a UDP socket. The
+// headers are kept between calls, so it must only be used from one goroutine
+// at a time.
+type udpBatchConn struct {
+	rc     syscall.RawConn
+	family int
+	hdrs   []mmsghdr
+	iovs   []unix.Iovec
+	names  []unix.RawSockaddrAny
+}
+
+// newUDPBatchConn returns a udpBatchConn for batches of up to size packets.
+func newUDPBatchConn(conn *net.UDPConn, size int) (*udpBatchConn, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	// An unspecified bind address gets a dual stack IPv6 socket, so the
+	// address family has to come from the socket itself.
+	var family int
+	if cerr := rc.Control(func(fd uintptr) {
+		family, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+	}); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bc := &udpBatchConn{
+		rc:     rc,
+		family: family,
+		hdrs:   make([]mmsghdr, size),
+		iovs:   make([]unix.Iovec, size),
+		names:  make([]unix.RawSockaddrAny, size),
+	}
+	for i := range bc.hdrs {
+		bc.hdrs[i].hdr.Iov = &bc.iovs[i]
+		bc.hdrs[i].hdr.Iovlen = 1
+		bc.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&bc.names[i]))
+	}
+	return bc, nil
+}
+
+// readBatch blocks until at least one packet arrives, then reads as many as
+// are waiting into msgs, up to the batch size. It returns the number read.
+func (bc *udpBatchConn) readBatch(msgs []udpMsg) (int, error) {
+	if len(msgs) > len(bc.hdrs) {
+		msgs = msgs[:len(bc.hdrs)]
+	}
+	for i := range msgs {
+		bc.setBuf(i, msgs[i].buf)
+		bc.hdrs[i].hdr.Namelen = unix.SizeofSockaddrAny
+		bc.hdrs[i].hdr.Flags = 0
+		bc.hdrs[i].len = 0
+	}
+
+	n, err := bc.mmsg(unix.SYS_RECVMMSG, len(msgs), bc.rc.Read)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range msgs[:n] {
+		msgs[i].n = int(bc.hdrs[i].len)
+		if bc.hdrs[i].hdr.Flags&unix.MSG_TRUNC != 0 {
+			// Can't happen with buffers as big as the largest
+			// datagram, but don't hand on a partial packet.
+			msgs[i].n = 0
+		}
+		msgs[i].addr = bc.udpAddr(i)
+	}
+	return n, nil
+}
+
+// writeBatch sends as many of msgs as it can, up to the batch size. It
+// returns the number sent, and an error if msgs[n] couldn't be.
+func (bc *udpBatchConn) writeBatch(msgs []udpMsg) (int, error) {
+	if len(msgs) > len(bc.hdrs) {
+		msgs = msgs[:len(bc.hdrs)]
+	}
+	for i, msg := range msgs {
+		namelen, err := bc.setAddr(i, msg.addr)
+		if err != nil {
+			if i == 0 {
+				return 0, err
+			}
+
+			// Send what's before it, the caller will come back to
+			// it.
+			msgs = msgs[:i]
+			break
+		}
+		bc.setBuf(i, msg.buf)
+		bc.hdrs[i].hdr.Namelen = namelen
+		bc.hdrs[i].hdr.Flags = 0
+		bc.hdrs[i].len = 0
+	}
+
+	return bc.mmsg(unix.SYS_SENDMMSG, len(msgs), bc.rc.Write)
+}
+
+// mmsg makes a recvmmsg or sendmmsg call for the first n headers, waiting
+// for the socket to be ready if need be.
+func (bc *udpBatchConn) mmsg(trap uintptr, n int, wait func(func(uintptr) bool) error) (int, error) {
+	var done int
+	var operr error
+	err := wait(func(fd uintptr) bool {
+		r, _, errno := unix.Syscall6(trap, fd, uintptr(unsafe.Pointer(&bc.hdrs[0])), uintptr(n), 0, 0, 0)
+		if errno == unix.EAGAIN {
+			return false
+		}
+		if errno != 0 {
+			operr = errno
+		} else {
+			done = int(r)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if operr != nil {
+		name := "recvmmsg"
+		if trap == unix.SYS_SENDMMSG {
+			name = "sendmmsg"
+		}
+		return 0, &net.OpError{Op: name, Net: "udp", Err: operr}
+	}
+	return done, nil
+}
+
+// setBuf points header i at buf.
+func (bc *udpBatchConn) setBuf(i int, buf []byte) {
+	if len(buf) == 0 {
+		bc.iovs[i].Base = nil
+	} else {
+		bc.iovs[i].Base = &buf[0]
+	}
+	bc.iovs[i].SetLen(len(buf))
+}
+
+// setAddr stores addr as the destination for header i, mapping IPv4
+// addresses into IPv6 on a dual stack socket. It returns the address length.
+func (bc *udpBatchConn) setAddr(i int, addr *net.UDPAddr) (uint32, error) {
+	name := unsafe.Pointer(&bc.names[i])
+	port := [2]byte{byte(addr.Port >> 8), byte(addr.Port)}
+
+	switch bc.family {
+	case unix.AF_INET:
+		ip := addr.IP.To4()
+		if ip == nil {
+			return 0, fmt.Errorf("Can't send to %s from an IPv4 socket", addr)
+		}
+		sa := (*unix.RawSockaddrInet4)(name)
+		*sa = unix.RawSockaddrInet4{Family: unix.AF_INET}
+		*(*[2]byte)(unsafe.Pointer(&sa.Port)) = port
+		copy(sa.Addr[:], ip)
+		return unix.SizeofSockaddrInet4, nil
+
+	case unix.AF_INET6:
+		ip := addr.IP.To16()
+		if ip == nil {
+			return 0, fmt.Errorf("Invalid address %s", addr)
+		}
+		sa := (*unix.RawSockaddrInet6)(name)
+		*sa = unix.RawSockaddrInet6{Family: unix.AF_INET6}
+		*(*[2]byte)(unsafe.Pointer(&sa.Port)) = port
+		copy(sa.Addr[:], ip)
+		if addr.Zone != "" {
+			if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+				sa.Scope_id = uint32(ifi.Index)
+			} else if n, err := strconv.Atoi(addr.Zone); err == nil {
+				sa.Scope_id = uint32(n)
+			}
+		}
+		return unix.SizeofSockaddrInet6, nil
+	}
+	return 0, fmt.Errorf("Unsupported address family %d", bc.family)
+}
+
+// udpAddr returns the source address for header i.
+func (bc *udpBatchConn) udpAddr(i int) *net.UDPAddr {
+	name := unsafe.Pointer(&bc.names[i])
+	switch bc.names[i].Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(name)
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(name)
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		addr := &net.UDPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+		if sa.Scope_id != 0 {
+			addr.Zone = strconv.Itoa(int(sa.Scope_id))
+		}
+		return addr
+	}
+	return &net.UDPAddr{}
+}
@@ -0,0 +1,55 @@
+//go:build !linux
+// +build !linux
+
+package memberlist
+
+import (
+	"fmt"
+	"net"
+)
+
+// udpBatching is set where a batch of packets is read or written with one
+// system call. Elsewhere packets are handled one at a time.
+const udpBatching = false
+
+// udpReusePort is set where several sockets can share a UDP port, with the
+// kernel spreading incoming packets across them.
+const udpReusePort = false
+
+// listenUDPSocket binds a UDP socket to addr. Sharing the port isn't
+// supported.
+func listenUDPSocket(addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	if reusePort {
+		return nil, fmt.Errorf("Sharing a UDP port isn't supported on this platform")
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+// udpBatchConn reads or writes packets on a UDP socket one at a time.
+type udpBatchConn struct {
+	conn *net.UDPConn
+}
+
+// newUDPBatchConn returns a udpBatchConn. The batch size is ignored.
+func newUDPBatchConn(conn *net.UDPConn, size int) (*udpBatchConn, error) {
+	return &udpBatchConn{conn: conn}, nil
+}
+
+// readBatch blocks until a packet arrives and reads it into msgs[0].
+func (bc *udpBatchConn) readBatch(msgs []udpMsg) (int, error) {
+	n, addr, err := bc.conn.ReadFromUDP(msgs[0].buf)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].n = n
+	msgs[0].addr = addr
+	return 1, nil
+}
+
+// writeBatch sends msgs[0].
+func (bc *udpBatchConn) writeBatch(msgs []udpMsg) (int, error) {
+	if _, err := bc.conn.WriteToUDP(msgs[0].buf, msgs[0].addr); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
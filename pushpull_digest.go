@@ -0,0 +1,258 @@
+package memberlist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+const (
+	// digestNodesPerBucket is roughly how many nodes share a digest bucket.
+	// Fewer nodes per bucket means a bigger digest but less state sent for
+	// each difference.
+	digestNodesPerBucket = 8
+
+	// maxDigestBuckets bounds the size of a digest, both the ones we send
+	// and the ones we accept.
+	maxDigestBuckets = 1024
+)
+
+// pushPullDigest starts a digest based push/pull. Instead of sending every
+// node's state, the initiator sends a hash of the name, incarnation and
+// state of the nodes in each bucket, and only the nodes in buckets that
+// differ are exchanged.
+//
+// The responder answers with a pushPullDiffMsg listing the differing
+// buckets, followed by its nodes in those buckets and its user state. The
+// initiator merges that as it reads it, then sends its own pushPullDiffMsg
+// with its nodes in the same buckets and its user state, which the
+// responder merges in turn.
+type pushPullDigest struct {
+	Buckets []uint64
+
+	// Compression algorithms the sender can decode, and whether it can
+	// read chunked compression, as in pushPullHeader.
+	Compression []compressionType `codec:",omitempty"`
+	Stream      bool              `codec:",omitempty"`
+}
+
+// digestBuckets returns the number of buckets to use for a digest of the
+// given number of nodes. This is always a power of two.
+func digestBuckets(n int) int {
+	b := 1
+	for b*digestNodesPerBucket < n && b < maxDigestBuckets {
+		b <<= 1
+	}
+	return b
+}
+
+// digestBucket returns the bucket a node belongs to.
+func digestBucket(name string, buckets int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(buckets))
+}
+
+// digestNodeHash hashes the parts of a node's state that change whenever
+// it would need to be sent to a peer. Anything else, like the meta data or
+// the address, only changes along with the incarnation.
+func digestNodeHash(n *nodeState) uint64 {
+	var buf [9]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(n.Incarnation))
+	buf[8] = byte(n.State)
+
+	h := fnv.New64a()
+	h.Write([]byte(n.Name))
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+// stateDigest returns a digest of our node states with the given number of
+// buckets. The nodes in a bucket are combined with XOR, so the order they
+// are in doesn't matter.
+func (m *Memberlist) stateDigest(buckets int) []uint64 {
+	digest := make([]uint64, buckets)
+
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	for _, n := range m.nodes {
+		digest[digestBucket(n.Name, buckets)] ^= digestNodeHash(n)
+	}
+	return digest
+}
+
+// supportsDigest returns true if the node at the given address understands
+// digest based push/pull.
+func (m *Memberlist) supportsDigest(addr string) bool {
+	return m.protocolMaxForAddr(addr) >= 6
+}
+
+// protocolMaxForAddr returns the highest protocol version understood by the
+// node at the given address, or zero if we don't know it.
+func (m *Memberlist) protocolMaxForAddr(addr string) uint8 {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	for _, n := range m.nodes {
+		if n.Address() == addr {
+			return n.PMax
+		}
+	}
+	return 0
+}
+
+// sendDiffState sends our nodes in the given digest buckets, along with our
+// user state.
+func (m *Memberlist) sendDiffState(conn net.Conn, buckets []int, numBuckets int, algo compressionType, stream bool) error {
+	want := make(map[int]struct{}, len(buckets))
+	for _, b := range buckets {
+		want[b] = struct{}{}
+	}
+
+	header := pushPullHeader{
+		Compression: m.compression,
+		Buckets:     buckets,
+		Stream:      true,
+	}
+	return m.sendState(conn, pushPullDiffMsg, &header, func(n *nodeState) bool {
+		_, ok := want[digestBucket(n.Name, numBuckets)]
+		return ok
+	}, algo, stream)
+}
+
+// readDiffState reads a pushPullDiffMsg for a digest with the given number
+// of buckets, merging each node as it's read, and handling an error reply
+// from the remote side.
+func (m *Memberlist) readDiffState(conn net.Conn, numBuckets int) (*pushPullHeader, error) {
+	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
+	msgType, bufConn, dec, err := m.readStream(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if msgType == errMsg {
+		var resp errResp
+		if err := dec.Decode(&resp); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("remote error: %v", resp.Error)
+	}
+
+	if msgType != pushPullDiffMsg {
+		err := fmt.Errorf("received invalid msgType (%d), expected pushPullDiffMsg (%d) %s", msgType, pushPullDiffMsg, LogConn(conn))
+		return nil, err
+	}
+
+	header, err := m.readRemoteHeader(dec)
+	if err != nil {
+		return nil, err
+	}
+	sent, err := diffBuckets(header, numBuckets)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only nodes from buckets that differ should have been sent
+	err = m.streamRemoteState(header, bufConn, dec, func(n *pushNodeState) error {
+		if _, ok := sent[digestBucket(n.Name, numBuckets)]; !ok {
+			return fmt.Errorf("node %s isn't in a differing digest bucket", n.Name)
+		}
+		return nil
+	})
+	return header, err
+}
+
+// diffBuckets returns the set of buckets a pushPullDiffMsg says differ,
+// making sure they are valid.
+func diffBuckets(header *pushPullHeader, numBuckets int) (map[int]struct{}, error) {
+	sent := make(map[int]struct{}, len(header.Buckets))
+	for _, b := range header.Buckets {
+		if b < 0 || b >= numBuckets {
+			return nil, fmt.Errorf("invalid digest bucket %d of %d", b, numBuckets)
+		}
+		sent[b] = struct{}{}
+	}
+	return sent, nil
+}
+
+// pushPullDigestNode does a digest based push/pull with a remote host. This
+// is never used for joins, which always exchange the full state.
+func (m *Memberlist) pushPullDigestNode(addr string) error {
+	defer metrics.MeasureSince([]string{"memberlist", "pushPullDigestNode"}, time.Now())
+
+	conn, err := m.dialStream(addr, m.config.TCPTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	m.logger.Printf("[DEBUG] memberlist: Initiating digest push/pull sync with: %s", conn.RemoteAddr())
+	metrics.IncrCounter([]string{"memberlist", "tcp", "connect"}, 1)
+
+	// Send our digest
+	numBuckets := digestBuckets(m.estNumNodes())
+	digest := pushPullDigest{
+		Buckets:     m.stateDigest(numBuckets),
+		Compression: m.compression,
+		Stream:      true,
+	}
+	out, err := encode(pushPullDigestMsg, &digest)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
+	algo := m.compressionForAddr(addr)
+	if err := m.rawSendMsgStream(conn, out.Bytes(), algo); err != nil {
+		return err
+	}
+
+	// Read back the differences
+	header, err := m.readDiffState(conn, numBuckets)
+	if err != nil {
+		return err
+	}
+	metrics.AddSample([]string{"memberlist", "pushPull", "digestDiff"}, float32(len(header.Buckets)))
+
+	// Send our side of them
+	stream := m.protocolMaxForAddr(addr) >= 7
+	return m.sendDiffState(conn, header.Buckets, numBuckets, algo, stream)
+}
+
+// handlePushPullDigest answers a digest based push/pull started by a remote
+// host.
+func (m *Memberlist) handlePushPullDigest(conn net.Conn, dec *codec.Decoder) error {
+	var digest pushPullDigest
+	if err := dec.Decode(&digest); err != nil {
+		return err
+	}
+
+	numBuckets := len(digest.Buckets)
+	if numBuckets == 0 || numBuckets > maxDigestBuckets {
+		return fmt.Errorf("invalid digest with %d buckets", numBuckets)
+	}
+
+	// Find the buckets that differ
+	local := m.stateDigest(numBuckets)
+	var diff []int
+	for i, h := range local {
+		if h != digest.Buckets[i] {
+			diff = append(diff, i)
+		}
+	}
+
+	// Reply with our side of them, with an algorithm the initiator told us
+	// it can decode
+	algo := m.pickCompression(digest.Compression)
+	if err := m.sendDiffState(conn, diff, numBuckets, algo, digest.Stream); err != nil {
+		return err
+	}
+
+	// Read and merge the initiator's side
+	_, err := m.readDiffState(conn, numBuckets)
+	return err
+}
@@ -0,0 +1,133 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestBuckets(t *testing.T) {
+	require.Equal(t, 1, digestBuckets(0))
+	require.Equal(t, 1, digestBuckets(8))
+	require.Equal(t, 2, digestBuckets(9))
+	require.Equal(t, 64, digestBuckets(500))
+	require.Equal(t, maxDigestBuckets, digestBuckets(1000000))
+}
+
+func TestMemberlist_stateDigest(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	for i := 0; i < 20; i++ {
+		a := alive{Node: fmt.Sprintf("node%d", i), Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+		m.aliveNode(&a, nil, false)
+	}
+	before := m.stateDigest(4)
+	require.Equal(t, before, m.stateDigest(4))
+
+	// Only the bucket of the node that changed should differ.
+	a := alive{Node: "node3", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 2, Vsn: m.config.BuildVsnArray()}
+	m.aliveNode(&a, nil, false)
+	after := m.stateDigest(4)
+	for i := range before {
+		if i == digestBucket("node3", 4) {
+			require.NotEqual(t, before[i], after[i])
+		} else {
+			require.Equal(t, before[i], after[i])
+		}
+	}
+}
+
+func TestMemberlist_PushPullDigest(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.GossipInterval = 10 * time.Second
+		c.ProbeInterval = 10 * time.Second
+		c.PushPullInterval = 0
+	})
+	defer m1.Shutdown()
+
+	bindPort := m1.config.BindPort
+
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.BindPort = bindPort
+		c.GossipInterval = 10 * time.Second
+		c.ProbeInterval = 10 * time.Second
+		c.PushPullInterval = 0
+	})
+	defer m2.Shutdown()
+
+	// Both sides know about each other and a bunch of other nodes.
+	for _, m := range []*Memberlist{m1, m2} {
+		a1 := alive{Node: addr1.String(), Addr: ip1, Port: uint16(bindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+		m.aliveNode(&a1, nil, m == m1)
+		a2 := alive{Node: addr2.String(), Addr: ip2, Port: uint16(bindPort), Incarnation: 1, Vsn: m2.config.BuildVsnArray()}
+		m.aliveNode(&a2, nil, m == m2)
+		for i := 0; i < 40; i++ {
+			a := alive{Node: fmt.Sprintf("node%d", i), Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m.config.BuildVsnArray()}
+			m.aliveNode(&a, nil, false)
+		}
+	}
+
+	// Each side has one node the other hasn't heard of.
+	a := alive{Node: "only1", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a, nil, false)
+	a = alive{Node: "only2", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m2.config.BuildVsnArray()}
+	m2.aliveNode(&a, nil, false)
+
+	addr := net.JoinHostPort(addr2.String(), fmt.Sprintf("%d", bindPort))
+	require.True(t, m1.supportsDigest(addr))
+
+	// Start an exchange by hand to see what m2 answers with.
+	numBuckets := digestBuckets(m1.estNumNodes())
+	require.True(t, numBuckets > 1)
+
+	conn, err := m1.dialStream(addr, m1.config.TCPTimeout)
+	require.NoError(t, err)
+	out, err := encode(pushPullDigestMsg, &pushPullDigest{Buckets: m1.stateDigest(numBuckets)})
+	require.NoError(t, err)
+	require.NoError(t, m1.rawSendMsgStream(conn, out.Bytes(), lzwAlgo))
+
+	header, err := m1.readDiffState(conn, numBuckets)
+	require.NoError(t, err)
+	conn.Close()
+
+	require.True(t, header.Nodes < m2.estNumNodes(), "sent %d of %d nodes", header.Nodes, m2.estNumNodes())
+	require.True(t, len(header.Buckets) <= 2, "expected at most 2 differing buckets, got %v", header.Buckets)
+	m1.nodeLock.RLock()
+	_, ok := m1.nodeMap["only2"]
+	m1.nodeLock.RUnlock()
+	require.True(t, ok, "expected m2's node to be merged as it was read")
+
+	// A full digest push/pull brings m2 up to date too.
+	require.NoError(t, m1.pushPullNode(addr, false))
+	retry(t, 10, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+		m2.nodeLock.RLock()
+		_, ok := m2.nodeMap["only1"]
+		m2.nodeLock.RUnlock()
+		if !ok {
+			failf("expected m2 to learn m1's node")
+		}
+	})
+	require.Equal(t, m1.stateDigest(numBuckets), m2.stateDigest(numBuckets))
+}
+
+func TestMemberlist_supportsDigest_OldPeer(t *testing.T) {
+	m := GetMemberlist(t, nil)
+	defer m.Shutdown()
+
+	vsn := m.config.BuildVsnArray()
+	vsn[1] = 5
+	a := alive{Node: "old", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: vsn}
+	m.aliveNode(&a, nil, false)
+
+	require.False(t, m.supportsDigest("127.0.0.1:7946"))
+	require.False(t, m.supportsDigest("127.0.0.1:7947"))
+}
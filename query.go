@@ -0,0 +1,508 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// querySeenPruneInterval bounds how often remembered query IDs are swept.
+const querySeenPruneInterval = time.Second
+
+// queryReq is flooded through the gossip layer to ask the cluster something.
+// Responses go straight back to Addr and Port.
+type queryReq struct {
+	ID          uint32
+	Origin      string
+	Addr        []byte
+	Port        uint16
+	Name        string
+	Payload     []byte
+	Timeout     time.Duration
+	FilterNodes []string `codec:",omitempty"` // Empty selects every node
+	RequestAck  bool     `codec:",omitempty"`
+}
+
+// queryResp is sent directly to the origin of a query, over a packet if it
+// fits and over a stream otherwise.
+type queryResp struct {
+	ID      uint32
+	From    string
+	Ack     bool   `codec:",omitempty"`
+	Payload []byte `codec:",omitempty"`
+}
+
+// queryKey identifies a query across the cluster.
+type queryKey struct {
+	origin string
+	id     uint32
+}
+
+// queryBroadcast carries a query through the broadcast queue. Every query is
+// distinct, so it never invalidates anything.
+type queryBroadcast struct {
+	msg []byte
+}
+
+func (b *queryBroadcast) Invalidates(other Broadcast) bool {
+	return false
+}
+
+// memberlist.UniqueBroadcast optional interface
+func (b *queryBroadcast) UniqueBroadcast() {}
+
+func (b *queryBroadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *queryBroadcast) Finished() {}
+
+// QueryParams controls how a query is sent. A nil *QueryParams uses the
+// defaults: every node is asked, no acks are requested and the timeout is
+// derived from Config.QueryTimeoutMult.
+type QueryParams struct {
+	// FilterNodes, if set, restricts the query to the named nodes.
+	FilterNodes []string
+
+	// FilterMeta, if set, restricts the query to the alive nodes whose
+	// meta data it returns true for. It is evaluated locally against our
+	// view of the cluster when the query is sent, and combines with
+	// FilterNodes if both are set.
+	FilterMeta func(meta []byte) bool
+
+	// RequestAck asks every selected node to acknowledge receipt of the
+	// query, whether or not it responds.
+	RequestAck bool
+
+	// Timeout is how long to wait for responses. Zero uses the default.
+	// Other members cap it at their own default when deciding how long to
+	// answer, so a longer timeout only helps with slow local processing.
+	Timeout time.Duration
+}
+
+// NodeResponse is a single response to a query.
+type NodeResponse struct {
+	From    string
+	Payload []byte
+}
+
+// QueryResponse collects the acks and responses to a query until its
+// deadline, after which both channels are closed.
+type QueryResponse struct {
+	m        *Memberlist
+	id       uint32
+	deadline time.Time
+	timer    Timer
+
+	ackCh  chan string
+	respCh chan NodeResponse
+
+	l         sync.Mutex
+	closed    bool
+	acks      map[string]struct{}
+	responses map[string]struct{}
+}
+
+// AckCh returns a channel that receives the name of each node that acked
+// the query. It's nil unless acks were requested.
+func (r *QueryResponse) AckCh() <-chan string {
+	return r.ackCh
+}
+
+// ResponseCh returns a channel that receives each node's response.
+func (r *QueryResponse) ResponseCh() <-chan NodeResponse {
+	return r.respCh
+}
+
+// Deadline returns when the query stops accepting responses.
+func (r *QueryResponse) Deadline() time.Time {
+	return r.deadline
+}
+
+// Finished returns true once the deadline has passed or Close was called.
+func (r *QueryResponse) Finished() bool {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.closed
+}
+
+// Close stops waiting for responses before the deadline and closes the
+// channels. It is safe to call more than once.
+func (r *QueryResponse) Close() {
+	r.m.queryLock.Lock()
+	delete(r.m.queries, r.id)
+	r.m.queryLock.Unlock()
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.timer.Stop()
+	if r.ackCh != nil {
+		close(r.ackCh)
+	}
+	close(r.respCh)
+}
+
+// deliver hands an ack or response to the caller. Only the first of each
+// from a given node is kept, and anything that arrives after the deadline
+// or with the channel full is dropped.
+func (r *QueryResponse) deliver(resp *queryResp) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.closed {
+		return
+	}
+
+	if resp.Ack {
+		if r.ackCh == nil {
+			return
+		}
+		if _, ok := r.acks[resp.From]; ok {
+			return
+		}
+		select {
+		case r.ackCh <- resp.From:
+			r.acks[resp.From] = struct{}{}
+		default:
+			metrics.IncrCounter([]string{"memberlist", "query", "dropped"}, 1)
+		}
+		return
+	}
+
+	if _, ok := r.responses[resp.From]; ok {
+		return
+	}
+	select {
+	case r.respCh <- NodeResponse{From: resp.From, Payload: resp.Payload}:
+		r.responses[resp.From] = struct{}{}
+	default:
+		metrics.IncrCounter([]string{"memberlist", "query", "dropped"}, 1)
+	}
+}
+
+// Query is a query as seen by a QueryDelegate.
+type Query struct {
+	// Name and Payload are what the sender passed to Memberlist.Query.
+	Name    string
+	Payload []byte
+
+	// From is the name of the node that sent the query.
+	From string
+
+	m        *Memberlist
+	id       uint32
+	addr     string
+	deadline time.Time
+
+	l         sync.Mutex
+	responded bool
+}
+
+// Deadline returns when the sender stops accepting responses.
+func (q *Query) Deadline() time.Time {
+	return q.deadline
+}
+
+// Respond sends a response back to the node that sent the query. Only one
+// response is allowed, and it must be made before the deadline.
+func (q *Query) Respond(buf []byte) error {
+	q.l.Lock()
+	defer q.l.Unlock()
+	if q.responded {
+		return fmt.Errorf("Query already has a response")
+	}
+	if q.m.clock.Now().After(q.deadline) {
+		return fmt.Errorf("Query deadline has passed")
+	}
+	if len(buf) > q.m.config.QueryResponseSizeLimit {
+		return fmt.Errorf("Query response is %d bytes, exceeding the limit of %d", len(buf), q.m.config.QueryResponseSizeLimit)
+	}
+
+	resp := queryResp{
+		ID:      q.id,
+		From:    q.m.config.Name,
+		Payload: buf,
+	}
+	if err := q.m.sendQueryResponse(q.From, q.addr, &resp); err != nil {
+		return err
+	}
+	q.responded = true
+	return nil
+}
+
+// Query floods a named query with the given payload through the cluster and
+// returns a handle that collects the responses. Members answer through their
+// QueryDelegate, directly back to us, until the deadline. If the filter
+// selects this node, it answers its own query too.
+func (m *Memberlist) Query(name string, payload []byte, params *QueryParams) (*QueryResponse, error) {
+	if params == nil {
+		params = &QueryParams{}
+	}
+
+	filter, err := m.queryFilter(params)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := params.Timeout
+	if timeout <= 0 {
+		timeout = queryTimeout(m.config.QueryTimeoutMult, m.estNumNodes(), m.config.GossipInterval)
+	}
+
+	addr, port, err := m.transport.FinalAdvertiseAddr(m.config.AdvertiseAddr, m.config.AdvertisePort)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get final advertise address: %v", err)
+	}
+
+	q := queryReq{
+		ID:          m.nextSeqNo(),
+		Origin:      m.config.Name,
+		Addr:        addr,
+		Port:        uint16(port),
+		Name:        name,
+		Payload:     payload,
+		Timeout:     timeout,
+		FilterNodes: filter,
+		RequestAck:  params.RequestAck,
+	}
+	out, err := encode(queryMsg, &q)
+	if err != nil {
+		return nil, err
+	}
+	if out.Len() > m.config.QuerySizeLimit {
+		return nil, fmt.Errorf("Query is %d bytes, exceeding the limit of %d", out.Len(), m.config.QuerySizeLimit)
+	}
+
+	// Size the channels so that every expected answer fits without the
+	// caller having to keep up.
+	expected := len(filter)
+	if expected == 0 {
+		expected = m.estNumNodes()
+	}
+	if expected < 1 {
+		expected = 1
+	}
+
+	resp := &QueryResponse{
+		m:         m,
+		id:        q.ID,
+		deadline:  m.clock.Now().Add(timeout),
+		respCh:    make(chan NodeResponse, expected),
+		responses: make(map[string]struct{}),
+	}
+	if q.RequestAck {
+		resp.ackCh = make(chan string, expected)
+		resp.acks = make(map[string]struct{})
+	}
+
+	m.queryLock.Lock()
+	m.queries[q.ID] = resp
+	m.querySeen[queryKey{q.Origin, q.ID}] = resp.deadline
+	m.queryLock.Unlock()
+
+	// Hold the lock until the timer is set, so that an early Close can't
+	// find it missing.
+	resp.l.Lock()
+	resp.timer = m.clock.AfterFunc(timeout, resp.Close)
+	resp.l.Unlock()
+
+	metrics.IncrCounter([]string{"memberlist", "query", "sent"}, 1)
+	m.broadcasts.QueueBroadcast(&queryBroadcast{msg: out.Bytes()})
+
+	// Answer our own query if we're selected.
+	m.processQuery(&q, joinHostPort(net.IP(addr).String(), uint16(port)))
+	return resp, nil
+}
+
+// queryFilter resolves the node filter for a query. A meta predicate is
+// turned into the names of the alive nodes it selects.
+func (m *Memberlist) queryFilter(params *QueryParams) ([]string, error) {
+	if params.FilterMeta == nil {
+		return params.FilterNodes, nil
+	}
+
+	allowed := make(map[string]bool, len(params.FilterNodes))
+	for _, name := range params.FilterNodes {
+		allowed[name] = true
+	}
+
+	var filter []string
+	m.nodeLock.RLock()
+	for _, n := range m.nodes {
+		if n.DeadOrLeft() {
+			continue
+		}
+		if len(allowed) > 0 && !allowed[n.Name] {
+			continue
+		}
+		if params.FilterMeta(n.Meta) {
+			filter = append(filter, n.Name)
+		}
+	}
+	m.nodeLock.RUnlock()
+
+	if len(filter) == 0 {
+		return nil, fmt.Errorf("No nodes match the query filter")
+	}
+	return filter, nil
+}
+
+// handleQuery is invoked for a query received through gossip. New queries
+// are passed on to other members before being processed.
+func (m *Memberlist) handleQuery(buf []byte, from net.Addr) {
+	var q queryReq
+	if err := decode(buf, &q); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to decode query: %s %s", err, LogAddress(from))
+		return
+	}
+
+	// The timeout comes from the origin, so cap it before it decides how
+	// long we remember the query and how long the delegate may answer.
+	if max := queryTimeout(m.config.QueryTimeoutMult, m.estNumNodes(), m.config.GossipInterval); q.Timeout > max {
+		q.Timeout = max
+	}
+
+	now := m.clock.Now()
+	key := queryKey{q.Origin, q.ID}
+	m.queryLock.Lock()
+	if _, ok := m.querySeen[key]; ok {
+		m.queryLock.Unlock()
+		return
+	}
+	m.querySeen[key] = now.Add(q.Timeout)
+	m.pruneQueriesSeen(now)
+	m.queryLock.Unlock()
+
+	// Re-gossip the query as it was received.
+	msg := make([]byte, 1+len(buf))
+	msg[0] = byte(queryMsg)
+	copy(msg[1:], buf)
+	m.broadcasts.QueueBroadcast(&queryBroadcast{msg: msg})
+
+	m.processQuery(&q, joinHostPort(net.IP(q.Addr).String(), q.Port))
+}
+
+// pruneQueriesSeen forgets queries that have expired. The query lock must
+// be held.
+func (m *Memberlist) pruneQueriesSeen(now time.Time) {
+	if now.Sub(m.queryLastPrune) < querySeenPruneInterval {
+		return
+	}
+	m.queryLastPrune = now
+	for key, expires := range m.querySeen {
+		if now.After(expires) {
+			delete(m.querySeen, key)
+		}
+	}
+}
+
+// processQuery acks and hands a query to the delegate if its filter selects
+// this node.
+func (m *Memberlist) processQuery(q *queryReq, addr string) {
+	if len(q.FilterNodes) > 0 {
+		selected := false
+		for _, name := range q.FilterNodes {
+			if name == m.config.Name {
+				selected = true
+				break
+			}
+		}
+		if !selected {
+			return
+		}
+	}
+
+	if q.RequestAck {
+		ack := queryResp{ID: q.ID, From: m.config.Name, Ack: true}
+		if err := m.sendQueryResponse(q.Origin, addr, &ack); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to ack query: %s", err)
+		}
+	}
+
+	d := m.config.Queries
+	if d == nil {
+		return
+	}
+	d.NotifyQuery(&Query{
+		Name:     q.Name,
+		Payload:  q.Payload,
+		From:     q.Origin,
+		m:        m,
+		id:       q.ID,
+		addr:     addr,
+		deadline: m.clock.Now().Add(q.Timeout),
+	})
+}
+
+// sendQueryResponse sends an ack or response to the origin of a query. It
+// goes in a packet if it fits and over a stream if it doesn't. Our own
+// queries are answered without touching the network.
+func (m *Memberlist) sendQueryResponse(origin, addr string, resp *queryResp) error {
+	if origin == m.config.Name {
+		m.deliverQueryResponse(resp)
+		return nil
+	}
+
+	out, err := encode(queryRespMsg, resp)
+	if err != nil {
+		return err
+	}
+
+	// The address comes with the query, so only answer an origin we know,
+	// and only at its own address, or a forged query could aim our
+	// responses at anyone.
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[origin]
+	if !ok {
+		m.nodeLock.RUnlock()
+		return fmt.Errorf("Not responding to unknown query origin %s", origin)
+	}
+	node := state.Node
+	m.nodeLock.RUnlock()
+
+	if node.Address() != addr {
+		return fmt.Errorf("Query response address %s isn't that of %s (%s)", addr, origin, node.Address())
+	}
+
+	limit := m.packetBudget(origin) - m.packetOverhead(&node)
+	if out.Len() <= limit {
+		return m.rawSendMsgPacket(addr, &node, out.Bytes())
+	}
+
+	conn, err := m.dialStream(addr, m.config.TCPTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return m.rawSendMsgStream(conn, out.Bytes(), m.pickCompression(node.compression))
+}
+
+// handleQueryResponse is invoked for an ack or response that arrived in a
+// packet.
+func (m *Memberlist) handleQueryResponse(buf []byte, from net.Addr) {
+	var resp queryResp
+	if err := decode(buf, &resp); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to decode query response: %s %s", err, LogAddress(from))
+		return
+	}
+	m.deliverQueryResponse(&resp)
+}
+
+// deliverQueryResponse passes an ack or response to the pending query it
+// belongs to, if that query is still open.
+func (m *Memberlist) deliverQueryResponse(resp *queryResp) {
+	m.queryLock.Lock()
+	r, ok := m.queries[resp.ID]
+	m.queryLock.Unlock()
+	if !ok {
+		m.logger.Printf("[DEBUG] memberlist: Response from %s for unknown or finished query %d", resp.From, resp.ID)
+		return
+	}
+	r.deliver(resp)
+}
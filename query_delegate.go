@@ -0,0 +1,11 @@
+package memberlist
+
+// QueryDelegate is used to answer queries sent with Memberlist.Query. It is
+// only invoked for queries whose filter selects this node.
+type QueryDelegate interface {
+	// NotifyQuery is invoked when a query arrives. The query can be
+	// answered once with Respond, up until its deadline. Like NotifyMsg,
+	// this is called from the message handling goroutine and must not
+	// block; slow work should respond from another goroutine.
+	NotifyQuery(q *Query)
+}
@@ -0,0 +1,218 @@
+package memberlist
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// echoQueries answers every query with the node name and the payload.
+type echoQueries struct {
+	name string
+	size int // Pads the response to this many bytes if set
+}
+
+func (e *echoQueries) NotifyQuery(q *Query) {
+	resp := append([]byte(e.name+":"), q.Payload...)
+	if e.size > len(resp) {
+		resp = append(resp, bytes.Repeat([]byte("x"), e.size-len(resp))...)
+	}
+	q.Respond(resp)
+}
+
+// collectQuery drains a query's channels until they close.
+func collectQuery(t *testing.T, resp *QueryResponse) (acks []string, from map[string][]byte) {
+	from = make(map[string][]byte)
+	timeout := time.After(5 * time.Second)
+	ackCh := resp.AckCh()
+	respCh := resp.ResponseCh()
+	for ackCh != nil || respCh != nil {
+		select {
+		case a, ok := <-ackCh:
+			if !ok {
+				ackCh = nil
+				continue
+			}
+			acks = append(acks, a)
+		case r, ok := <-respCh:
+			if !ok {
+				respCh = nil
+				continue
+			}
+			from[r.From] = r.Payload
+		case <-timeout:
+			t.Fatalf("query never finished")
+		}
+	}
+	sort.Strings(acks)
+	return acks, from
+}
+
+// queryCluster starts a mock cluster whose members echo queries.
+func queryCluster(t *testing.T, n int, f func(c *Config)) []*Memberlist {
+	ms := mockCluster(t, &MockNetwork{}, n, func(c *Config) {
+		c.GossipInterval = 10 * time.Millisecond
+		c.Queries = &echoQueries{name: c.Name}
+		if f != nil {
+			f(c)
+		}
+	})
+	return ms
+}
+
+func TestQuery_AllNodes(t *testing.T) {
+	ms := queryCluster(t, 4, nil)
+	for _, m := range ms {
+		defer m.Shutdown()
+	}
+
+	resp, err := ms[0].Query("echo", []byte("hi"), &QueryParams{
+		RequestAck: true,
+		Timeout:    500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	acks, from := collectQuery(t, resp)
+	require.True(t, resp.Finished())
+	require.Equal(t, []string{"node0", "node1", "node2", "node3"}, acks)
+	require.Len(t, from, 4)
+	for name, payload := range from {
+		require.Equal(t, name+":hi", string(payload))
+	}
+}
+
+func TestQuery_Filter(t *testing.T) {
+	ms := queryCluster(t, 4, func(c *Config) {
+		c.Delegate = &MockDelegate{meta: []byte("role=" + c.Name[len(c.Name)-1:])}
+	})
+	for _, m := range ms {
+		defer m.Shutdown()
+	}
+
+	resp, err := ms[0].Query("echo", nil, &QueryParams{
+		FilterNodes: []string{"node1", "node2"},
+		Timeout:     300 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	_, from := collectQuery(t, resp)
+	require.Len(t, from, 2)
+	require.Contains(t, from, "node1")
+	require.Contains(t, from, "node2")
+
+	// A meta predicate is resolved into node names.
+	resp, err = ms[0].Query("echo", nil, &QueryParams{
+		FilterMeta: func(meta []byte) bool {
+			return bytes.Equal(meta, []byte("role=3"))
+		},
+		Timeout: 300 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	_, from = collectQuery(t, resp)
+	require.Len(t, from, 1)
+	require.Contains(t, from, "node3")
+
+	_, err = ms[0].Query("echo", nil, &QueryParams{
+		FilterMeta: func([]byte) bool { return false },
+	})
+	require.Error(t, err)
+}
+
+func TestQuery_LargeResponseUsesStream(t *testing.T) {
+	ms := queryCluster(t, 2, func(c *Config) {
+		c.Queries = &echoQueries{name: c.Name, size: 4000}
+	})
+	for _, m := range ms {
+		defer m.Shutdown()
+	}
+
+	resp, err := ms[0].Query("echo", nil, &QueryParams{
+		FilterNodes: []string{"node1"},
+		Timeout:     500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	_, from := collectQuery(t, resp)
+	require.Len(t, from["node1"], 4000)
+}
+
+func TestQuery_Limits(t *testing.T) {
+	ms := queryCluster(t, 1, func(c *Config) {
+		c.QuerySizeLimit = 128
+		c.QueryResponseSizeLimit = 4
+	})
+	defer ms[0].Shutdown()
+
+	_, err := ms[0].Query("echo", make([]byte, 256), nil)
+	require.Error(t, err)
+
+	// The local response is over the limit, so nothing comes back.
+	resp, err := ms[0].Query("echo", nil, &QueryParams{Timeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	_, from := collectQuery(t, resp)
+	require.Empty(t, from)
+}
+
+func TestQuery_Close(t *testing.T) {
+	ms := queryCluster(t, 1, nil)
+	defer ms[0].Shutdown()
+
+	resp, err := ms[0].Query("echo", nil, &QueryParams{Timeout: time.Hour})
+	require.NoError(t, err)
+	require.False(t, resp.Finished())
+
+	resp.Close()
+	resp.Close()
+	require.True(t, resp.Finished())
+	_, from := collectQuery(t, resp)
+	require.Len(t, from, 1)
+
+	ms[0].queryLock.Lock()
+	require.Empty(t, ms[0].queries)
+	ms[0].queryLock.Unlock()
+}
+
+func TestQuery_RemoteTimeoutCapped(t *testing.T) {
+	ms := queryCluster(t, 2, nil)
+	for _, m := range ms {
+		defer m.Shutdown()
+	}
+
+	n := ms[1].LocalNode()
+	q := queryReq{
+		ID:      1,
+		Origin:  n.Name,
+		Addr:    n.Addr,
+		Port:    n.Port,
+		Name:    "echo",
+		Timeout: 24 * time.Hour,
+	}
+	out, err := encode(queryMsg, &q)
+	require.NoError(t, err)
+	ms[0].handleQuery(out.Bytes()[1:], nil)
+
+	m := ms[0]
+	max := queryTimeout(m.config.QueryTimeoutMult, m.estNumNodes(), m.config.GossipInterval)
+	m.queryLock.Lock()
+	expires := m.querySeen[queryKey{n.Name, 1}]
+	m.queryLock.Unlock()
+	require.False(t, expires.After(m.clock.Now().Add(max)))
+}
+
+func TestQuery_ResponseAddrChecked(t *testing.T) {
+	ms := queryCluster(t, 2, nil)
+	for _, m := range ms {
+		defer m.Shutdown()
+	}
+
+	// A known origin is only answered at its own address.
+	resp := &queryResp{ID: 1, From: "node0", Ack: true}
+	require.Error(t, ms[0].sendQueryResponse("node1", "127.0.0.1:9", resp))
+	require.NoError(t, ms[0].sendQueryResponse("node1", ms[1].LocalNode().Address(), resp))
+
+	// An unknown origin isn't answered at all.
+	require.Error(t, ms[0].sendQueryResponse("nobody", ms[1].LocalNode().Address(), resp))
+	big := &queryResp{ID: 1, From: "node0", Payload: make([]byte, 4000)}
+	require.Error(t, ms[0].sendQueryResponse("nobody", ms[1].LocalNode().Address(), big))
+}
@@ -0,0 +1,111 @@
+package memberlist
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// replayHeaderSize is the size of the replay guard that is put in front of
+// an encrypted packet's plaintext when Config.ReplayWindow is set:
+//
+//	[replayGuardMsg][8 byte send time, unix nanos][8 byte random nonce]
+const replayHeaderSize = 1 + 8 + 8
+
+// replayPruneInterval bounds how often the seen nonces are swept.
+const replayPruneInterval = time.Second
+
+// replayMaxNonces caps how many nonces are remembered at once. Once that
+// many packets have arrived within a window, more are dropped until the
+// oldest nonces can be forgotten, since a packet whose nonce we can't keep
+// can't be told apart from a replay.
+const replayMaxNonces = 256 * 1024
+
+// replayFilter rejects packets that were sent outside the replay window, or
+// that have already been seen inside it. Since every nonce is remembered for
+// a whole window either side of its send time, a replay is caught no matter
+// when in the window it arrives.
+type replayFilter struct {
+	window    time.Duration
+	maxNonces int
+
+	l         sync.Mutex
+	seen      map[uint64]time.Time // Nonce -> when it can be forgotten
+	lastPrune time.Time
+}
+
+// newReplayFilter returns a filter for the given window.
+func newReplayFilter(window time.Duration) *replayFilter {
+	return &replayFilter{
+		window:    window,
+		maxNonces: replayMaxNonces,
+		seen:      make(map[uint64]time.Time),
+	}
+}
+
+// wrap puts the replay guard in front of a packet about to be encrypted.
+func (r *replayFilter) wrap(msg []byte, now time.Time) ([]byte, error) {
+	out := make([]byte, replayHeaderSize+len(msg))
+	out[0] = byte(replayGuardMsg)
+	binary.BigEndian.PutUint64(out[1:9], uint64(now.UnixNano()))
+	if _, err := rand.Read(out[9:17]); err != nil {
+		return nil, fmt.Errorf("Failed to generate nonce: %v", err)
+	}
+	copy(out[replayHeaderSize:], msg)
+	return out, nil
+}
+
+// check strips the replay guard from a decrypted packet, rejecting it if
+// it's stale or a duplicate. Packets without a guard are passed through
+// unless required is set.
+func (r *replayFilter) check(buf []byte, now time.Time, required bool) ([]byte, error) {
+	if len(buf) == 0 || messageType(buf[0]) != replayGuardMsg {
+		if required {
+			metrics.IncrCounter([]string{"memberlist", "replay", "missing"}, 1)
+			return nil, fmt.Errorf("Packet has no replay guard")
+		}
+		return buf, nil
+	}
+	if len(buf) < replayHeaderSize {
+		return nil, fmt.Errorf("Truncated replay guard")
+	}
+
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(buf[1:9])))
+	if age := now.Sub(sent); age > r.window || age < -r.window {
+		metrics.IncrCounter([]string{"memberlist", "replay", "stale"}, 1)
+		return nil, fmt.Errorf("Packet sent at %v is outside the replay window", sent)
+	}
+
+	nonce := binary.BigEndian.Uint64(buf[9:17])
+	r.l.Lock()
+	defer r.l.Unlock()
+	if _, ok := r.seen[nonce]; ok {
+		metrics.IncrCounter([]string{"memberlist", "replay", "duplicate"}, 1)
+		return nil, fmt.Errorf("Duplicate packet")
+	}
+	r.prune(now)
+	if len(r.seen) >= r.maxNonces {
+		metrics.IncrCounter([]string{"memberlist", "replay", "full"}, 1)
+		return nil, fmt.Errorf("Too many packets within the replay window")
+	}
+	r.seen[nonce] = sent.Add(r.window)
+	return buf[replayHeaderSize:], nil
+}
+
+// prune forgets nonces whose packets would now be rejected as stale anyway.
+// The lock must be held.
+func (r *replayFilter) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < replayPruneInterval {
+		return
+	}
+	r.lastPrune = now
+	for nonce, expires := range r.seen {
+		if now.After(expires) {
+			delete(r.seen, nonce)
+		}
+	}
+}
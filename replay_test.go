@@ -0,0 +1,142 @@
+package memberlist
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayFilter(t *testing.T) {
+	window := 10 * time.Second
+	r := newReplayFilter(window)
+	now := time.Unix(1000, 0)
+	msg := []byte{byte(pingMsg), 1, 2, 3}
+
+	guarded, err := r.wrap(msg, now)
+	require.NoError(t, err)
+	require.Len(t, guarded, replayHeaderSize+len(msg))
+
+	out, err := r.check(guarded, now.Add(time.Second), true)
+	require.NoError(t, err)
+	require.Equal(t, msg, out)
+
+	// The same packet again is a duplicate.
+	_, err = r.check(guarded, now.Add(2*time.Second), true)
+	require.Error(t, err)
+
+	// Packets from too far in the past or future are stale.
+	old, err := r.wrap(msg, now.Add(-window-time.Second))
+	require.NoError(t, err)
+	_, err = r.check(old, now, true)
+	require.Error(t, err)
+	future, err := r.wrap(msg, now.Add(window+time.Second))
+	require.NoError(t, err)
+	_, err = r.check(future, now, true)
+	require.Error(t, err)
+
+	// Unguarded packets only pass when the guard isn't required.
+	_, err = r.check(msg, now, true)
+	require.Error(t, err)
+	out, err = r.check(msg, now, false)
+	require.NoError(t, err)
+	require.Equal(t, msg, out)
+	_, err = r.check(guarded[:replayHeaderSize-1], now, false)
+	require.Error(t, err)
+
+	// Nonces are forgotten once they'd be stale anyway.
+	require.Len(t, r.seen, 1)
+	later := now.Add(2 * window)
+	fresh, err := r.wrap(msg, later)
+	require.NoError(t, err)
+	_, err = r.check(fresh, later, true)
+	require.NoError(t, err)
+	require.Len(t, r.seen, 1)
+
+	// Once full, packets are dropped until nonces can be forgotten.
+	r.maxNonces = 2
+	for i, want := range []bool{true, false} {
+		p, err := r.wrap(msg, later)
+		require.NoError(t, err)
+		_, err = r.check(p, later.Add(time.Duration(i)*time.Millisecond), true)
+		require.Equal(t, want, err == nil)
+	}
+	require.Len(t, r.seen, 2)
+	latest := later.Add(2 * window)
+	p, err := r.wrap(msg, latest)
+	require.NoError(t, err)
+	_, err = r.check(p, latest, true)
+	require.NoError(t, err)
+}
+
+// recordingTransport keeps a copy of every packet it sends.
+type recordingTransport struct {
+	*MockTransport
+
+	l    sync.Mutex
+	sent [][]byte
+}
+
+func (t *recordingTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	t.l.Lock()
+	t.sent = append(t.sent, append([]byte(nil), b...))
+	t.l.Unlock()
+	return t.MockTransport.WriteTo(b, addr)
+}
+
+func TestMemberlist_ReplayWindow(t *testing.T) {
+	for _, window := range []time.Duration{0, time.Minute} {
+		network := &MockNetwork{}
+		key := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+		c1 := testConfig(t)
+		c1.Name = "node1"
+		rec := &recordingTransport{MockTransport: network.NewTransport()}
+		c1.Transport = rec
+		c1.SecretKey = key
+		c1.ReplayWindow = window
+		c1.ProbeInterval = time.Hour
+		c1.GossipInterval = time.Hour
+		m1, err := Create(c1)
+		require.NoError(t, err)
+		defer m1.Shutdown()
+
+		d := &MockDelegate{}
+		c2 := testConfig(t)
+		c2.Name = "node2"
+		c2.Transport = network.NewTransport()
+		c2.SecretKey = key
+		c2.ReplayWindow = window
+		c2.Delegate = d
+		m2, err := Create(c2)
+		require.NoError(t, err)
+		defer m2.Shutdown()
+
+		_, err = m1.Join([]string{m2.LocalNode().Address()})
+		require.NoError(t, err)
+
+		rec.l.Lock()
+		rec.sent = nil
+		rec.l.Unlock()
+		require.NoError(t, m1.SendBestEffort(m2.LocalNode(), []byte("hello")))
+		retry(t, 10, 10*time.Millisecond, func(failf func(string, ...interface{})) {
+			if len(d.getMessages()) != 1 {
+				failf("expected one message")
+			}
+		})
+
+		// Replay the captured packet straight into node2.
+		rec.l.Lock()
+		captured := rec.sent[0]
+		rec.l.Unlock()
+		m2.ingestPacket(captured, &MockAddress{m1.LocalNode().Address()}, time.Now())
+		time.Sleep(20 * time.Millisecond)
+
+		expected := 2
+		if window > 0 {
+			expected = 1
+		}
+		require.Len(t, d.getMessages(), expected, "window %v", window)
+	}
+}
@@ -0,0 +1,135 @@
+package memberlist
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// rttWindowSize is the number of most recent round trip time samples
+	// kept for each peer.
+	rttWindowSize = 128
+
+	// rttMinSamples is the number of samples we need for a peer before we
+	// trust its percentile enough to use it as a probe timeout.
+	rttMinSamples = 10
+
+	// rttTimeoutMult is how many times the round trip time percentile we
+	// wait for an ack. Waiting for just the percentile would send a healthy
+	// node to indirect probes on every round trip slower than it.
+	rttTimeoutMult = 2
+)
+
+// rttHistogram keeps a sliding window of round trip time samples for a single
+// peer and answers percentile queries over them.
+type rttHistogram struct {
+	samples []time.Duration
+	next    int
+}
+
+// add records a new sample, evicting the oldest one once the window is full.
+func (h *rttHistogram) add(rtt time.Duration) {
+	if len(h.samples) < rttWindowSize {
+		h.samples = append(h.samples, rtt)
+		return
+	}
+	h.samples[h.next] = rtt
+	h.next = (h.next + 1) % rttWindowSize
+}
+
+// percentile returns the sample at the given percentile, which should be in
+// the range (0, 1]. This returns false if there aren't enough samples yet.
+func (h *rttHistogram) percentile(p float64) (time.Duration, bool) {
+	n := len(h.samples)
+	if n < rttMinSamples {
+		return 0, false
+	}
+
+	sorted := make([]time.Duration, n)
+	copy(sorted, h.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(p*float64(n)+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	} else if idx >= n {
+		idx = n - 1
+	}
+	return sorted[idx], true
+}
+
+// rttTracker holds the round trip time histograms for all the peers we probe.
+type rttTracker struct {
+	sync.Mutex
+	peers map[string]*rttHistogram
+}
+
+func newRTTTracker() *rttTracker {
+	return &rttTracker{
+		peers: make(map[string]*rttHistogram),
+	}
+}
+
+// Observe records a round trip time measured while probing the given node.
+func (r *rttTracker) Observe(node string, rtt time.Duration) {
+	if rtt < 0 {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	h, ok := r.peers[node]
+	if !ok {
+		h = &rttHistogram{}
+		r.peers[node] = h
+	}
+	h.add(rtt)
+}
+
+// Percentile returns the round trip time percentile for the given node, and
+// false if we don't have enough samples for it yet.
+func (r *rttTracker) Percentile(node string, p float64) (time.Duration, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	h, ok := r.peers[node]
+	if !ok {
+		return 0, false
+	}
+	return h.percentile(p)
+}
+
+// Remove forgets everything about the given node.
+func (r *rttTracker) Remove(node string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.peers, node)
+}
+
+// probeTimeout returns how long to wait for an ack from the given node before
+// falling back to indirect probes. This is the configured ProbeTimeout unless
+// dynamic timeouts are enabled and we've measured enough round trips to this
+// node, in which case it's rttTimeoutMult times the configured percentile of
+// those, clamped to the configured bounds.
+func (m *Memberlist) probeTimeout(node string) time.Duration {
+	if !m.config.DynamicProbeTimeout {
+		return m.config.ProbeTimeout
+	}
+
+	rtt, ok := m.rtts.Percentile(node, m.config.ProbeTimeoutPercentile)
+	if !ok {
+		return m.config.ProbeTimeout
+	}
+
+	timeout := rttTimeoutMult * rtt
+	if timeout < m.config.ProbeTimeoutMin {
+		timeout = m.config.ProbeTimeoutMin
+	}
+	if m.config.ProbeTimeoutMax > 0 && timeout > m.config.ProbeTimeoutMax {
+		timeout = m.config.ProbeTimeoutMax
+	}
+	return timeout
+}
@@ -0,0 +1,85 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTTHistogram_Percentile(t *testing.T) {
+	h := &rttHistogram{}
+	for i := 1; i < rttMinSamples; i++ {
+		h.add(time.Duration(i) * time.Millisecond)
+	}
+	_, ok := h.percentile(0.99)
+	require.False(t, ok, "should need more samples")
+
+	for i := rttMinSamples; i <= 100; i++ {
+		h.add(time.Duration(i) * time.Millisecond)
+	}
+	p, ok := h.percentile(0.99)
+	require.True(t, ok)
+	require.Equal(t, 99*time.Millisecond, p)
+	p, _ = h.percentile(0.5)
+	require.Equal(t, 50*time.Millisecond, p)
+
+	// Overflow the window with small samples so the big ones age out.
+	for i := 0; i < rttWindowSize; i++ {
+		h.add(time.Millisecond)
+	}
+	require.Equal(t, rttWindowSize, len(h.samples))
+	p, _ = h.percentile(0.99)
+	require.Equal(t, time.Millisecond, p)
+}
+
+func TestMemberlist_probeTimeout(t *testing.T) {
+	c := DefaultLANConfig()
+	m := &Memberlist{config: c, rtts: newRTTTracker()}
+	for i := 0; i < rttMinSamples; i++ {
+		m.rtts.Observe("slow", 10*time.Second)
+		m.rtts.Observe("fast", time.Millisecond)
+		m.rtts.Observe("medium", 250*time.Millisecond)
+	}
+
+	// Disabled means we always use the static timeout.
+	require.Equal(t, c.ProbeTimeout, m.probeTimeout("medium"))
+
+	c.DynamicProbeTimeout = true
+	require.Equal(t, 500*time.Millisecond, m.probeTimeout("medium"))
+	require.Equal(t, c.ProbeTimeoutMin, m.probeTimeout("fast"))
+	require.Equal(t, c.ProbeTimeoutMax, m.probeTimeout("slow"))
+	require.Equal(t, c.ProbeTimeout, m.probeTimeout("unknown"))
+
+	m.rtts.Remove("medium")
+	require.Equal(t, c.ProbeTimeout, m.probeTimeout("medium"))
+}
+
+func TestMemberList_Probe_RecordsRTT(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeInterval = 10 * time.Second
+	})
+	defer m1.Shutdown()
+
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.BindPort = m1.config.BindPort
+	})
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: []byte(addr1), Port: uint16(m1.config.BindPort), Incarnation: 1, Vsn: m1.config.BuildVsnArray()}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: []byte(addr2), Port: uint16(m2.config.BindPort), Incarnation: 1, Vsn: m2.config.BuildVsnArray()}
+	m1.aliveNode(&a2, nil, false)
+
+	// A direct ack records its round trip time.
+	m1.probeNode(m1.nodeMap[addr2.String()])
+
+	m1.rtts.Lock()
+	h := m1.rtts.peers[addr2.String()]
+	m1.rtts.Unlock()
+	require.NotNil(t, h)
+	require.Len(t, h.samples, 1)
+}
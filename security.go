@@ -7,6 +7,8 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 /*
@@ -17,23 +19,115 @@ currently support the following versions:
 
  0 - AES-GCM 128, using PKCS7 padding
  1 - AES-GCM 128, no padding. Padding not needed, caused bloat.
+ 2 - AES-GCM 256, no padding.
+ 3 - XChaCha20-Poly1305, 24 byte nonce, no padding.
+
+Versions 0 and 1 pick the AES key size from the key length, from
+version 2 on the version byte identifies a CipherSuite.
 
 */
 type encryptionVersion uint8
 
 const (
 	minEncryptionVersion encryptionVersion = 0
-	maxEncryptionVersion encryptionVersion = 1
+	maxEncryptionVersion encryptionVersion = 3
 )
 
+// CipherSuite identifies the authenticated cipher used to encrypt messages.
+// Each key in the Keyring is tagged with a suite, and the primary key's suite
+// is used for everything we send. Every message names its suite, so a node
+// can decrypt any suite it has a suitable key for, which lets a cluster move
+// to a new suite by installing a key everywhere before switching to it.
+type CipherSuite uint8
+
+const (
+	// CipherSuiteAESGCM is AES-GCM with AES-128, AES-192 or AES-256 picked by
+	// the key length. This is the only suite older versions understand.
+	CipherSuiteAESGCM CipherSuite = 1
+
+	// CipherSuiteAES256GCM is AES-GCM that requires a 32 byte key.
+	CipherSuiteAES256GCM CipherSuite = 2
+
+	// CipherSuiteXChaCha20Poly1305 is XChaCha20-Poly1305 with a 32 byte key.
+	// The extended nonce is safe to pick at random for any number of
+	// messages.
+	CipherSuiteXChaCha20Poly1305 CipherSuite = 3
+)
+
+func (s CipherSuite) String() string {
+	switch s {
+	case CipherSuiteAESGCM:
+		return "AES-GCM"
+	case CipherSuiteAES256GCM:
+		return "AES-256-GCM"
+	case CipherSuiteXChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+// suite returns the cipher suite used by an encryption version.
+func (v encryptionVersion) suite() CipherSuite {
+	if v <= 1 {
+		return CipherSuiteAESGCM
+	}
+	return CipherSuite(v)
+}
+
 const (
 	versionSize    = 1
 	nonceSize      = 12
+	xNonceSize     = chacha20poly1305.NonceSizeX
 	tagSize        = 16
 	maxPadOverhead = 16
 	blockSize      = aes.BlockSize
 )
 
+// nonceSizeFor returns the nonce size used by an encryption version.
+func nonceSizeFor(vsn encryptionVersion) int {
+	if vsn.suite() == CipherSuiteXChaCha20Poly1305 {
+		return xNonceSize
+	}
+	return nonceSize
+}
+
+// newAEAD returns the cipher for an encryption version, or an error if the
+// key isn't the right size for it.
+func newAEAD(vsn encryptionVersion, key []byte) (cipher.AEAD, error) {
+	if err := validateSuiteKey(vsn.suite(), key); err != nil {
+		return nil, err
+	}
+
+	if vsn.suite() == CipherSuiteXChaCha20Poly1305 {
+		return chacha20poly1305.NewX(key)
+	}
+
+	// Get the AES block cipher
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the GCM cipher mode
+	return cipher.NewGCM(aesBlock)
+}
+
+// validateSuiteKey checks that a key can be used with a cipher suite.
+func validateSuiteKey(suite CipherSuite, key []byte) error {
+	switch suite {
+	case CipherSuiteAESGCM:
+		return ValidateKey(key)
+	case CipherSuiteAES256GCM, CipherSuiteXChaCha20Poly1305:
+		if len(key) != 32 {
+			return fmt.Errorf("key size must be 32 bytes for %s", suite)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown cipher suite %d", suite)
+	}
+}
+
 // pkcs7encode is used to pad a byte buffer to a specific block size using
 // the PKCS7 algorithm. "Ignores" some bytes to compensate for IV
 func pkcs7encode(buf *bytes.Buffer, ignore, blockSize int) {
@@ -60,8 +154,10 @@ func encryptOverhead(vsn encryptionVersion) int {
 	switch vsn {
 	case 0:
 		return 45 // Version: 1, IV: 12, Padding: 16, Tag: 16
-	case 1:
+	case 1, 2:
 		return 29 // Version: 1, IV: 12, Tag: 16
+	case 3:
+		return 41 // Version: 1, IV: 24, Tag: 16
 	default:
 		panic("unsupported version")
 	}
@@ -72,7 +168,7 @@ func encryptOverhead(vsn encryptionVersion) int {
 func encryptedLength(vsn encryptionVersion, inp int) int {
 	// If we are on version 1, there is no padding
 	if vsn >= 1 {
-		return versionSize + nonceSize + inp + tagSize
+		return versionSize + nonceSizeFor(vsn) + inp + tagSize
 	}
 
 	// Determine the padding size
@@ -82,21 +178,15 @@ func encryptedLength(vsn encryptionVersion, inp int) int {
 	return versionSize + nonceSize + inp + padding + tagSize
 }
 
-// encryptPayload is used to encrypt a message with a given key.
-// We make use of AES-128 in GCM mode. New byte buffer is the version,
+// encryptPayload is used to encrypt a message with a given key, using the
+// cipher suite of the encryption version. New byte buffer is the version,
 // nonce, ciphertext and tag
 func encryptPayload(vsn encryptionVersion, key []byte, msg []byte, data []byte, dst *bytes.Buffer) error {
-	// Get the AES block cipher
-	aesBlock, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
-
-	// Get the GCM cipher mode
-	gcm, err := cipher.NewGCM(aesBlock)
+	aead, err := newAEAD(vsn, key)
 	if err != nil {
 		return err
 	}
+	nonceLen := nonceSizeFor(vsn)
 
 	// Grow the buffer to make room for everything
 	offset := dst.Len()
@@ -106,28 +196,28 @@ func encryptPayload(vsn encryptionVersion, key []byte, msg []byte, data []byte,
 	dst.WriteByte(byte(vsn))
 
 	// Add a random nonce
-	io.CopyN(dst, rand.Reader, nonceSize)
+	io.CopyN(dst, rand.Reader, int64(nonceLen))
 	afterNonce := dst.Len()
 
 	// Ensure we are correctly padded (only version 0)
 	if vsn == 0 {
 		io.Copy(dst, bytes.NewReader(msg))
-		pkcs7encode(dst, offset+versionSize+nonceSize, aes.BlockSize)
+		pkcs7encode(dst, offset+versionSize+nonceLen, aes.BlockSize)
 	}
 
 	// Encrypt message using GCM
 	slice := dst.Bytes()[offset:]
-	nonce := slice[versionSize : versionSize+nonceSize]
+	nonce := slice[versionSize : versionSize+nonceLen]
 
 	// Message source depends on the encryption version.
 	// Version 0 uses padding, version 1 does not
 	var src []byte
 	if vsn == 0 {
-		src = slice[versionSize+nonceSize:]
+		src = slice[versionSize+nonceLen:]
 	} else {
 		src = msg
 	}
-	out := gcm.Seal(nil, nonce, src, data)
+	out := aead.Seal(nil, nonce, src, data)
 
 	// Truncate the plaintext, and write the cipher text
 	dst.Truncate(afterNonce)
@@ -138,22 +228,17 @@ func encryptPayload(vsn encryptionVersion, key []byte, msg []byte, data []byte,
 // decryptMessage performs the actual decryption of ciphertext. This is in its
 // own function to allow it to be called on all keys easily.
 func decryptMessage(key, msg []byte, data []byte) ([]byte, error) {
-	// Get the AES block cipher
-	aesBlock, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	// Get the GCM cipher mode
-	gcm, err := cipher.NewGCM(aesBlock)
+	vsn := encryptionVersion(msg[0])
+	aead, err := newAEAD(vsn, key)
 	if err != nil {
 		return nil, err
 	}
 
 	// Decrypt the message
-	nonce := msg[versionSize : versionSize+nonceSize]
-	ciphertext := msg[versionSize+nonceSize:]
-	plain, err := gcm.Open(nil, nonce, ciphertext, data)
+	nonceLen := nonceSizeFor(vsn)
+	nonce := msg[versionSize : versionSize+nonceLen]
+	ciphertext := msg[versionSize+nonceLen:]
+	plain, err := aead.Open(nil, nonce, ciphertext, data)
 	if err != nil {
 		return nil, err
 	}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"reflect"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestPKCS7(t *testing.T) {
@@ -68,3 +70,98 @@ func encryptDecryptVersioned(vsn encryptionVersion, t *testing.T) {
 		t.Fatalf("encrypt/decrypt failed! %d '%s' '%s'", cmp, msg, plaintext)
 	}
 }
+
+func TestEncryptDecrypt_Suites(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	plaintext := []byte("this is a plain text message")
+	extra := []byte("random data")
+
+	for _, vsn := range []encryptionVersion{1, 2, 3} {
+		var buf bytes.Buffer
+		if err := encryptPayload(vsn, key, plaintext, extra, &buf); err != nil {
+			t.Fatalf("vsn %d: err: %v", vsn, err)
+		}
+		if buf.Len() != encryptedLength(vsn, len(plaintext)) {
+			t.Fatalf("vsn %d: output length is unexpected %d", vsn, buf.Len())
+		}
+		if buf.Len()-len(plaintext) != encryptOverhead(vsn) {
+			t.Fatalf("vsn %d: overhead is unexpected %d", vsn, buf.Len()-len(plaintext))
+		}
+
+		// A short key on the ring is skipped rather than failing the decrypt.
+		short := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+		msg, err := decryptPayload([][]byte{short, key}, buf.Bytes(), extra)
+		if err != nil {
+			t.Fatalf("vsn %d: err: %v", vsn, err)
+		}
+		if !bytes.Equal(msg, plaintext) {
+			t.Fatalf("vsn %d: encrypt/decrypt failed: %q", vsn, msg)
+		}
+	}
+
+	// The new suites need 32 byte keys.
+	var buf bytes.Buffer
+	short := bytes.Repeat([]byte{7}, 16)
+	for _, vsn := range []encryptionVersion{2, 3} {
+		if err := encryptPayload(vsn, short, plaintext, extra, &buf); err == nil {
+			t.Fatalf("vsn %d: expected a key size error", vsn)
+		}
+	}
+
+	// Unknown versions are refused.
+	if _, err := decryptPayload([][]byte{key}, []byte{4, 0, 0}, nil); err == nil {
+		t.Fatalf("expected an unsupported version error")
+	}
+}
+
+func TestMemberlist_CipherSuiteMigration(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 16)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	newConfig := func(primary []byte, suite CipherSuite) *Config {
+		keyring, err := NewKeyring([][]byte{oldKey}, oldKey)
+		require.NoError(t, err)
+		require.NoError(t, keyring.AddKeyWithSuite(newKey, CipherSuiteXChaCha20Poly1305))
+		require.NoError(t, keyring.UseKey(primary))
+
+		c := testConfig(t)
+		c.Keyring = keyring
+		c.MinCipherSuite = suite
+		return c
+	}
+
+	// One node has switched to the new suite, the other still sends with
+	// the old one. Both can decrypt both.
+	c1 := newConfig(newKey, CipherSuiteXChaCha20Poly1305)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+	require.Equal(t, encryptionVersion(3), m1.encryptionVersion())
+
+	// Its keyring won't drop below the minimum for sending either.
+	require.Error(t, c1.Keyring.UseKey(oldKey))
+	require.Error(t, c1.Keyring.AddKeyWithSuite(newKey, CipherSuiteAESGCM))
+	require.Equal(t, encryptionVersion(3), m1.encryptionVersion())
+
+	c2 := newConfig(oldKey, 0)
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	require.NoError(t, err)
+	defer m2.Shutdown()
+
+	// m1 requires the new suite, so m2's join is refused...
+	_, err = m2.Join([]string{m1.config.BindAddr})
+	require.Error(t, err)
+
+	// ...until m2 switches too.
+	require.NoError(t, c2.Keyring.UseKey(newKey))
+	_, err = m2.Join([]string{m1.config.BindAddr})
+	require.NoError(t, err)
+	waitUntilSize(t, m1, 2)
+	waitUntilSize(t, m2, 2)
+
+	// A primary key below the minimum is a configuration error.
+	c3 := newConfig(oldKey, CipherSuiteAES256GCM)
+	_, err = Create(c3)
+	require.Error(t, err)
+}
@@ -0,0 +1,211 @@
+package simulation
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// VirtualClock is a memberlist.Clock whose time only moves when Advance is
+// called. Timers and tickers fire in deadline order as the clock passes
+// them. Zero or negative durations fire on the next Advance.
+type VirtualClock struct {
+	l       sync.Mutex
+	now     time.Time
+	seq     uint64
+	timers  timerHeap
+	running int32 // AfterFunc callbacks that haven't returned yet
+}
+
+// NewVirtualClock returns a clock that starts at the given time.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+// Now returns the current virtual time.
+func (c *VirtualClock) Now() time.Time {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.now
+}
+
+// After sends the virtual time on the returned channel once d has elapsed.
+func (c *VirtualClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.l.Lock()
+	c.schedule(&virtualTimer{clock: c, ch: ch}, d)
+	c.l.Unlock()
+	return ch
+}
+
+// AfterFunc calls f in its own goroutine once d has elapsed.
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) memberlist.Timer {
+	t := &virtualTimer{clock: c, fn: f}
+	c.l.Lock()
+	c.schedule(t, d)
+	c.l.Unlock()
+	return t
+}
+
+// NewTicker returns a ticker that fires every d of virtual time. Like
+// time.Ticker it drops ticks for slow receivers.
+func (c *VirtualClock) NewTicker(d time.Duration) memberlist.Ticker {
+	if d <= 0 {
+		panic("simulation: non-positive interval for NewTicker")
+	}
+	t := &virtualTimer{clock: c, ch: make(chan time.Time, 1), period: d}
+	c.l.Lock()
+	c.schedule(t, d)
+	c.l.Unlock()
+	return &virtualTicker{t}
+}
+
+// Pending returns the number of timers and tickers that have not fired or
+// been stopped.
+func (c *VirtualClock) Pending() int {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return len(c.timers)
+}
+
+// Running returns the number of AfterFunc callbacks that have fired but not
+// yet returned.
+func (c *VirtualClock) Running() int {
+	return int(atomic.LoadInt32(&c.running))
+}
+
+// Advance moves the clock forward by d, firing every timer whose deadline
+// falls within that window. The clock reads each timer's deadline while it
+// fires, and reads the full amount once Advance returns.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.l.Lock()
+	end := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].when.After(end) {
+		t := c.timers[0]
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+			heap.Fix(&c.timers, 0)
+		} else {
+			heap.Pop(&c.timers)
+		}
+		t.fire(c.now)
+	}
+	c.now = end
+	c.l.Unlock()
+}
+
+// schedule adds t to the heap with a deadline d from now. The lock must be
+// held.
+func (c *VirtualClock) schedule(t *virtualTimer, d time.Duration) {
+	c.seq++
+	t.when = c.now.Add(d)
+	t.seq = c.seq
+	heap.Push(&c.timers, t)
+}
+
+// virtualTimer is a single entry on the clock's heap. Exactly one of ch and
+// fn is set.
+type virtualTimer struct {
+	clock  *VirtualClock
+	when   time.Time
+	seq    uint64
+	period time.Duration
+	index  int // Position in the heap, -1 when not scheduled
+	ch     chan time.Time
+	fn     func()
+}
+
+// fire delivers the timer. The clock lock is held, so callbacks run in
+// their own goroutine like time.AfterFunc.
+func (t *virtualTimer) fire(now time.Time) {
+	if t.fn != nil {
+		c := t.clock
+		atomic.AddInt32(&c.running, 1)
+		go func() {
+			defer atomic.AddInt32(&c.running, -1)
+			t.fn()
+		}()
+		return
+	}
+	select {
+	case t.ch <- now:
+	default:
+	}
+}
+
+// Stop prevents the timer from firing. It returns false if the timer had
+// already fired or been stopped.
+func (t *virtualTimer) Stop() bool {
+	c := t.clock
+	c.l.Lock()
+	defer c.l.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&c.timers, t.index)
+	return true
+}
+
+// Reset changes the timer to fire after d. It returns true if the timer
+// had been active.
+func (t *virtualTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.l.Lock()
+	defer c.l.Unlock()
+	active := t.index >= 0
+	if active {
+		heap.Remove(&c.timers, t.index)
+	}
+	c.schedule(t, d)
+	return active
+}
+
+// virtualTicker adapts a periodic virtualTimer to memberlist.Ticker.
+type virtualTicker struct {
+	t *virtualTimer
+}
+
+func (v *virtualTicker) C() <-chan time.Time { return v.t.ch }
+
+func (v *virtualTicker) Stop() { v.t.Stop() }
+
+// timerHeap orders timers by deadline, breaking ties by creation order so
+// that simultaneous timers fire deterministically.
+type timerHeap []*virtualTimer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*virtualTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
@@ -0,0 +1,122 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualClock_After(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewVirtualClock(start)
+
+	ch := c.After(time.Second)
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-ch:
+		t.Fatalf("fired early")
+	default:
+	}
+
+	c.Advance(time.Millisecond)
+	select {
+	case now := <-ch:
+		require.Equal(t, start.Add(time.Second), now)
+	default:
+		t.Fatalf("should have fired")
+	}
+	require.Equal(t, 0, c.Pending())
+}
+
+func TestVirtualClock_AfterFunc(t *testing.T) {
+	c := NewVirtualClock(time.Unix(1000, 0))
+
+	fired := make(chan time.Time, 2)
+	c.AfterFunc(2*time.Second, func() { fired <- c.Now() })
+	stopped := c.AfterFunc(time.Second, func() { fired <- time.Time{} })
+	require.True(t, stopped.Stop())
+	require.False(t, stopped.Stop())
+
+	c.Advance(3 * time.Second)
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatalf("should have fired")
+	}
+	select {
+	case <-fired:
+		t.Fatalf("stopped timer fired")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Reset re-arms a timer that has already fired.
+	timer := c.AfterFunc(time.Second, func() { fired <- c.Now() })
+	c.Advance(time.Second)
+	<-fired
+	require.False(t, timer.Reset(time.Second))
+	require.Equal(t, 1, c.Pending())
+	require.True(t, timer.Reset(2*time.Second))
+	c.Advance(time.Second)
+	require.Equal(t, 1, c.Pending())
+}
+
+func TestVirtualClock_Running(t *testing.T) {
+	c := NewVirtualClock(time.Unix(1000, 0))
+
+	release := make(chan struct{})
+	c.AfterFunc(time.Second, func() { <-release })
+	require.Equal(t, 0, c.Running())
+	c.Advance(time.Second)
+	require.Equal(t, 1, c.Running())
+
+	close(release)
+	for i := 0; c.Running() > 0; i++ {
+		require.True(t, i < 1000, "callback still running")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestVirtualClock_Ticker(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewVirtualClock(start)
+
+	tick := c.NewTicker(time.Second)
+	c.Advance(time.Second)
+	require.Equal(t, start.Add(time.Second), <-tick.C())
+
+	// Ticks are dropped for a slow receiver, like time.Ticker.
+	c.Advance(5 * time.Second)
+	require.Equal(t, start.Add(2*time.Second), <-tick.C())
+	select {
+	case <-tick.C():
+		t.Fatalf("should have dropped ticks")
+	default:
+	}
+
+	tick.Stop()
+	c.Advance(time.Second)
+	select {
+	case <-tick.C():
+		t.Fatalf("stopped ticker fired")
+	default:
+	}
+	require.Equal(t, start.Add(7*time.Second), c.Now())
+}
+
+func TestVirtualClock_Advance(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewVirtualClock(start)
+
+	// A single advance fires every timer at its own deadline.
+	delays := []time.Duration{3 * time.Second, time.Second, 2 * time.Second}
+	var chs []<-chan time.Time
+	for _, d := range delays {
+		chs = append(chs, c.After(d))
+	}
+	c.Advance(5 * time.Second)
+	for i, ch := range chs {
+		require.Equal(t, start.Add(delays[i]), <-ch)
+	}
+	require.Equal(t, start.Add(5*time.Second), c.Now())
+}
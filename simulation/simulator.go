@@ -0,0 +1,357 @@
+// Package simulation runs many memberlist nodes in a single process on a
+// virtual clock, so that cluster-scale behavior such as convergence time
+// and the false positive rate of the failure detector can be measured
+// without waiting out real protocol intervals.
+//
+// Every node is a real *memberlist.Memberlist talking over a
+// memberlist.MockNetwork. Every time source they use, from protocol timers
+// to packet timestamps, comes from a shared VirtualClock that the Simulator
+// advances in fixed steps, so wall-clock time never enters the results.
+// After each step the simulator yields to the nodes' goroutines until no
+// packets are queued and no timer callbacks are running. Those goroutines
+// are still scheduled by the Go runtime, so the order in which concurrent
+// messages are handled can vary from run to run.
+package simulation
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Config describes a simulated cluster.
+type Config struct {
+	// Nodes is the number of members to start.
+	Nodes int
+
+	// Configure, if set, is called for every node's config before it is
+	// created. Name, Transport, Clock and Events are already set and
+	// should be left alone. The default is DefaultLANConfig with logging
+	// discarded.
+	Configure func(i int, c *memberlist.Config)
+
+	// Step is how far the virtual clock moves at a time. Smaller steps
+	// resolve timeouts more precisely at the cost of more settling.
+	Step time.Duration
+
+	// Settle is how many times in a row the simulator yields to the nodes
+	// after each step, finding no packets queued and no timer callbacks
+	// running, before it takes the next step. More trades speed for
+	// fidelity on a busy machine.
+	Settle int
+}
+
+// DefaultConfig returns a config for n nodes with a 10ms step.
+func DefaultConfig(n int) *Config {
+	return &Config{
+		Nodes:  n,
+		Step:   10 * time.Millisecond,
+		Settle: 100,
+	}
+}
+
+// Report summarizes what the simulator observed since the last failure was
+// injected, or since the cluster started if there were none.
+type Report struct {
+	// Nodes is the number of members still running.
+	Nodes int
+
+	// Failed is the number of members that have been failed.
+	Failed int
+
+	// Converged is true once every running member sees exactly the set of
+	// running members.
+	Converged bool
+
+	// ConvergenceTime is the virtual time it took to converge.
+	ConvergenceTime time.Duration
+
+	// FalsePositives is the number of times a running member declared
+	// another running member dead.
+	FalsePositives int
+
+	// FalsePositiveRate is FalsePositives divided by the number of
+	// (observer, subject) pairs among running members.
+	FalsePositiveRate float64
+}
+
+// String formats the report on one line.
+func (r Report) String() string {
+	return fmt.Sprintf("nodes=%d failed=%d converged=%v time=%s false_positives=%d (%.4f%%)",
+		r.Nodes, r.Failed, r.Converged, r.ConvergenceTime, r.FalsePositives, 100*r.FalsePositiveRate)
+}
+
+// Simulator drives a cluster of memberlists on a VirtualClock.
+type Simulator struct {
+	config *Config
+	clock  *VirtualClock
+	net    *memberlist.MockNetwork
+
+	nodes      []*simNode
+	transports []*memberlist.MockTransport
+	stopCh     chan struct{}
+
+	l              sync.Mutex
+	failed         map[string]bool
+	falsePositives int
+	since          time.Time // Start of the current measurement
+	convergedAt    time.Time // Zero until convergence is seen
+}
+
+// simNode is one member of the simulated cluster.
+type simNode struct {
+	name   string
+	list   *memberlist.Memberlist
+	failed bool
+}
+
+// New starts the cluster described by conf and joins every node to the
+// first one. The members only learn about each other through the protocol,
+// so call RunUntilConverged before injecting failures.
+func New(conf *Config) (*Simulator, error) {
+	if conf.Nodes < 1 {
+		return nil, fmt.Errorf("simulation: need at least one node")
+	}
+	if conf.Step <= 0 {
+		return nil, fmt.Errorf("simulation: step must be positive")
+	}
+
+	clock := NewVirtualClock(time.Now())
+	s := &Simulator{
+		config: conf,
+		clock:  clock,
+		net:    &memberlist.MockNetwork{Clock: clock},
+		stopCh: make(chan struct{}),
+		failed: make(map[string]bool),
+		since:  clock.Now(),
+	}
+
+	for i := 0; i < conf.Nodes; i++ {
+		t := s.net.NewTransport()
+		s.transports = append(s.transports, t)
+
+		c := memberlist.DefaultLANConfig()
+		c.LogOutput = ioutil.Discard
+		if conf.Configure != nil {
+			conf.Configure(i, c)
+		}
+		c.Name = fmt.Sprintf("node-%d", i)
+		c.Transport = t
+		c.Clock = clock
+		c.Events = &simEvents{sim: s, observer: c.Name}
+
+		list, err := memberlist.Create(c)
+		if err != nil {
+			s.Shutdown()
+			return nil, fmt.Errorf("simulation: failed to start %s: %v", c.Name, err)
+		}
+		s.nodes = append(s.nodes, &simNode{name: c.Name, list: list})
+	}
+
+	seed := []string{s.nodes[0].list.LocalNode().Address()}
+	for _, n := range s.nodes[1:] {
+		if _, err := n.list.Join(seed); err != nil {
+			s.Shutdown()
+			return nil, fmt.Errorf("simulation: %s failed to join: %v", n.name, err)
+		}
+	}
+	return s, nil
+}
+
+// Clock returns the virtual clock shared by all nodes.
+func (s *Simulator) Clock() *VirtualClock {
+	return s.clock
+}
+
+// Network returns the mock network the nodes talk over, which can be used
+// to inject faults.
+func (s *Simulator) Network() *memberlist.MockNetwork {
+	return s.net
+}
+
+// Node returns the memberlist for the i-th node.
+func (s *Simulator) Node(i int) *memberlist.Memberlist {
+	return s.nodes[i].list
+}
+
+// Run advances the cluster by d of virtual time.
+func (s *Simulator) Run(d time.Duration) {
+	for elapsed := time.Duration(0); elapsed < d; elapsed += s.config.Step {
+		s.step()
+	}
+}
+
+// RunUntilConverged advances the cluster until every running member sees
+// exactly the running set, or until max virtual time has passed, and
+// returns the report at that point.
+func (s *Simulator) RunUntilConverged(max time.Duration) Report {
+	for elapsed := time.Duration(0); elapsed < max; elapsed += s.config.Step {
+		s.step()
+		if s.hasConverged() {
+			break
+		}
+	}
+	return s.Report()
+}
+
+// Fail crashes the given nodes without a graceful leave. Their addresses
+// silently drop everything sent to them from then on. This starts a new
+// measurement for the report.
+func (s *Simulator) Fail(indexes ...int) {
+	for _, i := range indexes {
+		n := s.nodes[i]
+		if n.failed {
+			continue
+		}
+		n.failed = true
+		n.list.Shutdown()
+		go blackhole(s.transports[i], s.stopCh)
+
+		s.l.Lock()
+		s.failed[n.name] = true
+		s.l.Unlock()
+	}
+
+	s.l.Lock()
+	s.falsePositives = 0
+	s.since = s.clock.Now()
+	s.convergedAt = time.Time{}
+	s.l.Unlock()
+}
+
+// Report summarizes the current measurement.
+func (s *Simulator) Report() Report {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	r := Report{
+		Failed:         len(s.failed),
+		Nodes:          len(s.nodes) - len(s.failed),
+		Converged:      !s.convergedAt.IsZero(),
+		FalsePositives: s.falsePositives,
+	}
+	if r.Converged {
+		r.ConvergenceTime = s.convergedAt.Sub(s.since)
+	}
+	if pairs := r.Nodes * (r.Nodes - 1); pairs > 0 {
+		r.FalsePositiveRate = float64(r.FalsePositives) / float64(pairs)
+	}
+	return r
+}
+
+// Shutdown stops every node.
+func (s *Simulator) Shutdown() {
+	for _, n := range s.nodes {
+		if !n.failed {
+			n.list.Shutdown()
+		}
+	}
+	close(s.stopCh)
+}
+
+// step advances the clock once and lets the nodes react. It keeps yielding
+// while any node still has packets queued or a timer callback is running, so
+// that a slow host shows up as a slower simulation rather than as spurious
+// timeouts.
+func (s *Simulator) step() {
+	s.clock.Advance(s.config.Step)
+	for quiet := 0; quiet < s.config.Settle; {
+		runtime.Gosched()
+		if s.busy() {
+			quiet = 0
+		} else {
+			quiet++
+		}
+	}
+}
+
+// busy reports whether any transport has undelivered packets or any timer
+// callback, such as a delayed packet delivery, is still running.
+func (s *Simulator) busy() bool {
+	if s.clock.Running() > 0 {
+		return true
+	}
+	for _, t := range s.transports {
+		if len(t.PacketCh()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasConverged checks, and records, whether every running member sees
+// exactly the running set.
+func (s *Simulator) hasConverged() bool {
+	s.l.Lock()
+	done := !s.convergedAt.IsZero()
+	s.l.Unlock()
+	if done {
+		return true
+	}
+
+	live := 0
+	for _, n := range s.nodes {
+		if !n.failed {
+			live++
+		}
+	}
+	for _, n := range s.nodes {
+		if n.failed {
+			continue
+		}
+		if n.list.NumMembers() != live {
+			return false
+		}
+		s.l.Lock()
+		for _, m := range n.list.Members() {
+			if s.failed[m.Name] {
+				s.l.Unlock()
+				return false
+			}
+		}
+		s.l.Unlock()
+	}
+
+	s.l.Lock()
+	s.convergedAt = s.clock.Now()
+	s.l.Unlock()
+	return true
+}
+
+// blackhole discards everything sent to a failed node's transport, so that
+// stream dials fail fast instead of waiting on a listener that is gone.
+func blackhole(t *memberlist.MockTransport, stopCh chan struct{}) {
+	for {
+		select {
+		case <-t.PacketCh():
+		case conn := <-t.StreamCh():
+			conn.Close()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// simEvents counts false positives as seen by one node.
+type simEvents struct {
+	sim      *Simulator
+	observer string
+}
+
+func (e *simEvents) NotifyJoin(*memberlist.Node) {}
+
+func (e *simEvents) NotifyUpdate(*memberlist.Node) {}
+
+// NotifyLeave counts a false positive if neither side has been failed.
+func (e *simEvents) NotifyLeave(n *memberlist.Node) {
+	s := e.sim
+	s.l.Lock()
+	defer s.l.Unlock()
+	if !s.failed[n.Name] && !s.failed[e.observer] {
+		s.falsePositives++
+	}
+}
@@ -0,0 +1,63 @@
+package simulation
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulator_Converge(t *testing.T) {
+	conf := DefaultConfig(16)
+	conf.Step = 25 * time.Millisecond
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	start := time.Now()
+	r := s.RunUntilConverged(time.Minute)
+	t.Logf("join: %s (real %s)", r, time.Since(start))
+	require.True(t, r.Converged)
+	require.Equal(t, 16, r.Nodes)
+
+	start = time.Now()
+	s.Fail(3, 11)
+	r = s.RunUntilConverged(5 * time.Minute)
+	t.Logf("failure: %s (real %s)", r, time.Since(start))
+	require.True(t, r.Converged)
+	require.Equal(t, 14, r.Nodes)
+	require.Equal(t, 2, r.Failed)
+	for _, m := range s.Node(0).Members() {
+		require.NotEqual(t, "node-3", m.Name)
+		require.NotEqual(t, "node-11", m.Name)
+	}
+
+	// Suspicion timeouts are many probe intervals long, so this can only
+	// have passed quickly in real time on the virtual clock.
+	require.True(t, r.ConvergenceTime > time.Second)
+}
+
+// Runs a thousand node cluster through a join and a failure. This takes
+// several minutes of real time, so it only runs in integration mode.
+func TestSimulator_Large(t *testing.T) {
+	if os.Getenv("INTEG_TESTS") == "" {
+		t.SkipNow()
+	}
+
+	conf := DefaultConfig(1000)
+	conf.Step = 25 * time.Millisecond
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	r := s.RunUntilConverged(5 * time.Minute)
+	t.Logf("join: %s", r)
+	require.True(t, r.Converged)
+
+	s.Fail(3, 11, 500)
+	r = s.RunUntilConverged(5 * time.Minute)
+	t.Logf("failure: %s", r)
+	require.True(t, r.Converged)
+	require.Equal(t, 997, r.Nodes)
+}
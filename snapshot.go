@@ -0,0 +1,439 @@
+package memberlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+/*
+
+The snapshot is an append-only text log with one entry per line:
+
+ alive: <name> <addr:port>   node became alive or changed address
+ not-alive: <name>           node died or left
+ incarnation: <n>            our incarnation number changed
+ leave                       we left the cluster on purpose
+
+Replaying it gives the members to rejoin and the incarnation to resume
+from. Once the log is much larger than the state it describes, it is
+rewritten with only the live entries.
+
+*/
+
+const (
+	// snapshotFlushInterval is how often buffered entries are written out.
+	snapshotFlushInterval = 500 * time.Millisecond
+
+	// snapshotCompactMinSize is the smallest log we bother to compact, and
+	// snapshotCompactFactor how much larger than its live entries the log
+	// may grow before it is compacted.
+	snapshotCompactMinSize = 128 * 1024
+	snapshotCompactFactor  = 2
+
+	// snapshotEventBuffer is how many entries may be queued before the
+	// state changes that produce them are dropped.
+	snapshotEventBuffer = 1024
+)
+
+type snapshotOp uint8
+
+const (
+	snapAlive snapshotOp = iota
+	snapNotAlive
+	snapIncarnation
+	snapLeave
+)
+
+// snapshotEvent is a single change queued for the snapshot log.
+type snapshotEvent struct {
+	op          snapshotOp
+	name        string
+	addr        string
+	incarnation uint32
+}
+
+// snapshotSource reads the current membership, for a snapshotter that has
+// dropped changes. It calls discard at a point where no changes can be
+// queued, so that everything queued afterwards is newer than what it
+// returns.
+type snapshotSource func(discard func()) (nodes map[string]string, incarnation uint32, left bool)
+
+// snapshotter records membership changes to disk so that a restarted node
+// can resume its incarnation and rejoin the members it knew. Changes are
+// queued on a channel and written by a separate goroutine, so callers that
+// hold the nodeLock never wait on the disk. If the writer falls so far
+// behind that the queue fills up, changes are dropped instead, and the log
+// is rewritten from the source once it catches up.
+type snapshotter struct {
+	path   string
+	fh     *os.File
+	buf    *bufio.Writer
+	offset int64
+
+	// The state described by the log, used for compaction.
+	aliveNodes  map[string]string
+	incarnation uint32
+	left        bool
+
+	// What the log held when we started, for restoring and rejoining.
+	prevNodes       map[string]string
+	prevIncarnation uint32
+
+	source  snapshotSource
+	dropped uint32 // Changes dropped since the last rewrite, accessed atomically
+
+	eventCh    chan snapshotEvent
+	clock      Clock
+	shutdownCh <-chan struct{}
+	doneCh     chan struct{}
+	logger     *log.Logger
+}
+
+// newSnapshotter replays the snapshot at path, if any, and starts recording
+// new changes to it, flushing them on the given clock. Recording stops when
+// shutdownCh is closed.
+func newSnapshotter(path string, source snapshotSource, clock Clock, logger *log.Logger, shutdownCh <-chan struct{}) (*snapshotter, error) {
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open snapshot: %v", err)
+	}
+
+	s := &snapshotter{
+		path:       path,
+		fh:         fh,
+		buf:        bufio.NewWriter(fh),
+		aliveNodes: make(map[string]string),
+		source:     source,
+		eventCh:    make(chan snapshotEvent, snapshotEventBuffer),
+		clock:      clock,
+		shutdownCh: shutdownCh,
+		doneCh:     make(chan struct{}),
+		logger:     logger,
+	}
+	if err := s.replay(); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	s.prevNodes = make(map[string]string, len(s.aliveNodes))
+	for name, addr := range s.aliveNodes {
+		s.prevNodes[name] = addr
+	}
+	s.prevIncarnation = s.incarnation
+
+	go s.run()
+	return s, nil
+}
+
+// replay rebuilds the state from the log on disk.
+func (s *snapshotter) replay() error {
+	if _, err := s.fh.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(s.fh)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Failed to read snapshot: %v", err)
+		}
+		s.offset += int64(len(line))
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case strings.HasPrefix(line, "alive: "):
+			info := strings.TrimPrefix(line, "alive: ")
+			idx := strings.LastIndex(info, " ")
+			if idx == -1 {
+				s.logger.Printf("[WARN] memberlist: Failed to parse snapshot line: %q", line)
+				continue
+			}
+			s.aliveNodes[info[:idx]] = info[idx+1:]
+			s.left = false
+
+		case strings.HasPrefix(line, "not-alive: "):
+			delete(s.aliveNodes, strings.TrimPrefix(line, "not-alive: "))
+
+		case strings.HasPrefix(line, "incarnation: "):
+			inc, err := strconv.ParseUint(strings.TrimPrefix(line, "incarnation: "), 10, 32)
+			if err != nil {
+				s.logger.Printf("[WARN] memberlist: Failed to parse snapshot incarnation: %v", err)
+				continue
+			}
+			s.incarnation = uint32(inc)
+
+		case line == "leave":
+			// Nothing to rejoin after a graceful leave.
+			s.aliveNodes = make(map[string]string)
+			s.left = true
+
+		case strings.HasPrefix(line, "#") || line == "":
+			continue
+
+		default:
+			s.logger.Printf("[WARN] memberlist: Unrecognized snapshot line: %q", line)
+		}
+	}
+
+	_, err := s.fh.Seek(0, io.SeekEnd)
+	return err
+}
+
+// alive, notAlive, setIncarnation and leave queue changes for the log.
+// They never block, see queue.
+func (s *snapshotter) alive(name, addr string) {
+	s.queue(snapshotEvent{op: snapAlive, name: name, addr: addr})
+}
+
+func (s *snapshotter) notAlive(name string) {
+	s.queue(snapshotEvent{op: snapNotAlive, name: name})
+}
+
+func (s *snapshotter) setIncarnation(inc uint32) {
+	s.queue(snapshotEvent{op: snapIncarnation, incarnation: inc})
+}
+
+func (s *snapshotter) leave() {
+	s.queue(snapshotEvent{op: snapLeave})
+}
+
+// queue hands a change to the writer. Callers hold the nodeLock, so if the
+// queue is full the change is dropped rather than wait, and the writer
+// rewrites the log from the source at its next flush.
+func (s *snapshotter) queue(e snapshotEvent) {
+	select {
+	case s.eventCh <- e:
+	default:
+		atomic.AddUint32(&s.dropped, 1)
+		metrics.IncrCounter([]string{"memberlist", "snapshot", "dropped"}, 1)
+	}
+}
+
+// wait blocks until the snapshot has been flushed and closed after shutdown.
+func (s *snapshotter) wait() {
+	<-s.doneCh
+}
+
+// run writes queued changes until shutdown.
+func (s *snapshotter) run() {
+	defer close(s.doneCh)
+
+	flush := s.clock.NewTicker(snapshotFlushInterval)
+	defer flush.Stop()
+
+	for {
+		select {
+		case e := <-s.eventCh:
+			s.record(e)
+
+		case <-flush.C():
+			s.resyncIfDropped()
+			if err := s.buf.Flush(); err != nil {
+				s.logger.Printf("[ERR] memberlist: Failed to flush snapshot: %v", err)
+			}
+
+		case <-s.shutdownCh:
+			s.drain()
+			s.resyncIfDropped()
+			if err := s.buf.Flush(); err != nil {
+				s.logger.Printf("[ERR] memberlist: Failed to flush snapshot: %v", err)
+			}
+			if err := s.fh.Sync(); err != nil {
+				s.logger.Printf("[ERR] memberlist: Failed to sync snapshot: %v", err)
+			}
+			s.fh.Close()
+			return
+		}
+	}
+}
+
+// drain records whatever was queued before shutdown.
+func (s *snapshotter) drain() {
+	for {
+		select {
+		case e := <-s.eventCh:
+			s.record(e)
+		default:
+			return
+		}
+	}
+}
+
+// discard throws away whatever is queued.
+func (s *snapshotter) discard() {
+	for {
+		select {
+		case <-s.eventCh:
+		default:
+			return
+		}
+	}
+}
+
+// resyncIfDropped replaces the state with the one from the source if any
+// changes were dropped, and rewrites the log to match.
+func (s *snapshotter) resyncIfDropped() {
+	dropped := atomic.SwapUint32(&s.dropped, 0)
+	if dropped == 0 {
+		return
+	}
+	s.logger.Printf("[WARN] memberlist: Dropped %d snapshot changes, rewriting snapshot", dropped)
+
+	nodes, inc, left := s.source(s.discard)
+	s.aliveNodes = nodes
+	if inc > s.incarnation {
+		s.incarnation = inc
+	}
+	s.left = left
+	if err := s.compact(); err != nil {
+		s.logger.Printf("[ERR] memberlist: Failed to compact snapshot: %v", err)
+	}
+}
+
+// record applies a change to the state and appends it to the log.
+func (s *snapshotter) record(e snapshotEvent) {
+	var line string
+	switch e.op {
+	case snapAlive:
+		if s.aliveNodes[e.name] == e.addr {
+			return
+		}
+		s.aliveNodes[e.name] = e.addr
+		s.left = false
+		line = fmt.Sprintf("alive: %s %s\n", e.name, e.addr)
+
+	case snapNotAlive:
+		if _, ok := s.aliveNodes[e.name]; !ok {
+			return
+		}
+		delete(s.aliveNodes, e.name)
+		line = fmt.Sprintf("not-alive: %s\n", e.name)
+
+	case snapIncarnation:
+		if e.incarnation <= s.incarnation {
+			return
+		}
+		s.incarnation = e.incarnation
+		line = fmt.Sprintf("incarnation: %d\n", e.incarnation)
+
+	case snapLeave:
+		s.aliveNodes = make(map[string]string)
+		s.left = true
+		line = "leave\n"
+	}
+
+	n, err := s.buf.WriteString(line)
+	s.offset += int64(n)
+	if err != nil {
+		s.logger.Printf("[ERR] memberlist: Failed to write to snapshot: %v", err)
+		return
+	}
+
+	if s.offset > s.compactThreshold() {
+		if err := s.compact(); err != nil {
+			s.logger.Printf("[ERR] memberlist: Failed to compact snapshot: %v", err)
+		}
+	}
+}
+
+// compactThreshold returns the log size that triggers a compaction.
+func (s *snapshotter) compactThreshold() int64 {
+	var live int64
+	for name, addr := range s.aliveNodes {
+		live += int64(len("alive:   \n") + len(name) + len(addr))
+	}
+	if threshold := live * snapshotCompactFactor; threshold > snapshotCompactMinSize {
+		return threshold
+	}
+	return snapshotCompactMinSize
+}
+
+// compact rewrites the log with only the entries needed to rebuild the
+// current state, then swaps it in place of the old one.
+func (s *snapshotter) compact() error {
+	defer metrics.MeasureSince([]string{"memberlist", "snapshot", "compact"}, time.Now())
+
+	tmpPath := s.path + ".compact"
+	fh, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(fh)
+
+	var offset int64
+	write := func(line string) {
+		n, _ := buf.WriteString(line)
+		offset += int64(n)
+	}
+	if s.incarnation > 0 {
+		write(fmt.Sprintf("incarnation: %d\n", s.incarnation))
+	}
+	for name, addr := range s.aliveNodes {
+		write(fmt.Sprintf("alive: %s %s\n", name, addr))
+	}
+	if s.left {
+		write("leave\n")
+	}
+
+	if err := buf.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+
+	// Flush the old log before replacing it, so nothing is lost if the
+	// rename fails and we keep appending to it.
+	if err := s.buf.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		fh.Close()
+		return err
+	}
+
+	s.fh.Close()
+	s.fh = fh
+	s.buf = bufio.NewWriter(fh)
+	s.offset = offset
+	return nil
+}
+
+// snapshotState is the snapshotSource for our snapshotter. Changes are only
+// queued with the nodeLock held, apart from incarnations, which can't go
+// backwards, so discard is called with it held too.
+func (m *Memberlist) snapshotState(discard func()) (map[string]string, uint32, bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	discard()
+
+	nodes := make(map[string]string)
+	left := false
+	for _, n := range m.nodes {
+		if n.Name == m.config.Name && n.DeadOrLeft() {
+			left = true
+		}
+		if !n.DeadOrLeft() {
+			nodes[n.Name] = n.Address()
+		}
+	}
+
+	// After a leave there's nothing to rejoin, as when the log is replayed
+	if left {
+		nodes = make(map[string]string)
+	}
+	return nodes, atomic.LoadUint32(&m.incarnation), left
+}
@@ -0,0 +1,225 @@
+package memberlist
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testSnapshotter keeps track of the membership it's told about, like the
+// memberlist would, to act as the source if changes are dropped.
+type testSnapshotter struct {
+	*snapshotter
+
+	l     sync.Mutex
+	nodes map[string]string
+	inc   uint32
+	left  bool
+}
+
+func newTestSnapshotter(t *testing.T, path string) (*testSnapshotter, chan struct{}) {
+	shutdownCh := make(chan struct{})
+	ts := &testSnapshotter{nodes: make(map[string]string)}
+	s, err := newSnapshotter(path, ts.source, realClock{}, testLogger(t), shutdownCh)
+	require.NoError(t, err)
+	ts.snapshotter = s
+	return ts, shutdownCh
+}
+
+func (ts *testSnapshotter) source(discard func()) (map[string]string, uint32, bool) {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	discard()
+
+	nodes := make(map[string]string, len(ts.nodes))
+	for name, addr := range ts.nodes {
+		nodes[name] = addr
+	}
+	return nodes, ts.inc, ts.left
+}
+
+func (ts *testSnapshotter) alive(name, addr string) {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	ts.nodes[name] = addr
+	ts.left = false
+	ts.snapshotter.alive(name, addr)
+}
+
+func (ts *testSnapshotter) notAlive(name string) {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	delete(ts.nodes, name)
+	ts.snapshotter.notAlive(name)
+}
+
+func (ts *testSnapshotter) setIncarnation(inc uint32) {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	ts.inc = inc
+	ts.snapshotter.setIncarnation(inc)
+}
+
+func (ts *testSnapshotter) leave() {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	ts.nodes = make(map[string]string)
+	ts.left = true
+	ts.snapshotter.leave()
+}
+
+func TestSnapshotter_Replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snap")
+
+	s, shutdownCh := newTestSnapshotter(t, path)
+	require.Empty(t, s.prevNodes)
+	s.setIncarnation(3)
+	s.alive("a", "127.0.0.1:7946")
+	s.alive("b", "127.0.0.2:7946")
+	s.alive("c", "127.0.0.3:7946")
+	s.notAlive("b")
+	s.alive("c", "127.0.0.4:7946")
+	s.setIncarnation(7)
+	close(shutdownCh)
+	s.wait()
+
+	s, shutdownCh = newTestSnapshotter(t, path)
+	require.Equal(t, uint32(7), s.prevIncarnation)
+	require.Equal(t, map[string]string{
+		"a": "127.0.0.1:7946",
+		"c": "127.0.0.4:7946",
+	}, s.prevNodes)
+
+	// After a graceful leave there is nothing to rejoin, but the
+	// incarnation survives.
+	s.leave()
+	close(shutdownCh)
+	s.wait()
+
+	s, shutdownCh = newTestSnapshotter(t, path)
+	require.Equal(t, uint32(7), s.prevIncarnation)
+	require.Empty(t, s.prevNodes)
+	close(shutdownCh)
+	s.wait()
+}
+
+func TestSnapshotter_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snap")
+
+	// Churn through far more entries than the compaction threshold.
+	s, shutdownCh := newTestSnapshotter(t, path)
+	for i := 0; i < 10000; i++ {
+		name := fmt.Sprintf("node-%d", i%50)
+		s.alive(name, fmt.Sprintf("127.0.0.1:%d", 7000+i))
+		if i%3 == 0 {
+			s.notAlive(name)
+		}
+	}
+	s.setIncarnation(42)
+	close(shutdownCh)
+	s.wait()
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.True(t, fi.Size() <= snapshotCompactMinSize, "snapshot is %d bytes", fi.Size())
+
+	// Compaction kept the live state.
+	expect := make(map[string]string)
+	for i := 9950; i < 10000; i++ {
+		if i%3 != 0 {
+			expect[fmt.Sprintf("node-%d", i%50)] = fmt.Sprintf("127.0.0.1:%d", 7000+i)
+		}
+	}
+	s, shutdownCh = newTestSnapshotter(t, path)
+	require.Equal(t, uint32(42), s.prevIncarnation)
+	require.Equal(t, expect, s.prevNodes)
+	close(shutdownCh)
+	s.wait()
+}
+
+func TestSnapshotter_Dropped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snap")
+
+	s, shutdownCh := newTestSnapshotter(t, path)
+	s.setIncarnation(3)
+	s.alive("a", "127.0.0.1:7946")
+	s.alive("b", "127.0.0.2:7946")
+
+	// Pretend b's death and a new incarnation didn't fit in the queue.
+	s.l.Lock()
+	delete(s.nodes, "b")
+	s.inc = 5
+	s.l.Unlock()
+	atomic.AddUint32(&s.dropped, 1)
+	close(shutdownCh)
+	s.wait()
+
+	// The log was rewritten from the source.
+	s, shutdownCh = newTestSnapshotter(t, path)
+	require.Equal(t, uint32(5), s.prevIncarnation)
+	require.Equal(t, map[string]string{"a": "127.0.0.1:7946"}, s.prevNodes)
+
+	// Once nothing is reading the queue, changes are dropped rather
+	// than block.
+	close(shutdownCh)
+	s.wait()
+	for i := 0; i < 2*snapshotEventBuffer; i++ {
+		s.snapshotter.alive(fmt.Sprintf("node-%d", i), "127.0.0.1:7946")
+	}
+	require.True(t, atomic.LoadUint32(&s.dropped) >= snapshotEventBuffer)
+}
+
+func TestMemberlist_SnapshotRejoin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c1 := testConfig(t)
+	m1, err := Create(c1)
+	require.NoError(t, err)
+	defer m1.Shutdown()
+
+	c2 := testConfig(t)
+	c2.BindPort = m1.config.BindPort
+	c2.SnapshotPath = filepath.Join(dir, "snap")
+	m2, err := Create(c2)
+	require.NoError(t, err)
+
+	_, err = m2.Join([]string{m1.config.BindAddr})
+	require.NoError(t, err)
+	waitUntilSize(t, m1, 2)
+	waitUntilSize(t, m2, 2)
+	require.NoError(t, m2.Shutdown())
+	m1.nodeLock.RLock()
+	prevInc := m1.nodeMap[c2.Name].Incarnation
+	m1.nodeLock.RUnlock()
+
+	// Restart without joining anyone; the snapshot brings us back.
+	c3 := testConfig(t)
+	c3.Name = c2.Name
+	c3.BindAddr = c2.BindAddr
+	c3.BindPort = c2.BindPort
+	c3.SnapshotPath = c2.SnapshotPath
+	m3, err := Create(c3)
+	require.NoError(t, err)
+	defer m3.Shutdown()
+
+	waitUntilSize(t, m3, 2)
+	inc := atomic.LoadUint32(&m3.incarnation)
+	require.True(t, inc > prevInc, "incarnation %d not above %d", inc, prevInc)
+}
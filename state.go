@@ -11,17 +11,35 @@ import (
 	"time"
 
 	metrics "github.com/armon/go-metrics"
+	"golang.org/x/crypto/ed25519"
 )
 
-type nodeStateType int
+// NodeStateType is the state of a node as we see it.
+type NodeStateType int
 
 const (
-	stateAlive nodeStateType = iota
-	stateSuspect
-	stateDead
-	stateLeft
+	StateAlive NodeStateType = iota
+	StateSuspect
+	StateDead
+	StateLeft
 )
 
+// String returns the name of the state.
+func (t NodeStateType) String() string {
+	switch t {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	case StateLeft:
+		return "left"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
 // Node represents a node in the cluster.
 type Node struct {
 	Name string
@@ -34,6 +52,9 @@ type Node struct {
 	DMin uint8  // Min protocol version for the delegate to understand
 	DMax uint8  // Max protocol version for the delegate to understand
 	DCur uint8  // Current version delegate is speaking
+	Zone string // Zone the node advertised, see Config.Zone
+
+	compression []compressionType // Compression algorithms this understands
 }
 
 // Address returns the host:port form of a node's address, suitable for use
@@ -51,8 +72,33 @@ func (n *Node) String() string {
 type nodeState struct {
 	Node
 	Incarnation uint32        // Last known incarnation number
-	State       nodeStateType // Current state
+	State       NodeStateType // Current state
 	StateChange time.Time     // Time last state change happened
+
+	pubKey   ed25519.PublicKey // Key that signed the alive for Incarnation, if any
+	sig      []byte            // Signature of that alive message
+	leaveSig []byte            // Signature of the node's leave, if it left
+}
+
+// NodeStatus is a snapshot of our view of a node, as returned by
+// Memberlist.NodeStates.
+type NodeStatus struct {
+	Node
+	State       NodeStateType
+	Incarnation uint32    // Last known incarnation number
+	StateChange time.Time // Time the node entered State
+
+	// Confirmations is the number of other nodes that have independently
+	// suspected a suspect node, and SuspicionTimeout is how much longer we
+	// will wait for it to refute before declaring it dead. Each new
+	// confirmation shortens the timeout. Both are zero for nodes that
+	// aren't suspect.
+	Confirmations    int
+	SuspicionTimeout time.Duration
+
+	// Suspicion is the level reported by the FailureDetector, see
+	// Memberlist.SuspicionLevel.
+	Suspicion float64
 }
 
 // Address returns the host:port form of a node's address, suitable for use
@@ -62,14 +108,14 @@ func (n *nodeState) Address() string {
 }
 
 func (n *nodeState) DeadOrLeft() bool {
-	return n.State == stateDead || n.State == stateLeft
+	return n.State == StateDead || n.State == StateLeft
 }
 
 // ackHandler is used to register handlers for incoming acks and nacks.
 type ackHandler struct {
 	ackFn  func([]byte, time.Time)
 	nackFn func()
-	timer  *time.Timer
+	timer  Timer
 }
 
 // NoPingResponseError is used to indicate a 'ping' packet was
@@ -101,8 +147,8 @@ func (m *Memberlist) schedule() {
 
 	// Create a new probeTicker
 	if m.config.ProbeInterval > 0 {
-		t := time.NewTicker(m.config.ProbeInterval)
-		go m.triggerFunc(m.config.ProbeInterval, t.C, stopCh, m.probe)
+		t := m.clock.NewTicker(m.config.ProbeInterval)
+		go m.triggerFunc(m.config.ProbeInterval, t.C(), stopCh, m.probe)
 		m.tickers = append(m.tickers, t)
 	}
 
@@ -113,11 +159,24 @@ func (m *Memberlist) schedule() {
 
 	// Create a gossip ticker if needed
 	if m.config.GossipInterval > 0 && m.config.GossipNodes > 0 {
-		t := time.NewTicker(m.config.GossipInterval)
-		go m.triggerFunc(m.config.GossipInterval, t.C, stopCh, m.gossip)
+		t := m.clock.NewTicker(m.config.GossipInterval)
+		go m.triggerFunc(m.config.GossipInterval, t.C(), stopCh, m.gossip)
 		m.tickers = append(m.tickers, t)
 	}
 
+	// Create a path MTU discovery ticker if needed. Probes that could be
+	// fragmented would tell us nothing, so without a way to stop that we
+	// stick with UDPBufferSize.
+	if m.config.MTUDiscoveryInterval > 0 {
+		if _, ok := m.transport.(DontFragmentTransport); ok {
+			t := m.clock.NewTicker(m.config.MTUDiscoveryInterval)
+			go m.triggerFunc(m.config.MTUDiscoveryInterval, t.C(), stopCh, m.discoverMTU)
+			m.tickers = append(m.tickers, t)
+		} else {
+			m.logger.Printf("[WARN] memberlist: Transport can't send packets without fragmenting them, path MTU discovery is disabled")
+		}
+	}
+
 	// If we made any tickers, then record the stopTick channel for
 	// later.
 	if len(m.tickers) > 0 {
@@ -131,7 +190,7 @@ func (m *Memberlist) triggerFunc(stagger time.Duration, C <-chan time.Time, stop
 	// Use a random stagger to avoid syncronizing
 	randStagger := time.Duration(uint64(rand.Int63()) % uint64(stagger))
 	select {
-	case <-time.After(randStagger):
+	case <-m.clock.After(randStagger):
 	case <-stop:
 		return
 	}
@@ -155,7 +214,7 @@ func (m *Memberlist) pushPullTrigger(stop <-chan struct{}) {
 	// Use a random stagger to avoid syncronizing
 	randStagger := time.Duration(uint64(rand.Int63()) % uint64(interval))
 	select {
-	case <-time.After(randStagger):
+	case <-m.clock.After(randStagger):
 	case <-stop:
 		return
 	}
@@ -164,7 +223,7 @@ func (m *Memberlist) pushPullTrigger(stop <-chan struct{}) {
 	for {
 		tickTime := pushPullScale(interval, m.estNumNodes())
 		select {
-		case <-time.After(tickTime):
+		case <-m.clock.After(tickTime):
 			m.pushPull()
 		case <-stop:
 			return
@@ -286,7 +345,7 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	// a bit, but it's the best we can do. We had originally put this right
 	// after the I/O, but that would sometimes give negative RTT measurements
 	// which was not desirable.
-	sent := time.Now()
+	sent := m.clock.Now()
 
 	// Send a ping to the node. If this node looks like it's suspect or dead,
 	// also tack on a suspect message so that it has a chance to refute as
@@ -299,7 +358,7 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	defer func() {
 		m.awareness.ApplyDelta(awarenessDelta)
 	}()
-	if node.State == stateAlive {
+	if node.State == StateAlive {
 		if err := m.encodeAndSendMsg(addr, pingMsg, &ping); err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to send ping: %s", err)
 			if failedRemote(err) {
@@ -346,9 +405,11 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	select {
 	case v := <-ackCh:
 		if v.Complete == true {
-			if m.config.Ping != nil {
-				rtt := v.Timestamp.Sub(sent)
-				m.config.Ping.NotifyPingComplete(&node.Node, rtt, v.Payload)
+			rtt := v.Timestamp.Sub(sent)
+			m.rtts.Observe(node.Name, rtt)
+			m.detector.Observe(ProbeResult{Node: node.Name, Time: m.clock.Now(), Acked: true, RTT: rtt})
+			if m.ping != nil {
+				m.ping.NotifyPingComplete(&node.Node, rtt, v.Payload)
 			}
 			return
 		}
@@ -358,7 +419,7 @@ func (m *Memberlist) probeNode(node *nodeState) {
 		if v.Complete == false {
 			ackCh <- v
 		}
-	case <-time.After(m.config.ProbeTimeout):
+	case <-m.clock.After(m.probeTimeout(node.Name)):
 		// Note that we don't scale this timeout based on awareness and
 		// the health score. That's because we don't really expect waiting
 		// longer to help get UDP through. Since health does extend the
@@ -371,10 +432,10 @@ func (m *Memberlist) probeNode(node *nodeState) {
 HANDLE_REMOTE_FAILURE:
 	// Get some random live nodes.
 	m.nodeLock.RLock()
-	kNodes := kRandomNodes(m.config.IndirectChecks, m.nodes, func(n *nodeState) bool {
+	kNodes := m.indirectProbeNodes(m.config.IndirectChecks, func(n *nodeState) bool {
 		return n.Name == m.config.Name ||
 			n.Name == node.Name ||
-			n.State != stateAlive
+			n.State != StateAlive
 	})
 	m.nodeLock.RUnlock()
 
@@ -425,6 +486,7 @@ HANDLE_REMOTE_FAILURE:
 	select {
 	case v := <-ackCh:
 		if v.Complete == true {
+			m.detector.Observe(ProbeResult{Node: node.Name, Time: m.clock.Now(), Acked: true})
 			return
 		}
 	}
@@ -435,6 +497,7 @@ HANDLE_REMOTE_FAILURE:
 	for didContact := range fallbackCh {
 		if didContact {
 			m.logger.Printf("[WARN] memberlist: Was able to connect to %s but other probes failed, network may be misconfigured", node.Name)
+			m.detector.Observe(ProbeResult{Node: node.Name, Time: m.clock.Now(), Acked: true})
 			return
 		}
 	}
@@ -447,15 +510,31 @@ HANDLE_REMOTE_FAILURE:
 	// decide if the probed node was really dead or if it was something wrong
 	// with ourselves.
 	awarenessDelta = 0
+	nackCount := len(nackCh)
 	if expectedNacks > 0 {
-		if nackCount := len(nackCh); nackCount < expectedNacks {
+		if nackCount < expectedNacks {
 			awarenessDelta += (expectedNacks - nackCount)
 		}
 	} else {
 		awarenessDelta += 1
 	}
 
-	// No acks received from target, suspect it as failed.
+	// No acks received from target, so let the failure detector decide
+	// whether that's enough to suspect it.
+	now := m.clock.Now()
+	m.detector.Observe(ProbeResult{
+		Node:          node.Name,
+		Time:          now,
+		Nacks:         nackCount,
+		ExpectedNacks: expectedNacks,
+	})
+	if !m.detector.Suspect(node.Name, now) {
+		m.logger.Printf("[DEBUG] memberlist: Failed probe of %s, but not suspecting it yet (suspicion %.2f)",
+			node.Name, m.detector.Suspicion(node.Name, now))
+		return
+	}
+
+	// Suspect it as failed.
 	m.logger.Printf("[INFO] memberlist: Suspect %s has failed, no acks received", node.Name)
 	s := suspect{Incarnation: node.Incarnation, Node: node.Name, From: m.config.Name}
 	m.suspectNode(&s)
@@ -476,7 +555,7 @@ func (m *Memberlist) Ping(node string, addr net.Addr) (time.Duration, error) {
 	// Mark the sent time here, which should be after any pre-processing and
 	// system calls to do the actual send. This probably under-reports a bit,
 	// but it's the best we can do.
-	sent := time.Now()
+	sent := m.clock.Now()
 
 	// Wait for response or timeout.
 	select {
@@ -484,7 +563,7 @@ func (m *Memberlist) Ping(node string, addr net.Addr) (time.Duration, error) {
 		if v.Complete == true {
 			return v.Timestamp.Sub(sent), nil
 		}
-	case <-time.After(m.config.ProbeTimeout):
+	case <-m.clock.After(m.config.ProbeTimeout):
 		// Timeout, return an error below.
 	}
 
@@ -499,11 +578,15 @@ func (m *Memberlist) resetNodes() {
 	defer m.nodeLock.Unlock()
 
 	// Move dead nodes, but respect gossip to the dead interval
-	deadIdx := moveDeadNodes(m.nodes, m.config.GossipToTheDeadTime)
+	deadIdx := moveDeadNodes(m.nodes, m.clock.Now(), m.config.GossipToTheDeadTime)
 
 	// Deregister the dead nodes
 	for i := deadIdx; i < len(m.nodes); i++ {
 		delete(m.nodeMap, m.nodes[i].Name)
+		m.rtts.Remove(m.nodes[i].Name)
+		m.detector.Remove(m.nodes[i].Name)
+		m.mtus.Remove(m.nodes[i].Name)
+		m.forgetCoordinate(m.nodes[i].Name)
 		m.nodes[i] = nil
 	}
 
@@ -531,18 +614,18 @@ func (m *Memberlist) gossip() {
 
 
 	// 随机获取 K 个节点
-	kNodes := kRandomNodes(m.config.GossipNodes, m.nodes, func(n *nodeState) bool {
+	kNodes := m.gossipNodes(m.config.GossipNodes, func(n *nodeState) bool {
 
 		if n.Name == m.config.Name {
 			return true
 		}
 
 		switch n.State {
-		case stateAlive, stateSuspect:
+		case StateAlive, StateSuspect:
 			return false
 
-		case stateDead:
-			return time.Since(n.StateChange) > m.config.GossipToTheDeadTime
+		case StateDead:
+			return m.clock.Now().Sub(n.StateChange) > m.config.GossipToTheDeadTime
 
 		default:
 			return true
@@ -550,17 +633,12 @@ func (m *Memberlist) gossip() {
 	})
 	m.nodeLock.RUnlock()
 
-	// Compute the bytes available
-	bytesAvail := m.config.UDPBufferSize - compoundHeaderOverhead
-	if m.config.EncryptionEnabled() {
-		bytesAvail -= encryptOverhead(m.encryptionVersion())
-	}
-
-
-
-
 	for _, node := range kNodes {
 
+		// Compute the bytes available, which depends on the path MTU to
+		// this node if we've discovered it.
+		bytesAvail := m.packetBudget(node.Name) - compoundHeaderOverhead - m.packetOverhead(&node.Node)
+
 		// Get any pending broadcasts
 		// 获取消息队列里的消息
 		msgs := m.getBroadcasts(compoundOverhead, bytesAvail)
@@ -598,7 +676,7 @@ func (m *Memberlist) pushPull() {
 	m.nodeLock.RLock()
 	nodes := kRandomNodes(1, m.nodes, func(n *nodeState) bool {
 		return n.Name == m.config.Name ||
-			n.State != stateAlive
+			n.State != StateAlive
 	})
 	m.nodeLock.RUnlock()
 
@@ -616,18 +694,16 @@ func (m *Memberlist) pushPull() {
 
 // pushPullNode does a complete state exchange with a specific node.
 func (m *Memberlist) pushPullNode(addr string, join bool) error {
+	// Peers that understand digests only need the nodes we disagree on,
+	// but joins always exchange everything
+	if !join && m.supportsDigest(addr) {
+		return m.pushPullDigestNode(addr)
+	}
+
 	defer metrics.MeasureSince([]string{"memberlist", "pushPullNode"}, time.Now())
 
 	// Attempt to send and receive with the node
-	remote, userState, err := m.sendAndReceiveState(addr, join)
-	if err != nil {
-		return err
-	}
-
-	if err := m.mergeRemoteState(join, remote, userState); err != nil {
-		return err
-	}
-	return nil
+	return m.sendAndReceiveState(addr, join)
 }
 
 // verifyProtocol verifies that all the remote nodes can speak with our
@@ -646,106 +722,118 @@ func (m *Memberlist) verifyProtocol(remote []pushNodeState) error {
 	m.nodeLock.RLock()
 	defer m.nodeLock.RUnlock()
 
+	v := newVersionCheck()
+	for i := range remote {
+		v.addRemote(&remote[i])
+	}
+	for _, n := range m.nodes {
+		v.addLocal(n)
+	}
+	return v.verify()
+}
+
+// versionCheck accumulates the version ranges and current versions of a set
+// of nodes, so that they can be verified against each other as described in
+// verifyProtocol without holding on to the nodes themselves.
+type versionCheck struct {
 	// Maximum minimum understood and minimum maximum understood for both
 	// the protocol and delegate versions. We use this to verify everyone
 	// can be understood.
-	var maxpmin, minpmax uint8
-	var maxdmin, mindmax uint8
-	minpmax = math.MaxUint8
-	mindmax = math.MaxUint8
-
-	for _, rn := range remote {
-		// If the node isn't alive, then skip it
-		if rn.State != stateAlive {
-			continue
-		}
-
-		// Skip nodes that don't have versions set, it just means
-		// their version is zero.
-		if len(rn.Vsn) == 0 {
-			continue
-		}
-
-		if rn.Vsn[0] > maxpmin {
-			maxpmin = rn.Vsn[0]
-		}
+	maxpmin, minpmax uint8
+	maxdmin, mindmax uint8
 
-		if rn.Vsn[1] < minpmax {
-			minpmax = rn.Vsn[1]
-		}
+	// The lowest and highest current versions, and who is speaking them.
+	pcur, dcur versionSpread
+}
 
-		if rn.Vsn[3] > maxdmin {
-			maxdmin = rn.Vsn[3]
-		}
+// versionSpread tracks the lowest and highest of a set of versions.
+type versionSpread struct {
+	min, max         uint8
+	minNode, maxNode string
+	seen             bool
+}
 
-		if rn.Vsn[4] < mindmax {
-			mindmax = rn.Vsn[4]
-		}
+func (s *versionSpread) add(node string, vsn uint8) {
+	if !s.seen || vsn < s.min {
+		s.min, s.minNode = vsn, node
 	}
-
-	for _, n := range m.nodes {
-		// Ignore non-alive nodes
-		if n.State != stateAlive {
-			continue
-		}
-
-		if n.PMin > maxpmin {
-			maxpmin = n.PMin
-		}
-
-		if n.PMax < minpmax {
-			minpmax = n.PMax
-		}
-
-		if n.DMin > maxdmin {
-			maxdmin = n.DMin
-		}
-
-		if n.DMax < mindmax {
-			mindmax = n.DMax
-		}
+	if !s.seen || vsn > s.max {
+		s.max, s.maxNode = vsn, node
 	}
+	s.seen = true
+}
 
-	// Now that we definitively know the minimum and maximum understood
-	// version that satisfies the whole cluster, we verify that every
-	// node in the cluster satisifies this.
-	for _, n := range remote {
-		var nPCur, nDCur uint8
-		if len(n.Vsn) > 0 {
-			nPCur = n.Vsn[2]
-			nDCur = n.Vsn[5]
-		}
-
-		if nPCur < maxpmin || nPCur > minpmax {
-			return fmt.Errorf(
-				"Node '%s' protocol version (%d) is incompatible: [%d, %d]",
-				n.Name, nPCur, maxpmin, minpmax)
-		}
-
-		if nDCur < maxdmin || nDCur > mindmax {
-			return fmt.Errorf(
-				"Node '%s' delegate protocol version (%d) is incompatible: [%d, %d]",
-				n.Name, nDCur, maxdmin, mindmax)
-		}
+func newVersionCheck() *versionCheck {
+	return &versionCheck{
+		minpmax: math.MaxUint8,
+		mindmax: math.MaxUint8,
 	}
+}
 
-	for _, n := range m.nodes {
-		nPCur := n.PCur
-		nDCur := n.DCur
+// addRange narrows the understood ranges by those of an alive node.
+func (v *versionCheck) addRange(pmin, pmax, dmin, dmax uint8) {
+	if pmin > v.maxpmin {
+		v.maxpmin = pmin
+	}
+	if pmax < v.minpmax {
+		v.minpmax = pmax
+	}
+	if dmin > v.maxdmin {
+		v.maxdmin = dmin
+	}
+	if dmax < v.mindmax {
+		v.mindmax = dmax
+	}
+}
 
-		if nPCur < maxpmin || nPCur > minpmax {
-			return fmt.Errorf(
-				"Node '%s' protocol version (%d) is incompatible: [%d, %d]",
-				n.Name, nPCur, maxpmin, minpmax)
+// addRemote adds a node from a remote state.
+func (v *versionCheck) addRemote(rn *pushNodeState) {
+	// Skip nodes that don't have versions set, it just means their
+	// version is zero. Only alive nodes limit what's understood.
+	var nPCur, nDCur uint8
+	if len(rn.Vsn) > 0 {
+		if rn.State == StateAlive {
+			v.addRange(rn.Vsn[0], rn.Vsn[1], rn.Vsn[3], rn.Vsn[4])
 		}
+		nPCur = rn.Vsn[2]
+		nDCur = rn.Vsn[5]
+	}
+	v.pcur.add(rn.Name, nPCur)
+	v.dcur.add(rn.Name, nDCur)
+}
 
-		if nDCur < maxdmin || nDCur > mindmax {
-			return fmt.Errorf(
-				"Node '%s' delegate protocol version (%d) is incompatible: [%d, %d]",
-				n.Name, nDCur, maxdmin, mindmax)
-		}
+// addLocal adds one of our nodes. The caller must hold the nodeLock.
+func (v *versionCheck) addLocal(n *nodeState) {
+	if n.State == StateAlive {
+		v.addRange(n.PMin, n.PMax, n.DMin, n.DMax)
 	}
+	v.pcur.add(n.Name, n.PCur)
+	v.dcur.add(n.Name, n.DCur)
+}
 
+// verify checks that every node added so far speaks versions that all of
+// them understand.
+func (v *versionCheck) verify() error {
+	if v.pcur.seen && v.pcur.min < v.maxpmin {
+		return fmt.Errorf(
+			"Node '%s' protocol version (%d) is incompatible: [%d, %d]",
+			v.pcur.minNode, v.pcur.min, v.maxpmin, v.minpmax)
+	}
+	if v.pcur.seen && v.pcur.max > v.minpmax {
+		return fmt.Errorf(
+			"Node '%s' protocol version (%d) is incompatible: [%d, %d]",
+			v.pcur.maxNode, v.pcur.max, v.maxpmin, v.minpmax)
+	}
+	if v.dcur.seen && v.dcur.min < v.maxdmin {
+		return fmt.Errorf(
+			"Node '%s' delegate protocol version (%d) is incompatible: [%d, %d]",
+			v.dcur.minNode, v.dcur.min, v.maxdmin, v.mindmax)
+	}
+	if v.dcur.seen && v.dcur.max > v.mindmax {
+		return fmt.Errorf(
+			"Node '%s' delegate protocol version (%d) is incompatible: [%d, %d]",
+			v.dcur.maxNode, v.dcur.max, v.maxdmin, v.mindmax)
+	}
 	return nil
 }
 
@@ -756,12 +844,20 @@ func (m *Memberlist) nextSeqNo() uint32 {
 
 // nextIncarnation returns the next incarnation number in a thread safe way
 func (m *Memberlist) nextIncarnation() uint32 {
-	return atomic.AddUint32(&m.incarnation, 1)
+	inc := atomic.AddUint32(&m.incarnation, 1)
+	if m.snap != nil {
+		m.snap.setIncarnation(inc)
+	}
+	return inc
 }
 
 // skipIncarnation adds the positive offset to the incarnation number.
 func (m *Memberlist) skipIncarnation(offset uint32) uint32 {
-	return atomic.AddUint32(&m.incarnation, offset)
+	inc := atomic.AddUint32(&m.incarnation, offset)
+	if m.snap != nil {
+		m.snap.setIncarnation(inc)
+	}
+	return inc
 }
 
 // estNumNodes is used to get the current estimate of the number of nodes
@@ -801,12 +897,12 @@ func (m *Memberlist) setProbeChannels(seqNo uint32, ackCh chan ackMessage, nackC
 	m.ackLock.Unlock()
 
 	// Setup a reaping routing
-	ah.timer = time.AfterFunc(timeout, func() {
+	ah.timer = m.clock.AfterFunc(timeout, func() {
 		m.ackLock.Lock()
 		delete(m.ackHandlers, seqNo)
 		m.ackLock.Unlock()
 		select {
-		case ackCh <- ackMessage{false, nil, time.Now()}:
+		case ackCh <- ackMessage{false, nil, m.clock.Now()}:
 		default:
 		}
 	})
@@ -824,7 +920,7 @@ func (m *Memberlist) setAckHandler(seqNo uint32, ackFn func([]byte, time.Time),
 	m.ackLock.Unlock()
 
 	// Setup a reaping routing
-	ah.timer = time.AfterFunc(timeout, func() {
+	ah.timer = m.clock.AfterFunc(timeout, func() {
 		m.ackLock.Lock()
 		delete(m.ackHandlers, seqNo)
 		m.ackLock.Unlock()
@@ -882,7 +978,11 @@ func (m *Memberlist) refute(me *nodeState, accusedInc uint32) {
 			me.PMin, me.PMax, me.PCur,
 			me.DMin, me.DMax, me.DCur,
 		},
+		Compression: m.compression,
+		Zone:        me.Zone,
 	}
+	m.signAlive(&a)
+	me.pubKey, me.sig = a.PubKey, a.Sig
 	m.encodeAndBroadcast(me.Addr.String(), aliveMsg, a)
 }
 
@@ -911,6 +1011,24 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 		}
 	}
 
+	// Ignore nodes that advertise an address we wouldn't accept traffic
+	// from anyway.
+	if a.Node != m.config.Name {
+		if err := m.config.IPAllowed(a.Addr); err != nil {
+			m.logger.Printf("[WARN] memberlist: Ignoring an alive message for '%s' (%v:%d): %v", a.Node, net.IP(a.Addr), a.Port, err)
+			return
+		}
+	}
+
+	// Check the node's signature if identities are enforced.
+	if m.config.Identity != nil && !bootstrap {
+		if err := m.verifyAlive(a); err != nil {
+			identityRejected("alive")
+			m.logger.Printf("[WARN] memberlist: Ignoring an alive message for '%s' (%v:%d): %v", a.Node, net.IP(a.Addr), a.Port, err)
+			return
+		}
+	}
+
 	// Invoke the Alive delegate if any. This can be used to filter out
 	// alive messages based on custom logic. For example, using a cluster name.
 	// Using a merge delegate is not enough, as it is possible for passive
@@ -951,7 +1069,7 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 				Port: a.Port,
 				Meta: a.Meta,
 			},
-			State: stateDead,
+			State: StateDead,
 		}
 		if len(a.Vsn) > 5 {
 			state.PMin = a.Vsn[0]
@@ -961,6 +1079,9 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 			state.DMax = a.Vsn[4]
 			state.DCur = a.Vsn[5]
 		}
+		state.compression = a.Compression
+		state.Zone = a.Zone
+		state.pubKey, state.sig = a.PubKey, a.Sig
 
 		// Add to map
 		m.nodeMap[a.Node] = state
@@ -983,10 +1104,10 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 		if !bytes.Equal([]byte(state.Addr), a.Addr) || state.Port != a.Port {
 			// If DeadNodeReclaimTime is configured, check if enough time has elapsed since the node died.
 			canReclaim := (m.config.DeadNodeReclaimTime > 0 &&
-				time.Since(state.StateChange) > m.config.DeadNodeReclaimTime)
+				m.clock.Now().Sub(state.StateChange) > m.config.DeadNodeReclaimTime)
 
 			// Allow the address to be updated if a dead node is being replaced.
-			if state.State == stateLeft || (state.State == stateDead && canReclaim) {
+			if state.State == StateLeft || (state.State == StateDead && canReclaim) {
 				m.logger.Printf("[INFO] memberlist: Updating address for left or failed node %s from %v:%d to %v:%d",
 					state.Name, state.Addr, state.Port, net.IP(a.Addr), a.Port)
 				updatesNode = true
@@ -1026,6 +1147,7 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 	// Store the old state and meta data
 	oldState := state.State
 	oldMeta := state.Meta
+	oldAddr := state.Address()
 
 	// If this is us we need to refute, otherwise re-broadcast
 	if !bootstrap && isLocalNode {
@@ -1066,23 +1188,39 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 			state.DCur = a.Vsn[5]
 		}
 
+		// Older nodes relay alive messages without the algorithms, so
+		// keep what we have if they are missing
+		if len(a.Compression) > 0 {
+			state.compression = a.Compression
+		}
+
+		// The zone is taken as is, so that a node can clear it by
+		// advertising a newer incarnation without one
+		state.Zone = a.Zone
+
 		// Update the state and incarnation number
 		state.Incarnation = a.Incarnation
+		state.pubKey, state.sig, state.leaveSig = a.PubKey, a.Sig, nil
 		state.Meta = a.Meta
 		state.Addr = a.Addr
 		state.Port = a.Port
-		if state.State != stateAlive {
-			state.State = stateAlive
-			state.StateChange = time.Now()
+		if state.State != StateAlive {
+			state.State = StateAlive
+			state.StateChange = m.clock.Now()
 		}
 	}
 
 	// Update metrics
 	metrics.IncrCounter([]string{"memberlist", "msg", "alive"}, 1)
 
+	// Record new or moved nodes in the snapshot
+	if m.snap != nil && (oldState == StateDead || oldState == StateLeft || oldAddr != state.Address()) {
+		m.snap.alive(state.Name, state.Address())
+	}
+
 	// Notify the delegate of any relevant updates
 	if m.config.Events != nil {
-		if oldState == stateDead || oldState == stateLeft {
+		if oldState == StateDead || oldState == StateLeft {
 			// if Dead/Left -> Alive, notify of join
 			m.config.Events.NotifyJoin(&state.Node)
 
@@ -1090,6 +1228,12 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 			// if Meta changed, trigger an update notification
 			m.config.Events.NotifyUpdate(&state.Node)
 		}
+
+		// if Suspect -> Alive, notify of the refutation
+		if se, ok := m.config.Events.(SuspectEventDelegate); ok &&
+			oldState == StateSuspect && state.State == StateAlive {
+			se.NotifyRefute(&state.Node)
+		}
 	}
 }
 
@@ -1110,6 +1254,13 @@ func (m *Memberlist) suspectNode(s *suspect) {
 		return
 	}
 
+	// Only the node itself can move its incarnation forward when
+	// identities are enforced.
+	if m.config.Identity != nil && s.Incarnation > state.Incarnation && s.Node != m.config.Name {
+		identityRejected("suspect")
+		return
+	}
+
 	// See if there's a suspicion timer we can confirm. If the info is new
 	// to us we will go ahead and re-gossip it. This allows for multiple
 	// independent confirmations to flow even when a node probes a node
@@ -1122,7 +1273,7 @@ func (m *Memberlist) suspectNode(s *suspect) {
 	}
 
 	// Ignore non-alive nodes
-	if state.State != stateAlive {
+	if state.State != StateAlive {
 		return
 	}
 
@@ -1140,8 +1291,8 @@ func (m *Memberlist) suspectNode(s *suspect) {
 
 	// Update the state
 	state.Incarnation = s.Incarnation
-	state.State = stateSuspect
-	changeTime := time.Now()
+	state.State = StateSuspect
+	changeTime := m.clock.Now()
 	state.StateChange = changeTime
 
 	// Setup a suspicion timer. Given that we don't have any known phase
@@ -1164,7 +1315,7 @@ func (m *Memberlist) suspectNode(s *suspect) {
 	fn := func(numConfirmations int) {
 		m.nodeLock.Lock()
 		state, ok := m.nodeMap[s.Node]
-		timeout := ok && state.State == stateSuspect && state.StateChange == changeTime
+		timeout := ok && state.State == StateSuspect && state.StateChange == changeTime
 		m.nodeLock.Unlock()
 
 		if timeout {
@@ -1178,7 +1329,12 @@ func (m *Memberlist) suspectNode(s *suspect) {
 			m.deadNode(&d)
 		}
 	}
-	m.nodeTimers[s.Node] = newSuspicion(s.From, k, min, max, fn)
+	m.nodeTimers[s.Node] = newSuspicion(m.clock, s.From, k, min, max, fn)
+
+	// Notify the delegate that the node is now suspect
+	if se, ok := m.config.Events.(SuspectEventDelegate); ok {
+		se.NotifySuspect(&state.Node)
+	}
 }
 
 // deadNode is invoked by the network layer when we get a message
@@ -1198,6 +1354,22 @@ func (m *Memberlist) deadNode(d *dead) {
 		return
 	}
 
+	// With identities enforced, only the node itself can move its
+	// incarnation forward or announce that it left.
+	if m.config.Identity != nil && d.Node != m.config.Name {
+		if d.Incarnation > state.Incarnation {
+			identityRejected("dead")
+			return
+		}
+		if d.Node == d.From {
+			if err := m.verifyLeave(state, d); err != nil {
+				identityRejected("leave")
+				m.logger.Printf("[WARN] memberlist: Ignoring a leave message for '%s': %v", d.Node, err)
+				return
+			}
+		}
+	}
+
 	// Clear out any suspicion timer that may be in effect.
 	delete(m.nodeTimers, d.Node)
 
@@ -1230,11 +1402,21 @@ func (m *Memberlist) deadNode(d *dead) {
 	// If the dead message was send by the node itself, mark it is left
 	// instead of dead.
 	if d.Node == d.From {
-		state.State = stateLeft
+		state.State = StateLeft
+		state.leaveSig = d.Sig
 	} else {
-		state.State = stateDead
+		state.State = StateDead
+	}
+	state.StateChange = m.clock.Now()
+
+	// Record the change in the snapshot, where our own death means we left
+	if m.snap != nil {
+		if state.Name == m.config.Name {
+			m.snap.leave()
+		} else {
+			m.snap.notAlive(state.Name)
+		}
 	}
-	state.StateChange = time.Now()
 
 	// Notify of death
 	if m.config.Events != nil {
@@ -1245,29 +1427,38 @@ func (m *Memberlist) deadNode(d *dead) {
 // mergeState is invoked by the network layer when we get a Push/Pull
 // state transfer
 func (m *Memberlist) mergeState(remote []pushNodeState) {
-	for _, r := range remote {
-		switch r.State {
-		case stateAlive:
-			a := alive{
-				Incarnation: r.Incarnation,
-				Node:        r.Name,
-				Addr:        r.Addr,
-				Port:        r.Port,
-				Meta:        r.Meta,
-				Vsn:         r.Vsn,
-			}
-			m.aliveNode(&a, nil, false)
+	for i := range remote {
+		m.mergeNode(&remote[i])
+	}
+}
 
-		case stateLeft:
-			d := dead{Incarnation: r.Incarnation, Node: r.Name, From: r.Name}
-			m.deadNode(&d)
-		case stateDead:
-			// If the remote node believes a node is dead, we prefer to
-			// suspect that node instead of declaring it dead instantly
-			fallthrough
-		case stateSuspect:
-			s := suspect{Incarnation: r.Incarnation, Node: r.Name, From: m.config.Name}
-			m.suspectNode(&s)
+// mergeNode merges the state of a single remote node with ours.
+func (m *Memberlist) mergeNode(r *pushNodeState) {
+	switch r.State {
+	case StateAlive:
+		a := alive{
+			Incarnation: r.Incarnation,
+			Node:        r.Name,
+			Addr:        r.Addr,
+			Port:        r.Port,
+			Meta:        r.Meta,
+			Vsn:         r.Vsn,
+			Compression: r.Compression,
+			Zone:        r.Zone,
+			PubKey:      r.PubKey,
+			Sig:         r.Sig,
 		}
+		m.aliveNode(&a, nil, false)
+
+	case StateLeft:
+		d := dead{Incarnation: r.Incarnation, Node: r.Name, From: r.Name, Sig: r.LeaveSig}
+		m.deadNode(&d)
+	case StateDead:
+		// If the remote node believes a node is dead, we prefer to
+		// suspect that node instead of declaring it dead instantly
+		fallthrough
+	case StateSuspect:
+		s := suspect{Incarnation: r.Incarnation, Node: r.Name, From: m.config.Name}
+		m.suspectNode(&s)
 	}
 }
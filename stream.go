@@ -0,0 +1,943 @@
+package memberlist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+const (
+	// streamFrameSize is the most application data put in a single frame.
+	streamFrameSize = 32 * 1024
+
+	// streamMaxFrame bounds the size of a frame we'll read, leaving room
+	// for compression and encryption overhead on top of streamFrameSize.
+	streamMaxFrame = 2 * streamFrameSize
+
+	// streamWindow is how much data may be sent on a stream before the
+	// other side has read it, and so the most a stream buffers. It keeps a
+	// slow reader from stalling the other streams sharing its session.
+	streamWindow = 256 * 1024
+
+	// streamBacklog is how many opened streams a listener holds before
+	// new ones are refused.
+	streamBacklog = 16
+
+	// streamProtocolMaxSize is the longest protocol ID allowed.
+	streamProtocolMaxSize = 255
+
+	// streamSessionIdle is how long a session we dialed is kept open once
+	// its last stream has closed.
+	streamSessionIdle = 30 * time.Second
+)
+
+// Frame kinds on a stream session. Every frame after the session is set up
+// is a streamDataMsg holding the kind, a 4 byte stream ID and a payload.
+const (
+	streamFrameOpen   byte = iota // Protocol ID, only sent by the dialer
+	streamFrameAccept             // Empty
+	streamFrameRefuse             // Reason
+	streamFrameData               // Application data
+	streamFrameWindow             // 4 byte increase of the send window
+	streamFrameClose              // Empty, the sender is done with the stream
+)
+
+// streamOpen is sent by the dialing side to start a stream session, which
+// then carries any number of application streams. It's answered with an
+// errResp frame whose Error is empty on success.
+type streamOpen struct {
+	From string
+
+	// Compression algorithms the sender can decode, so that the reply
+	// frames can use them.
+	Compression []compressionType `codec:",omitempty"`
+}
+
+// streamTimeoutError is returned when a stream deadline passes.
+type streamTimeoutError struct{}
+
+func (streamTimeoutError) Error() string   { return "i/o timeout" }
+func (streamTimeoutError) Timeout() bool   { return true }
+func (streamTimeoutError) Temporary() bool { return true }
+
+// errStreamSessionEnded is returned when opening a stream on a session that
+// has already ended, so that a new one can be dialed.
+var errStreamSessionEnded = fmt.Errorf("Stream session has ended")
+
+// Stream is a full-duplex application connection to another member, opened
+// with Memberlist.OpenStream or accepted from a listener returned by
+// Memberlist.ListenStream. Streams to the same member share one connection,
+// with flow control per stream. Data travels in frames that are compressed
+// and encrypted the same way as memberlist's own streams.
+type Stream struct {
+	sess     *streamMux
+	id       uint32
+	protocol string
+	peer     string
+
+	openCh chan string   // Answer to our open, empty if accepted
+	ready  chan struct{} // Closed once the peer knows about the stream
+
+	rl sync.Mutex // Serialises readers
+	wl sync.Mutex // Serialises writers
+
+	l             sync.Mutex
+	rbuf          bytes.Buffer
+	unacked       int // Read but not yet given back to the sender's window
+	sendWindow    int
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        bool
+	remoteClosed  bool
+
+	readCh  chan struct{} // Signalled when there's data, or the deadline moved
+	writeCh chan struct{} // Signalled when the window opens, or the deadline moved
+	closeCh chan struct{} // Closed by Close
+}
+
+func newStream(sess *streamMux, id uint32, protocol string) *Stream {
+	return &Stream{
+		sess:       sess,
+		id:         id,
+		protocol:   protocol,
+		peer:       sess.peer,
+		ready:      make(chan struct{}),
+		sendWindow: streamWindow,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+		closeCh:    make(chan struct{}),
+	}
+}
+
+// Protocol returns the protocol ID the stream was opened for.
+func (s *Stream) Protocol() string {
+	return s.protocol
+}
+
+// Peer returns the name of the node at the other end.
+func (s *Stream) Peer() string {
+	return s.peer
+}
+
+// Read reads data from the stream, waiting for some to arrive if nothing is
+// buffered.
+func (s *Stream) Read(b []byte) (int, error) {
+	s.rl.Lock()
+	defer s.rl.Unlock()
+
+	for {
+		s.l.Lock()
+		if s.rbuf.Len() > 0 {
+			n, _ := s.rbuf.Read(b)
+
+			// Give the window back in large steps, not a frame per read.
+			s.unacked += n
+			ack := 0
+			if s.unacked >= streamWindow/2 && !s.remoteClosed {
+				ack, s.unacked = s.unacked, 0
+			}
+			s.l.Unlock()
+
+			if ack > 0 {
+				var buf [4]byte
+				binary.BigEndian.PutUint32(buf[:], uint32(ack))
+				s.sess.writeFrame(streamFrameWindow, s.id, buf[:])
+			}
+			return n, nil
+		}
+		if s.closed {
+			s.l.Unlock()
+			return 0, fmt.Errorf("Stream is closed")
+		}
+		if s.remoteClosed {
+			s.l.Unlock()
+			return 0, io.EOF
+		}
+		deadline := s.readDeadline
+		s.l.Unlock()
+
+		if err := s.sess.failed(); err != nil {
+			return 0, err
+		}
+		if err := s.wait(s.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends data on the stream, split into as many frames as needed and
+// waiting whenever the peer's window is full.
+func (s *Stream) Write(b []byte) (int, error) {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+
+	select {
+	case <-s.ready:
+	case <-s.closeCh:
+		return 0, fmt.Errorf("Stream is closed")
+	case <-s.sess.doneCh:
+		return 0, s.sess.failed()
+	}
+
+	written := 0
+	for written < len(b) {
+		n, err := s.reserve(len(b) - written)
+		if err != nil {
+			return written, err
+		}
+		if err := s.sess.writeFrame(streamFrameData, s.id, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// reserve waits for room in the send window and takes up to n bytes of it,
+// but no more than fit in a frame.
+func (s *Stream) reserve(n int) (int, error) {
+	for {
+		s.l.Lock()
+		if s.closed {
+			s.l.Unlock()
+			return 0, fmt.Errorf("Stream is closed")
+		}
+		if s.remoteClosed {
+			s.l.Unlock()
+			return 0, fmt.Errorf("Stream was closed by %s", s.peer)
+		}
+		if s.sendWindow > 0 {
+			if n > s.sendWindow {
+				n = s.sendWindow
+			}
+			if n > streamFrameSize {
+				n = streamFrameSize
+			}
+			s.sendWindow -= n
+			s.l.Unlock()
+			return n, nil
+		}
+		deadline := s.writeDeadline
+		s.l.Unlock()
+
+		if err := s.sess.failed(); err != nil {
+			return 0, err
+		}
+		if err := s.wait(s.writeCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait blocks until ch is signalled, the stream or its session ends, or the
+// deadline passes.
+func (s *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return streamTimeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+	case <-s.closeCh:
+	case <-s.sess.doneCh:
+	case <-timeout:
+		return streamTimeoutError{}
+	}
+	return nil
+}
+
+// notify wakes whoever is waiting on ch, if anyone.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// deliver buffers data that arrived for the stream.
+func (s *Stream) deliver(data []byte) error {
+	s.l.Lock()
+	if s.closed {
+		s.l.Unlock()
+		return nil
+	}
+	if s.rbuf.Len()+len(data) > streamWindow {
+		s.l.Unlock()
+		return fmt.Errorf("Stream %d overran its window", s.id)
+	}
+	s.rbuf.Write(data)
+	s.l.Unlock()
+	notify(s.readCh)
+	return nil
+}
+
+// grow adds to the send window after the peer has read some data.
+func (s *Stream) grow(n int) error {
+	s.l.Lock()
+	s.sendWindow += n
+	over := s.sendWindow > streamWindow
+	s.l.Unlock()
+	if over {
+		return fmt.Errorf("Stream %d window grew past %d", s.id, streamWindow)
+	}
+	notify(s.writeCh)
+	return nil
+}
+
+// remoteClose records that the peer has closed the stream. Buffered data
+// can still be read.
+func (s *Stream) remoteClose() {
+	s.l.Lock()
+	s.remoteClosed = true
+	s.l.Unlock()
+	notify(s.readCh)
+	notify(s.writeCh)
+}
+
+// Close closes the stream, leaving the session it shares open.
+func (s *Stream) Close() error {
+	s.l.Lock()
+	if s.closed {
+		s.l.Unlock()
+		return nil
+	}
+	s.closed = true
+	remoteClosed := s.remoteClosed
+	s.l.Unlock()
+	close(s.closeCh)
+
+	s.sess.remove(s.id)
+	if !remoteClosed {
+		// The close has to follow our answer to the peer's open.
+		select {
+		case <-s.ready:
+			s.sess.writeFrame(streamFrameClose, s.id, nil)
+		case <-s.sess.doneCh:
+		}
+	}
+	return nil
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.sess.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.sess.conn.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.l.Lock()
+	s.readDeadline = t
+	s.l.Unlock()
+	notify(s.readCh)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.l.Lock()
+	s.writeDeadline = t
+	s.l.Unlock()
+	notify(s.writeCh)
+	return nil
+}
+
+// streamMux is a connection to another member that carries application
+// streams. Only the side that dialed it opens streams on it, so there's a
+// session in each direction between two members that both open streams.
+type streamMux struct {
+	m    *Memberlist
+	conn net.Conn
+	r    *bufio.Reader
+	peer string
+	addr string // Address we dialed, empty if the peer dialed us
+	algo compressionType
+
+	wl sync.Mutex // Serialises frames
+
+	l       sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	idle    Timer
+	err     error // Why the session ended, nil while it's open
+
+	doneCh chan struct{}
+}
+
+func (m *Memberlist) newStreamMux(conn net.Conn, r *bufio.Reader, peer, addr string, algo compressionType) *streamMux {
+	sess := &streamMux{
+		m:       m,
+		conn:    conn,
+		r:       r,
+		peer:    peer,
+		addr:    addr,
+		algo:    algo,
+		streams: make(map[uint32]*Stream),
+		doneCh:  make(chan struct{}),
+	}
+	go sess.serve()
+	return sess
+}
+
+// serve reads frames and hands them to their streams until the session ends.
+func (sess *streamMux) serve() {
+	go func() {
+		select {
+		case <-sess.m.shutdownCh:
+			sess.end(fmt.Errorf("Memberlist is shut down"), false)
+		case <-sess.doneCh:
+		}
+	}()
+
+	for {
+		msgType, body, err := sess.m.readStreamFrame(sess.r)
+		if err == nil && (msgType != streamDataMsg || len(body) < 5) {
+			err = fmt.Errorf("Unexpected message type (%d) on stream session", msgType)
+		}
+		if err == nil {
+			err = sess.handleFrame(body[0], binary.BigEndian.Uint32(body[1:5]), body[5:])
+		}
+		if err != nil {
+			if sess.end(err, false) && err != io.EOF {
+				sess.m.logger.Printf("[ERR] memberlist: Stream session with %s failed: %v %s", sess.peer, err, LogConn(sess.conn))
+			}
+			return
+		}
+	}
+}
+
+// handleFrame acts on a frame read from the session.
+func (sess *streamMux) handleFrame(kind byte, id uint32, payload []byte) error {
+	if kind == streamFrameOpen {
+		return sess.handleOpen(id, string(payload))
+	}
+
+	sess.l.Lock()
+	s, ok := sess.streams[id]
+	sess.l.Unlock()
+	if !ok {
+		// Frames for a stream can cross its close on the wire.
+		return nil
+	}
+
+	switch kind {
+	case streamFrameAccept, streamFrameRefuse:
+		if s.openCh == nil {
+			return fmt.Errorf("Unexpected answer for stream %d", id)
+		}
+		reason := string(payload)
+		if kind == streamFrameRefuse {
+			sess.remove(id)
+			if reason == "" {
+				reason = "refused"
+			}
+		}
+		select {
+		case s.openCh <- reason:
+		default:
+		}
+	case streamFrameData:
+		return s.deliver(payload)
+	case streamFrameWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("Invalid window frame for stream %d", id)
+		}
+		return s.grow(int(binary.BigEndian.Uint32(payload)))
+	case streamFrameClose:
+		sess.remove(id)
+		s.remoteClose()
+	default:
+		return fmt.Errorf("Unknown stream frame kind %d", kind)
+	}
+	return nil
+}
+
+// handleOpen answers the peer's request for a stream, handing it to the
+// protocol's listener.
+func (sess *streamMux) handleOpen(id uint32, protocol string) error {
+	if sess.addr != "" {
+		return fmt.Errorf("Peer opened stream %d on a session we dialed", id)
+	}
+
+	m := sess.m
+	m.streamLock.Lock()
+	l, ok := m.streamListeners[protocol]
+	m.streamLock.Unlock()
+
+	refuse := func(reason string) error {
+		metrics.IncrCounter([]string{"memberlist", "stream", "refused"}, 1)
+		m.logger.Printf("[WARN] memberlist: Refused stream for %q from %s: %s", protocol, sess.peer, reason)
+		return sess.writeFrame(streamFrameRefuse, id, []byte(reason))
+	}
+	if !ok {
+		return refuse("no listener for protocol")
+	}
+
+	s := newStream(sess, id, protocol)
+	sess.l.Lock()
+	_, dup := sess.streams[id]
+	if !dup {
+		sess.streams[id] = s
+	}
+	sess.l.Unlock()
+	if dup {
+		return fmt.Errorf("Peer reused stream ID %d", id)
+	}
+
+	// The application can have the stream before our answer is out, but
+	// anything it sends waits on ready so that the answer comes first.
+	select {
+	case l.acceptCh <- s:
+	default:
+		sess.remove(id)
+		return refuse("backlog full")
+	}
+	if err := sess.writeFrame(streamFrameAccept, id, nil); err != nil {
+		return err
+	}
+	close(s.ready)
+	metrics.IncrCounter([]string{"memberlist", "stream", "accepted"}, 1)
+	return nil
+}
+
+// open opens a stream for a protocol on a session we dialed, waiting at
+// most TCPTimeout for the peer to accept it.
+func (sess *streamMux) open(protocol string) (*Stream, error) {
+	sess.l.Lock()
+	if sess.err != nil {
+		sess.l.Unlock()
+		return nil, errStreamSessionEnded
+	}
+	sess.nextID++
+	s := newStream(sess, sess.nextID, protocol)
+	s.openCh = make(chan string, 1)
+	close(s.ready)
+	sess.streams[s.id] = s
+	if sess.idle != nil {
+		sess.idle.Stop()
+	}
+	sess.l.Unlock()
+
+	if err := sess.writeFrame(streamFrameOpen, s.id, []byte(protocol)); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reason := <-s.openCh:
+		if reason != "" {
+			return nil, fmt.Errorf("Stream to %s refused: %s", sess.peer, reason)
+		}
+		return s, nil
+	case <-sess.m.clock.After(sess.m.config.TCPTimeout):
+		s.Close()
+		return nil, fmt.Errorf("Timed out opening stream to %s", sess.peer)
+	case <-sess.doneCh:
+		return nil, sess.failed()
+	}
+}
+
+// writeFrame sends a frame for a stream.
+func (sess *streamMux) writeFrame(kind byte, id uint32, payload []byte) error {
+	msg := make([]byte, 6+len(payload))
+	msg[0] = byte(streamDataMsg)
+	msg[1] = kind
+	binary.BigEndian.PutUint32(msg[2:6], id)
+	copy(msg[6:], payload)
+
+	sess.wl.Lock()
+	defer sess.wl.Unlock()
+	if err := sess.failed(); err != nil {
+		return err
+	}
+
+	// A frame that's only partly written leaves the session unusable, so
+	// the deadline is per frame and failing it ends the session.
+	sess.conn.SetWriteDeadline(time.Now().Add(sess.m.config.TCPTimeout))
+	if err := sess.m.writeStreamFrame(sess.conn, msg, sess.algo); err != nil {
+		sess.end(err, false)
+		return err
+	}
+	return nil
+}
+
+// remove forgets a stream. A session we dialed is closed once it has had no
+// streams for streamSessionIdle.
+func (sess *streamMux) remove(id uint32) {
+	sess.l.Lock()
+	defer sess.l.Unlock()
+
+	delete(sess.streams, id)
+	if sess.addr == "" || len(sess.streams) > 0 || sess.err != nil {
+		return
+	}
+	if sess.idle == nil {
+		sess.idle = sess.m.clock.AfterFunc(streamSessionIdle, func() {
+			sess.end(fmt.Errorf("Stream session is idle"), true)
+		})
+	} else {
+		sess.idle.Reset(streamSessionIdle)
+	}
+}
+
+// end ends the session and every stream on it, unless it has already ended
+// or onlyIdle is set and it has streams. It returns true if it ended it.
+func (sess *streamMux) end(err error, onlyIdle bool) bool {
+	sess.l.Lock()
+	if sess.err != nil || (onlyIdle && len(sess.streams) > 0) {
+		sess.l.Unlock()
+		return false
+	}
+	sess.err = err
+	if sess.idle != nil {
+		sess.idle.Stop()
+	}
+	sess.l.Unlock()
+
+	close(sess.doneCh)
+	sess.conn.Close()
+
+	if sess.addr != "" {
+		m := sess.m
+		m.streamLock.Lock()
+		if m.streamSessions[sess.addr] == sess {
+			delete(m.streamSessions, sess.addr)
+		}
+		m.streamLock.Unlock()
+	}
+	return true
+}
+
+// failed returns why the session ended, or nil if it's open.
+func (sess *streamMux) failed() error {
+	sess.l.Lock()
+	defer sess.l.Unlock()
+	return sess.err
+}
+
+// streamAddr is the net.Addr of a stream listener.
+type streamAddr struct {
+	node     string
+	protocol string
+}
+
+func (a *streamAddr) Network() string {
+	return "memberlist"
+}
+
+func (a *streamAddr) String() string {
+	return a.node + "/" + a.protocol
+}
+
+// streamListener is the net.Listener returned by ListenStream.
+type streamListener struct {
+	m        *Memberlist
+	protocol string
+	acceptCh chan *Stream
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+// Accept waits for the next stream opened for this listener's protocol.
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.acceptCh:
+		return s, nil
+	case <-l.closeCh:
+		return nil, fmt.Errorf("Stream listener for %q is closed", l.protocol)
+	case <-l.m.shutdownCh:
+		return nil, fmt.Errorf("Memberlist is shut down")
+	}
+}
+
+// Close stops accepting streams. Streams already accepted stay open.
+func (l *streamListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.m.streamLock.Lock()
+		if l.m.streamListeners[l.protocol] == l {
+			delete(l.m.streamListeners, l.protocol)
+		}
+		l.m.streamLock.Unlock()
+		close(l.closeCh)
+
+		// Refuse anything that was opened but never accepted.
+		for {
+			select {
+			case s := <-l.acceptCh:
+				s.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return &streamAddr{node: l.m.config.Name, protocol: l.protocol}
+}
+
+// ListenStream returns a listener for application streams that other
+// members open for the given protocol ID with OpenStream. Only one listener
+// may exist per protocol at a time. Accepted connections are *Stream.
+func (m *Memberlist) ListenStream(protocol string) (net.Listener, error) {
+	if err := validateStreamProtocol(protocol); err != nil {
+		return nil, err
+	}
+
+	m.streamLock.Lock()
+	defer m.streamLock.Unlock()
+	if _, ok := m.streamListeners[protocol]; ok {
+		return nil, fmt.Errorf("Already listening for streams on %q", protocol)
+	}
+	l := &streamListener{
+		m:        m,
+		protocol: protocol,
+		acceptCh: make(chan *Stream, streamBacklog),
+		closeCh:  make(chan struct{}),
+	}
+	m.streamListeners[protocol] = l
+	return l, nil
+}
+
+// OpenStream opens a full-duplex application stream to the given node for a
+// protocol ID, which the node must be listening for with ListenStream. The
+// returned connection is a *Stream. Streams to a node share one connection,
+// which is dialed by the first of them and closed once it has been unused
+// for a while. Opening waits at most TCPTimeout for the other side to
+// accept; after that the stream has no deadline unless one is set.
+func (m *Memberlist) OpenStream(to *Node, protocol string) (net.Conn, error) {
+	if err := validateStreamProtocol(protocol); err != nil {
+		return nil, err
+	}
+
+	// A session can end between us picking it and opening the stream, so
+	// try once more on a fresh one.
+	for attempt := 0; ; attempt++ {
+		sess, err := m.streamMuxTo(to)
+		if err != nil {
+			return nil, err
+		}
+		s, err := sess.open(protocol)
+		if err == errStreamSessionEnded && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		metrics.IncrCounter([]string{"memberlist", "stream", "opened"}, 1)
+		return s, nil
+	}
+}
+
+// streamMuxTo returns the open session to a node, dialing one if needed.
+func (m *Memberlist) streamMuxTo(to *Node) (*streamMux, error) {
+	addr := to.Address()
+	m.streamLock.Lock()
+	sess, ok := m.streamSessions[addr]
+	m.streamLock.Unlock()
+	if ok && sess.failed() == nil {
+		return sess, nil
+	}
+
+	// Dial without the lock so that a slow node doesn't hold up streams to
+	// the others.
+	sess, err := m.dialStreamMux(to)
+	if err != nil {
+		return nil, err
+	}
+
+	m.streamLock.Lock()
+	defer m.streamLock.Unlock()
+	if other, ok := m.streamSessions[addr]; ok && other.failed() == nil {
+		sess.end(fmt.Errorf("Stream session is a duplicate"), false)
+		return other, nil
+	}
+	m.streamSessions[addr] = sess
+	return sess, nil
+}
+
+// dialStreamMux dials a node and starts a stream session with it.
+func (m *Memberlist) dialStreamMux(to *Node) (*streamMux, error) {
+	addr := to.Address()
+	conn, err := m.dialStream(addr, m.config.TCPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
+
+	algo := m.pickCompression(to.compression)
+	open := streamOpen{
+		From:        m.config.Name,
+		Compression: m.compression,
+	}
+	out, err := encode(streamOpenMsg, &open)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := m.rawSendMsgStream(conn, out.Bytes(), algo); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The answer is the first frame, read through the reader that the
+	// session keeps so that nothing after it is lost.
+	r := bufio.NewReader(conn)
+	msgType, body, err := m.readStreamFrame(r)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to read stream session response: %v", err)
+	}
+	if msgType != errMsg {
+		conn.Close()
+		return nil, fmt.Errorf("Unexpected message type (%d) starting stream session", msgType)
+	}
+	var resp errResp
+	if err := decode(body, &resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.Error != "" {
+		conn.Close()
+		return nil, fmt.Errorf("Stream session with %s refused: %s", to.Name, resp.Error)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return m.newStreamMux(conn, r, to.Name, addr, algo), nil
+}
+
+// handleStreamOpen answers a request for a stream session and serves it. It
+// returns true if the connection was handed off and must be left open.
+func (m *Memberlist) handleStreamOpen(conn net.Conn, dec *codec.Decoder) (bool, error) {
+	var open streamOpen
+	if err := dec.Decode(&open); err != nil {
+		return false, err
+	}
+	algo := m.pickCompression(open.Compression)
+	if err := m.sendStreamOpenResp(conn, algo, ""); err != nil {
+		return false, err
+	}
+
+	// The dialer waits for our answer before sending anything else, so
+	// there's nothing buffered past the request and the session can read
+	// the connection afresh.
+	conn.SetDeadline(time.Time{})
+	m.newStreamMux(conn, bufio.NewReader(conn), open.From, "", algo)
+	return true, nil
+}
+
+// sendStreamOpenResp answers a stream session request in a frame.
+func (m *Memberlist) sendStreamOpenResp(conn net.Conn, algo compressionType, reason string) error {
+	out, err := encode(errMsg, &errResp{Error: reason})
+	if err != nil {
+		return err
+	}
+	return m.writeStreamFrame(conn, out.Bytes(), algo)
+}
+
+// writeStreamFrame writes a length prefixed frame holding msg, which is
+// compressed and encrypted if they're enabled.
+func (m *Memberlist) writeStreamFrame(w io.Writer, msg []byte, algo compressionType) error {
+	if m.config.EnableCompression {
+		buf, err := compressPayload(algo, msg)
+		if err != nil {
+			m.logger.Printf("[WARN] memberlist: Failed to compress payload: %v", err)
+		} else if buf.Len() < len(msg) {
+			msg = buf.Bytes()
+		}
+	}
+
+	if m.config.EncryptionEnabled() && m.config.GossipVerifyOutgoing {
+		var buf bytes.Buffer
+		buf.WriteByte(byte(encryptMsg))
+		key, encVsn := m.primaryKey()
+		if err := encryptPayload(encVsn, key, msg, nil, &buf); err != nil {
+			return err
+		}
+		msg = buf.Bytes()
+	}
+
+	frame := make([]byte, 4+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[4:], msg)
+	metrics.IncrCounter([]string{"memberlist", "tcp", "sent"}, float32(len(frame)))
+	_, err := w.Write(frame)
+	return err
+}
+
+// readStreamFrame reads the next frame written by writeStreamFrame and
+// returns its message type and body.
+func (m *Memberlist) readStreamFrame(r io.Reader) (messageType, []byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 || n > streamMaxFrame {
+		return 0, nil, fmt.Errorf("Invalid stream frame size %d", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return 0, nil, err
+	}
+
+	if messageType(msg[0]) == encryptMsg {
+		if !m.config.EncryptionEnabled() {
+			return 0, nil, fmt.Errorf("Stream frame is encrypted and encryption is not configured")
+		}
+		if err := m.checkCipherSuite(msg[1:]); err != nil {
+			return 0, nil, err
+		}
+		plain, err := decryptPayload(m.config.Keyring.GetKeys(), msg[1:], nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		msg = plain
+	} else if m.config.EncryptionEnabled() && m.config.GossipVerifyIncoming {
+		return 0, nil, fmt.Errorf("Encryption is configured but stream frame is not encrypted")
+	}
+
+	if len(msg) > 0 && messageType(msg[0]) == compressMsg {
+		decomp, err := decompressPayload(msg[1:], streamMaxFrame)
+		if err != nil {
+			return 0, nil, err
+		}
+		msg = decomp
+	}
+	if len(msg) == 0 {
+		return 0, nil, fmt.Errorf("Empty stream frame")
+	}
+	return messageType(msg[0]), msg[1:], nil
+}
+
+// validateStreamProtocol checks a protocol ID.
+func validateStreamProtocol(protocol string) error {
+	if protocol == "" {
+		return fmt.Errorf("Stream protocol ID must not be empty")
+	}
+	if len(protocol) > streamProtocolMaxSize {
+		return fmt.Errorf("Stream protocol ID is %d bytes, longer than the maximum of %d", len(protocol), streamProtocolMaxSize)
+	}
+	return nil
+}
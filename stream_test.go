@@ -0,0 +1,203 @@
+package memberlist
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// streamEcho accepts streams on l and echoes everything back.
+func streamEcho(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func testStreamEcho(t *testing.T, f func(c *Config)) {
+	ms := mockCluster(t, &MockNetwork{}, 2, f)
+	for _, m := range ms {
+		defer m.Shutdown()
+	}
+
+	l, err := ms[1].ListenStream("echo")
+	require.NoError(t, err)
+	defer l.Close()
+	go streamEcho(l)
+
+	conn, err := ms[0].OpenStream(ms[1].LocalNode(), "echo")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "node1", conn.(*Stream).Peer())
+	require.Equal(t, "echo", conn.(*Stream).Protocol())
+
+	// Big enough to span several frames.
+	payload := make([]byte, 3*streamFrameSize+100)
+	rand.Read(payload)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		errCh <- err
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	require.NoError(t, <-errCh)
+	require.True(t, bytes.Equal(payload, got))
+}
+
+func TestStream_Echo(t *testing.T) {
+	testStreamEcho(t, nil)
+}
+
+func TestStream_Echo_EncryptedCompressed(t *testing.T) {
+	testStreamEcho(t, func(c *Config) {
+		c.SecretKey = []byte("0123456789abcdef")
+		c.EnableCompression = true
+	})
+}
+
+func TestStream_Refused(t *testing.T) {
+	ms := mockCluster(t, &MockNetwork{}, 2, nil)
+	for _, m := range ms {
+		defer m.Shutdown()
+	}
+
+	_, err := ms[0].OpenStream(ms[1].LocalNode(), "nobody")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no listener")
+
+	l, err := ms[1].ListenStream("rpc")
+	require.NoError(t, err)
+	_, err = ms[1].ListenStream("rpc")
+	require.Error(t, err)
+
+	// Closing the listener frees the protocol and refuses new streams.
+	require.NoError(t, l.Close())
+	_, err = l.Accept()
+	require.Error(t, err)
+	_, err = ms[0].OpenStream(ms[1].LocalNode(), "rpc")
+	require.Error(t, err)
+
+	l, err = ms[1].ListenStream("rpc")
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = ms[1].ListenStream("")
+	require.Error(t, err)
+}
+
+func TestStream_Multiplexed(t *testing.T) {
+	ms := mockCluster(t, &MockNetwork{}, 2, nil)
+	for _, m := range ms {
+		defer m.Shutdown()
+	}
+
+	l, err := ms[1].ListenStream("echo")
+	require.NoError(t, err)
+	defer l.Close()
+	go streamEcho(l)
+
+	// A stalled stream fills its window without holding up the others.
+	sink, err := ms[1].ListenStream("sink")
+	require.NoError(t, err)
+	defer sink.Close()
+	stalled, err := ms[0].OpenStream(ms[1].LocalNode(), "sink")
+	require.NoError(t, err)
+	defer stalled.Close()
+	_, err = stalled.Write(make([]byte, streamWindow))
+	require.NoError(t, err)
+	stalled.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = stalled.Write([]byte{1})
+	require.Error(t, err)
+	require.True(t, err.(net.Error).Timeout())
+
+	// Each payload is bigger than the window, so the echo needs the
+	// window to be given back as it's read.
+	const streams = 4
+	errCh := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		conn, err := ms[0].OpenStream(ms[1].LocalNode(), "echo")
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, stalled.LocalAddr(), conn.LocalAddr())
+
+		go func() {
+			payload := make([]byte, 2*streamWindow+100)
+			rand.Read(payload)
+			go conn.Write(payload)
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				errCh <- err
+				return
+			}
+			if !bytes.Equal(payload, got) {
+				errCh <- io.ErrUnexpectedEOF
+				return
+			}
+			errCh <- nil
+		}()
+	}
+	for i := 0; i < streams; i++ {
+		require.NoError(t, <-errCh)
+	}
+
+	ms[0].streamLock.Lock()
+	require.Len(t, ms[0].streamSessions, 1)
+	ms[0].streamLock.Unlock()
+}
+
+func TestStream_Close(t *testing.T) {
+	ms := mockCluster(t, &MockNetwork{}, 2, nil)
+	for _, m := range ms {
+		defer m.Shutdown()
+	}
+
+	l, err := ms[1].ListenStream("rpc")
+	require.NoError(t, err)
+	defer l.Close()
+
+	conn, err := ms[0].OpenStream(ms[1].LocalNode(), "rpc")
+	require.NoError(t, err)
+	peer, err := l.Accept()
+	require.NoError(t, err)
+
+	// Data sent before a close can still be read, then the reader sees EOF.
+	_, err = conn.Write([]byte("bye"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(peer)
+	require.NoError(t, err)
+	require.Equal(t, "bye", string(got))
+	_, err = peer.Write([]byte("x"))
+	require.Error(t, err)
+	require.NoError(t, peer.Close())
+
+	// The session outlives its streams and is reused.
+	ms[0].streamLock.Lock()
+	sess := ms[0].streamSessions[ms[1].LocalNode().Address()]
+	ms[0].streamLock.Unlock()
+	require.NotNil(t, sess)
+	conn, err = ms[0].OpenStream(ms[1].LocalNode(), "rpc")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.True(t, conn.(*Stream).sess == sess)
+}
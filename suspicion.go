@@ -30,8 +30,11 @@ type suspicion struct {
 	// a way the achieves the overall time we'd like.
 	start time.Time
 
+	// clock is the source of time for start and the timer.
+	clock Clock
+
 	// timer is the underlying timer that implements the timeout.
-	timer *time.Timer
+	timer Timer
 
 	// f is the function to call when the timer expires. We hold on to this
 	// because there are cases where we call it directly.
@@ -47,8 +50,9 @@ type suspicion struct {
 // excluded from confirmations since we might get our own suspicion message
 // gossiped back to us. The minimum time will be used if no confirmations are
 // called for (k <= 0).
-func newSuspicion(from string, k int, min time.Duration, max time.Duration, fn func(int)) *suspicion {
+func newSuspicion(clock Clock, from string, k int, min time.Duration, max time.Duration, fn func(int)) *suspicion {
 	s := &suspicion{
+		clock:         clock,
 		k:             int32(k),
 		min:           min,
 		max:           max,
@@ -70,12 +74,12 @@ func newSuspicion(from string, k int, min time.Duration, max time.Duration, fn f
 	if k < 1 {
 		timeout = min
 	}
-	s.timer = time.AfterFunc(timeout, s.timeoutFn)
+	s.timer = clock.AfterFunc(timeout, s.timeoutFn)
 
 	// Capture the start time right after starting the timer above so
 	// we should always err on the side of a little longer timeout if
 	// there's any preemption that separates this and the step above.
-	s.start = time.Now()
+	s.start = clock.Now()
 	return s
 }
 
@@ -117,7 +121,7 @@ func (s *suspicion) Confirm(from string) bool {
 	// stop the timer then we will call the timeout function directly from
 	// here.
 	n := atomic.AddInt32(&s.n, 1)
-	elapsed := time.Since(s.start)
+	elapsed := s.clock.Now().Sub(s.start)
 	remaining := remainingSuspicionTime(n, s.k, elapsed, s.min, s.max)
 	if s.timer.Stop() {
 		if remaining > 0 {
@@ -128,3 +132,24 @@ func (s *suspicion) Confirm(from string) bool {
 	}
 	return true
 }
+
+// Confirmations returns the number of independent confirmations we've seen.
+func (s *suspicion) Confirmations() int {
+	return int(atomic.LoadInt32(&s.n))
+}
+
+// Remaining returns how long is left until the timer fires, which is never
+// less than zero.
+func (s *suspicion) Remaining() time.Duration {
+	elapsed := s.clock.Now().Sub(s.start)
+	var remaining time.Duration
+	if s.k < 1 {
+		remaining = s.min - elapsed
+	} else {
+		remaining = remainingSuspicionTime(atomic.LoadInt32(&s.n), s.k, elapsed, s.min, s.max)
+	}
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
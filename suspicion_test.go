@@ -118,7 +118,7 @@ func TestSuspicion_Timer(t *testing.T) {
 		// Create the timer and add the requested confirmations. Wait
 		// the fudge amount to help make sure we calculate the timeout
 		// overall, and don't accumulate extra time.
-		s := newSuspicion(c.from, k, min, max, f)
+		s := newSuspicion(realClock{}, c.from, k, min, max, f)
 		fudge := 25 * time.Millisecond
 		for _, p := range c.confirmations {
 			time.Sleep(fudge)
@@ -166,7 +166,7 @@ func TestSuspicion_Timer_ZeroK(t *testing.T) {
 
 	// This should select the min time since there are no expected
 	// confirmations to accelerate the timer.
-	s := newSuspicion("me", 0, 25*time.Millisecond, 30*time.Second, f)
+	s := newSuspicion(realClock{}, "me", 0, 25*time.Millisecond, 30*time.Second, f)
 	if s.Confirm("foo") {
 		t.Fatalf("should not provide new information")
 	}
@@ -185,7 +185,7 @@ func TestSuspicion_Timer_Immediate(t *testing.T) {
 	}
 
 	// This should underflow the timeout and fire immediately.
-	s := newSuspicion("me", 1, 100*time.Millisecond, 30*time.Second, f)
+	s := newSuspicion(realClock{}, "me", 1, 100*time.Millisecond, 30*time.Second, f)
 	time.Sleep(200 * time.Millisecond)
 	s.Confirm("foo")
 
@@ -196,3 +196,38 @@ func TestSuspicion_Timer_Immediate(t *testing.T) {
 		t.Fatalf("should have fired")
 	}
 }
+
+func TestSuspicion_Remaining(t *testing.T) {
+	f := func(int) {}
+
+	s := newSuspicion(realClock{}, "me", 3, 2*time.Second, 30*time.Second, f)
+	defer s.timer.Stop()
+	if n := s.Confirmations(); n != 0 {
+		t.Fatalf("bad confirmations: %d", n)
+	}
+	if r := s.Remaining(); r > 30*time.Second || r < 29*time.Second {
+		t.Fatalf("bad remaining: %v", r)
+	}
+
+	// Each confirmation brings the timeout down towards the min.
+	s.Confirm("foo")
+	s.Confirm("bar")
+	if n := s.Confirmations(); n != 2 {
+		t.Fatalf("bad confirmations: %d", n)
+	}
+	want := remainingSuspicionTime(2, 3, 0, 2*time.Second, 30*time.Second)
+	if r := s.Remaining(); r > want || r < want-time.Second {
+		t.Fatalf("bad remaining: %v, want about %v", r, want)
+	}
+
+	// With no confirmations expected it's the min, and it never goes
+	// negative.
+	z := newSuspicion(realClock{}, "me", 0, 10*time.Millisecond, 30*time.Second, f)
+	if r := z.Remaining(); r > 10*time.Millisecond {
+		t.Fatalf("bad remaining: %v", r)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if r := z.Remaining(); r != 0 {
+		t.Fatalf("bad remaining: %v", r)
+	}
+}
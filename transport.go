@@ -104,3 +104,18 @@ type Transport interface {
 
 
 }
+
+// DontFragmentTransport is an optional extension of Transport for sending
+// packets with the IP don't fragment bit set. Path MTU discovery only runs
+// over transports that implement it, since a probe that gets fragmented on
+// the way would be acknowledged whatever the path MTU is.
+//
+// DontFragmentTransport 是 Transport 的可选扩展，发送的报文设置 IP 不分片标志，只有实现它的 Transport 才会进行路径 MTU 探测。
+type DontFragmentTransport interface {
+	Transport
+
+	// WriteToDontFragment is like WriteTo, but the packet must not be
+	// fragmented on its way to addr. A packet that's too big for the path
+	// may be dropped without an error.
+	WriteToDontFragment(b []byte, addr string) (time.Time, error)
+}
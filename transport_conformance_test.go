@@ -0,0 +1,60 @@
+package memberlist_test
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/memberlist/transporttest"
+)
+
+func TestNetTransport_Conformance(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T) (memberlist.Transport, string) {
+		tr, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+			BindAddrs: []string{"127.0.0.1"},
+			Logger:    log.New(ioutil.Discard, "", 0),
+		})
+		if err != nil {
+			t.Fatalf("NewNetTransport: %v", err)
+		}
+		return tr, net.JoinHostPort("127.0.0.1", strconv.Itoa(tr.GetAutoBindPort()))
+	})
+}
+
+func TestNetTransport_Conformance_Pooled(t *testing.T) {
+	transporttest.Run(t, func(t *testing.T) (memberlist.Transport, string) {
+		tr, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+			BindAddrs:      []string{"127.0.0.1"},
+			Logger:         log.New(ioutil.Discard, "", 0),
+			StreamPoolSize: 2,
+			UDPReaders:     2,
+		})
+		if err != nil {
+			t.Fatalf("NewNetTransport: %v", err)
+		}
+		return tr, net.JoinHostPort("127.0.0.1", strconv.Itoa(tr.GetAutoBindPort()))
+	})
+}
+
+func TestUnixTransport_Conformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	transporttest.Run(t, func(t *testing.T) (memberlist.Transport, string) {
+		tr, err := memberlist.NewUnixTransport(&memberlist.UnixTransportConfig{
+			Dir:    dir,
+			Logger: log.New(ioutil.Discard, "", 0),
+		})
+		if err != nil {
+			t.Fatalf("NewUnixTransport: %v", err)
+		}
+		return tr, net.JoinHostPort("127.0.0.1", strconv.Itoa(tr.GetAutoBindPort()))
+	})
+}
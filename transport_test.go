@@ -1,8 +1,21 @@
 package memberlist
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -207,3 +220,872 @@ func TestTransport_TcpListenBackoff(t *testing.T) {
 	// no connections should have been accepted and sent to the channel
 	require.Equal(t, len(transport.streamCh), 0)
 }
+
+// testCA is a throwaway certificate authority for exercising the TLS
+// transport.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "memberlist test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	file := filepath.Join(dir, "ca.pem")
+	writePEM(t, file, "CERTIFICATE", der)
+	return &testCA{cert, key, file}
+}
+
+// issue writes out a certificate and key for the given DNS name and returns
+// the file names.
+func (ca *testCA) issue(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	out := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	require.NoError(t, ioutil.WriteFile(file, out, 0600))
+}
+
+func newTLSTestMemberlist(t *testing.T, name string, tc *TLSTransportConfig, d Delegate) *Memberlist {
+	tc.BindAddrs = []string{getBindAddr().String()}
+	tc.Logger = testLoggerWithName(t, name)
+	transport, err := NewTLSTransport(tc)
+	require.NoError(t, err)
+
+	c := DefaultLANConfig()
+	c.Name = name
+	c.BindPort = transport.GetAutoBindPort()
+	c.Transport = transport
+	c.Delegate = d
+	c.Logger = testLoggerWithName(t, name)
+	m, err := Create(c)
+	require.NoError(t, err)
+	return m
+}
+
+func TestTLSTransport_JoinAndSend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir)
+	cert1, key1 := ca.issue(t, dir, "node.memberlist")
+	cert2, key2 := ca.issue(t, dir, "other.memberlist")
+
+	d1 := &MockDelegate{}
+	m1 := newTLSTestMemberlist(t, "node1", &TLSTransportConfig{
+		CertFile:   cert1,
+		KeyFile:    key1,
+		CAFile:     ca.file,
+		ServerName: "node.memberlist",
+	}, d1)
+	defer m1.Shutdown()
+
+	// A peer with a certificate for the wrong name must not get in.
+	bad := newTLSTestMemberlist(t, "bad", &TLSTransportConfig{
+		CertFile:   cert2,
+		KeyFile:    key2,
+		CAFile:     ca.file,
+		ServerName: "node.memberlist",
+	}, nil)
+	defer bad.Shutdown()
+	_, err = bad.Join([]string{m1.LocalNode().Address()})
+	require.Error(t, err)
+
+	m2 := newTLSTestMemberlist(t, "node2", &TLSTransportConfig{
+		CertFile:   cert1,
+		KeyFile:    key1,
+		CAFile:     ca.file,
+		ServerName: "node.memberlist",
+	}, nil)
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{m1.LocalNode().Address()})
+	require.NoError(t, err)
+	require.Equal(t, 1, num)
+	require.Equal(t, 2, len(m2.Members()))
+
+	require.NoError(t, m2.SendReliable(m1.LocalNode(), []byte("over tls")))
+	time.Sleep(100 * time.Millisecond)
+	msgs := d1.getMessages()
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "over tls", string(msgs[0]))
+}
+
+func TestTLSTransport_ReloadCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issue(t, dir, "node.memberlist")
+
+	tc := &TLSTransportConfig{
+		NetTransportConfig: NetTransportConfig{
+			BindAddrs: []string{getBindAddr().String()},
+			Logger:    testLogger(t),
+		},
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   ca.file,
+	}
+	transport, err := NewTLSTransport(tc)
+	require.NoError(t, err)
+	defer transport.Shutdown()
+
+	before, _ := transport.getCertificate()
+
+	// A broken file must leave the old certificate in place.
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("garbage"), 0600))
+	require.Error(t, transport.ReloadCertificates())
+	after, _ := transport.getCertificate()
+	require.True(t, before == after)
+
+	// Issuing a new certificate and reloading should swap it in.
+	ca.issue(t, dir, "node.memberlist")
+	require.NoError(t, transport.ReloadCertificates())
+	after, _ = transport.getCertificate()
+	require.False(t, before == after)
+}
+
+func newPooledTestMemberlist(t *testing.T, name string, poolSize int, d Delegate) (*Memberlist, *NetTransport) {
+	transport, err := NewNetTransport(&NetTransportConfig{
+		BindAddrs:      []string{getBindAddr().String()},
+		Logger:         testLoggerWithName(t, name),
+		StreamPoolSize: poolSize,
+	})
+	require.NoError(t, err)
+
+	c := DefaultLANConfig()
+	c.Name = name
+	c.BindPort = transport.GetAutoBindPort()
+	c.Transport = transport
+	c.Delegate = d
+	c.Logger = testLoggerWithName(t, name)
+	m, err := Create(c)
+	require.NoError(t, err)
+	return m, transport
+}
+
+func TestNetTransport_StreamPool(t *testing.T) {
+	d1 := &MockDelegate{}
+	m1, t1 := newPooledTestMemberlist(t, "node1", 1, d1)
+	defer m1.Shutdown()
+	m2, t2 := newPooledTestMemberlist(t, "node2", 2, nil)
+	defer m2.Shutdown()
+
+	_, err := m2.Join([]string{m1.LocalNode().Address()})
+	require.NoError(t, err)
+
+	var expected []string
+	for i := 0; i < 10; i++ {
+		msg := "reliable-" + strconv.Itoa(i)
+		expected = append(expected, msg)
+		require.NoError(t, m2.SendReliable(m1.LocalNode(), []byte(msg)))
+		time.Sleep(10 * time.Millisecond)
+	}
+	retry(t, 10, 50*time.Millisecond, func(failf func(string, ...interface{})) {
+		if n := len(d1.getMessages()); n != len(expected) {
+			failf("got %d messages", n)
+		}
+	})
+	require.Equal(t, expected, func() []string {
+		var got []string
+		for _, msg := range d1.getMessages() {
+			got = append(got, string(msg))
+		}
+		return got
+	}())
+
+	// The join and the messages shared the pooled sessions. Sessions are
+	// released in the background, so an exchange may dial a second one
+	// before the first is back in the pool.
+	t1.sessionLock.Lock()
+	sessions := len(t1.sessions)
+	t1.sessionLock.Unlock()
+	require.True(t, sessions >= 1 && sessions <= 2, "sessions: %d", sessions)
+
+	// Every session goes back to the pool once its exchange is done.
+	addr := m1.LocalNode().Address()
+	retry(t, 10, 50*time.Millisecond, func(failf func(string, ...interface{})) {
+		t2.pool.l.Lock()
+		idle := len(t2.pool.idle[addr])
+		t2.pool.l.Unlock()
+		if idle != sessions {
+			failf("got %d idle sessions, want %d", idle, sessions)
+		}
+	})
+
+	// A push/pull works over the pooled connection too.
+	require.NoError(t, m2.pushPullNode(addr, false))
+}
+
+func TestNetTransport_StreamPoolIdleTimeout(t *testing.T) {
+	p := newStreamPool(1, 20*time.Millisecond)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	s := &streamSession{conn: c1}
+	p.put("a", s)
+	p.put("a", &streamSession{conn: c2}) // Over the limit, so closed
+	require.Equal(t, s, p.get("a"))
+	require.Nil(t, p.get("a"))
+
+	p.put("a", s)
+	time.Sleep(30 * time.Millisecond)
+	p.reap()
+	require.Nil(t, p.get("a"))
+}
+
+func TestNetTransport_AcceptHandshake(t *testing.T) {
+	// Without pooling, connections are handed off as they're accepted,
+	// even before they've sent anything.
+	plain := newUDPTestTransport(t, 1, 1)
+	defer plain.Shutdown()
+	conn, err := net.Dial("tcp", plain.tcpListeners[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	select {
+	case c := <-plain.StreamCh():
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection wasn't handed off")
+	}
+
+	// With pooling, a connection that says nothing is dropped after
+	// TCPTimeout and frees its handshake slot.
+	pooled, err := NewNetTransport(&NetTransportConfig{
+		BindAddrs:      []string{"127.0.0.1"},
+		Logger:         testLogger(t),
+		StreamPoolSize: 1,
+		TCPTimeout:     50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer pooled.Shutdown()
+	conn, err = net.Dial("tcp", pooled.tcpListeners[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+	require.Len(t, pooled.handshakes, 0)
+}
+
+func TestNetTransport_SessionExchanges(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := &streamSession{conn: c1, r: bufio.NewReader(c1)}
+	server := &streamSession{conn: c2, r: bufio.NewReader(c2)}
+	defer c1.Close()
+	defer c2.Close()
+
+	for i := 0; i < 3; i++ {
+		clientDone := make(chan bool, 1)
+		serverDone := make(chan bool, 1)
+		cc := client.exchange(func(ok bool) { clientDone <- ok })
+		sc := server.exchange(func(ok bool) { serverDone <- ok })
+
+		go func() {
+			cc.Write([]byte("ping"))
+			cc.Write([]byte(" again"))
+		}()
+		buf := make([]byte, 10)
+		_, err := io.ReadFull(sc, buf)
+		require.NoError(t, err)
+		require.Equal(t, "ping again", string(buf))
+
+		// The server only reads part of its request and the client
+		// never reads the reply, but both halves still end cleanly.
+		go sc.Write([]byte("pong"))
+		require.NoError(t, cc.Close())
+		require.NoError(t, sc.Close())
+		require.True(t, <-clientDone)
+		require.True(t, <-serverDone)
+	}
+}
+
+func newUDPTestTransport(t testing.TB, readers, batchSize int) *NetTransport {
+	transport, err := NewNetTransport(&NetTransportConfig{
+		BindAddrs:    []string{"127.0.0.1"},
+		Logger:       testLogger(t),
+		UDPReaders:   readers,
+		UDPBatchSize: batchSize,
+	})
+	require.NoError(t, err)
+	return transport
+}
+
+func TestNetTransport_UDPBatchReceive(t *testing.T) {
+	transport := newUDPTestTransport(t, 4, 8)
+	defer transport.Shutdown()
+	if udpReusePort {
+		require.Len(t, transport.udpListeners, 4)
+	}
+	to := transport.udpListeners[0].LocalAddr()
+
+	// Send from several sockets so the packets are spread across the
+	// readers.
+	const senders, perSender = 4, 50
+	sources := make(map[string]bool)
+	for i := 0; i < senders; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+		defer conn.Close()
+		sources[conn.LocalAddr().String()] = true
+
+		go func(i int) {
+			for j := 0; j < perSender; j++ {
+				conn.WriteTo([]byte(strconv.Itoa(i)+"-"+strconv.Itoa(j)), to)
+			}
+		}(i)
+	}
+
+	seen := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for len(seen) < senders*perSender {
+		select {
+		case p := <-transport.PacketCh():
+			require.True(t, sources[p.From.String()], "unexpected source %s", p.From)
+			require.False(t, seen[string(p.Buf)])
+			seen[string(p.Buf)] = true
+		case <-timeout:
+			t.Fatalf("got %d of %d packets", len(seen), senders*perSender)
+		}
+	}
+}
+
+func TestNetTransport_WriteToDontFragment(t *testing.T) {
+	t1 := newUDPTestTransport(t, 1, 1)
+	defer t1.Shutdown()
+	var tr Transport = t1
+	df, ok := tr.(DontFragmentTransport)
+	if !ok {
+		t.Skip("don't fragment isn't supported on this platform")
+	}
+
+	t2 := newUDPTestTransport(t, 1, 1)
+	defer t2.Shutdown()
+
+	_, err := df.WriteToDontFragment([]byte("probe"), t2.udpListeners[0].LocalAddr().String())
+	require.NoError(t, err)
+
+	var from net.Addr
+	select {
+	case p := <-t2.PacketCh():
+		require.Equal(t, "probe", string(p.Buf))
+		from = p.From
+	case <-time.After(5 * time.Second):
+		t.Fatalf("probe wasn't received")
+	}
+	require.NotEqual(t, t1.udpListeners[0].LocalAddr().String(), from.String())
+
+	// A reply to wherever the probe came from should find its way back.
+	_, err = t2.WriteTo([]byte("ack"), from.String())
+	require.NoError(t, err)
+	select {
+	case p := <-t1.PacketCh():
+		require.Equal(t, "ack", string(p.Buf))
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reply wasn't received")
+	}
+}
+
+func TestNetTransport_UDPBatchWrite(t *testing.T) {
+	transport := newUDPTestTransport(t, 1, 8)
+	defer transport.Shutdown()
+	if udpBatching {
+		require.NotNil(t, transport.udpWriter)
+	}
+
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer sink.Close()
+	require.NoError(t, setUDPRecvBuf(sink))
+	to := sink.LocalAddr().String()
+
+	// Concurrent writes get batched together.
+	const writers, perWriter = 8, 25
+	errCh := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			for j := 0; j < perWriter; j++ {
+				if _, err := transport.WriteTo([]byte(strconv.Itoa(i)+"-"+strconv.Itoa(j)), to); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			errCh <- nil
+		}(i)
+	}
+	for i := 0; i < writers; i++ {
+		require.NoError(t, <-errCh)
+	}
+
+	seen := make(map[string]bool)
+	buf := make([]byte, 64)
+	sink.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(seen) < writers*perWriter {
+		n, from, err := sink.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, transport.udpListeners[0].LocalAddr().String(), from.String())
+		seen[string(buf[:n])] = true
+	}
+
+	// An address the socket can't reach fails on its own.
+	_, err = transport.WriteTo([]byte("nope"), "[::1]:1234")
+	require.Error(t, err)
+	_, err = transport.WriteTo([]byte("yes"), to)
+	require.NoError(t, err)
+}
+
+// benchmarkUDPReceive measures how fast packets are taken off the socket and
+// handed to the packet channel, with several senders flooding the transport.
+func benchmarkUDPReceive(b *testing.B, readers, batchSize int) {
+	transport := newUDPTestTransport(b, readers, batchSize)
+	defer transport.Shutdown()
+	to := transport.udpListeners[0].LocalAddr()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	payload := make([]byte, 512)
+	for i := 0; i < 4; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(b, err)
+		defer conn.Close()
+		go func() {
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				conn.WriteTo(payload, to)
+			}
+		}()
+	}
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		<-transport.PacketCh()
+	}
+}
+
+func BenchmarkNetTransport_UDPReceive(b *testing.B) {
+	b.Run("single", func(b *testing.B) { benchmarkUDPReceive(b, 1, 1) })
+	b.Run("batch", func(b *testing.B) { benchmarkUDPReceive(b, 1, 16) })
+	b.Run("batch-readers", func(b *testing.B) { benchmarkUDPReceive(b, 4, 16) })
+}
+
+// benchmarkUDPSend measures WriteTo from many goroutines at once.
+func benchmarkUDPSend(b *testing.B, batchSize int) {
+	transport := newUDPTestTransport(b, 1, batchSize)
+	defer transport.Shutdown()
+
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(b, err)
+	defer sink.Close()
+	to := sink.LocalAddr().String()
+
+	payload := make([]byte, 512)
+	b.SetBytes(int64(len(payload)))
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := transport.WriteTo(payload, to); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkNetTransport_UDPSend(b *testing.B) {
+	b.Run("single", func(b *testing.B) { benchmarkUDPSend(b, 1) })
+	b.Run("batch", func(b *testing.B) { benchmarkUDPSend(b, 16) })
+}
+
+func TestMockNetwork_LinkFaults(t *testing.T) {
+	// Packets are queued rather than handed over, which needs a clock.
+	n := &MockNetwork{Clock: realClock{}}
+	a, b := n.NewTransport(), n.NewTransport()
+	addrA, addrB := a.addr.String(), b.addr.String()
+
+	recv := func(tr *MockTransport) int {
+		count := 0
+		for {
+			select {
+			case <-tr.PacketCh():
+				count++
+			case <-time.After(20 * time.Millisecond):
+				return count
+			}
+		}
+	}
+
+	// Clean links deliver everything exactly once.
+	_, err := a.WriteTo([]byte("hi"), addrB)
+	require.NoError(t, err)
+	require.Equal(t, 1, recv(b))
+
+	n.SetLinkFaults(addrA, addrB, &LinkFaults{Loss: 1})
+	a.WriteTo([]byte("hi"), addrB)
+	require.Equal(t, 0, recv(b))
+
+	n.SetLinkFaults(addrA, addrB, &LinkFaults{Duplicate: 1})
+	a.WriteTo([]byte("hi"), addrB)
+	require.Equal(t, 2, recv(b))
+
+	// Latency shows up in the receive timestamp.
+	n.SetLinkFaults(addrA, addrB, &LinkFaults{Latency: 30 * time.Millisecond})
+	sent, _ := a.WriteTo([]byte("hi"), addrB)
+	p := <-b.PacketCh()
+	require.True(t, p.Timestamp.Sub(sent) >= 30*time.Millisecond)
+
+	// A held back packet is overtaken by the next one.
+	n.SetLinkFaults(addrA, addrB, &LinkFaults{Reorder: 1, ReorderDelay: 30 * time.Millisecond})
+	a.WriteTo([]byte("first"), addrB)
+	n.SetLinkFaults(addrA, addrB, nil)
+	a.WriteTo([]byte("second"), addrB)
+	require.Equal(t, "second", string((<-b.PacketCh()).Buf))
+	require.Equal(t, "first", string((<-b.PacketCh()).Buf))
+
+	// Partitions are one way for packets, but block streams both ways.
+	n.Partition([]string{addrA}, []string{addrB})
+	a.WriteTo([]byte("hi"), addrB)
+	require.Equal(t, 0, recv(b))
+	b.WriteTo([]byte("hi"), addrA)
+	require.Equal(t, 1, recv(a))
+	_, err = b.DialTimeout(addrA, 10*time.Millisecond)
+	require.Error(t, err)
+
+	// Blocking UDP leaves streams open.
+	n.Heal()
+	n.BlockPackets([]string{addrA}, []string{addrB})
+	a.WriteTo([]byte("hi"), addrB)
+	require.Equal(t, 0, recv(b))
+	go func() {
+		conn := <-b.StreamCh()
+		conn.Close()
+	}()
+	conn, err := a.DialTimeout(addrB, time.Second)
+	require.NoError(t, err)
+	conn.Close()
+
+	// Defaults apply to every link without its own faults.
+	n.Heal()
+	n.SetDefaultFaults(&LinkFaults{Loss: 1})
+	b.WriteTo([]byte("hi"), addrA)
+	require.Equal(t, 0, recv(a))
+	n.SetLinkFaults(addrB, addrA, &LinkFaults{})
+	b.WriteTo([]byte("hi"), addrA)
+	require.Equal(t, 1, recv(a))
+}
+
+func TestMockNetwork_NoClock(t *testing.T) {
+	// Without a clock, WriteTo hands the packet straight to the receiver.
+	n := &MockNetwork{}
+	a, b := n.NewTransport(), n.NewTransport()
+	sent := make(chan struct{})
+	go func() {
+		a.WriteTo([]byte("hi"), b.addr.String())
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatalf("write should wait for the receiver")
+	case <-time.After(20 * time.Millisecond):
+	}
+	require.Equal(t, "hi", string((<-b.PacketCh()).Buf))
+	<-sent
+
+	// Once the receiver shuts down, packets are dropped rather than left
+	// waiting, even ones held back by latency.
+	n.SetDefaultFaults(&LinkFaults{Latency: 10 * time.Millisecond})
+	require.NoError(t, b.Shutdown())
+	_, err := a.WriteTo([]byte("late"), b.addr.String())
+	require.NoError(t, err)
+	n.Heal()
+	_, err = a.WriteTo([]byte("gone"), b.addr.String())
+	require.NoError(t, err)
+	_, err = a.DialTimeout(b.addr.String(), time.Second)
+	require.Error(t, err)
+}
+
+func TestMockNetwork_Seed(t *testing.T) {
+	run := func() []int {
+		n := &MockNetwork{Clock: realClock{}}
+		n.Seed(42)
+		a, b := n.NewTransport(), n.NewTransport()
+		n.SetDefaultFaults(&LinkFaults{Loss: 0.5})
+
+		var got []int
+		for i := 0; i < 32; i++ {
+			a.WriteTo([]byte{byte(i)}, b.addr.String())
+		}
+		for {
+			select {
+			case p := <-b.PacketCh():
+				got = append(got, int(p.Buf[0]))
+			default:
+				return got
+			}
+		}
+	}
+	first := run()
+	require.NotEmpty(t, first)
+	require.True(t, len(first) < 32)
+	require.Equal(t, first, run())
+}
+
+// mockCluster starts n joined memberlists on the network with fast failure
+// detection. Probes blocked by a fault can outlive Shutdown, so logs are
+// discarded rather than sent to the test. The network is given the wall
+// clock if it has none, so that packets are queued and nodes answering each
+// other at once can't block forever.
+func mockCluster(t *testing.T, network *MockNetwork, n int, f func(c *Config)) []*Memberlist {
+	if network.Clock == nil {
+		network.Clock = realClock{}
+	}
+	var ms []*Memberlist
+	for i := 0; i < n; i++ {
+		c := testConfig(t)
+		c.Name = "node" + strconv.Itoa(i)
+		c.Logger = nil
+		c.LogOutput = ioutil.Discard
+		c.Transport = network.NewTransport()
+		c.ProbeInterval = 100 * time.Millisecond
+		c.ProbeTimeout = 20 * time.Millisecond
+		c.SuspicionMult = 1
+		c.TCPTimeout = 100 * time.Millisecond
+		if f != nil {
+			f(c)
+		}
+		m, err := Create(c)
+		require.NoError(t, err)
+		ms = append(ms, m)
+
+		if i > 0 {
+			_, err = m.Join([]string{ms[0].LocalNode().Address()})
+			require.NoError(t, err)
+		}
+	}
+	for _, m := range ms {
+		waitUntilSize(t, m, n)
+	}
+	return ms
+}
+
+// nodeStateOf returns the state of a node as seen by m.
+func nodeStateOf(m *Memberlist, name string) NodeStateType {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	return m.nodeMap[name].State
+}
+
+func TestMockNetwork_IndirectProbe(t *testing.T) {
+	network := &MockNetwork{}
+	ms := mockCluster(t, network, 3, func(c *Config) {
+		c.DisableTcpPings = true
+	})
+	for _, m := range ms {
+		defer m.Shutdown()
+	}
+	addr := func(i int) []string { return []string{ms[i].LocalNode().Address()} }
+
+	// node0 and node2 can't exchange packets, but node1 can vouch for
+	// node2 through an indirect probe. A relayed ack can still miss the
+	// short probe timeout on a busy host, so allow a refuted suspicion.
+	network.BlockPackets(addr(0), addr(2))
+	network.BlockPackets(addr(2), addr(0))
+	time.Sleep(time.Second)
+	retry(t, 10, 100*time.Millisecond, func(failf func(string, ...interface{})) {
+		if s := nodeStateOf(ms[0], "node2"); s != StateAlive {
+			failf("node0 sees node2 as %v", s)
+		}
+		if s := nodeStateOf(ms[2], "node0"); s != StateAlive {
+			failf("node2 sees node0 as %v", s)
+		}
+	})
+}
+
+func TestMockNetwork_FallbackTCP(t *testing.T) {
+	network := &MockNetwork{}
+	ms := mockCluster(t, network, 3, nil)
+	for _, m := range ms {
+		defer m.Shutdown()
+	}
+	var all []string
+	for _, m := range ms {
+		all = append(all, m.LocalNode().Address())
+	}
+
+	// With UDP blocked everywhere, only the TCP fallback ping keeps the
+	// cluster together.
+	network.BlockPackets(all, all)
+	time.Sleep(time.Second)
+	for _, m := range ms {
+		for _, other := range ms {
+			require.Equal(t, StateAlive, nodeStateOf(m, other.config.Name))
+		}
+	}
+}
+
+func TestMockNetwork_PartitionConfirmed(t *testing.T) {
+	// This runs on the wall clock, so the budgets below leave plenty of
+	// room for a loaded machine, and regular push/pulls make up for any
+	// gossip that's missed on the way back.
+	network := &MockNetwork{}
+	ms := mockCluster(t, network, 3, func(c *Config) {
+		c.PushPullInterval = 500 * time.Millisecond
+	})
+	for _, m := range ms {
+		defer m.Shutdown()
+	}
+	addr2 := []string{ms[2].LocalNode().Address()}
+	others := []string{ms[0].LocalNode().Address(), ms[1].LocalNode().Address()}
+
+	// Cut node2 off completely. Both others suspect it and confirm each
+	// other's suspicion, so it's declared dead.
+	network.Partition(others, addr2)
+	network.Partition(addr2, others)
+	retry(t, 100, 100*time.Millisecond, func(failf func(string, ...interface{})) {
+		for _, m := range ms[:2] {
+			if s := nodeStateOf(m, "node2"); s != StateDead {
+				failf("%s sees node2 as %v", m.config.Name, s)
+			}
+		}
+	})
+
+	// Once healed, node2 refutes and rejoins via push/pull.
+	network.Heal()
+	_, err := ms[2].Join(others[:1])
+	require.NoError(t, err)
+	retry(t, 100, 100*time.Millisecond, func(failf func(string, ...interface{})) {
+		for _, m := range ms {
+			if m.NumMembers() != 3 {
+				failf("%s has %d members", m.config.Name, m.NumMembers())
+			}
+		}
+	})
+}
+
+func TestInmemTransport_Advertise(t *testing.T) {
+	network := &InmemNetwork{}
+	a, err := network.NewTransport("10.0.0.1:7946")
+	require.NoError(t, err)
+	defer a.Shutdown()
+	b, err := network.NewTransport("")
+	require.NoError(t, err)
+	defer b.Shutdown()
+
+	_, err = network.NewTransport("10.0.0.1:7946")
+	require.Error(t, err)
+	_, err = network.NewTransport("nope")
+	require.Error(t, err)
+
+	// An advertised address reaches the transport too, and can't be one
+	// that's taken.
+	ip, port, err := a.FinalAdvertiseAddr("192.168.0.1", 0)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1", ip.String())
+	require.Equal(t, 7946, port)
+	_, err = b.WriteTo([]byte("x"), "192.168.0.1:7946")
+	require.NoError(t, err)
+	p := <-a.PacketCh()
+	require.Equal(t, b.Addr().String(), p.From.String())
+
+	_, _, err = b.FinalAdvertiseAddr("192.168.0.1", 7946)
+	require.Error(t, err)
+
+	// Shutting down frees every address.
+	require.NoError(t, a.Shutdown())
+	_, err = b.WriteTo([]byte("x"), "192.168.0.1:7946")
+	require.Error(t, err)
+	c, err := network.NewTransport("10.0.0.1:7946")
+	require.NoError(t, err)
+	c.Shutdown()
+}
+
+func TestUnixTransport_BindPort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := &UnixTransportConfig{Dir: dir, BindPort: 7946, Logger: testLogger(t)}
+	a, err := NewUnixTransport(config)
+	require.NoError(t, err)
+	ip, port, err := a.FinalAdvertiseAddr("", 0)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:7946", joinHostPort(ip.String(), uint16(port)))
+
+	// Only the bind address can be advertised.
+	_, _, err = a.FinalAdvertiseAddr("127.0.0.1", 7946)
+	require.NoError(t, err)
+	_, _, err = a.FinalAdvertiseAddr("10.0.0.1", 7946)
+	require.Error(t, err)
+
+	// The port is taken while the transport is running.
+	_, err = NewUnixTransport(config)
+	require.Error(t, err)
+
+	require.NoError(t, a.Shutdown())
+
+	// Files left behind by a process that died without shutting down its
+	// transport are cleaned up.
+	packetPath, streamPath := a.socketPaths("127.0.0.1:7946")
+	packetConn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: packetPath, Net: "unixgram"})
+	require.NoError(t, err)
+	packetConn.Close()
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: streamPath, Net: "unix"})
+	require.NoError(t, err)
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+
+	b, err := NewUnixTransport(config)
+	require.NoError(t, err)
+	require.NoError(t, b.Shutdown())
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
@@ -0,0 +1,402 @@
+// Package transporttest checks that a memberlist.Transport behaves the way
+// memberlist expects, so that custom transports can be validated against the
+// same contract as the built-in ones.
+//
+// A transport's own tests call Run with a Factory that makes transports able
+// to reach each other:
+//
+//	func TestMyTransport(t *testing.T) {
+//		transporttest.Run(t, func(t *testing.T) (memberlist.Transport, string) {
+//			tr := newMyTransport(t)
+//			return tr, tr.Addr()
+//		})
+//	}
+//
+// The individual checks are exported too, for transports that can only meet
+// part of the contract.
+package transporttest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Factory makes a transport for the tests, returning it along with the
+// "ip:port" address peers reach it at. Transports made by the same Factory
+// must be able to reach each other. The tests shut down every transport
+// they make.
+type Factory func(t *testing.T) (memberlist.Transport, string)
+
+const (
+	// timeout bounds how long any one thing the tests wait for may take.
+	timeout = 5 * time.Second
+
+	// packetSize is the size of the largest packets sent, which is a
+	// little under the default UDPBufferSize.
+	packetSize = 1350
+)
+
+// Run runs every check against the transports made by f, each as a subtest.
+func Run(t *testing.T, f Factory) {
+	t.Run("Advertise", func(t *testing.T) { TestAdvertise(t, f) })
+	t.Run("Packets", func(t *testing.T) { TestPackets(t, f) })
+	t.Run("Timestamps", func(t *testing.T) { TestTimestamps(t, f) })
+	t.Run("Streams", func(t *testing.T) { TestStreams(t, f) })
+	t.Run("Shutdown", func(t *testing.T) { TestShutdown(t, f) })
+	t.Run("Concurrency", func(t *testing.T) { TestConcurrency(t, f) })
+	t.Run("Memberlist", func(t *testing.T) { TestMemberlist(t, f) })
+}
+
+// TestAdvertise checks that a transport advertises the address it's reached
+// at when no address is configured, and rejects an advertise address that
+// isn't an IP.
+func TestAdvertise(t *testing.T, f Factory) {
+	tr, addr := f(t)
+	defer tr.Shutdown()
+
+	ip, port, err := tr.FinalAdvertiseAddr("", 0)
+	if err != nil {
+		t.Fatalf("FinalAdvertiseAddr: %v", err)
+	}
+	if got := net.JoinHostPort(ip.String(), fmt.Sprint(port)); got != addr {
+		t.Fatalf("advertised %s, want %s", got, addr)
+	}
+
+	if _, _, err := tr.FinalAdvertiseAddr("not-an-ip", port); err == nil {
+		t.Fatalf("advertised an invalid address")
+	}
+}
+
+// TestPackets checks that packets get through in both directions intact,
+// from the sender's address, and that the sender may reuse its buffer as
+// soon as WriteTo returns.
+func TestPackets(t *testing.T, f Factory) {
+	a, aAddr := f(t)
+	defer a.Shutdown()
+	b, bAddr := f(t)
+	defer b.Shutdown()
+
+	for _, dir := range []struct {
+		from, to         memberlist.Transport
+		fromAddr, toAddr string
+	}{
+		{a, b, aAddr, bAddr},
+		{b, a, bAddr, aAddr},
+	} {
+		for _, size := range []int{1, 100, packetSize} {
+			payload := make([]byte, size)
+			for i := range payload {
+				payload[i] = byte(i)
+			}
+			want := string(payload)
+
+			if _, err := dir.from.WriteTo(payload, dir.toAddr); err != nil {
+				t.Fatalf("WriteTo %s: %v", dir.toAddr, err)
+			}
+			for i := range payload {
+				payload[i] = 0xff
+			}
+
+			p := receive(t, dir.to)
+			if string(p.Buf) != want {
+				t.Fatalf("got a %d byte packet, want %d bytes as sent", len(p.Buf), size)
+			}
+			if p.From == nil || p.From.String() != dir.fromAddr {
+				t.Fatalf("packet from %v, want %s", p.From, dir.fromAddr)
+			}
+		}
+	}
+}
+
+// TestTimestamps checks that WriteTo returns the time a packet was sent, and
+// that a packet is stamped when it's received rather than when it's taken
+// from the packet channel. Memberlist measures round trip times with these.
+func TestTimestamps(t *testing.T, f Factory) {
+	a, _ := f(t)
+	defer a.Shutdown()
+	b, bAddr := f(t)
+	defer b.Shutdown()
+
+	before := time.Now()
+	sent, err := a.WriteTo([]byte("ping"), bAddr)
+	after := time.Now()
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if sent.Before(before) || sent.After(after) {
+		t.Fatalf("WriteTo returned %v, outside of the call (%v to %v)", sent, before, after)
+	}
+
+	// Leave the packet waiting for a while before reading it.
+	const wait = 200 * time.Millisecond
+	time.Sleep(wait)
+	p := receive(t, b)
+	read := time.Now()
+	if p.Timestamp.Before(before) {
+		t.Fatalf("packet stamped %v, before it was sent at %v", p.Timestamp, before)
+	}
+	if read.Sub(p.Timestamp) < wait/2 {
+		t.Fatalf("packet stamped %v, when it was read rather than received", p.Timestamp)
+	}
+}
+
+// TestStreams checks that a dialed stream reaches the other transport, that
+// data flows both ways, that closing one end is seen by the other, and that
+// deadlines work. Memberlist always writes first on a stream it dials, so a
+// transport may wait for the first bytes before handing a stream over.
+// Streams needn't be buffered, so every write is made while the other end
+// is reading.
+func TestStreams(t *testing.T, f Factory) {
+	a, _ := f(t)
+	defer a.Shutdown()
+	b, bAddr := f(t)
+	defer b.Shutdown()
+
+	client, err := a.DialTimeout(bAddr, timeout)
+	if err != nil {
+		t.Fatalf("DialTimeout: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(timeout))
+	errCh := write(client, "ping")
+
+	server := accept(t, b)
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(timeout))
+
+	// Memberlist logs both addresses.
+	_ = client.LocalAddr()
+	_ = client.RemoteAddr()
+	_ = server.LocalAddr()
+	_ = server.RemoteAddr()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("server read %q: %v", buf, err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+
+	errCh = write(server, "pong")
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("client read %q: %v", buf, err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("server write: %v", err)
+	}
+
+	// A read deadline that passes fails the read.
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := server.Read(buf); err == nil {
+		t.Fatalf("read didn't time out")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read failed with %v, want a timeout", err)
+	}
+
+	// Closing the client is seen as the end of the stream.
+	client.Close()
+	server.SetDeadline(time.Now().Add(timeout))
+	if rest, err := ioutil.ReadAll(server); err != nil || len(rest) != 0 {
+		t.Fatalf("server read %q after close: %v", rest, err)
+	}
+}
+
+// TestShutdown checks that shutting a transport down is idempotent, doesn't
+// wait on packets nobody is reading, and leaves it unreachable.
+func TestShutdown(t *testing.T, f Factory) {
+	a, _ := f(t)
+	defer a.Shutdown()
+	b, bAddr := f(t)
+
+	// Nobody reads these.
+	for i := 0; i < 10; i++ {
+		a.WriteTo([]byte("unread"), bAddr)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- b.Shutdown() }()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("Shutdown blocked")
+	}
+	if err := b.Shutdown(); err != nil {
+		t.Fatalf("second Shutdown: %v", err)
+	}
+
+	start := time.Now()
+	conn, err := a.DialTimeout(bAddr, 500*time.Millisecond)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("dialed a transport that was shut down")
+	}
+	if time.Since(start) > timeout {
+		t.Fatalf("dial took %v to fail", time.Since(start))
+	}
+}
+
+// TestConcurrency checks that packets and streams can be sent from many
+// goroutines at once without any being lost on a quiet link.
+func TestConcurrency(t *testing.T, f Factory) {
+	a, _ := f(t)
+	defer a.Shutdown()
+	b, bAddr := f(t)
+	defer b.Shutdown()
+
+	const workers, each = 8, 25
+	var wg sync.WaitGroup
+	errCh := make(chan error, 2*workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				if _, err := a.WriteTo([]byte(fmt.Sprintf("%d-%d", i, j)), bAddr); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := a.DialTimeout(bAddr, timeout)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(timeout))
+			msg := []byte(fmt.Sprintf("stream-%d", i))
+			if _, err := conn.Write(msg); err != nil {
+				errCh <- err
+				return
+			}
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				errCh <- err
+				return
+			}
+			if string(buf) != string(msg) {
+				errCh <- fmt.Errorf("echoed %q, want %q", buf, msg)
+			}
+		}(i)
+	}
+
+	// Take packets and echo streams until everything has been seen.
+	packets := make(map[string]bool)
+	streams := 0
+	deadline := time.After(timeout)
+	for len(packets) < workers*each || streams < workers {
+		select {
+		case p := <-b.PacketCh():
+			packets[string(p.Buf)] = true
+		case conn := <-b.StreamCh():
+			streams++
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(timeout))
+				io.Copy(conn, conn)
+			}()
+		case err := <-errCh:
+			t.Fatalf("%v", err)
+		case <-deadline:
+			t.Fatalf("got %d of %d packets and %d of %d streams",
+				len(packets), workers*each, streams, workers)
+		}
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("%v", err)
+	}
+}
+
+// TestMemberlist checks that memberlists using the transports can form a
+// cluster and send reliable messages.
+func TestMemberlist(t *testing.T, f Factory) {
+	var ms []*memberlist.Memberlist
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		tr, addr := f(t)
+		c := memberlist.DefaultLANConfig()
+		c.Name = fmt.Sprintf("node%d", i)
+		c.Transport = tr
+		c.Logger = log.New(ioutil.Discard, "", 0)
+		c.ProbeInterval = 100 * time.Millisecond
+		c.GossipInterval = 20 * time.Millisecond
+		c.PushPullInterval = time.Second
+		m, err := memberlist.Create(c)
+		if err != nil {
+			tr.Shutdown()
+			t.Fatalf("Create: %v", err)
+		}
+		defer m.Shutdown()
+		ms = append(ms, m)
+		addrs = append(addrs, addr)
+	}
+
+	if n, err := ms[0].Join(addrs[1:]); err != nil || n != 2 {
+		t.Fatalf("joined %d of 2: %v", n, err)
+	}
+	deadline := time.Now().Add(timeout)
+	for _, m := range ms {
+		for m.NumMembers() != 3 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s sees %d members", m.LocalNode().Name, m.NumMembers())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := ms[1].SendReliable(ms[2].LocalNode(), []byte("hi")); err != nil {
+		t.Fatalf("SendReliable: %v", err)
+	}
+}
+
+// receive waits for a packet on tr.
+func receive(t *testing.T, tr memberlist.Transport) *memberlist.Packet {
+	t.Helper()
+	select {
+	case p := <-tr.PacketCh():
+		return p
+	case <-time.After(timeout):
+		t.Fatalf("no packet arrived")
+	}
+	return nil
+}
+
+// accept waits for a stream on tr.
+func accept(t *testing.T, tr memberlist.Transport) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-tr.StreamCh():
+		return conn
+	case <-time.After(timeout):
+		t.Fatalf("no stream arrived")
+	}
+	return nil
+}
+
+// write writes msg to conn in the background, returning the result on the
+// channel.
+func write(conn net.Conn, msg string) <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte(msg))
+		errCh <- err
+	}()
+	return errCh
+}
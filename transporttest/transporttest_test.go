@@ -0,0 +1,18 @@
+package transporttest
+
+import (
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestRun_Inmem(t *testing.T) {
+	network := &memberlist.InmemNetwork{}
+	Run(t, func(t *testing.T) (memberlist.Transport, string) {
+		tr, err := network.NewTransport("")
+		if err != nil {
+			t.Fatalf("NewTransport: %v", err)
+		}
+		return tr, tr.Addr().String()
+	})
+}
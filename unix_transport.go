@@ -0,0 +1,422 @@
+package memberlist
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// unixPacketSuffix and unixStreamSuffix end the names of the packet
+	// and stream sockets in a UnixTransport's directory.
+	unixPacketSuffix = ".pkt"
+	unixStreamSuffix = ".sock"
+
+	// unixPacketWriteTimeout bounds how long a packet write may wait for
+	// room in a slow receiver's queue before the packet is dropped.
+	unixPacketWriteTimeout = 250 * time.Millisecond
+
+	// unixAutoPortMin and unixAutoPortMax are the range of ports picked
+	// from when UnixTransportConfig.BindPort is zero.
+	unixAutoPortMin = 10000
+	unixAutoPortMax = 60000
+)
+
+// UnixTransportConfig is used to configure a Unix domain socket transport.
+type UnixTransportConfig struct {
+	// Dir is the directory holding the sockets of every node that takes
+	// part, which must be on the same host. Each transport binds a unixgram
+	// socket for packets and a unix socket for streams in it. Anyone who
+	// can write to the directory can reach the cluster, so its permissions
+	// should be set accordingly. Socket paths are limited to about 100
+	// bytes, so the directory's path should be short.
+	Dir string
+
+	// BindAddr and BindPort make up the "ip:port" address this node is
+	// known by. No network port is opened; the address only names the
+	// sockets. If BindAddr is empty, 127.0.0.1 is used, and if BindPort is
+	// zero, an unused port is picked.
+	BindAddr string
+	BindPort int
+
+	// Logger is a logger for operator messages.
+	Logger *log.Logger
+}
+
+// UnixTransport is a Transport implementation that uses unixgram sockets for
+// packet operations and unix sockets for stream operations, so that processes
+// on the same host can form a cluster without opening network ports.
+//
+// Peers are still addressed as "ip:port", and each address maps to a pair of
+// socket files in the shared directory. Accepted streams have no address for
+// the remote end, so Config.CIDRsAllowed can't be used with this transport.
+type UnixTransport struct {
+	config     *UnixTransportConfig
+	ip         net.IP
+	port       int
+	addr       *unixPeerAddr
+	packetCh   chan *Packet
+	streamCh   chan net.Conn
+	logger     *log.Logger
+	wg         sync.WaitGroup
+	packetConn *net.UnixConn
+	listener   *net.UnixListener
+	shutdown   int32
+	shutdownCh chan struct{}
+}
+
+// NewUnixTransport returns a Unix domain socket transport with the given
+// configuration. On success both sockets will be bound and listening.
+func NewUnixTransport(config *UnixTransportConfig) (*UnixTransport, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("A socket directory is required")
+	}
+	bindAddr := config.BindAddr
+	if bindAddr == "" {
+		bindAddr = "127.0.0.1"
+	}
+	ip := net.ParseIP(bindAddr)
+	if ip == nil {
+		return nil, fmt.Errorf("Failed to parse bind address %q", bindAddr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	t := UnixTransport{
+		config:     config,
+		ip:         ip,
+		packetCh:   make(chan *Packet),
+		streamCh:   make(chan net.Conn),
+		logger:     config.Logger,
+		shutdownCh: make(chan struct{}),
+	}
+	if t.logger == nil {
+		t.logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	if config.BindPort != 0 {
+		if err := t.bind(config.BindPort, true); err != nil {
+			return nil, err
+		}
+	} else {
+		// Start somewhere random so that nodes starting at the same
+		// time don't all race for the same port.
+		span := unixAutoPortMax - unixAutoPortMin
+		start := rand.Intn(span)
+		var err error
+		for i := 0; i < span; i++ {
+			port := unixAutoPortMin + (start+i)%span
+			if err = t.bind(port, false); err == nil {
+				break
+			}
+			if !os.IsExist(err) {
+				return nil, err
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to find an unused port: %v", err)
+		}
+	}
+
+	t.wg.Add(2)
+	go t.packetListen()
+	go t.streamListen()
+	return &t, nil
+}
+
+// bind binds both sockets for port. If the socket files are there already
+// and cleanStale is set, they are removed if nothing is listening on them.
+// It returns an error satisfying os.IsExist if the port is taken.
+func (t *UnixTransport) bind(port int, cleanStale bool) error {
+	addr := joinHostPort(t.ip.String(), uint16(port))
+	packetPath, streamPath := t.socketPaths(addr)
+
+	if _, err := os.Stat(packetPath); err == nil {
+		if !cleanStale || !unixSocketStale(streamPath) {
+			return &os.PathError{Op: "bind", Path: packetPath, Err: os.ErrExist}
+		}
+		os.Remove(packetPath)
+		os.Remove(streamPath)
+	}
+
+	packetConn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: packetPath, Net: "unixgram"})
+	if err != nil {
+		if isAddrInUse(err) {
+			return &os.PathError{Op: "bind", Path: packetPath, Err: os.ErrExist}
+		}
+		return fmt.Errorf("Failed to start packet listener on %q: %v", packetPath, err)
+	}
+	if err := setUnixRecvBuf(packetConn); err != nil {
+		packetConn.Close()
+		os.Remove(packetPath)
+		return fmt.Errorf("Failed to resize packet buffer: %v", err)
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: streamPath, Net: "unix"})
+	if err != nil {
+		packetConn.Close()
+		os.Remove(packetPath)
+		if isAddrInUse(err) {
+			return &os.PathError{Op: "bind", Path: streamPath, Err: os.ErrExist}
+		}
+		return fmt.Errorf("Failed to start stream listener on %q: %v", streamPath, err)
+	}
+
+	t.port = port
+	t.addr = &unixPeerAddr{addr}
+	t.packetConn = packetConn
+	t.listener = listener
+	return nil
+}
+
+// socketPaths returns the packet and stream socket paths for an address.
+func (t *UnixTransport) socketPaths(addr string) (string, string) {
+	base := filepath.Join(t.config.Dir, addr)
+	return base + unixPacketSuffix, base + unixStreamSuffix
+}
+
+// unixSocketStale returns true if nothing is accepting connections on the
+// stream socket at path, which is left behind when a process dies without
+// shutting its transport down.
+func unixSocketStale(path string) bool {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return true
+	}
+	conn.Close()
+	return false
+}
+
+// isAddrInUse returns true if err is from binding a socket path that
+// exists.
+func isAddrInUse(err error) bool {
+	return strings.Contains(err.Error(), "address already in use")
+}
+
+// setUnixRecvBuf is like setUDPRecvBuf for the packet socket.
+func setUnixRecvBuf(c *net.UnixConn) error {
+	size := udpRecvBufSize
+	var err error
+	for size > 0 {
+		if err = c.SetReadBuffer(size); err == nil {
+			return nil
+		}
+		size = size / 2
+	}
+	return err
+}
+
+// unixPeerAddr is the "ip:port" address of a UnixTransport.
+type unixPeerAddr struct {
+	addr string
+}
+
+// See net.Addr.
+func (a *unixPeerAddr) Network() string {
+	return "unix"
+}
+
+// See net.Addr.
+func (a *unixPeerAddr) String() string {
+	return a.addr
+}
+
+// GetAutoBindPort returns the port that was picked, if a bind port of 0 was
+// given.
+func (t *UnixTransport) GetAutoBindPort() int {
+	return t.port
+}
+
+// See Transport. Peers reach this node through the socket files for its bind
+// address, so that's the only address it can advertise.
+func (t *UnixTransport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	if ip == "" {
+		return t.ip, t.port, nil
+	}
+
+	advertiseAddr := net.ParseIP(ip)
+	if advertiseAddr == nil {
+		return nil, 0, fmt.Errorf("Failed to parse advertise address %q", ip)
+	}
+	if !advertiseAddr.Equal(t.ip) || (port != 0 && port != t.port) {
+		return nil, 0, fmt.Errorf("Advertise address %s must match the bind address %s", joinHostPort(ip, uint16(port)), t.addr)
+	}
+	return t.ip, t.port, nil
+}
+
+// See Transport.
+func (t *UnixTransport) WriteTo(b []byte, addr string) (time.Time, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return time.Time{}, err
+	}
+	packetPath, _ := t.socketPaths(addr)
+
+	// A receiver that isn't keeping up makes writes block rather than
+	// dropping packets, so give up on it after a while like UDP would.
+	t.packetConn.SetWriteDeadline(time.Now().Add(unixPacketWriteTimeout))
+	_, err := t.packetConn.WriteToUnix(b, &net.UnixAddr{Name: packetPath, Net: "unixgram"})
+	return time.Now(), err
+}
+
+// See Transport.
+func (t *UnixTransport) PacketCh() <-chan *Packet {
+	return t.packetCh
+}
+
+// See Transport.
+func (t *UnixTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+	_, streamPath := t.socketPaths(addr)
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("unix", streamPath)
+	if err != nil {
+		return nil, err
+	}
+	return &unixConn{conn, t.addr, &unixPeerAddr{addr}}, nil
+}
+
+// unixConn is a stream to a peer, reporting the peer's "ip:port" address
+// instead of its socket path.
+type unixConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *unixConn) LocalAddr() net.Addr { return c.local }
+
+func (c *unixConn) RemoteAddr() net.Addr { return c.remote }
+
+// See Transport.
+func (t *UnixTransport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// See Transport.
+func (t *UnixTransport) Shutdown() error {
+	// This will avoid log spam about errors when we shut down.
+	if !atomic.CompareAndSwapInt32(&t.shutdown, 0, 1) {
+		return nil
+	}
+	close(t.shutdownCh)
+
+	// The stream listener removes its socket file when it's closed, but
+	// the packet socket's has to be removed by hand.
+	packetPath, _ := t.socketPaths(t.addr.String())
+	t.listener.Close()
+	t.packetConn.Close()
+	os.Remove(packetPath)
+
+	// Block until all the listener threads have died.
+	t.wg.Wait()
+	return nil
+}
+
+// streamListen is a long running goroutine that accepts incoming stream
+// connections and hands them off to the stream channel.
+func (t *UnixTransport) streamListen() {
+	defer t.wg.Done()
+
+	// baseDelay and maxDelay bound the back off after an accept error, as
+	// in NetTransport.tcpListen.
+	const baseDelay = 5 * time.Millisecond
+	const maxDelay = 1 * time.Second
+
+	var loopDelay time.Duration
+	for {
+		conn, err := t.listener.AcceptUnix()
+		if err != nil {
+			if s := atomic.LoadInt32(&t.shutdown); s == 1 {
+				return
+			}
+
+			if loopDelay == 0 {
+				loopDelay = baseDelay
+			} else {
+				loopDelay *= 2
+			}
+			if loopDelay > maxDelay {
+				loopDelay = maxDelay
+			}
+
+			t.logger.Printf("[ERR] memberlist: Error accepting unix connection: %v", err)
+			time.Sleep(loopDelay)
+			continue
+		}
+		loopDelay = 0
+
+		metrics.IncrCounter([]string{"memberlist", "unix", "accept"}, 1)
+		select {
+		case t.streamCh <- &unixConn{conn, t.addr, conn.RemoteAddr()}:
+		case <-t.shutdownCh:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// packetListen is a long running goroutine that accepts incoming packets and
+// hands them off to the packet channel.
+func (t *UnixTransport) packetListen() {
+	defer t.wg.Done()
+	buf := make([]byte, udpPacketBufSize)
+	for {
+		// Do a blocking read, reusing the buffer. Grab a time stamp as
+		// close as possible to the I/O.
+		n, from, err := t.packetConn.ReadFromUnix(buf)
+		ts := time.Now()
+		if err != nil {
+			if s := atomic.LoadInt32(&t.shutdown); s == 1 {
+				return
+			}
+
+			t.logger.Printf("[ERR] memberlist: Error reading unix packet: %v", err)
+			continue
+		}
+
+		// Check the length - it needs to have at least one byte to be a
+		// proper message.
+		if n < 1 {
+			t.logger.Printf("[ERR] memberlist: Unix packet too short (%d bytes) %s",
+				n, LogAddress(from))
+			continue
+		}
+
+		// Peers send from their own packet socket, so its name gives
+		// their address.
+		var addr net.Addr
+		if from != nil {
+			addr = from
+			name := filepath.Base(from.Name)
+			if strings.HasSuffix(name, unixPacketSuffix) {
+				addr = &unixPeerAddr{strings.TrimSuffix(name, unixPacketSuffix)}
+			}
+		}
+
+		// Ingest a copy of the packet.
+		packet := make([]byte, n)
+		copy(packet, buf)
+		metrics.IncrCounter([]string{"memberlist", "unix", "received"}, float32(n))
+		select {
+		case t.packetCh <- &Packet{
+			Buf:       packet,
+			From:      addr,
+			Timestamp: ts,
+		}:
+		case <-t.shutdownCh:
+			return
+		}
+	}
+}
@@ -2,10 +2,8 @@ package memberlist
 
 import (
 	"bytes"
-	"compress/lzw"
 	"encoding/binary"
 	"fmt"
-	"io"
 	"math"
 	"math/rand"
 	"net"
@@ -68,6 +66,13 @@ func suspicionTimeout(suspicionMult, n int, interval time.Duration) time.Duratio
 	return timeout
 }
 
+// queryTimeout computes the default time to wait for query responses, which
+// scales with the number of gossip rounds needed to reach every node
+func queryTimeout(queryTimeoutMult, n int, interval time.Duration) time.Duration {
+	nodeScale := math.Ceil(math.Log10(float64(n + 1)))
+	return time.Duration(queryTimeoutMult) * time.Duration(nodeScale) * interval
+}
+
 // retransmitLimit computes the limit of retransmissions
 func retransmitLimit(retransmitMult, n int) int {
 	nodeScale := math.Ceil(math.Log10(float64(n + 1)))
@@ -98,16 +103,16 @@ func pushPullScale(interval time.Duration, n int) time.Duration {
 
 // moveDeadNodes moves nodes that are dead and beyond the gossip to the dead interval
 // to the end of the slice and returns the index of the first moved node.
-func moveDeadNodes(nodes []*nodeState, gossipToTheDeadTime time.Duration) int {
+func moveDeadNodes(nodes []*nodeState, now time.Time, gossipToTheDeadTime time.Duration) int {
 	numDead := 0
 	n := len(nodes)
 	for i := 0; i < n-numDead; i++ {
-		if nodes[i].State != stateDead {
+		if nodes[i].State != StateDead {
 			continue
 		}
 
 		// Respect the gossip to the dead interval
-		if time.Since(nodes[i].StateChange) <= gossipToTheDeadTime {
+		if now.Sub(nodes[i].StateChange) <= gossipToTheDeadTime {
 			continue
 		}
 
@@ -152,6 +157,41 @@ OUTER:
 	return kNodes
 }
 
+// kRandomNodesPreferring is like kRandomNodes, but takes as many of the nodes
+// as it can from those where preferFn returns true, and only the rest from
+// the others. Unlike kRandomNodes it looks at every node, so it always finds
+// k of them if there are that many.
+func kRandomNodesPreferring(k int, nodes []*nodeState, filterFn, preferFn func(*nodeState) bool) []*nodeState {
+	var preferred, others []*nodeState
+	for _, n := range nodes {
+		if filterFn != nil && filterFn(n) {
+			continue
+		}
+		if preferFn(n) {
+			preferred = append(preferred, n)
+		} else {
+			others = append(others, n)
+		}
+	}
+
+	kNodes := make([]*nodeState, 0, k)
+	kNodes = append(kNodes, randomSample(k, preferred)...)
+	return append(kNodes, randomSample(k-len(kNodes), others)...)
+}
+
+// randomSample returns up to k of the nodes, picked at random. It reorders
+// the slice it's given.
+func randomSample(k int, nodes []*nodeState) []*nodeState {
+	if k > len(nodes) {
+		k = len(nodes)
+	}
+	for i := 0; i < k; i++ {
+		j := i + randomOffset(len(nodes)-i)
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+	return nodes[:k]
+}
+
 // makeCompoundMessage takes a list of messages and generates
 // a single compound message containing all of them
 func makeCompoundMessage(msgs [][]byte) *bytes.Buffer {
@@ -216,62 +256,50 @@ func decodeCompoundMessage(buf []byte) (trunc int, parts [][]byte, err error) {
 	return
 }
 
-// compressPayload takes an opaque input buffer, compresses it
-// and wraps it in a compress{} message that is encoded.
-func compressPayload(inp []byte) (*bytes.Buffer, error) {
-	var buf bytes.Buffer
-	compressor := lzw.NewWriter(&buf, lzw.LSB, lzwLitWidth)
-
-	_, err := compressor.Write(inp)
-	if err != nil {
-		return nil, err
+// compressPayload takes an opaque input buffer, compresses it with the
+// given algorithm and wraps it in a compress{} message that is encoded.
+func compressPayload(algo compressionType, inp []byte) (*bytes.Buffer, error) {
+	comp, ok := compressors[algo]
+	if !ok {
+		return nil, fmt.Errorf("Cannot compress with unknown algorithm %d", algo)
 	}
 
-	// Ensure we flush everything out
-	if err := compressor.Close(); err != nil {
+	buf, err := comp.Compress(inp)
+	if err != nil {
 		return nil, err
 	}
 
 	// Create a compressed message
 	c := compress{
-		Algo: lzwAlgo,
-		Buf:  buf.Bytes(),
+		Algo: algo,
+		Buf:  buf,
 	}
 	return encode(compressMsg, &c)
 }
 
 // decompressPayload is used to unpack an encoded compress{}
-// message and return its payload uncompressed
-func decompressPayload(msg []byte) ([]byte, error) {
+// message and return its payload uncompressed, failing if it's bigger than
+// limit.
+func decompressPayload(msg []byte, limit int) ([]byte, error) {
 	// Decode the message
 	var c compress
 	if err := decode(msg, &c); err != nil {
 		return nil, err
 	}
-	return decompressBuffer(&c)
+	return decompressBuffer(&c, limit)
 }
 
 // decompressBuffer is used to decompress the buffer of
-// a single compress message, handling multiple algorithms
-func decompressBuffer(c *compress) ([]byte, error) {
+// a single compress message, handling multiple algorithms. The caller picks
+// limit to suit where the message came from, so that a packet can't expand
+// to the size of a push/pull.
+func decompressBuffer(c *compress, limit int) ([]byte, error) {
 	// Verify the algorithm
-	if c.Algo != lzwAlgo {
+	comp, ok := compressors[c.Algo]
+	if !ok {
 		return nil, fmt.Errorf("Cannot decompress unknown algorithm %d", c.Algo)
 	}
-
-	// Create a uncompressor
-	uncomp := lzw.NewReader(bytes.NewReader(c.Buf), lzw.LSB, lzwLitWidth)
-	defer uncomp.Close()
-
-	// Read all the data
-	var b bytes.Buffer
-	_, err := io.Copy(&b, uncomp)
-	if err != nil {
-		return nil, err
-	}
-
-	// Return the uncompressed bytes
-	return b.Bytes(), nil
+	return comp.Decompress(c.Buf, limit)
 }
 
 // joinHostPort returns the host:port form of an address, for use with a
@@ -307,3 +335,22 @@ func ensurePort(s string, port int) string {
 	s = net.JoinHostPort(s, strconv.Itoa(port))
 	return s
 }
+
+// addrIP extracts the IP from a transport address.
+func addrIP(addr net.Addr) (net.IP, error) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, nil
+	case *net.TCPAddr:
+		return a.IP, nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("Failed to parse IP %q", host)
+	}
+	return ip, nil
+}
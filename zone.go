@@ -0,0 +1,49 @@
+package memberlist
+
+// sameZone returns true if the node advertised the same zone as ours. Nodes
+// that don't advertise a zone are never in ours.
+func (m *Memberlist) sameZone(n *nodeState) bool {
+	return n.Zone != "" && n.Zone == m.config.Zone
+}
+
+// gossipNodes picks up to k random nodes to gossip to. Without a zone they
+// are picked uniformly. With one, up to GossipCrossZoneNodes of them are
+// from other zones and the rest from ours, and if either side doesn't have
+// enough nodes the other makes up the difference.
+func (m *Memberlist) gossipNodes(k int, filterFn func(*nodeState) bool) []*nodeState {
+	if m.config.Zone == "" {
+		return kRandomNodes(k, m.nodes, filterFn)
+	}
+
+	cross := m.config.GossipCrossZoneNodes
+	if cross > k {
+		cross = k
+	} else if cross < 0 {
+		cross = 0
+	}
+	otherZone := func(n *nodeState) bool {
+		return !m.sameZone(n)
+	}
+	kNodes := kRandomNodesPreferring(cross, m.nodes, filterFn, otherZone)
+	picked := func(n *nodeState) bool {
+		for _, p := range kNodes {
+			if p == n {
+				return true
+			}
+		}
+		return filterFn != nil && filterFn(n)
+	}
+	return append(kNodes, kRandomNodesPreferring(k-len(kNodes), m.nodes, picked, m.sameZone)...)
+}
+
+// indirectProbeNodes picks up to k random nodes to ask to probe a node for
+// us. Without a zone they are picked uniformly. With one, nodes outside our
+// zone are preferred, since they don't share its network.
+func (m *Memberlist) indirectProbeNodes(k int, filterFn func(*nodeState) bool) []*nodeState {
+	if m.config.Zone == "" {
+		return kRandomNodes(k, m.nodes, filterFn)
+	}
+	return kRandomNodesPreferring(k, m.nodes, filterFn, func(n *nodeState) bool {
+		return !m.sameZone(n)
+	})
+}
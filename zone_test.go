@@ -0,0 +1,127 @@
+package memberlist
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// zoneMemberlist returns a memberlist in zone "a" that knows about four
+// alive nodes in each of zones "a", "b" and "c", and two without a zone.
+func zoneMemberlist() *Memberlist {
+	c := DefaultLANConfig()
+	c.Name = "me"
+	c.Zone = "a"
+	m := &Memberlist{config: c}
+	for _, zone := range []string{"a", "b", "c"} {
+		for i := 0; i < 4; i++ {
+			m.nodes = append(m.nodes, &nodeState{
+				Node: Node{Name: fmt.Sprintf("%s%d", zone, i), Zone: zone},
+			})
+		}
+	}
+	m.nodes = append(m.nodes,
+		&nodeState{Node: Node{Name: "none0"}},
+		&nodeState{Node: Node{Name: "none1"}},
+	)
+	return m
+}
+
+func countZones(nodes []*nodeState) map[string]int {
+	zones := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		if seen[n.Name] {
+			panic("picked twice: " + n.Name)
+		}
+		seen[n.Name] = true
+		zones[n.Zone]++
+	}
+	return zones
+}
+
+func TestMemberlist_gossipNodes_Zone(t *testing.T) {
+	m := zoneMemberlist()
+	for i := 0; i < 50; i++ {
+		zones := countZones(m.gossipNodes(3, nil))
+		require.Equal(t, 2, zones["a"])
+		require.Equal(t, 1, zones["b"]+zones["c"]+zones[""])
+	}
+
+	// If our zone runs short the other zones make up the difference.
+	m.config.GossipCrossZoneNodes = 0
+	zones := countZones(m.gossipNodes(6, nil))
+	require.Equal(t, 4, zones["a"])
+	require.Equal(t, 6, zones["a"]+zones["b"]+zones["c"]+zones[""])
+
+	// And the other way around.
+	m.config.GossipCrossZoneNodes = 3
+	local := func(n *nodeState) bool { return !m.sameZone(n) && n.Name != "b0" }
+	zones = countZones(m.gossipNodes(3, local))
+	require.Equal(t, 1, zones["b"])
+	require.Equal(t, 2, zones["a"])
+
+	// Without a zone it's uniform, so both sides show up.
+	m.config.Zone = ""
+	seen := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		for z, n := range countZones(m.gossipNodes(3, nil)) {
+			seen[z] += n
+		}
+	}
+	require.True(t, seen["a"] > 0 && seen["b"] > 0 && seen["c"] > 0)
+	require.True(t, seen["a"] < 100, "too many local picks: %v", seen)
+}
+
+func TestMemberlist_indirectProbeNodes_Zone(t *testing.T) {
+	m := zoneMemberlist()
+	for i := 0; i < 50; i++ {
+		zones := countZones(m.indirectProbeNodes(3, nil))
+		require.Zero(t, zones["a"])
+		require.Equal(t, 3, zones["b"]+zones["c"]+zones[""])
+	}
+
+	// Helpers in our zone are used when there aren't enough elsewhere.
+	onlyB0 := func(n *nodeState) bool { return !m.sameZone(n) && n.Name != "b0" }
+	zones := countZones(m.indirectProbeNodes(3, onlyB0))
+	require.Equal(t, 1, zones["b"])
+	require.Equal(t, 2, zones["a"])
+}
+
+func TestMemberList_AliveNode_Zone(t *testing.T) {
+	m := GetMemberlist(t, func(c *Config) {
+		c.Zone = "us-east-1a"
+	})
+	defer m.Shutdown()
+
+	require.NoError(t, m.setAlive())
+	require.Equal(t, "us-east-1a", m.LocalNode().Zone)
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: m.config.BuildVsnArray(), Zone: "us-east-1b"}
+	m.aliveNode(&a, nil, false)
+	require.Equal(t, "us-east-1b", m.nodeMap["test"].Zone)
+
+	// A stale message doesn't change it, but a newer incarnation without a
+	// zone clears it.
+	a.Zone = "us-east-1c"
+	m.aliveNode(&a, nil, false)
+	require.Equal(t, "us-east-1b", m.nodeMap["test"].Zone)
+	a.Incarnation = 2
+	a.Zone = ""
+	m.aliveNode(&a, nil, false)
+	require.Equal(t, "", m.nodeMap["test"].Zone)
+
+	// It's signed when there is one, and the signature is the same as
+	// before when there isn't.
+	withZone := a
+	withZone.Zone = "us-east-1b"
+	require.NotEqual(t, aliveSigningBytes(&a), aliveSigningBytes(&withZone))
+
+	// And it's passed on in push/pull.
+	m.mergeState([]pushNodeState{{
+		Name: "other", Addr: []byte{127, 0, 0, 2}, Incarnation: 1, State: StateAlive,
+		Vsn: m.config.BuildVsnArray(), Zone: "us-east-1c",
+	}})
+	require.Equal(t, "us-east-1c", m.nodeMap["other"].Zone)
+}